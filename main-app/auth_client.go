@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -132,3 +133,12 @@ func (ac *AuthClient) RequireStreamerRole(next http.HandlerFunc) http.HandlerFun
 		next.ServeHTTP(w, r)
 	})
 }
+
+// IsServiceRequest проверяет X-API-Key внутреннего сервиса (stream-app и др.)
+func (ac *AuthClient) IsServiceRequest(r *http.Request) bool {
+	key := r.Header.Get("X-API-Key")
+	if key == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(key), []byte(ac.apiKey)) == 1
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Допустимая длина клипа в секундах
+const (
+	minClipDuration     = 30
+	maxClipDuration     = 120
+	defaultClipDuration = 60
+)
+
+// ClipRequest запрос на создание клипа из live стрима
+type ClipRequest struct {
+	Duration int    `json:"duration_seconds,omitempty"` // последние N секунд, 30-120
+	Title    string `json:"title,omitempty"`
+}
+
+// ClipResponse клип принят в обработку; готовый клип появится в VOD под clip_id
+type ClipResponse struct {
+	ClipID         string    `json:"clip_id"`
+	SourceStreamID string    `json:"source_stream_id"`
+	Title          string    `json:"title"`
+	Duration       int       `json:"duration_seconds"`
+	Status         string    `json:"status"`
+	RecordingURL   string    `json:"recording_url"`
+	Created        time.Time `json:"created"`
+}
+
+// CreateClipHandler клип из последних секунд live стрима (любой авторизованный пользователь)
+func CreateClipHandler(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value("user").(*AuthClaims)
+	if !ok {
+		http.Error(w, "User context not found", http.StatusInternalServerError)
+		return
+	}
+
+	streamID := mux.Vars(r)["streamId"]
+	if streamID == "" {
+		http.Error(w, "Stream ID is required", http.StatusBadRequest)
+		return
+	}
+
+	var req ClipRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if req.Duration == 0 {
+		req.Duration = defaultClipDuration
+	}
+	if req.Duration < minClipDuration || req.Duration > maxClipDuration {
+		http.Error(w, fmt.Sprintf("duration_seconds must be between %d and %d", minClipDuration, maxClipDuration), http.StatusBadRequest)
+		return
+	}
+
+	var name, status string
+	err := db.QueryRow(context.Background(),
+		`SELECT name, status FROM Tasks WHERE streamid = $1`, streamID).Scan(&name, &status)
+	if err != nil {
+		http.Error(w, "Stream not found", http.StatusNotFound)
+		return
+	}
+
+	// Сегменты в MinIO пишутся только пока идет эфир
+	if status != "running" {
+		http.Error(w, fmt.Sprintf("Clips can only be created from a live stream. Current status: %s", status), http.StatusConflict)
+		return
+	}
+
+	if req.Title == "" {
+		req.Title = fmt.Sprintf("Clip: %s", name)
+	}
+
+	clipID, err := generateClipID(streamID)
+	if err != nil {
+		http.Error(w, "Failed to generate clip ID", http.StatusInternalServerError)
+		return
+	}
+
+	clip := map[string]interface{}{
+		"clip_id":          clipID,
+		"duration_seconds": req.Duration,
+		"title":            req.Title,
+		"user_id":          claims.UserID,
+		"username":         claims.Username,
+	}
+
+	statusCode, err := requestStreamAppClip(streamID, clip)
+	if err != nil {
+		log.Printf("Failed to request clip for stream %s: %v", streamID, err)
+		switch statusCode {
+		case http.StatusNotFound, http.StatusConflict, http.StatusTooManyRequests:
+			http.Error(w, err.Error(), statusCode)
+		default:
+			http.Error(w, "Failed to create clip", http.StatusBadGateway)
+		}
+		return
+	}
+
+	log.Printf("✂️ Clip %s requested from stream %s by %s (ID: %d, %ds)", clipID, streamID, claims.Username, claims.UserID, req.Duration)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(ClipResponse{
+		ClipID:         clipID,
+		SourceStreamID: streamID,
+		Title:          req.Title,
+		Duration:       req.Duration,
+		Status:         "processing",
+		RecordingURL:   fmt.Sprintf("/api/recordings/%s", clipID),
+		Created:        time.Now(),
+	})
+}
+
+// ID клипа: VOD запись хранится под ним вместо stream_id
+func generateClipID(streamID string) (string, error) {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s-clip-%s", streamID, hex.EncodeToString(suffix)), nil
+}
+
+// Сборка клипа идет на узле, который ведет стрим. Возвращает код ответа stream-app
+func requestStreamAppClip(streamID string, clip map[string]interface{}) (int, error) {
+	jsonData, err := json.Marshal(clip)
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/stream/%s/clips", streamNodeURL(streamID), streamID), bytes.NewBuffer(jsonData))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	// stream-app принимает заказ клипа только от внутренних сервисов
+	req.Header.Set("X-API-Key", authClient.apiKey)
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		// Текст ошибки stream-app отдаем клиенту как есть (стрим не найден, занято и т.п.)
+		var message bytes.Buffer
+		message.ReadFrom(resp.Body)
+		return resp.StatusCode, errors.New(strings.TrimSpace(message.String()))
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,22 @@
+-- Migration: Add per-stream ingest keys
+-- Description: Secret stream key used as SRT passphrase, with rotation timestamp
+
+-- +migrate Up
+
+ALTER TABLE Tasks ADD COLUMN IF NOT EXISTS stream_key TEXT;
+ALTER TABLE Tasks ADD COLUMN IF NOT EXISTS stream_key_rotated TIMESTAMPTZ;
+
+-- Генерируем ключи для существующих задач
+UPDATE Tasks
+SET stream_key = md5(random()::text || clock_timestamp()::text || StreamID),
+    stream_key_rotated = NOW()
+WHERE stream_key IS NULL;
+
+ALTER TABLE Tasks ALTER COLUMN stream_key SET NOT NULL;
+
+COMMENT ON COLUMN Tasks.stream_key IS 'Secret ingest key (SRT passphrase), visible only to the owner';
+
+-- +migrate Down
+
+ALTER TABLE Tasks DROP COLUMN IF EXISTS stream_key_rotated;
+ALTER TABLE Tasks DROP COLUMN IF EXISTS stream_key;
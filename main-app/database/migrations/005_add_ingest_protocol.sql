@@ -0,0 +1,15 @@
+-- Migration: Add ingest protocol
+-- Description: Per-stream ingest protocol selected at creation (srt or rtmp)
+
+-- +migrate Up
+
+ALTER TABLE Tasks ADD COLUMN IF NOT EXISTS ingest_protocol VARCHAR(10) NOT NULL DEFAULT 'srt';
+
+ALTER TABLE Tasks ADD CONSTRAINT chk_tasks_ingest_protocol CHECK (ingest_protocol IN ('srt', 'rtmp'));
+
+COMMENT ON COLUMN Tasks.ingest_protocol IS 'Ingest protocol used by stream-app listener: srt or rtmp';
+
+-- +migrate Down
+
+ALTER TABLE Tasks DROP CONSTRAINT IF EXISTS chk_tasks_ingest_protocol;
+ALTER TABLE Tasks DROP COLUMN IF EXISTS ingest_protocol;
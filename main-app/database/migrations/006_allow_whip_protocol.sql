@@ -0,0 +1,15 @@
+-- Migration: Allow WHIP ingest protocol
+-- Description: Browser (WebRTC/WHIP) ingest in addition to srt and rtmp
+
+-- +migrate Up
+
+ALTER TABLE Tasks DROP CONSTRAINT IF EXISTS chk_tasks_ingest_protocol;
+ALTER TABLE Tasks ADD CONSTRAINT chk_tasks_ingest_protocol CHECK (ingest_protocol IN ('srt', 'rtmp', 'whip'));
+
+COMMENT ON COLUMN Tasks.ingest_protocol IS 'Ingest protocol used by stream-app: srt, rtmp or whip';
+
+-- +migrate Down
+
+UPDATE Tasks SET ingest_protocol = 'srt' WHERE ingest_protocol = 'whip';
+ALTER TABLE Tasks DROP CONSTRAINT IF EXISTS chk_tasks_ingest_protocol;
+ALTER TABLE Tasks ADD CONSTRAINT chk_tasks_ingest_protocol CHECK (ingest_protocol IN ('srt', 'rtmp'));
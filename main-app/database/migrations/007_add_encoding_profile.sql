@@ -0,0 +1,15 @@
+-- Migration: Add encoding profile
+-- Description: Per-stream live encoding profile (passthrough, transcode or ladder)
+
+-- +migrate Up
+
+ALTER TABLE Tasks ADD COLUMN IF NOT EXISTS encoding_profile VARCHAR(16) NOT NULL DEFAULT 'ladder';
+
+ALTER TABLE Tasks ADD CONSTRAINT chk_tasks_encoding_profile CHECK (encoding_profile IN ('passthrough', 'transcode', 'ladder'));
+
+COMMENT ON COLUMN Tasks.encoding_profile IS 'Live encoding profile: passthrough (copy H.264/AAC), transcode (single rendition) or ladder (ABR)';
+
+-- +migrate Down
+
+ALTER TABLE Tasks DROP CONSTRAINT IF EXISTS chk_tasks_encoding_profile;
+ALTER TABLE Tasks DROP COLUMN IF EXISTS encoding_profile;
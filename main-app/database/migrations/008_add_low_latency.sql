@@ -0,0 +1,12 @@
+-- Migration: Add low latency flag
+-- Description: Per-stream opt-in for LL-HLS output (fMP4 parts, EXT-X-PART, blocking playlist reload)
+
+-- +migrate Up
+
+ALTER TABLE Tasks ADD COLUMN IF NOT EXISTS low_latency BOOLEAN NOT NULL DEFAULT FALSE;
+
+COMMENT ON COLUMN Tasks.low_latency IS 'Stream-app writes LL-HLS (fMP4 partial segments) instead of 4s .ts segments';
+
+-- +migrate Down
+
+ALTER TABLE Tasks DROP COLUMN IF EXISTS low_latency;
@@ -0,0 +1,15 @@
+-- Migration: Add output format
+-- Description: Per-stream output format: hls (.ts or LL-HLS) or cmaf (CMAF segments with HLS and DASH manifests)
+
+-- +migrate Up
+
+ALTER TABLE Tasks ADD COLUMN IF NOT EXISTS output_format VARCHAR(8) NOT NULL DEFAULT 'hls';
+
+ALTER TABLE Tasks ADD CONSTRAINT chk_tasks_output_format CHECK (output_format IN ('hls', 'cmaf'));
+
+COMMENT ON COLUMN Tasks.output_format IS 'Live output format: hls or cmaf (HLS playlists + DASH MPD over the same segments)';
+
+-- +migrate Down
+
+ALTER TABLE Tasks DROP CONSTRAINT IF EXISTS chk_tasks_output_format;
+ALTER TABLE Tasks DROP COLUMN IF EXISTS output_format;
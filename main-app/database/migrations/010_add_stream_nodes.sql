@@ -0,0 +1,29 @@
+-- Migration: Add stream-app node registry
+-- Description: Registered stream-app instances with capacity/heartbeat and the node assigned to each task
+
+-- +migrate Up
+
+CREATE TABLE IF NOT EXISTS stream_nodes (
+    node_id VARCHAR(64) PRIMARY KEY,
+    url TEXT NOT NULL,
+    capacity INTEGER NOT NULL CHECK (capacity >= 0),
+    active_streams INTEGER NOT NULL DEFAULT 0,
+    registered_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    last_heartbeat TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+ALTER TABLE Tasks ADD COLUMN IF NOT EXISTS node_id VARCHAR(64);
+
+-- Подсчет нагрузки узла при размещении нового стрима
+CREATE INDEX IF NOT EXISTS idx_tasks_node_active
+ON Tasks(node_id)
+WHERE Status IN ('waiting', 'running');
+
+COMMENT ON TABLE stream_nodes IS 'stream-app instances available for ingest';
+COMMENT ON COLUMN Tasks.node_id IS 'stream-app node that runs the stream (NULL: default node)';
+
+-- +migrate Down
+
+DROP INDEX IF EXISTS idx_tasks_node_active;
+ALTER TABLE Tasks DROP COLUMN IF EXISTS node_id;
+DROP TABLE IF EXISTS stream_nodes;
@@ -0,0 +1,15 @@
+-- Migration: Add DVR window
+-- Description: Per-stream live rewind window (seconds) served by stream-app from segments already in MinIO
+
+-- +migrate Up
+
+ALTER TABLE Tasks ADD COLUMN IF NOT EXISTS dvr_window INTEGER NOT NULL DEFAULT 0;
+
+ALTER TABLE Tasks ADD CONSTRAINT chk_tasks_dvr_window CHECK (dvr_window BETWEEN 0 AND 86400);
+
+COMMENT ON COLUMN Tasks.dvr_window IS 'Live DVR window in seconds (0: rewind disabled)';
+
+-- +migrate Down
+
+ALTER TABLE Tasks DROP CONSTRAINT IF EXISTS chk_tasks_dvr_window;
+ALTER TABLE Tasks DROP COLUMN IF EXISTS dvr_window;
@@ -0,0 +1,24 @@
+-- Migration: Add restream targets
+-- Description: External RTMP/SRT destinations that stream-app relays each stream to
+
+-- +migrate Up
+
+CREATE TABLE IF NOT EXISTS restream_targets (
+    id SERIAL PRIMARY KEY,
+    stream_id TEXT NOT NULL REFERENCES Tasks(StreamID) ON DELETE CASCADE,
+    name VARCHAR(100) NOT NULL,
+    url TEXT NOT NULL,
+    stream_key TEXT NOT NULL DEFAULT '',
+    enabled BOOLEAN NOT NULL DEFAULT TRUE,
+    created TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_restream_targets_stream ON restream_targets(stream_id);
+
+COMMENT ON TABLE restream_targets IS 'Simulcast destinations (rtmp://, rtmps://, srt://) per stream';
+COMMENT ON COLUMN restream_targets.stream_key IS 'Destination key, visible only to the owner and stream-app';
+
+-- +migrate Down
+
+DROP INDEX IF EXISTS idx_restream_targets_stream;
+DROP TABLE IF EXISTS restream_targets;
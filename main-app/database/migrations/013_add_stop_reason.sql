@@ -0,0 +1,12 @@
+-- Migration: Add stop reason
+-- Description: Why a stream was stopped by stream-app itself (e.g. idle timeout)
+
+-- +migrate Up
+
+ALTER TABLE Tasks ADD COLUMN IF NOT EXISTS stop_reason TEXT;
+
+COMMENT ON COLUMN Tasks.stop_reason IS 'Reason of the last automatic stop (timed_out), NULL for manual stops';
+
+-- +migrate Down
+
+ALTER TABLE Tasks DROP COLUMN IF EXISTS stop_reason;
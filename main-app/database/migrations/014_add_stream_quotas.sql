@@ -0,0 +1,44 @@
+-- Migration: Add stream quotas
+-- Description: Streaming sessions for monthly minutes accounting and per-user quota overrides
+
+-- +migrate Up
+
+-- Интервалы, когда стрим был запущен (waiting/running). Без FK: удаление стрима
+-- не должно обнулять израсходованные минуты
+CREATE TABLE IF NOT EXISTS stream_sessions (
+    id SERIAL PRIMARY KEY,
+    stream_id TEXT NOT NULL,
+    user_id INTEGER NOT NULL,
+    started TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    ended TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_stream_sessions_user ON stream_sessions(user_id, started);
+
+-- Не больше одной открытой сессии на стрим
+CREATE UNIQUE INDEX IF NOT EXISTS idx_stream_sessions_open
+ON stream_sessions(stream_id)
+WHERE ended IS NULL;
+
+-- Индивидуальные лимиты; NULL - лимит роли по умолчанию, 0 - без ограничения
+CREATE TABLE IF NOT EXISTS user_quotas (
+    user_id INTEGER PRIMARY KEY,
+    max_concurrent INTEGER CHECK (max_concurrent >= 0),
+    max_streams INTEGER CHECK (max_streams >= 0),
+    monthly_minutes INTEGER CHECK (monthly_minutes >= 0),
+    updated TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Уже запущенные стримы начинают сессию с момента миграции
+INSERT INTO stream_sessions (stream_id, user_id)
+SELECT StreamID, COALESCE(user_id, 0) FROM Tasks WHERE Status IN ('waiting', 'running');
+
+COMMENT ON TABLE stream_sessions IS 'Streaming intervals used for monthly minutes quota';
+COMMENT ON TABLE user_quotas IS 'Per-user overrides of role stream quotas';
+
+-- +migrate Down
+
+DROP TABLE IF EXISTS user_quotas;
+DROP INDEX IF EXISTS idx_stream_sessions_open;
+DROP INDEX IF EXISTS idx_stream_sessions_user;
+DROP TABLE IF EXISTS stream_sessions;
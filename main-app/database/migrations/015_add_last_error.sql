@@ -0,0 +1,12 @@
+-- Migration: Add last stream error
+-- Description: Last ffmpeg error reported by stream-app when a stream moves to error
+
+-- +migrate Up
+
+ALTER TABLE Tasks ADD COLUMN IF NOT EXISTS last_error TEXT;
+
+COMMENT ON COLUMN Tasks.last_error IS 'Last ffmpeg error reported with status error (crash loop), NULL otherwise';
+
+-- +migrate Down
+
+ALTER TABLE Tasks DROP COLUMN IF EXISTS last_error;
@@ -0,0 +1,38 @@
+-- Migration: Atomic stream node placement
+-- Description: Pick the least loaded live node and assign it to a task in one call, serialized by a lock on stream_nodes
+
+-- +migrate Up
+
+-- Строки stream_nodes блокируются до конца транзакции вызова, поэтому параллельные
+-- размещения идут по очереди. В READ COMMITTED каждый запрос функции берет новый
+-- снимок: подсчет нагрузки видит размещения, закоммиченные до получения блокировки
+CREATE OR REPLACE FUNCTION assign_stream_node(p_stream_id VARCHAR, p_heartbeat_seconds INTEGER)
+RETURNS VARCHAR AS $$
+DECLARE
+    chosen VARCHAR;
+BEGIN
+    PERFORM 1 FROM stream_nodes FOR UPDATE;
+
+    SELECT n.node_id INTO chosen
+    FROM stream_nodes n
+    LEFT JOIN Tasks t ON t.node_id = n.node_id
+        AND t.status IN ('waiting', 'running')
+        AND t.streamid <> p_stream_id
+    WHERE n.last_heartbeat > NOW() - make_interval(secs => p_heartbeat_seconds)
+    GROUP BY n.node_id, n.capacity, n.active_streams
+    HAVING GREATEST(COUNT(t.id), n.active_streams) < n.capacity
+    ORDER BY GREATEST(COUNT(t.id), n.active_streams)::float8 / n.capacity, n.node_id
+    LIMIT 1;
+
+    IF chosen IS NOT NULL THEN
+        UPDATE Tasks SET node_id = chosen WHERE streamid = p_stream_id;
+    END IF;
+    RETURN chosen;
+END;
+$$ LANGUAGE plpgsql;
+
+COMMENT ON FUNCTION assign_stream_node(VARCHAR, INTEGER) IS 'Assigns the least loaded live stream-app node with free capacity to the task; NULL if none';
+
+-- +migrate Down
+
+DROP FUNCTION IF EXISTS assign_stream_node(VARCHAR, INTEGER);
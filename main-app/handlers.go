@@ -4,12 +4,13 @@ import (
 	"bytes"
 	"context"
 	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
-	"os"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -28,10 +29,38 @@ type Task struct {
 	Created  time.Time `json:"created,omitempty"`
 	Updated  time.Time `json:"updated,omitempty"`
 	Status   string    `json:"status"`
+	// Секретный ключ ingest, заполняется только для владельца или внутренних сервисов
+	StreamKey string `json:"stream_key,omitempty"`
+	Protocol  string `json:"protocol,omitempty"` // srt, rtmp или whip
+	Profile   string `json:"profile,omitempty"`  // passthrough, transcode или ladder
+	// LL-HLS вывод включен для стрима
+	LowLatency bool `json:"low_latency,omitempty"`
+	// hls или cmaf (HLS + DASH)
+	OutputFormat string `json:"output_format,omitempty"`
+	// DVR окно в секундах (0 - перемотка выключена)
+	DVRWindow int `json:"dvr_window,omitempty"`
+	// Направления restream с ключами, только для stream-app
+	RestreamTargets []RestreamTarget `json:"restream_targets,omitempty"`
+	// Причина автоматической остановки stream-app (timed_out)
+	StopReason string `json:"stop_reason,omitempty"`
+	// Последняя ошибка ffmpeg, если стрим перешел в error
+	LastError string `json:"last_error,omitempty"`
 }
 
-// Адрес stream-app из переменных окружения
-var streamAppURL = fmt.Sprintf("http://%s:%s", os.Getenv("STREAMAPP_HOST"), os.Getenv("STREAMAPP_PORT"))
+// StreamSettings параметры ingest, которые передаются в stream-app при запуске
+type StreamSettings struct {
+	StreamKey    string
+	Protocol     string
+	Profile      string
+	LowLatency   bool
+	OutputFormat string
+	DVRWindow    int
+	// Включенные направления restream
+	RestreamTargets []RestreamTarget
+}
+
+// Адрес stream-app по умолчанию (для задач без назначенного узла)
+var streamAppURL = fmt.Sprintf("http://%s:%s", getEnv("STREAMAPP_HOST", "stream-app"), getEnv("STREAMAPP_PORT", "9090"))
 
 // Генерация StreamID: случайная строка из цифр, букв и дефисов
 func generateStreamID() (string, error) {
@@ -48,6 +77,15 @@ func generateStreamID() (string, error) {
 	return fmt.Sprintf("%s%s-%s-%s", string(bytes[0:3]), string(bytes[3:6]), string(bytes[6:9]), string(bytes[9:12])), nil
 }
 
+// Генерация секретного ключа стрима (используется как SRT passphrase, 32 hex символа)
+func generateStreamKey() (string, error) {
+	key := make([]byte, 16)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(key), nil
+}
+
 // Хэндлеры для задач (tasks)
 func GetTasksHandler(w http.ResponseWriter, r *http.Request) {
 	// ✅ ДОБАВЛЕНА ПОДДЕРЖКА ФИЛЬТРАЦИИ ПО STREAM_ID
@@ -107,12 +145,17 @@ func CreateTaskHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to generate streamID", http.StatusInternalServerError)
 		return
 	}
+	streamKey, err := generateStreamKey()
+	if err != nil {
+		http.Error(w, "Failed to generate stream key", http.StatusInternalServerError)
+		return
+	}
 	t.StreamID = streamID
 	t.Status = "stopped"
 
 	err = db.QueryRow(context.Background(),
-		`INSERT INTO Tasks (streamid, name, status) VALUES ($1, $2, $3) RETURNING id, created, updated`,
-		t.StreamID, t.Name, t.Status).Scan(&t.ID, &t.Created, &t.Updated)
+		`INSERT INTO Tasks (streamid, name, status, stream_key) VALUES ($1, $2, $3, $4) RETURNING id, created, updated`,
+		t.StreamID, t.Name, t.Status, streamKey).Scan(&t.ID, &t.Created, &t.Updated)
 	if err != nil {
 		http.Error(w, "Failed to create task", http.StatusInternalServerError)
 		return
@@ -147,16 +190,30 @@ func UpdateTaskHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Получаем stream_id задачи из базы для уведомления stream-app
+	// Получаем stream_id и параметры ingest задачи из базы для уведомления stream-app
 	var streamID string
-	err = db.QueryRow(context.Background(), "SELECT streamid FROM Tasks WHERE id=$1", id).Scan(&streamID)
+	var settings StreamSettings
+	err = db.QueryRow(context.Background(), "SELECT streamid, stream_key, ingest_protocol, encoding_profile, low_latency, output_format, dvr_window FROM Tasks WHERE id=$1", id).
+		Scan(&streamID, &settings.StreamKey, &settings.Protocol, &settings.Profile, &settings.LowLatency, &settings.OutputFormat, &settings.DVRWindow)
 	if err != nil {
 		http.Error(w, "Task not found", http.StatusNotFound)
 		return
 	}
 
+	// Запуск: выбираем stream-app узел для стрима
+	if req.Status == "waiting" {
+		if err := assignStreamNode(streamID); err != nil {
+			log.Printf("Failed to place stream %s: %v", streamID, err)
+			http.Error(w, "No stream nodes available", http.StatusServiceUnavailable)
+			return
+		}
+		if settings.RestreamTargets, err = loadRestreamTargets(streamID); err != nil {
+			log.Printf("Failed to load restream targets for stream %s: %v", streamID, err)
+		}
+	}
+
 	cmdTag, err := db.Exec(context.Background(),
-		`UPDATE Tasks SET status=$1, updated=NOW() WHERE id=$2`,
+		`UPDATE Tasks SET status=$1, stop_reason=NULL, last_error=NULL, updated=NOW() WHERE id=$2`,
 		req.Status, id)
 	if err != nil {
 		http.Error(w, "Failed to update task", http.StatusInternalServerError)
@@ -166,9 +223,10 @@ func UpdateTaskHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Task not found", http.StatusNotFound)
 		return
 	}
+	trackStreamSession(streamID, req.Status)
 
 	// Уведомляем stream-app о смене статуса
-	if err := notifyStreamApp(streamID, req.Status, id); err != nil {
+	if err := notifyStreamAppWithUserInfo(streamID, req.Status, id, 0, "legacy", fmt.Sprintf("Legacy task %d", id), settings); err != nil {
 		log.Printf("Failed to notify stream-app: %v", err)
 		// Не возвращаем ошибку, чтобы не блокировать обновление задачи
 	}
@@ -197,6 +255,8 @@ func DeleteTaskHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Task not found", http.StatusNotFound)
 		return
 	}
+	// После удаления задачи узел стрима уже не найти
+	nodeURL := streamNodeURL(streamID)
 
 	// Если задача активна, сначала останавливаем стрим
 	if status == "waiting" || status == "running" {
@@ -205,6 +265,7 @@ func DeleteTaskHandler(w http.ResponseWriter, r *http.Request) {
 			log.Printf("Failed to stop stream before deletion: %v", err)
 		}
 		time.Sleep(2 * time.Second) // Даем время на остановку
+		trackStreamSession(streamID, "stopped")
 	}
 
 	// Удаляем задачу из базы данных
@@ -219,7 +280,7 @@ func DeleteTaskHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Запрашиваем удаление ТОЛЬКО локальной папки в stream-app контейнере
-	if err := notifyStreamAppCleanupFolder(streamID); err != nil {
+	if err := notifyStreamAppCleanupFolder(nodeURL, streamID); err != nil {
 		log.Printf("Failed to request folder cleanup for stream %s: %v", streamID, err)
 	}
 
@@ -228,7 +289,7 @@ func DeleteTaskHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // Функция уведомления stream-app для очистки локальной папки
-func notifyStreamAppCleanupFolder(streamID string) error {
+func notifyStreamAppCleanupFolder(nodeURL, streamID string) error {
 	payload := map[string]string{
 		"stream_id": streamID,
 		"action":    "cleanup_folder",
@@ -239,7 +300,7 @@ func notifyStreamAppCleanupFolder(streamID string) error {
 		return fmt.Errorf("failed to marshal cleanup payload: %v", err)
 	}
 
-	url := "http://stream-app:9090/stream/cleanup"
+	url := nodeURL + "/stream/cleanup"
 	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(jsonData))
 	if err != nil {
 		return fmt.Errorf("failed to create cleanup request: %v", err)
@@ -261,6 +322,59 @@ func notifyStreamAppCleanupFolder(streamID string) error {
 	return nil
 }
 
+func isValidProtocol(p string) bool {
+	switch p {
+	case "srt", "rtmp", "whip":
+		return true
+	default:
+		return false
+	}
+}
+
+func isValidProfile(p string) bool {
+	switch p {
+	case "passthrough", "transcode", "ladder":
+		return true
+	default:
+		return false
+	}
+}
+
+func isValidOutputFormat(f string) bool {
+	switch f {
+	case "hls", "cmaf":
+		return true
+	default:
+		return false
+	}
+}
+
+// Ошибка ffmpeg от stream-app хранится обрезанной
+const maxLastErrorLength = 1000
+
+// Причина отказа в запуске: узлу не хватает ресурсов на кодирование
+const stopReasonOverCapacity = "over_capacity"
+
+// streamAppError ответ stream-app с ошибкой; Message - причина отказа от stream-app
+type streamAppError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *streamAppError) Error() string {
+	return fmt.Sprintf("stream-app returned status %d: %s", e.StatusCode, e.Message)
+}
+
+// Причины автоматической остановки; пустая - ручная остановка или обычная смена статуса
+func isValidStopReason(r string) bool {
+	switch r {
+	case "", "timed_out", "shutdown", "crash_loop":
+		return true
+	default:
+		return false
+	}
+}
+
 func isValidStatus(s string) bool {
 	switch s {
 	case "stopped", "waiting", "running", "error":
@@ -271,7 +385,7 @@ func isValidStatus(s string) bool {
 }
 
 // ✅ ОБНОВЛЕННАЯ ФУНКЦИЯ: передача информации о пользователе в stream-app
-func notifyStreamAppWithUserInfo(streamID, status string, taskID int, userID int, username, title string) error {
+func notifyStreamAppWithUserInfo(streamID, status string, taskID int, userID int, username, title string, settings StreamSettings) error {
 	notification := map[string]interface{}{
 		"stream_id": streamID,
 		"status":    status,
@@ -281,20 +395,46 @@ func notifyStreamAppWithUserInfo(streamID, status string, taskID int, userID int
 		"title":     title,    // ✅ ДОБАВЛЕНО
 	}
 
+	// Ключ и протокол нужны stream-app только для запуска listener
+	if settings.StreamKey != "" {
+		notification["stream_key"] = settings.StreamKey
+	}
+	if settings.Protocol != "" {
+		notification["protocol"] = settings.Protocol
+	}
+	if settings.Profile != "" {
+		notification["profile"] = settings.Profile
+	}
+	if settings.LowLatency {
+		notification["low_latency"] = true
+	}
+	if settings.OutputFormat != "" {
+		notification["output_format"] = settings.OutputFormat
+	}
+	if settings.DVRWindow > 0 {
+		notification["dvr_window"] = settings.DVRWindow
+	}
+	if len(settings.RestreamTargets) > 0 {
+		notification["restream_targets"] = settings.RestreamTargets
+	}
+
 	jsonData, err := json.Marshal(notification)
 	if err != nil {
 		return err
 	}
 
+	// Запрос уходит на узел, которому назначен стрим
 	client := &http.Client{Timeout: 5 * time.Second}
-	resp, err := client.Post("http://stream-app:9090/stream/notify", "application/json", bytes.NewBuffer(jsonData))
+	resp, err := client.Post(streamNodeURL(streamID)+"/stream/notify", "application/json", bytes.NewBuffer(jsonData))
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode >= 400 {
-		return fmt.Errorf("stream-app returned status %s", resp.Status)
+		var message bytes.Buffer
+		message.ReadFrom(resp.Body)
+		return &streamAppError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(message.String())}
 	}
 
 	log.Printf("✅ Notified stream-app: %s -> %s (user: %s, id: %d)", streamID, status, username, userID)
@@ -303,7 +443,7 @@ func notifyStreamAppWithUserInfo(streamID, status string, taskID int, userID int
 
 // Обновить старую функцию для совместимости
 func notifyStreamApp(streamID, status string, taskID int) error {
-	return notifyStreamAppWithUserInfo(streamID, status, taskID, 0, "legacy", fmt.Sprintf("Legacy task %d", taskID))
+	return notifyStreamAppWithUserInfo(streamID, status, taskID, 0, "legacy", fmt.Sprintf("Legacy task %d", taskID), StreamSettings{})
 }
 
 // Обновление статуса задачи по StreamID (для уведомлений от stream-app)
@@ -316,6 +456,10 @@ func UpdateTaskStatusByStreamHandler(w http.ResponseWriter, r *http.Request) {
 	var req struct {
 		StreamID string `json:"stream_id"`
 		Status   string `json:"status"`
+		// Причина, если stream-app остановил стрим сам
+		Reason string `json:"reason,omitempty"`
+		// Последняя ошибка ffmpeg для статуса error
+		Error string `json:"error,omitempty"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
@@ -326,10 +470,18 @@ func UpdateTaskStatusByStreamHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid status value", http.StatusBadRequest)
 		return
 	}
+	if !isValidStopReason(req.Reason) {
+		http.Error(w, "Invalid reason value", http.StatusBadRequest)
+		return
+	}
+
+	if len(req.Error) > maxLastErrorLength {
+		req.Error = req.Error[:maxLastErrorLength]
+	}
 
 	cmdTag, err := db.Exec(context.Background(),
-		`UPDATE Tasks SET status=$1, updated=NOW() WHERE streamid=$2`,
-		req.Status, req.StreamID)
+		`UPDATE Tasks SET status=$1, stop_reason=NULLIF($3, ''), last_error=NULLIF($4, ''), updated=NOW() WHERE streamid=$2`,
+		req.Status, req.StreamID, req.Reason, req.Error)
 	if err != nil {
 		http.Error(w, "Failed to update task", http.StatusInternalServerError)
 		return
@@ -338,8 +490,15 @@ func UpdateTaskStatusByStreamHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Task not found", http.StatusNotFound)
 		return
 	}
+	trackStreamSession(req.StreamID, req.Status)
 
-	log.Printf("Updated task status to %s for stream %s", req.Status, req.StreamID)
+	if req.Error != "" {
+		log.Printf("Updated task status to %s for stream %s (reason: %s, error: %s)", req.Status, req.StreamID, req.Reason, req.Error)
+	} else if req.Reason != "" {
+		log.Printf("Updated task status to %s for stream %s (reason: %s)", req.Status, req.StreamID, req.Reason)
+	} else {
+		log.Printf("Updated task status to %s for stream %s", req.Status, req.StreamID)
+	}
 	w.WriteHeader(http.StatusNoContent)
 }
 
@@ -350,8 +509,19 @@ func GetActiveTasksHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	rows, err := db.Query(context.Background(),
-		"SELECT id, streamid, name, status FROM Tasks WHERE status IN ('waiting', 'running')")
+	// Ключи стримов отдаем только внутренним сервисам с X-API-Key
+	includeKeys := authClient.IsServiceRequest(r)
+
+	query := "SELECT id, streamid, name, status, stream_key, ingest_protocol, encoding_profile, low_latency, output_format, dvr_window FROM Tasks WHERE status IN ('waiting', 'running')"
+	var args []interface{}
+
+	// stream-app восстанавливает только свои стримы
+	if nodeID := r.URL.Query().Get("node_id"); nodeID != "" {
+		query += " AND node_id = $1"
+		args = append(args, nodeID)
+	}
+
+	rows, err := db.Query(context.Background(), query, args...)
 	if err != nil {
 		http.Error(w, "Failed to fetch active tasks", http.StatusInternalServerError)
 		return
@@ -361,12 +531,28 @@ func GetActiveTasksHandler(w http.ResponseWriter, r *http.Request) {
 	var tasks []Task
 	for rows.Next() {
 		var t Task
-		if err := rows.Scan(&t.ID, &t.StreamID, &t.Name, &t.Status); err != nil {
+		if err := rows.Scan(&t.ID, &t.StreamID, &t.Name, &t.Status, &t.StreamKey, &t.Protocol, &t.Profile, &t.LowLatency, &t.OutputFormat, &t.DVRWindow); err != nil {
 			http.Error(w, "Error scanning task", http.StatusInternalServerError)
 			return
 		}
+		if !includeKeys {
+			t.StreamKey = ""
+		}
 		tasks = append(tasks, t)
 	}
+	rows.Close()
+
+	// Направления restream содержат ключи внешних сервисов
+	if includeKeys {
+		for i := range tasks {
+			targets, err := loadRestreamTargets(tasks[i].StreamID)
+			if err != nil {
+				log.Printf("Failed to load restream targets for stream %s: %v", tasks[i].StreamID, err)
+				continue
+			}
+			tasks[i].RestreamTargets = targets
+		}
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(tasks)
@@ -99,6 +99,12 @@ func setupRoutes() {
 	r.HandleFunc("/tasks/update_status_by_stream", UpdateTaskStatusByStreamHandler).Methods("PUT")
 	r.HandleFunc("/tasks/active", GetActiveTasksHandler).Methods("GET")
 
+	// Реестр stream-app узлов (только с X-API-Key)
+	r.HandleFunc("/nodes", ListNodesHandler).Methods("GET")
+	r.HandleFunc("/nodes/register", RegisterNodeHandler).Methods("POST")
+	r.HandleFunc("/nodes/{nodeId}/heartbeat", NodeHeartbeatHandler).Methods("PUT")
+	r.HandleFunc("/nodes/{nodeId}/ingest/{streamId}", NodeIngestCheckHandler).Methods("GET")
+
 	// ===================================
 	// ПУБЛИЧНЫЕ ENDPOINTS (БЕЗ АВТОРИЗАЦИИ)
 	// ===================================
@@ -125,11 +131,26 @@ func setupRoutes() {
 	// Управление своими стримами
 	protected.HandleFunc("/{streamId}/start", StartStreamHandler).Methods("POST")
 	protected.HandleFunc("/{streamId}/stop", StopStreamHandler).Methods("POST")
+	protected.HandleFunc("/{streamId}/key/rotate", RotateStreamKeyHandler).Methods("POST")
 
-	// ✅ ДОБАВИТЬ ЭТОТ ENDPOINT:
-	protected.HandleFunc("/{streamId}", GetStreamByIdHandler).Methods("GET")
-	// Список моих стримов
+	// Клип из последних 30-120 секунд эфира (любой авторизованный зритель)
+	protected.HandleFunc("/{streamId}/clips", CreateClipHandler).Methods("POST")
+
+	// Restream на внешние RTMP/SRT направления (владелец или admin)
+	protected.HandleFunc("/{streamId}/restreams", ListRestreamTargetsHandler).Methods("GET")
+	protected.HandleFunc("/{streamId}/restreams", CreateRestreamTargetHandler).Methods("POST")
+	protected.HandleFunc("/{streamId}/restreams/{targetId}", DeleteRestreamTargetHandler).Methods("DELETE")
+
+	// Логи ffmpeg с узла stream-app (владелец или admin)
+	protected.HandleFunc("/{streamId}/logs", StreamLogsHandler).Methods("GET")
+
+	// Лимиты и использование: одновременные стримы, всего стримов, минуты за месяц
+	protected.HandleFunc("/quota", QuotaHandler).Methods("GET")
+	protected.HandleFunc("/quota/users/{userId}", SetUserQuotaHandler).Methods("PUT")
+
+	// Список моих стримов (регистрируется до /{streamId}, иначе "my" считается ID)
 	protected.HandleFunc("/my", MyStreamsHandler).Methods("GET")
+	protected.HandleFunc("/{streamId}", GetStreamByIdHandler).Methods("GET")
 
 	// ===================================
 	// DEBUG ENDPOINTS
@@ -187,6 +208,11 @@ func main() {
 	log.Printf("    GET/POST/PUT/DEL /tasks")
 	log.Printf("    PUT  /tasks/update_status_by_stream")
 	log.Printf("    GET  /tasks/active")
+	log.Printf("  NODES (require X-API-Key):")
+	log.Printf("    GET  /nodes")
+	log.Printf("    POST /nodes/register")
+	log.Printf("    PUT  /nodes/{id}/heartbeat")
+	log.Printf("    GET  /nodes/{id}/ingest/{streamId}")
 	log.Printf("  PUBLIC:")
 	log.Printf("    GET  /api/health")
 	log.Printf("    GET  /api/streams (live streams list)")
@@ -194,7 +220,13 @@ func main() {
 	log.Printf("    POST /api/streams (create stream - streamer/admin only)")
 	log.Printf("    POST /api/streams/{id}/start")
 	log.Printf("    POST /api/streams/{id}/stop")
+	log.Printf("    POST /api/streams/{id}/key/rotate")
+	log.Printf("    POST /api/streams/{id}/clips")
+	log.Printf("    GET/POST /api/streams/{id}/restreams, DEL /api/streams/{id}/restreams/{targetId}")
+	log.Printf("    GET  /api/streams/{id}/logs")
+	log.Printf("    GET  /api/streams/{id} (stream key for owner)")
 	log.Printf("    GET  /api/streams/my")
+	log.Printf("    GET  /api/streams/quota, PUT /api/streams/quota/users/{userId} (admin)")
 	log.Printf("  AUTH SERVICE: %s", getEnv("AUTH_SERVICE_URL", "http://localhost:8082"))
 
 	if err := http.ListenAndServe(":8080", nil); err != nil {
@@ -238,46 +270,56 @@ func GetStreamByIdHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Получаем информацию о пользователе из контекста (установлено middleware)
-	userInfo, ok := r.Context().Value("user").(map[string]interface{})
-	if !ok {
-		http.Error(w, "User info not found", http.StatusInternalServerError)
-		return
-	}
-
-	userId, ok := userInfo["user_id"].(float64)
+	claims, ok := r.Context().Value("user").(*AuthClaims)
 	if !ok {
-		http.Error(w, "Invalid user ID", http.StatusInternalServerError)
+		http.Error(w, "User context not found", http.StatusInternalServerError)
 		return
 	}
 
 	// SQL запрос для получения стрима
 	query := `
-        SELECT id, stream_id, name, title, user_id, username, status, created_at
-        FROM streams 
-        WHERE stream_id = $1 AND user_id = $2
+        SELECT id, streamid, name, user_id, username, status, created, stream_key, stream_key_rotated, ingest_protocol, encoding_profile, low_latency, output_format, dvr_window, stop_reason, last_error
+        FROM Tasks 
+        WHERE streamid = $1
     `
 
 	var stream struct {
-		ID        int       `json:"id"`
-		StreamID  string    `json:"stream_id"`
-		Name      string    `json:"name"`
-		Title     string    `json:"title"`
-		UserID    int       `json:"user_id"`
-		Username  string    `json:"username"`
-		Status    string    `json:"status"`
-		CreatedAt time.Time `json:"created_at"`
+		ID               int        `json:"id"`
+		StreamID         string     `json:"stream_id"`
+		Name             string     `json:"name"`
+		Title            string     `json:"title"`
+		UserID           int        `json:"user_id"`
+		Username         string     `json:"username"`
+		Status           string     `json:"status"`
+		CreatedAt        time.Time  `json:"created_at"`
+		StreamKey        string     `json:"stream_key,omitempty"`
+		StreamKeyRotated *time.Time `json:"stream_key_rotated,omitempty"`
+		Protocol         string     `json:"protocol"`
+		Profile          string     `json:"profile"`
+		LowLatency       bool       `json:"low_latency"`
+		OutputFormat     string     `json:"output_format"`
+		DVRWindow        int        `json:"dvr_window"`
+		StopReason       *string    `json:"stop_reason,omitempty"`
+		LastError        *string    `json:"last_error,omitempty"`
 	}
 
-	err := db.QueryRow(context.Background(), query, streamId, int(userId)).Scan(
+	err := db.QueryRow(context.Background(), query, streamId).Scan(
 		&stream.ID,
 		&stream.StreamID,
 		&stream.Name,
-		&stream.Title,
 		&stream.UserID,
 		&stream.Username,
 		&stream.Status,
 		&stream.CreatedAt,
+		&stream.StreamKey,
+		&stream.StreamKeyRotated,
+		&stream.Protocol,
+		&stream.Profile,
+		&stream.LowLatency,
+		&stream.OutputFormat,
+		&stream.DVRWindow,
+		&stream.StopReason,
+		&stream.LastError,
 	)
 
 	if err != nil {
@@ -290,6 +332,18 @@ func GetStreamByIdHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Доступ: владелец или admin
+	if stream.UserID != claims.UserID && claims.Role != "admin" {
+		http.Error(w, "Stream not found or access denied", http.StatusNotFound)
+		return
+	}
+
+	// ✅ Ключ ingest возвращаем только владельцу
+	stream.Title = stream.Name
+	if stream.UserID != claims.UserID {
+		stream.StreamKey = ""
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(stream); err != nil {
 		log.Printf("JSON encoding error: %v", err)
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+)
+
+// Узел без heartbeat дольше этого времени не получает новые стримы
+const nodeHeartbeatTimeout = 30 * time.Second
+
+var errNoStreamNodes = errors.New("no stream nodes available")
+
+// StreamNode зарегистрированный экземпляр stream-app
+type StreamNode struct {
+	NodeID        string    `json:"node_id"`
+	URL           string    `json:"url"`
+	Capacity      int       `json:"capacity"`
+	ActiveStreams int       `json:"active_streams"`
+	Assigned      int       `json:"assigned"`
+	RegisteredAt  time.Time `json:"registered_at"`
+	LastHeartbeat time.Time `json:"last_heartbeat"`
+	Alive         bool      `json:"alive"`
+}
+
+// RegisterNodeHandler регистрация (или повторная регистрация) stream-app
+func RegisterNodeHandler(w http.ResponseWriter, r *http.Request) {
+	if !authClient.IsServiceRequest(r) {
+		http.Error(w, "Service API key required", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		NodeID        string `json:"node_id"`
+		URL           string `json:"url"`
+		Capacity      int    `json:"capacity"`
+		ActiveStreams int    `json:"active_streams"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.NodeID == "" || req.URL == "" || req.Capacity < 0 {
+		http.Error(w, "Missing node_id, url or capacity", http.StatusBadRequest)
+		return
+	}
+
+	_, err := db.Exec(context.Background(),
+		`INSERT INTO stream_nodes (node_id, url, capacity, active_streams, registered_at, last_heartbeat)
+         VALUES ($1, $2, $3, $4, NOW(), NOW())
+         ON CONFLICT (node_id) DO UPDATE
+         SET url = EXCLUDED.url, capacity = EXCLUDED.capacity, active_streams = EXCLUDED.active_streams,
+             registered_at = NOW(), last_heartbeat = NOW()`,
+		req.NodeID, req.URL, req.Capacity, req.ActiveStreams)
+	if err != nil {
+		log.Printf("❌ Failed to register stream node %s: %v", req.NodeID, err)
+		http.Error(w, "Failed to register node", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("🖥️ Stream node registered: %s at %s (capacity: %d, active: %d)", req.NodeID, req.URL, req.Capacity, req.ActiveStreams)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// NodeHeartbeatHandler обновление нагрузки узла. 404 - узел должен зарегистрироваться заново
+func NodeHeartbeatHandler(w http.ResponseWriter, r *http.Request) {
+	if !authClient.IsServiceRequest(r) {
+		http.Error(w, "Service API key required", http.StatusUnauthorized)
+		return
+	}
+
+	nodeID := mux.Vars(r)["nodeId"]
+
+	var req struct {
+		Capacity      int `json:"capacity"`
+		ActiveStreams int `json:"active_streams"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	cmdTag, err := db.Exec(context.Background(),
+		`UPDATE stream_nodes SET capacity = $1, active_streams = $2, last_heartbeat = NOW() WHERE node_id = $3`,
+		req.Capacity, req.ActiveStreams, nodeID)
+	if err != nil {
+		http.Error(w, "Failed to update node", http.StatusInternalServerError)
+		return
+	}
+	if cmdTag.RowsAffected() == 0 {
+		http.Error(w, "Node not registered", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// NodeIngestCheckHandler проверка SRT подключения к gateway узла: стрим запущен,
+// принимает SRT и назначен этому узлу (node_id = NULL - режим одного stream-app)
+func NodeIngestCheckHandler(w http.ResponseWriter, r *http.Request) {
+	if !authClient.IsServiceRequest(r) {
+		http.Error(w, "Service API key required", http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+	nodeID, streamID := vars["nodeId"], vars["streamId"]
+
+	var status, protocol string
+	var assignedNode *string
+	err := db.QueryRow(context.Background(),
+		`SELECT status, ingest_protocol, node_id FROM Tasks WHERE streamid = $1`,
+		streamID).Scan(&status, &protocol, &assignedNode)
+	if err == pgx.ErrNoRows {
+		http.Error(w, "Stream not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch stream", http.StatusInternalServerError)
+		return
+	}
+
+	switch {
+	case status != "waiting" && status != "running":
+		http.Error(w, fmt.Sprintf("Stream is not started (status: %s)", status), http.StatusConflict)
+		return
+	case protocol != "srt":
+		http.Error(w, fmt.Sprintf("Stream uses %s ingest", protocol), http.StatusConflict)
+		return
+	case assignedNode != nil && *assignedNode != nodeID:
+		http.Error(w, "Stream is assigned to another node", http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"stream_id": streamID,
+		"status":    status,
+	})
+}
+
+// ListNodesHandler состояние узлов и число назначенных им стримов
+func ListNodesHandler(w http.ResponseWriter, r *http.Request) {
+	if !authClient.IsServiceRequest(r) {
+		http.Error(w, "Service API key required", http.StatusUnauthorized)
+		return
+	}
+
+	nodes, err := loadStreamNodes(context.Background())
+	if err != nil {
+		log.Printf("❌ Failed to fetch stream nodes: %v", err)
+		http.Error(w, "Failed to fetch nodes", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(nodes)
+}
+
+func loadStreamNodes(ctx context.Context) ([]StreamNode, error) {
+	rows, err := db.Query(ctx,
+		`SELECT n.node_id, n.url, n.capacity, n.active_streams, n.registered_at, n.last_heartbeat,
+                COUNT(t.id) AS assigned
+         FROM stream_nodes n
+         LEFT JOIN Tasks t ON t.node_id = n.node_id AND t.status IN ('waiting', 'running')
+         GROUP BY n.node_id
+         ORDER BY n.node_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var nodes []StreamNode
+	for rows.Next() {
+		var n StreamNode
+		if err := rows.Scan(&n.NodeID, &n.URL, &n.Capacity, &n.ActiveStreams, &n.RegisteredAt, &n.LastHeartbeat, &n.Assigned); err != nil {
+			return nil, err
+		}
+		n.Alive = time.Since(n.LastHeartbeat) < nodeHeartbeatTimeout
+		nodes = append(nodes, n)
+	}
+	return nodes, rows.Err()
+}
+
+// Назначение наименее загруженного живого узла задаче перед запуском. Нагрузка
+// считается по назначенным задачам, а не по heartbeat. Выбор и назначение - одним
+// вызовом assign_stream_node под блокировкой stream_nodes: параллельные запуски
+// не занимают один и тот же последний слот. Если ни один узел не зарегистрирован,
+// работаем в режиме одного stream-app (node_id = NULL)
+func assignStreamNode(streamID string) error {
+	ctx := context.Background()
+
+	var registered int
+	if err := db.QueryRow(ctx, `SELECT COUNT(*) FROM stream_nodes`).Scan(&registered); err != nil {
+		return fmt.Errorf("failed to count stream nodes: %v", err)
+	}
+	if registered == 0 {
+		_, err := db.Exec(ctx, `UPDATE Tasks SET node_id = NULL WHERE streamid = $1`, streamID)
+		return err
+	}
+
+	var nodeID *string
+	if err := db.QueryRow(ctx, `SELECT assign_stream_node($1, $2)`,
+		streamID, int(nodeHeartbeatTimeout.Seconds())).Scan(&nodeID); err != nil {
+		return fmt.Errorf("failed to assign node: %v", err)
+	}
+	if nodeID == nil {
+		return errNoStreamNodes
+	}
+
+	log.Printf("🖥️ Stream %s placed on node %s", streamID, *nodeID)
+	return nil
+}
+
+// Адрес stream-app, которому принадлежит стрим
+func streamNodeURL(streamID string) string {
+	var url *string
+	err := db.QueryRow(context.Background(),
+		`SELECT n.url FROM Tasks t LEFT JOIN stream_nodes n ON n.node_id = t.node_id WHERE t.streamid = $1`,
+		streamID).Scan(&url)
+	if err != nil && err != pgx.ErrNoRows {
+		log.Printf("⚠️ Failed to resolve node for stream %s: %v", streamID, err)
+	}
+	if url == nil || *url == "" {
+		return streamAppURL
+	}
+	return *url
+}
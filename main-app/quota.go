@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+)
+
+// QuotaLimits лимиты пользователя; 0 - без ограничения
+type QuotaLimits struct {
+	MaxConcurrent  int `json:"max_concurrent"`  // одновременно запущенных стримов
+	MaxStreams     int `json:"max_streams"`     // всего созданных стримов
+	MonthlyMinutes int `json:"monthly_minutes"` // минут эфира в календарный месяц
+}
+
+// QuotaUsage текущее использование
+type QuotaUsage struct {
+	Concurrent     int       `json:"concurrent"`
+	Streams        int       `json:"streams"`
+	MonthlyMinutes int       `json:"monthly_minutes"`
+	PeriodStart    time.Time `json:"period_start"`
+}
+
+// QuotaResponse ответ GET /api/streams/quota
+type QuotaResponse struct {
+	UserID int         `json:"user_id"`
+	Role   string      `json:"role"`
+	Limits QuotaLimits `json:"limits"`
+	Usage  QuotaUsage  `json:"usage"`
+}
+
+// Лимиты ролей по умолчанию, переопределяются через QUOTA_<ROLE>_<LIMIT>
+var roleQuotas = map[string]QuotaLimits{
+	"streamer": loadRoleQuota("STREAMER", QuotaLimits{MaxConcurrent: 2, MaxStreams: 20, MonthlyMinutes: 3000}),
+	"admin":    loadRoleQuota("ADMIN", QuotaLimits{}),
+}
+
+func loadRoleQuota(role string, defaults QuotaLimits) QuotaLimits {
+	return QuotaLimits{
+		MaxConcurrent:  quotaFromEnv("QUOTA_"+role+"_CONCURRENT", defaults.MaxConcurrent),
+		MaxStreams:     quotaFromEnv("QUOTA_"+role+"_STREAMS", defaults.MaxStreams),
+		MonthlyMinutes: quotaFromEnv("QUOTA_"+role+"_MONTHLY_MINUTES", defaults.MonthlyMinutes),
+	}
+}
+
+func quotaFromEnv(key string, defaultValue int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		log.Printf("⚠️ Invalid %s %q, using %d", key, value, defaultValue)
+		return defaultValue
+	}
+	return n
+}
+
+// Лимиты пользователя: роль по умолчанию + индивидуальные значения из user_quotas
+func quotaLimits(userID int, role string) (QuotaLimits, error) {
+	limits, ok := roleQuotas[role]
+	if !ok {
+		limits = roleQuotas["streamer"]
+	}
+
+	var maxConcurrent, maxStreams, monthlyMinutes *int
+	err := db.QueryRow(context.Background(),
+		`SELECT max_concurrent, max_streams, monthly_minutes FROM user_quotas WHERE user_id = $1`,
+		userID).Scan(&maxConcurrent, &maxStreams, &monthlyMinutes)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return limits, nil
+	}
+	if err != nil {
+		return limits, err
+	}
+
+	if maxConcurrent != nil {
+		limits.MaxConcurrent = *maxConcurrent
+	}
+	if maxStreams != nil {
+		limits.MaxStreams = *maxStreams
+	}
+	if monthlyMinutes != nil {
+		limits.MonthlyMinutes = *monthlyMinutes
+	}
+	return limits, nil
+}
+
+// Использование: запущенные и все стримы, минуты эфира с начала месяца
+func quotaUsage(userID int) (QuotaUsage, error) {
+	var usage QuotaUsage
+	err := db.QueryRow(context.Background(),
+		`SELECT COUNT(*) FILTER (WHERE status IN ('waiting', 'running')), COUNT(*) FROM Tasks WHERE user_id = $1`,
+		userID).Scan(&usage.Concurrent, &usage.Streams)
+	if err != nil {
+		return usage, err
+	}
+
+	var seconds float64
+	err = db.QueryRow(context.Background(),
+		`SELECT date_trunc('month', NOW()),
+                COALESCE(SUM(EXTRACT(EPOCH FROM COALESCE(ended, NOW()) - GREATEST(started, date_trunc('month', NOW())))), 0)::float8
+         FROM stream_sessions
+         WHERE user_id = $1 AND COALESCE(ended, NOW()) > date_trunc('month', NOW())`,
+		userID).Scan(&usage.PeriodStart, &seconds)
+	if err != nil {
+		return usage, err
+	}
+	usage.MonthlyMinutes = int(seconds / 60)
+	return usage, nil
+}
+
+// Проверка перед запуском стрима; пустая строка - запуск разрешен. Лимит одновременных
+// стримов окончательно проверяет startStreamWithinQuota вместе со сменой статуса
+func checkStartQuota(userID int, role string) (QuotaLimits, string, error) {
+	limits, err := quotaLimits(userID, role)
+	if err != nil {
+		return limits, "", err
+	}
+	usage, err := quotaUsage(userID)
+	if err != nil {
+		return limits, "", err
+	}
+
+	if limits.MaxConcurrent > 0 && usage.Concurrent >= limits.MaxConcurrent {
+		return limits, concurrentLimitMessage(usage.Concurrent, limits.MaxConcurrent), nil
+	}
+	if limits.MonthlyMinutes > 0 && usage.MonthlyMinutes >= limits.MonthlyMinutes {
+		return limits, fmt.Sprintf("Monthly streaming limit reached: %d of %d minutes used since %s",
+			usage.MonthlyMinutes, limits.MonthlyMinutes, usage.PeriodStart.Format("2006-01-02")), nil
+	}
+	return limits, "", nil
+}
+
+func concurrentLimitMessage(concurrent, maxConcurrent int) string {
+	return fmt.Sprintf("Concurrent stream limit reached: %d of %d streams are live. Stop another stream first",
+		concurrent, maxConcurrent)
+}
+
+const startWithinQuotaSQL = `
+    WITH owned AS (
+        SELECT status FROM Tasks WHERE user_id = $2 FOR UPDATE
+    )
+    UPDATE Tasks SET status = 'waiting', node_id = NULL, stop_reason = NULL, last_error = NULL, updated = NOW()
+    WHERE id = $1 AND status = 'stopped'
+      AND ($3::int = 0 OR (SELECT COUNT(*) FROM owned WHERE status IN ('waiting', 'running')) < $3::int)`
+
+// Перевод остановленного стрима в waiting. При maxConcurrent > 0 - только если у владельца
+// запущено меньше стримов: проверка и обновление одним запросом, строки владельца
+// блокируются (FOR UPDATE), поэтому параллельные запуски не проходят лимит вдвоем.
+// node_id сбрасывается: узел назначается следом (assignStreamNode).
+// false - лимит достигнут или стрим уже запущен другим запросом
+func startStreamWithinQuota(taskID, ownerID, maxConcurrent int) (bool, error) {
+	tag, err := db.Exec(context.Background(), startWithinQuotaSQL, taskID, ownerID, maxConcurrent)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// Проверка перед созданием стрима; пустая строка - создание разрешено
+func checkCreateQuota(userID int, role string) (string, error) {
+	limits, err := quotaLimits(userID, role)
+	if err != nil {
+		return "", err
+	}
+	if limits.MaxStreams == 0 {
+		return "", nil
+	}
+
+	var streams int
+	if err := db.QueryRow(context.Background(),
+		`SELECT COUNT(*) FROM Tasks WHERE user_id = $1`, userID).Scan(&streams); err != nil {
+		return "", err
+	}
+	if streams >= limits.MaxStreams {
+		return fmt.Sprintf("Stream limit reached: %d of %d streams created. Delete an old stream first",
+			streams, limits.MaxStreams), nil
+	}
+	return "", nil
+}
+
+// Учет минут: сессия открыта, пока стрим запущен (waiting/running)
+func trackStreamSession(streamID, status string) {
+	var err error
+	switch status {
+	case "waiting", "running":
+		_, err = db.Exec(context.Background(),
+			`INSERT INTO stream_sessions (stream_id, user_id)
+             SELECT streamid, COALESCE(user_id, 0) FROM Tasks WHERE streamid = $1
+             ON CONFLICT (stream_id) WHERE ended IS NULL DO NOTHING`,
+			streamID)
+	case "stopped", "error":
+		_, err = db.Exec(context.Background(),
+			`UPDATE stream_sessions SET ended = NOW() WHERE stream_id = $1 AND ended IS NULL`,
+			streamID)
+	}
+	if err != nil {
+		log.Printf("⚠️ Failed to track streaming session for %s (%s): %v", streamID, status, err)
+	}
+}
+
+// QuotaHandler лимиты и использование текущего пользователя (admin: ?user_id=)
+func QuotaHandler(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value("user").(*AuthClaims)
+	if !ok {
+		http.Error(w, "User context not found", http.StatusInternalServerError)
+		return
+	}
+
+	userID, role := claims.UserID, claims.Role
+	if value := r.URL.Query().Get("user_id"); value != "" {
+		if claims.Role != "admin" {
+			http.Error(w, "Only admins can view quotas of other users", http.StatusForbidden)
+			return
+		}
+		id, err := strconv.Atoi(value)
+		if err != nil {
+			http.Error(w, "Invalid user_id", http.StatusBadRequest)
+			return
+		}
+		// Роль другого пользователя знает только auth-service
+		if id != claims.UserID {
+			userID, role = id, "streamer"
+		}
+	}
+
+	limits, err := quotaLimits(userID, role)
+	if err != nil {
+		log.Printf("Failed to load quota limits for user %d: %v", userID, err)
+		http.Error(w, "Failed to load quota", http.StatusInternalServerError)
+		return
+	}
+	usage, err := quotaUsage(userID)
+	if err != nil {
+		log.Printf("Failed to load quota usage for user %d: %v", userID, err)
+		http.Error(w, "Failed to load quota", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(QuotaResponse{UserID: userID, Role: role, Limits: limits, Usage: usage})
+}
+
+// SetUserQuotaHandler индивидуальные лимиты пользователя (только admin).
+// null в поле возвращает лимит роли, 0 снимает ограничение
+func SetUserQuotaHandler(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value("user").(*AuthClaims)
+	if !ok {
+		http.Error(w, "User context not found", http.StatusInternalServerError)
+		return
+	}
+	if claims.Role != "admin" {
+		http.Error(w, "Only admins can change quotas", http.StatusForbidden)
+		return
+	}
+
+	userID, err := strconv.Atoi(mux.Vars(r)["userId"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		MaxConcurrent  *int `json:"max_concurrent"`
+		MaxStreams     *int `json:"max_streams"`
+		MonthlyMinutes *int `json:"monthly_minutes"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	for name, value := range map[string]*int{
+		"max_concurrent":  req.MaxConcurrent,
+		"max_streams":     req.MaxStreams,
+		"monthly_minutes": req.MonthlyMinutes,
+	} {
+		if value != nil && *value < 0 {
+			http.Error(w, fmt.Sprintf("%s must be >= 0 (0 means unlimited)", name), http.StatusBadRequest)
+			return
+		}
+	}
+
+	_, err = db.Exec(context.Background(),
+		`INSERT INTO user_quotas (user_id, max_concurrent, max_streams, monthly_minutes, updated)
+         VALUES ($1, $2, $3, $4, NOW())
+         ON CONFLICT (user_id) DO UPDATE
+         SET max_concurrent = EXCLUDED.max_concurrent, max_streams = EXCLUDED.max_streams,
+             monthly_minutes = EXCLUDED.monthly_minutes, updated = NOW()`,
+		userID, req.MaxConcurrent, req.MaxStreams, req.MonthlyMinutes)
+	if err != nil {
+		log.Printf("Failed to save quota for user %d: %v", userID, err)
+		http.Error(w, "Failed to save quota", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("📏 Quota for user %d updated by %s", userID, claims.Username)
+	w.WriteHeader(http.StatusNoContent)
+}
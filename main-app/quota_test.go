@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"web/main-app/database"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Тесты SQL квот идут на PostgreSQL из MAIN_APP_TEST_DATABASE_URL (без нее пропускаются).
+// Каждый тест получает свою схему с примененными миграциями
+func connectTestDB(t *testing.T, schema string) *pgx.Conn {
+	t.Helper()
+	url := os.Getenv("MAIN_APP_TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("MAIN_APP_TEST_DATABASE_URL is not set")
+	}
+
+	ctx := context.Background()
+	conn, err := pgx.Connect(ctx, url)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	t.Cleanup(func() { conn.Close(ctx) })
+
+	if _, err := conn.Exec(ctx, fmt.Sprintf(`CREATE SCHEMA IF NOT EXISTS %s`, schema)); err != nil {
+		t.Fatalf("create schema: %v", err)
+	}
+	if _, err := conn.Exec(ctx, fmt.Sprintf(`SET search_path TO %s, public`, schema)); err != nil {
+		t.Fatalf("set search_path: %v", err)
+	}
+	return conn
+}
+
+func newQuotaTestDB(t *testing.T) string {
+	t.Helper()
+	schema := fmt.Sprintf("quota_test_%d", time.Now().UnixNano())
+	conn := connectTestDB(t, schema)
+	t.Cleanup(func() {
+		conn.Exec(context.Background(), fmt.Sprintf(`DROP SCHEMA %s CASCADE`, schema))
+	})
+
+	if err := database.InitMigrationTable(conn); err != nil {
+		t.Fatalf("init migrations: %v", err)
+	}
+	migrations, err := database.LoadMigrations("./database/migrations")
+	if err != nil {
+		t.Fatalf("load migrations: %v", err)
+	}
+	if err := database.ApplyMigrations(conn, migrations); err != nil {
+		t.Fatalf("apply migrations: %v", err)
+	}
+
+	saved := db
+	db = conn
+	t.Cleanup(func() { db = saved })
+	return schema
+}
+
+// Стримы владельца в заданных статусах, возвращает ID задач
+func insertTestTasks(t *testing.T, conn *pgx.Conn, userID int, statuses ...string) []int {
+	t.Helper()
+	ids := make([]int, len(statuses))
+	for i, status := range statuses {
+		err := conn.QueryRow(context.Background(),
+			`INSERT INTO Tasks (streamid, name, status, user_id, node_id) VALUES ($1, 'test', $2, $3, 'node-1') RETURNING id`,
+			fmt.Sprintf("u%d-s%d", userID, i), status, userID).Scan(&ids[i])
+		if err != nil {
+			t.Fatalf("insert task: %v", err)
+		}
+	}
+	return ids
+}
+
+func TestStartStreamWithinQuota(t *testing.T) {
+	tests := []struct {
+		name          string
+		statuses      []string // стримы владельца; запускается первый
+		maxConcurrent int
+		want          bool
+	}{
+		{"under limit", []string{"stopped", "running"}, 2, true},
+		{"at limit", []string{"stopped", "running", "waiting"}, 2, false},
+		{"error streams do not count", []string{"stopped", "error", "error"}, 1, true},
+		{"unlimited", []string{"stopped", "running", "running"}, 0, true},
+		{"already started", []string{"waiting"}, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newQuotaTestDB(t)
+			ids := insertTestTasks(t, db, 1, tt.statuses...)
+			// Стримы другого пользователя в лимит не входят
+			insertTestTasks(t, db, 2, "running", "running")
+
+			started, err := startStreamWithinQuota(ids[0], 1, tt.maxConcurrent)
+			if err != nil {
+				t.Fatalf("startStreamWithinQuota: %v", err)
+			}
+			if started != tt.want {
+				t.Fatalf("started = %v, want %v", started, tt.want)
+			}
+
+			var status string
+			var nodeID *string
+			db.QueryRow(context.Background(), `SELECT status, node_id FROM Tasks WHERE id = $1`, ids[0]).Scan(&status, &nodeID)
+			if tt.want && (status != "waiting" || nodeID != nil) {
+				t.Fatalf("started stream: status = %s, node_id = %v", status, nodeID)
+			}
+			if !tt.want && status != tt.statuses[0] {
+				t.Fatalf("refused start changed status to %s", status)
+			}
+		})
+	}
+}
+
+// Два параллельных запуска на последний слот: второй ждет блокировку первого
+// и после его коммита видит занятый слот
+func TestStartStreamWithinQuotaConcurrent(t *testing.T) {
+	schema := newQuotaTestDB(t)
+	ids := insertTestTasks(t, db, 1, "stopped", "stopped", "running")
+	other := connectTestDB(t, schema)
+
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		t.Fatalf("begin: %v", err)
+	}
+	tag, err := tx.Exec(ctx, startWithinQuotaSQL, ids[0], 1, 2)
+	if err != nil || tag.RowsAffected() != 1 {
+		t.Fatalf("first start: rows = %d, err = %v", tag.RowsAffected(), err)
+	}
+
+	second := make(chan int64, 1)
+	go func() {
+		tag, err := other.Exec(ctx, startWithinQuotaSQL, ids[1], 1, 2)
+		if err != nil {
+			t.Errorf("second start: %v", err)
+		}
+		second <- tag.RowsAffected()
+	}()
+
+	// Второй запрос не должен завершиться, пока первый держит строки владельца
+	select {
+	case rows := <-second:
+		t.Fatalf("second start finished before the first committed (rows = %d)", rows)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if rows := <-second; rows != 0 {
+		t.Fatalf("second start passed the concurrent limit")
+	}
+}
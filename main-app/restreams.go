@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Ограничения на restream направления одного стрима
+const (
+	maxRestreamTargets   = 5
+	maxRestreamKeyLength = 512
+)
+
+// RestreamTarget внешнее направление (YouTube, Twitch, свой сервер), куда stream-app
+// ретранслирует стрим. Ключ отдается только stream-app, владельцу виден лишь has_key
+type RestreamTarget struct {
+	ID        int       `json:"id"`
+	StreamID  string    `json:"stream_id,omitempty"`
+	Name      string    `json:"name"`
+	URL       string    `json:"url"`
+	StreamKey string    `json:"stream_key,omitempty"`
+	HasKey    bool      `json:"has_key"`
+	Enabled   bool      `json:"enabled"`
+	Created   time.Time `json:"created,omitempty"`
+}
+
+// RestreamTargetRequest добавление направления
+type RestreamTargetRequest struct {
+	Name      string `json:"name"`
+	URL       string `json:"url"`
+	StreamKey string `json:"stream_key,omitempty"`
+	Enabled   *bool  `json:"enabled,omitempty"` // по умолчанию true
+}
+
+// ListRestreamTargetsHandler направления стрима (владелец или admin)
+func ListRestreamTargetsHandler(w http.ResponseWriter, r *http.Request) {
+	streamID, _, ok := authorizeStreamOwner(w, r, "You can only manage restream targets of your own streams")
+	if !ok {
+		return
+	}
+
+	rows, err := db.Query(context.Background(),
+		`SELECT id, name, url, stream_key <> '', enabled, created FROM restream_targets WHERE stream_id = $1 ORDER BY id`,
+		streamID)
+	if err != nil {
+		log.Printf("Failed to fetch restream targets: %v", err)
+		http.Error(w, "Failed to fetch restream targets", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	targets := []RestreamTarget{}
+	for rows.Next() {
+		t := RestreamTarget{StreamID: streamID}
+		if err := rows.Scan(&t.ID, &t.Name, &t.URL, &t.HasKey, &t.Enabled, &t.Created); err != nil {
+			http.Error(w, "Error scanning restream target", http.StatusInternalServerError)
+			return
+		}
+		targets = append(targets, t)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"stream_id": streamID,
+		"targets":   targets,
+		"count":     len(targets),
+	})
+}
+
+// CreateRestreamTargetHandler добавление направления (владелец или admin).
+// Направления применяются при следующем запуске стрима
+func CreateRestreamTargetHandler(w http.ResponseWriter, r *http.Request) {
+	streamID, status, ok := authorizeStreamOwner(w, r, "You can only manage restream targets of your own streams")
+	if !ok {
+		return
+	}
+
+	var req RestreamTargetRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	req.URL = strings.TrimSpace(req.URL)
+	req.StreamKey = strings.TrimSpace(req.StreamKey)
+	if req.Name == "" || len(req.Name) > 100 {
+		http.Error(w, "name is required (up to 100 characters)", http.StatusBadRequest)
+		return
+	}
+	if err := validateRestreamURL(req.URL); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.StreamKey) > maxRestreamKeyLength {
+		http.Error(w, fmt.Sprintf("stream_key must be at most %d characters", maxRestreamKeyLength), http.StatusBadRequest)
+		return
+	}
+
+	enabled := true
+	if req.Enabled != nil {
+		enabled = *req.Enabled
+	}
+
+	var count int
+	if err := db.QueryRow(context.Background(),
+		`SELECT COUNT(*) FROM restream_targets WHERE stream_id = $1`, streamID).Scan(&count); err != nil {
+		http.Error(w, "Failed to add restream target", http.StatusInternalServerError)
+		return
+	}
+	if count >= maxRestreamTargets {
+		http.Error(w, fmt.Sprintf("A stream can have at most %d restream targets", maxRestreamTargets), http.StatusConflict)
+		return
+	}
+
+	target := RestreamTarget{
+		StreamID: streamID,
+		Name:     req.Name,
+		URL:      req.URL,
+		HasKey:   req.StreamKey != "",
+		Enabled:  enabled,
+	}
+	err := db.QueryRow(context.Background(),
+		`INSERT INTO restream_targets (stream_id, name, url, stream_key, enabled) VALUES ($1, $2, $3, $4, $5) RETURNING id, created`,
+		streamID, req.Name, req.URL, req.StreamKey, enabled).Scan(&target.ID, &target.Created)
+	if err != nil {
+		log.Printf("Failed to add restream target: %v", err)
+		http.Error(w, "Failed to add restream target", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("📡 Restream target %d (%s) added to stream %s", target.ID, target.Name, streamID)
+
+	response := map[string]interface{}{
+		"target": target,
+	}
+	// Запущенный ffmpeg список направлений не перечитывает
+	if status == "waiting" || status == "running" {
+		response["message"] = "Target will be used from the next stream start"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
+
+// DeleteRestreamTargetHandler удаление направления (владелец или admin)
+func DeleteRestreamTargetHandler(w http.ResponseWriter, r *http.Request) {
+	streamID, _, ok := authorizeStreamOwner(w, r, "You can only manage restream targets of your own streams")
+	if !ok {
+		return
+	}
+
+	targetID, err := strconv.Atoi(mux.Vars(r)["targetId"])
+	if err != nil {
+		http.Error(w, "Invalid target ID", http.StatusBadRequest)
+		return
+	}
+
+	cmdTag, err := db.Exec(context.Background(),
+		`DELETE FROM restream_targets WHERE id = $1 AND stream_id = $2`, targetID, streamID)
+	if err != nil {
+		http.Error(w, "Failed to delete restream target", http.StatusInternalServerError)
+		return
+	}
+	if cmdTag.RowsAffected() == 0 {
+		http.Error(w, "Restream target not found", http.StatusNotFound)
+		return
+	}
+
+	log.Printf("📡 Restream target %d removed from stream %s", targetID, streamID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Проверка прав на стрим (владелец или admin); при ошибке ответ уже отправлен,
+// forbidden - текст для чужого стрима. Возвращает stream_id и статус
+func authorizeStreamOwner(w http.ResponseWriter, r *http.Request, forbidden string) (string, string, bool) {
+	claims, ok := r.Context().Value("user").(*AuthClaims)
+	if !ok {
+		http.Error(w, "User context not found", http.StatusInternalServerError)
+		return "", "", false
+	}
+
+	streamID := mux.Vars(r)["streamId"]
+	if streamID == "" {
+		http.Error(w, "Stream ID is required", http.StatusBadRequest)
+		return "", "", false
+	}
+
+	var ownerID int
+	var status string
+	err := db.QueryRow(context.Background(),
+		`SELECT user_id, status FROM Tasks WHERE streamid = $1`, streamID).Scan(&ownerID, &status)
+	if err != nil {
+		http.Error(w, "Stream not found", http.StatusNotFound)
+		return "", "", false
+	}
+
+	if ownerID != claims.UserID && claims.Role != "admin" {
+		http.Error(w, forbidden, http.StatusForbidden)
+		return "", "", false
+	}
+	return streamID, status, true
+}
+
+// Поддерживаются RTMP(S) и SRT направления
+func validateRestreamURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("url must be an absolute rtmp://, rtmps:// or srt:// address")
+	}
+	switch u.Scheme {
+	case "rtmp", "rtmps", "srt":
+		return nil
+	default:
+		return fmt.Errorf("unsupported restream scheme %q: use rtmp://, rtmps:// or srt://", u.Scheme)
+	}
+}
+
+// Включенные направления стрима с ключами, для передачи в stream-app
+func loadRestreamTargets(streamID string) ([]RestreamTarget, error) {
+	rows, err := db.Query(context.Background(),
+		`SELECT id, name, url, stream_key FROM restream_targets WHERE stream_id = $1 AND enabled ORDER BY id`,
+		streamID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var targets []RestreamTarget
+	for rows.Next() {
+		t := RestreamTarget{Enabled: true}
+		if err := rows.Scan(&t.ID, &t.Name, &t.URL, &t.StreamKey); err != nil {
+			return nil, err
+		}
+		t.HasKey = t.StreamKey != ""
+		targets = append(targets, t)
+	}
+	return targets, rows.Err()
+}
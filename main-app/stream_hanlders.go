@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -14,22 +15,41 @@ import (
 
 // StreamRequest структура для создания стрима
 type StreamRequest struct {
-	Name  string `json:"name"`
-	Title string `json:"title,omitempty"`
+	Name     string `json:"name"`
+	Title    string `json:"title,omitempty"`
+	Protocol string `json:"protocol,omitempty"` // srt (по умолчанию), rtmp или whip
+	Profile  string `json:"profile,omitempty"`  // ladder (по умолчанию), transcode или passthrough
+	// LL-HLS: задержка 2-4 секунды вместо 15-25
+	LowLatency bool `json:"low_latency,omitempty"`
+	// hls (по умолчанию) или cmaf: CMAF сегменты с HLS и DASH манифестами
+	OutputFormat string `json:"output_format,omitempty"`
+	// DVR: зрители могут перематывать live на столько секунд назад (0 - выключено)
+	DVRWindow int `json:"dvr_window,omitempty"`
 }
 
+// Максимальное DVR окно, 24 часа (ограничение chk_tasks_dvr_window в БД)
+const maxDVRWindow = 24 * 60 * 60
+
 // StreamResponse структура ответа при создании стрима
 type StreamResponse struct {
-	ID          int       `json:"id"`
-	StreamID    string    `json:"stream_id"`
-	Name        string    `json:"name"`
-	Title       string    `json:"title"`
-	UserID      int       `json:"user_id"`
-	Username    string    `json:"username"`
-	Status      string    `json:"status"`
-	Created     time.Time `json:"created"`
-	SRTEndpoint string    `json:"srt_endpoint,omitempty"`
-	HLSUrl      string    `json:"hls_url,omitempty"`
+	ID           int       `json:"id"`
+	StreamID     string    `json:"stream_id"`
+	Name         string    `json:"name"`
+	Title        string    `json:"title"`
+	UserID       int       `json:"user_id"`
+	Username     string    `json:"username"`
+	Status       string    `json:"status"`
+	Protocol     string    `json:"protocol"`
+	Profile      string    `json:"profile"`
+	LowLatency   bool      `json:"low_latency"`
+	OutputFormat string    `json:"output_format"`
+	DVRWindow    int       `json:"dvr_window"`
+	Created      time.Time `json:"created"`
+	SRTEndpoint  string    `json:"srt_endpoint,omitempty"`
+	HLSUrl       string    `json:"hls_url,omitempty"`
+	DASHUrl      string    `json:"dash_url,omitempty"`
+	DVRUrl       string    `json:"dvr_url,omitempty"`
+	StreamKey    string    `json:"stream_key,omitempty"` // Только для владельца
 }
 
 // CreateStreamHandler создает новый стрим (авторизованный)
@@ -55,6 +75,49 @@ func CreateStreamHandler(w http.ResponseWriter, r *http.Request) {
 		req.Title = fmt.Sprintf("%s's Stream", claims.Username)
 	}
 
+	if req.Protocol == "" {
+		req.Protocol = "srt"
+	}
+	if !isValidProtocol(req.Protocol) {
+		http.Error(w, "Invalid protocol. Allowed: srt, rtmp, whip", http.StatusBadRequest)
+		return
+	}
+
+	if req.Profile == "" {
+		req.Profile = "ladder"
+	}
+	if !isValidProfile(req.Profile) {
+		http.Error(w, "Invalid profile. Allowed: passthrough, transcode, ladder", http.StatusBadRequest)
+		return
+	}
+
+	if req.OutputFormat == "" {
+		req.OutputFormat = "hls"
+	}
+	if !isValidOutputFormat(req.OutputFormat) {
+		http.Error(w, "Invalid output_format. Allowed: hls, cmaf", http.StatusBadRequest)
+		return
+	}
+	// LL-HLS собирается из .m3u8 частей hls muxer, для CMAF его нет
+	if req.OutputFormat == "cmaf" && req.LowLatency {
+		http.Error(w, "low_latency is not supported with cmaf output", http.StatusBadRequest)
+		return
+	}
+	if req.DVRWindow < 0 || req.DVRWindow > maxDVRWindow {
+		http.Error(w, fmt.Sprintf("dvr_window must be between 0 and %d seconds", maxDVRWindow), http.StatusBadRequest)
+		return
+	}
+
+	// Лимит на число созданных стримов
+	if message, err := checkCreateQuota(claims.UserID, claims.Role); err != nil {
+		log.Printf("Failed to check quota for user %d: %v", claims.UserID, err)
+		http.Error(w, "Failed to check quota", http.StatusInternalServerError)
+		return
+	} else if message != "" {
+		http.Error(w, message, http.StatusForbidden)
+		return
+	}
+
 	// Генерируем StreamID
 	streamID, err := generateStreamID()
 	if err != nil {
@@ -62,13 +125,20 @@ func CreateStreamHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Генерируем секретный ключ ingest
+	streamKey, err := generateStreamKey()
+	if err != nil {
+		http.Error(w, "Failed to generate stream key", http.StatusInternalServerError)
+		return
+	}
+
 	// Создаем задачу в БД с информацией о пользователе
 	var task Task
 	err = db.QueryRow(context.Background(),
-		`INSERT INTO Tasks (streamid, name, user_id, username, status) 
-         VALUES ($1, $2, $3, $4, $5) 
+		`INSERT INTO Tasks (streamid, name, user_id, username, status, stream_key, stream_key_rotated, ingest_protocol, encoding_profile, low_latency, output_format, dvr_window) 
+         VALUES ($1, $2, $3, $4, $5, $6, NOW(), $7, $8, $9, $10, $11) 
          RETURNING id, created, updated`,
-		streamID, req.Title, claims.UserID, claims.Username, "stopped").
+		streamID, req.Title, claims.UserID, claims.Username, "stopped", streamKey, req.Protocol, req.Profile, req.LowLatency, req.OutputFormat, req.DVRWindow).
 		Scan(&task.ID, &task.Created, &task.Updated)
 
 	if err != nil {
@@ -77,18 +147,24 @@ func CreateStreamHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Printf("✅ Stream created: %s by %s (ID: %d, role: %s)", streamID, claims.Username, claims.UserID, claims.Role)
+	log.Printf("✅ Stream created: %s by %s (ID: %d, role: %s, protocol: %s, profile: %s)", streamID, claims.Username, claims.UserID, claims.Role, req.Protocol, req.Profile)
 
 	// Формируем ответ
 	response := StreamResponse{
-		ID:       task.ID,
-		StreamID: streamID,
-		Name:     req.Name,
-		Title:    req.Title,
-		UserID:   claims.UserID,
-		Username: claims.Username,
-		Status:   "stopped",
-		Created:  task.Created,
+		ID:           task.ID,
+		StreamID:     streamID,
+		Name:         req.Name,
+		Title:        req.Title,
+		UserID:       claims.UserID,
+		Username:     claims.Username,
+		Status:       "stopped",
+		Protocol:     req.Protocol,
+		Profile:      req.Profile,
+		LowLatency:   req.LowLatency,
+		OutputFormat: req.OutputFormat,
+		DVRWindow:    req.DVRWindow,
+		Created:      task.Created,
+		StreamKey:    streamKey, // Создатель стрима = владелец
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -115,8 +191,8 @@ func StartStreamHandler(w http.ResponseWriter, r *http.Request) {
 	// Получаем информацию о стриме из БД
 	var task Task
 	err := db.QueryRow(context.Background(),
-		`SELECT id, streamid, name, user_id, username, status FROM Tasks WHERE streamid = $1`,
-		streamID).Scan(&task.ID, &task.StreamID, &task.Name, &task.UserID, &task.Username, &task.Status)
+		`SELECT id, streamid, name, user_id, username, status, stream_key, ingest_protocol, encoding_profile, low_latency, output_format, dvr_window FROM Tasks WHERE streamid = $1`,
+		streamID).Scan(&task.ID, &task.StreamID, &task.Name, &task.UserID, &task.Username, &task.Status, &task.StreamKey, &task.Protocol, &task.Profile, &task.LowLatency, &task.OutputFormat, &task.DVRWindow)
 
 	if err != nil {
 		http.Error(w, "Stream not found", http.StatusNotFound)
@@ -134,22 +210,89 @@ func StartStreamHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Обновляем статус в БД
-	_, err = db.Exec(context.Background(),
-		`UPDATE Tasks SET status = 'waiting', updated = NOW() WHERE id = $1`,
-		task.ID)
+	// Лимиты владельца: одновременные стримы и минуты эфира, в том числе когда
+	// чужой стрим запускает админ. Роль другого пользователя знает только auth-service,
+	// поэтому для него берутся лимиты streamer с индивидуальными значениями из user_quotas
+	ownerRole := "streamer"
+	if task.UserID == claims.UserID {
+		ownerRole = claims.Role
+	}
+	limits, message, err := checkStartQuota(task.UserID, ownerRole)
+	if err != nil {
+		log.Printf("Failed to check quota for user %d: %v", task.UserID, err)
+		http.Error(w, "Failed to check quota", http.StatusInternalServerError)
+		return
+	}
+	if message != "" {
+		http.Error(w, message, http.StatusForbidden)
+		return
+	}
+	maxConcurrent := limits.MaxConcurrent
 
+	// Обновляем статус в БД; лимит одновременных стримов проверяется в том же запросе
+	started, err := startStreamWithinQuota(task.ID, task.UserID, maxConcurrent)
 	if err != nil {
 		log.Printf("Failed to update stream status: %v", err)
 		http.Error(w, "Failed to start stream", http.StatusInternalServerError)
 		return
 	}
+	if !started {
+		// Параллельный запрос успел раньше: этот стрим или другой стрим владельца
+		var status string
+		if err := db.QueryRow(context.Background(),
+			`SELECT status FROM Tasks WHERE id = $1`, task.ID).Scan(&status); err == nil && status != "stopped" {
+			http.Error(w, fmt.Sprintf("Stream cannot be started. Current status: %s", status), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, concurrentLimitMessage(maxConcurrent, maxConcurrent), http.StatusForbidden)
+		return
+	}
+
+	// Узел выбирается только для запуска, прошедшего лимит: отказ не трогает node_id
+	if err := assignStreamNode(streamID); err != nil {
+		log.Printf("Failed to place stream %s: %v", streamID, err)
+		db.Exec(context.Background(), `UPDATE Tasks SET status = 'stopped' WHERE id = $1`, task.ID)
+		http.Error(w, "No stream nodes available", http.StatusServiceUnavailable)
+		return
+	}
+	trackStreamSession(streamID, "waiting")
+
+	// Restream не критичен для запуска: без направлений стрим идет как обычно
+	restreamTargets, err := loadRestreamTargets(streamID)
+	if err != nil {
+		log.Printf("Failed to load restream targets for stream %s: %v", streamID, err)
+	}
 
 	// ✅ УВЕДОМЛЯЕМ STREAM-APP С ИНФОРМАЦИЕЙ О ПОЛЬЗОВАТЕЛЕ
-	if err := notifyStreamAppWithUserInfo(streamID, "waiting", task.ID, claims.UserID, claims.Username, task.Name); err != nil {
+	if err := notifyStreamAppWithUserInfo(streamID, "waiting", task.ID, claims.UserID, claims.Username, task.Name, StreamSettings{
+		StreamKey:       task.StreamKey,
+		Protocol:        task.Protocol,
+		Profile:         task.Profile,
+		LowLatency:      task.LowLatency,
+		OutputFormat:    task.OutputFormat,
+		DVRWindow:       task.DVRWindow,
+		RestreamTargets: restreamTargets,
+	}); err != nil {
 		log.Printf("Failed to notify stream-app: %v", err)
+
+		// Узел перегружен: причину сохраняем в задаче и отдаем клиенту
+		var appErr *streamAppError
+		if errors.As(err, &appErr) && appErr.StatusCode == http.StatusServiceUnavailable {
+			message := appErr.Message
+			if len(message) > maxLastErrorLength {
+				message = message[:maxLastErrorLength]
+			}
+			db.Exec(context.Background(),
+				`UPDATE Tasks SET status = 'stopped', stop_reason = $2, last_error = NULLIF($3, '') WHERE id = $1`,
+				task.ID, stopReasonOverCapacity, message)
+			trackStreamSession(streamID, "stopped")
+			http.Error(w, fmt.Sprintf("Stream node is over capacity, try again later: %s", message), http.StatusServiceUnavailable)
+			return
+		}
+
 		// Откатываем статус
 		db.Exec(context.Background(), `UPDATE Tasks SET status = 'stopped' WHERE id = $1`, task.ID)
+		trackStreamSession(streamID, "stopped")
 		http.Error(w, "Failed to start streaming process", http.StatusInternalServerError)
 		return
 	}
@@ -157,15 +300,31 @@ func StartStreamHandler(w http.ResponseWriter, r *http.Request) {
 	log.Printf("🔴 Stream started: %s by %s (ID: %d)", streamID, claims.Username, claims.UserID)
 
 	response := StreamResponse{
-		ID:          task.ID,
-		StreamID:    streamID,
-		Name:        task.Name,
-		Title:       task.Name,
-		UserID:      claims.UserID,
-		Username:    claims.Username,
-		Status:      "waiting",
-		SRTEndpoint: fmt.Sprintf("srt://localhost:10000?streamid=%s", streamID),
-		HLSUrl:      fmt.Sprintf("http://localhost:9090/hls/%s/stream.m3u8", streamID),
+		ID:           task.ID,
+		StreamID:     streamID,
+		Name:         task.Name,
+		Title:        task.Name,
+		UserID:       claims.UserID,
+		Username:     claims.Username,
+		Status:       "waiting",
+		Protocol:     task.Protocol,
+		Profile:      task.Profile,
+		LowLatency:   task.LowLatency,
+		OutputFormat: task.OutputFormat,
+		DVRWindow:    task.DVRWindow,
+		HLSUrl:       fmt.Sprintf("http://localhost:9090/hls/%s/master.m3u8", streamID),
+	}
+
+	if task.OutputFormat == "cmaf" {
+		response.DASHUrl = fmt.Sprintf("http://localhost:9090/hls/%s/manifest.mpd", streamID)
+	}
+	if task.DVRWindow > 0 {
+		response.DVRUrl = fmt.Sprintf("http://localhost:9090/stream/%s/dvr/master.m3u8", streamID)
+	}
+
+	// Реальный порт и ingest_url для RTMP выдает stream-app в /stream/status
+	if task.Protocol == "srt" {
+		response.SRTEndpoint = fmt.Sprintf("srt://localhost:10000?streamid=%s", streamID)
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -212,7 +371,7 @@ func StopStreamHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Обновляем статус в БД
 	_, err = db.Exec(context.Background(),
-		`UPDATE Tasks SET status = 'stopped', updated = NOW() WHERE id = $1`,
+		`UPDATE Tasks SET status = 'stopped', stop_reason = NULL, last_error = NULL, updated = NOW() WHERE id = $1`,
 		task.ID)
 
 	if err != nil {
@@ -220,6 +379,7 @@ func StopStreamHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to stop stream", http.StatusInternalServerError)
 		return
 	}
+	trackStreamSession(streamID, "stopped")
 
 	// Уведомляем stream-app об остановке
 	if err := notifyStreamApp(streamID, "stopped", task.ID); err != nil {
@@ -241,6 +401,78 @@ func StopStreamHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
+// RotateStreamKeyHandler генерирует новый ключ стрима (владелец или admin)
+func RotateStreamKeyHandler(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value("user").(*AuthClaims)
+	if !ok {
+		http.Error(w, "User context not found", http.StatusInternalServerError)
+		return
+	}
+
+	vars := mux.Vars(r)
+	streamID := vars["streamId"]
+
+	if streamID == "" {
+		http.Error(w, "Stream ID is required", http.StatusBadRequest)
+		return
+	}
+
+	var task Task
+	err := db.QueryRow(context.Background(),
+		`SELECT id, user_id, status FROM Tasks WHERE streamid = $1`,
+		streamID).Scan(&task.ID, &task.UserID, &task.Status)
+
+	if err != nil {
+		http.Error(w, "Stream not found", http.StatusNotFound)
+		return
+	}
+
+	// Проверка прав доступа
+	if task.UserID != claims.UserID && claims.Role != "admin" {
+		http.Error(w, "You can only rotate keys of your own streams", http.StatusForbidden)
+		return
+	}
+
+	// Активный listener уже запущен со старым ключом
+	if task.Status == "waiting" || task.Status == "running" {
+		http.Error(w, "Stop the stream before rotating its key", http.StatusConflict)
+		return
+	}
+
+	streamKey, err := generateStreamKey()
+	if err != nil {
+		http.Error(w, "Failed to generate stream key", http.StatusInternalServerError)
+		return
+	}
+
+	var rotated time.Time
+	err = db.QueryRow(context.Background(),
+		`UPDATE Tasks SET stream_key = $1, stream_key_rotated = NOW(), updated = NOW() WHERE id = $2 RETURNING stream_key_rotated`,
+		streamKey, task.ID).Scan(&rotated)
+
+	if err != nil {
+		log.Printf("Failed to rotate stream key: %v", err)
+		http.Error(w, "Failed to rotate stream key", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("🔑 Stream key rotated: %s by %s (ID: %d)", streamID, claims.Username, claims.UserID)
+
+	response := map[string]interface{}{
+		"stream_id":  streamID,
+		"rotated_at": rotated,
+		"message":    "Stream key rotated successfully",
+	}
+
+	// Новый ключ видит только владелец
+	if task.UserID == claims.UserID {
+		response["stream_key"] = streamKey
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
 // MyStreamsHandler показывает стримы пользователя
 func MyStreamsHandler(w http.ResponseWriter, r *http.Request) {
 	claims, ok := r.Context().Value("user").(*AuthClaims)
@@ -255,11 +487,11 @@ func MyStreamsHandler(w http.ResponseWriter, r *http.Request) {
 
 	if claims.Role == "admin" {
 		rows, err = db.Query(context.Background(),
-			`SELECT id, streamid, name, user_id, username, created, updated, status 
+			`SELECT id, streamid, name, user_id, username, created, updated, status, COALESCE(stop_reason, ''), COALESCE(last_error, '') 
              FROM Tasks ORDER BY created DESC`)
 	} else {
 		rows, err = db.Query(context.Background(),
-			`SELECT id, streamid, name, user_id, username, created, updated, status 
+			`SELECT id, streamid, name, user_id, username, created, updated, status, COALESCE(stop_reason, ''), COALESCE(last_error, '') 
              FROM Tasks WHERE user_id = $1 ORDER BY created DESC`,
 			claims.UserID)
 	}
@@ -273,7 +505,7 @@ func MyStreamsHandler(w http.ResponseWriter, r *http.Request) {
 	var streams []Task
 	for rows.Next() {
 		var t Task
-		if err := rows.Scan(&t.ID, &t.StreamID, &t.Name, &t.UserID, &t.Username, &t.Created, &t.Updated, &t.Status); err != nil {
+		if err := rows.Scan(&t.ID, &t.StreamID, &t.Name, &t.UserID, &t.Username, &t.Created, &t.Updated, &t.Status, &t.StopReason, &t.LastError); err != nil {
 			http.Error(w, "Error scanning stream", http.StatusInternalServerError)
 			return
 		}
@@ -322,7 +554,7 @@ func PublicStreamsHandler(w http.ResponseWriter, r *http.Request) {
 			"username":  username,
 			"status":    status,
 			"created":   created,
-			"hls_url":   fmt.Sprintf("http://localhost:9090/hls/%s/stream.m3u8", streamID),
+			"hls_url":   fmt.Sprintf("http://localhost:9090/hls/%s/master.m3u8", streamID),
 		}
 
 		streams = append(streams, stream)
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// StreamLogsHandler логи ffmpeg стрима с узла stream-app (владелец или admin).
+// Параметры lines и session передаются в stream-app как есть
+func StreamLogsHandler(w http.ResponseWriter, r *http.Request) {
+	streamID, _, ok := authorizeStreamOwner(w, r, "You can only view logs of your own streams")
+	if !ok {
+		return
+	}
+
+	query := url.Values{}
+	for _, key := range []string{"lines", "session"} {
+		if value := r.URL.Query().Get(key); value != "" {
+			query.Set(key, value)
+		}
+	}
+	target := fmt.Sprintf("%s/stream/%s/logs", streamNodeURL(streamID), url.PathEscape(streamID))
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		http.Error(w, "Failed to build logs request", http.StatusInternalServerError)
+		return
+	}
+	// stream-app отдает логи только внутренним сервисам
+	req.Header.Set("X-API-Key", authClient.apiKey)
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Printf("❌ Failed to fetch logs of stream %s: %v", streamID, err)
+		http.Error(w, "Stream service unavailable", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
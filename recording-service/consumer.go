@@ -55,8 +55,8 @@ func (kc *KafkaConsumer) Start(ctx context.Context, jobChannel chan<- RecordingT
 				continue
 			}
 
-			// Фильтрация только stop_recording задач
-			if task.Action == "stop_recording" || task.Action == "stop_recording_direct" {
+			// Фильтрация: записи после остановки стрима и регистрация клипов
+			if task.Action == "stop_recording" || task.Action == "stop_recording_direct" || task.Action == "register_clip" {
 				log.Printf("📨 Received recording task: %s", task.StreamID)
 
 				select {
@@ -76,10 +76,23 @@ func convertToMP4(hlsPlaylist, outputMP4 string) error {
 		return fmt.Errorf("invalid HLS playlist: %w", err)
 	}
 
-	// ✅ Улучшенная FFmpeg команда с детальным логированием
-	ffmpegCmd := exec.Command("ffmpeg",
+	args := []string{
 		"-loglevel", "info", // Детальные логи
 		"-i", hlsPlaylist,
+	}
+
+	// ✅ CMAF: видео и аудио лежат в разных плейлистах (EXT-X-MEDIA TYPE=AUDIO)
+	if audioPlaylist := findAlternateAudio(hlsPlaylist); audioPlaylist != "" {
+		log.Printf("🔊 Using alternate audio playlist: %s", audioPlaylist)
+		args = append(args,
+			"-i", audioPlaylist,
+			"-map", "0:v:0",
+			"-map", "1:a:0",
+		)
+	}
+
+	// ✅ Улучшенная FFmpeg команда с детальным логированием
+	args = append(args,
 		"-c:v", "libx264", // Принудительное перекодирование видео
 		"-c:a", "aac", // Принудительное перекодирование аудио
 		"-preset", "fast", // Быстрое кодирование
@@ -89,6 +102,7 @@ func convertToMP4(hlsPlaylist, outputMP4 string) error {
 		"-y", // Перезаписать файл
 		outputMP4,
 	)
+	ffmpegCmd := exec.Command("ffmpeg", args...)
 
 	log.Printf("🔧 Running FFmpeg: %v", ffmpegCmd.Args)
 
@@ -135,34 +149,36 @@ func validateHLSPlaylist(playlistPath string) error {
 		return fmt.Errorf("invalid HLS playlist: missing #EXTM3U header")
 	}
 
-	// Подсчитать сегменты
-	segmentCount := strings.Count(playlistStr, ".ts")
-	if segmentCount == 0 {
-		return fmt.Errorf("no .ts segments found in playlist")
-	}
-
-	log.Printf("📊 Found %d segments in playlist", segmentCount)
-
-	// Проверить что файлы сегментов существуют
+	// Подсчитать сегменты (.ts или fMP4 части LL-HLS)
 	playlistDir := filepath.Dir(playlistPath)
 	lines := strings.Split(playlistStr, "\n")
 
+	segmentCount := 0
 	validSegments := 0
 	for _, line := range lines {
 		line = strings.TrimSpace(line)
-		if strings.HasSuffix(line, ".ts") {
-			segmentPath := filepath.Join(playlistDir, line)
-			if stat, err := os.Stat(segmentPath); err == nil && stat.Size() > 0 {
-				validSegments++
-				log.Printf("📦 Valid segment: %s (%d bytes)", line, stat.Size())
-			} else {
-				log.Printf("⚠️ Missing/empty segment: %s", line)
-			}
+		if !strings.HasSuffix(line, ".ts") && !strings.HasSuffix(line, ".m4s") {
+			continue
+		}
+		segmentCount++
+
+		segmentPath := filepath.Join(playlistDir, line)
+		if stat, err := os.Stat(segmentPath); err == nil && stat.Size() > 0 {
+			validSegments++
+			log.Printf("📦 Valid segment: %s (%d bytes)", line, stat.Size())
+		} else {
+			log.Printf("⚠️ Missing/empty segment: %s", line)
 		}
 	}
 
+	if segmentCount == 0 {
+		return fmt.Errorf("no segments found in playlist")
+	}
+
+	log.Printf("📊 Found %d segments in playlist", segmentCount)
+
 	if validSegments == 0 {
-		return fmt.Errorf("no valid .ts segments found on disk")
+		return fmt.Errorf("no valid segments found on disk")
 	}
 
 	log.Printf("✅ Validated %d/%d segments", validSegments, segmentCount)
@@ -323,6 +339,12 @@ func convertHLSToMP4WithTempDir(task RecordingTask, tempHLSDir string) Processin
 
 // ✅ ВСПОМОГАТЕЛЬНАЯ ФУНКЦИЯ: поиск плейлиста в директории
 func findHLSPlaylistInDir(dir string) (string, error) {
+	// ABR лестница: берем вариант с наибольшим битрейтом из master.m3u8
+	if variant, ok := selectBestVariant(dir); ok {
+		log.Printf("📋 Found master playlist, using variant: %s", variant)
+		return variant, nil
+	}
+
 	// Сначала проверяем стандартное имя
 	standardPlaylist := filepath.Join(dir, "stream.m3u8")
 	if _, err := os.Stat(standardPlaylist); err == nil {
@@ -346,3 +368,147 @@ func findHLSPlaylistInDir(dir string) (string, error) {
 
 	return "", fmt.Errorf("no .m3u8 playlist found in directory")
 }
+
+// ✅ ВСПОМОГАТЕЛЬНАЯ ФУНКЦИЯ: выбор видео-варианта с наибольшим BANDWIDTH из master.m3u8
+func selectBestVariant(dir string) (string, bool) {
+	content, err := os.ReadFile(filepath.Join(dir, "master.m3u8"))
+	if err != nil {
+		return "", false
+	}
+
+	bestPath := ""
+	bestBandwidth := -1
+	bestHasVideo := false
+
+	lines := strings.Split(string(content), "\n")
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+		if !strings.HasPrefix(line, "#EXT-X-STREAM-INF:") {
+			continue
+		}
+
+		// URI варианта — следующая непустая строка без #
+		uri := ""
+		for j := i + 1; j < len(lines); j++ {
+			next := strings.TrimSpace(lines[j])
+			if next == "" {
+				continue
+			}
+			if !strings.HasPrefix(next, "#") {
+				uri = next
+				i = j
+			}
+			break
+		}
+		if uri == "" {
+			continue
+		}
+
+		variantPath := filepath.Join(dir, filepath.FromSlash(uri))
+		if _, err := os.Stat(variantPath); err != nil {
+			continue
+		}
+
+		bandwidth := parsePlaylistAttrInt(line, "BANDWIDTH")
+		hasVideo := strings.Contains(line, "RESOLUTION=")
+
+		// Видео варианты всегда предпочтительнее audio-only
+		if (hasVideo && !bestHasVideo) || (hasVideo == bestHasVideo && bandwidth > bestBandwidth) {
+			bestPath = variantPath
+			bestBandwidth = bandwidth
+			bestHasVideo = hasVideo
+		}
+	}
+
+	return bestPath, bestPath != ""
+}
+
+func parsePlaylistAttrInt(line, attr string) int {
+	// Ищем атрибут целиком, чтобы BANDWIDTH не совпал с AVERAGE-BANDWIDTH
+	idx := strings.Index(line, ":"+attr+"=")
+	if idx == -1 {
+		idx = strings.Index(line, ","+attr+"=")
+	}
+	if idx == -1 {
+		return 0
+	}
+
+	value := line[idx+len(attr)+2:]
+	if end := strings.IndexByte(value, ','); end != -1 {
+		value = value[:end]
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// ✅ ВСПОМОГАТЕЛЬНАЯ ФУНКЦИЯ: аудио плейлист для варианта из master.m3u8 (группа AUDIO="...")
+func findAlternateAudio(variantPlaylist string) string {
+	dir := filepath.Dir(variantPlaylist)
+	content, err := os.ReadFile(filepath.Join(dir, "master.m3u8"))
+	if err != nil {
+		return ""
+	}
+
+	lines := strings.Split(string(content), "\n")
+	variantName := filepath.Base(variantPlaylist)
+
+	// Группа аудио, на которую ссылается выбранный вариант
+	group := ""
+	for i := 0; i < len(lines)-1; i++ {
+		line := strings.TrimSpace(lines[i])
+		if strings.HasPrefix(line, "#EXT-X-STREAM-INF:") && strings.TrimSpace(lines[i+1]) == variantName {
+			group = parsePlaylistAttrString(line, "AUDIO")
+			break
+		}
+	}
+	if group == "" {
+		return ""
+	}
+
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "#EXT-X-MEDIA:") ||
+			parsePlaylistAttrString(line, "TYPE") != "AUDIO" ||
+			parsePlaylistAttrString(line, "GROUP-ID") != group {
+			continue
+		}
+
+		uri := parsePlaylistAttrString(line, "URI")
+		if uri == "" {
+			continue
+		}
+		audioPath := filepath.Join(dir, filepath.FromSlash(uri))
+		if _, err := os.Stat(audioPath); err == nil {
+			return audioPath
+		}
+	}
+
+	return ""
+}
+
+func parsePlaylistAttrString(line, attr string) string {
+	idx := strings.Index(line, ":"+attr+"=")
+	if idx == -1 {
+		idx = strings.Index(line, ","+attr+"=")
+	}
+	if idx == -1 {
+		return ""
+	}
+
+	value := line[idx+len(attr)+2:]
+	if strings.HasPrefix(value, "\"") {
+		value = value[1:]
+		if end := strings.IndexByte(value, '"'); end != -1 {
+			return value[:end]
+		}
+		return value
+	}
+	if end := strings.IndexByte(value, ','); end != -1 {
+		value = value[:end]
+	}
+	return value
+}
@@ -230,6 +230,46 @@ func (dm *DatabaseManager) CreateRecording(recording Recording) error {
 	return nil
 }
 
+// Регистрация клипа. Сообщения о клипе могут обработать разные воркеры,
+// поэтому запоздавший processing не перезаписывает ready/failed
+func (dm *DatabaseManager) SaveClip(clip Recording) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	query := `
+        INSERT INTO recordings (
+            stream_id, user_id, username, title, duration_seconds,
+            file_path, thumbnail_path, file_size_bytes, status, kind, source_stream_id
+        ) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, 'clip', $10)
+        ON CONFLICT (stream_id) DO UPDATE SET
+            duration_seconds = EXCLUDED.duration_seconds,
+            file_path = EXCLUDED.file_path,
+            thumbnail_path = EXCLUDED.thumbnail_path,
+            file_size_bytes = EXCLUDED.file_size_bytes,
+            status = EXCLUDED.status,
+            updated_at = NOW()
+        WHERE recordings.status = 'processing'`
+
+	_, err := dm.pool.Exec(ctx, query,
+		clip.StreamID,
+		clip.UserID,
+		clip.Username,
+		clip.Title,
+		clip.Duration,
+		clip.FilePath,
+		clip.ThumbnailPath,
+		clip.FileSize,
+		clip.Status,
+		clip.SourceStreamID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save clip: %w", err)
+	}
+
+	log.Printf("📊 DB: Saved clip %s (source: %s, status: %s)", clip.StreamID, clip.SourceStreamID, clip.Status)
+	return nil
+}
+
 // ✅ НОВАЯ ФУНКЦИЯ: финальное обновление записи
 func (dm *DatabaseManager) UpdateRecordingComplete(recording Recording) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
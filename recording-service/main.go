@@ -115,6 +115,10 @@ func (wp *WorkerPool) worker(id int) {
 	for {
 		select {
 		case job := <-wp.JobChannel:
+			if job.Action == "register_clip" {
+				wp.registerClip(job)
+				continue
+			}
 			log.Printf("🔧 Worker %d processing stream: %s", id, job.StreamID)
 			wp.processRecordingTask(job)
 
@@ -254,3 +258,32 @@ func (wp *WorkerPool) processRecordingTask(task RecordingTask) {
 	log.Printf("✅ Successfully processed recording: %s → MinIO:%s (owner: %s)",
 		task.StreamID, vodPaths.MP4URL, task.Username)
 }
+
+// Клип уже собран и загружен stream-app: только регистрируем его как VOD запись
+func (wp *WorkerPool) registerClip(task RecordingTask) {
+	if task.ErrorMsg != "" {
+		log.Printf("❌ Clip %s from stream %s failed: %s", task.StreamID, task.SourceStreamID, task.ErrorMsg)
+	}
+
+	clip := Recording{
+		StreamID:       task.StreamID,
+		UserID:         task.UserID,
+		Username:       task.Username,
+		Title:          task.Title,
+		Duration:       task.Duration,
+		FilePath:       task.FilePath,
+		ThumbnailPath:  task.ThumbnailPath,
+		FileSize:       task.FileSize,
+		Status:         task.Status,
+		Kind:           "clip",
+		SourceStreamID: task.SourceStreamID,
+	}
+
+	if err := dbManager.SaveClip(clip); err != nil {
+		log.Printf("❌ Failed to register clip %s: %v", task.StreamID, err)
+		return
+	}
+
+	log.Printf("✂️ Clip %s from stream %s registered (status: %s, owner: %s)",
+		task.StreamID, task.SourceStreamID, task.Status, task.Username)
+}
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS idx_recordings_source_stream_id;
+DROP INDEX IF EXISTS idx_recordings_kind;
+
+ALTER TABLE recordings DROP COLUMN IF EXISTS source_stream_id;
+ALTER TABLE recordings DROP COLUMN IF EXISTS kind;
@@ -0,0 +1,9 @@
+-- Клипы из live стримов хранятся как отдельные VOD записи
+ALTER TABLE recordings ADD COLUMN IF NOT EXISTS kind VARCHAR(16) NOT NULL DEFAULT 'recording';  -- recording/clip
+ALTER TABLE recordings ADD COLUMN IF NOT EXISTS source_stream_id VARCHAR(100);
+
+CREATE INDEX IF NOT EXISTS idx_recordings_kind ON recordings(kind);
+CREATE INDEX IF NOT EXISTS idx_recordings_source_stream_id ON recordings(source_stream_id);
+
+COMMENT ON COLUMN recordings.kind IS 'recording (full stream) or clip (last seconds of a live stream)';
+COMMENT ON COLUMN recordings.source_stream_id IS 'Stream the clip was cut from';
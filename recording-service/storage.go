@@ -6,6 +6,7 @@ import (
 	"io"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 	"time"
@@ -87,18 +88,22 @@ func (sm *StorageManager) DownloadHLSFilesWithRetry(streamID string, attempt int
 			continue
 		}
 
-		// Извлекаем имя файла
-		fileName := filepath.Base(object.Key)
+		// Извлекаем путь относительно папки стрима (варианты лестницы лежат в подпапках)
+		fileName := strings.TrimPrefix(object.Key, streamID+"/")
 		if fileName == "" || fileName == streamID {
 			continue
 		}
 
 		// Скачиваем только HLS файлы
-		if !strings.HasSuffix(fileName, ".ts") && !strings.HasSuffix(fileName, ".m3u8") {
+		if !isHLSFile(fileName) {
 			continue
 		}
 
-		localPath := filepath.Join(tempDir, fileName)
+		localPath := filepath.Join(tempDir, filepath.FromSlash(fileName))
+		if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+			log.Printf("❌ Failed to create dir for %s: %v", object.Key, err)
+			continue
+		}
 
 		// Скачиваем файл
 		err := sm.minioClient.FGetObject(ctx, sm.bucketName, object.Key, localPath, minio.GetObjectOptions{})
@@ -156,39 +161,44 @@ func (sm *StorageManager) DownloadHLSFilesFromFallback(streamID string) (string,
 		return "", fmt.Errorf("no shared HLS directory found for stream %s", streamID)
 	}
 
-	files, err := os.ReadDir(sharedPath)
-	if err != nil {
-		os.RemoveAll(tempDir)
-		return "", fmt.Errorf("failed to read shared directory: %v", err)
-	}
-
 	copiedFiles := 0
 
-	for _, file := range files {
-		if file.IsDir() {
-			continue
+	err := filepath.WalkDir(sharedPath, func(srcPath string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
 		}
 
-		fileName := file.Name()
+		fileName := d.Name()
 
 		// Пропускаем временные файлы
 		if strings.HasSuffix(fileName, ".tmp") {
-			continue
+			return nil
 		}
 
-		if !strings.HasSuffix(fileName, ".ts") && !strings.HasSuffix(fileName, ".m3u8") {
-			continue
+		if !isHLSFile(fileName) {
+			return nil
 		}
 
-		srcPath := filepath.Join(sharedPath, fileName)
-		dstPath := filepath.Join(tempDir, fileName)
+		relPath, err := filepath.Rel(sharedPath, srcPath)
+		if err != nil {
+			return nil
+		}
+		dstPath := filepath.Join(tempDir, relPath)
+		if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
+			return err
+		}
 
 		if err := sm.copyFile(srcPath, dstPath); err == nil {
 			copiedFiles++
-			log.Printf("📁 Copied from shared volume: %s", fileName)
+			log.Printf("📁 Copied from shared volume: %s", relPath)
 		} else {
-			log.Printf("⚠️ Failed to copy %s: %v", fileName, err)
+			log.Printf("⚠️ Failed to copy %s: %v", relPath, err)
 		}
+		return nil
+	})
+	if err != nil {
+		os.RemoveAll(tempDir)
+		return "", fmt.Errorf("failed to read shared directory: %v", err)
 	}
 
 	if copiedFiles == 0 {
@@ -206,28 +216,28 @@ func (sm *StorageManager) CountHLSFiles(tempDir string) int {
 		return 0
 	}
 
-	files, err := os.ReadDir(tempDir)
-	if err != nil {
-		return 0
-	}
-
 	count := 0
-	for _, file := range files {
-		if file.IsDir() {
-			continue
+	filepath.WalkDir(tempDir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
 		}
 
-		fileName := file.Name()
-		if strings.HasSuffix(fileName, ".ts") || strings.HasSuffix(fileName, ".m3u8") {
+		if isHLSFile(d.Name()) {
 			count++
 		}
-	}
+		return nil
+	})
 
 	return count
 }
 
 // ✅ ОБНОВЛЕННАЯ ФУНКЦИЯ: путь к плейлисту
 func (sm *StorageManager) GetHLSPlaylistPath(tempDir string) (string, error) {
+	// ABR лестница: выбираем лучший вариант из master.m3u8
+	if variant, ok := selectBestVariant(tempDir); ok {
+		return variant, nil
+	}
+
 	// Сначала ищем стандартное имя
 	standardPath := filepath.Join(tempDir, "stream.m3u8")
 	if _, err := os.Stat(standardPath); err == nil {
@@ -331,3 +341,12 @@ func (sm *StorageManager) copyFile(src, dst string) error {
 	_, err = io.Copy(destFile, sourceFile)
 	return err
 }
+
+// ✅ HLS файлы: плейлисты, .ts сегменты и fMP4 (LL-HLS части + init)
+func isHLSFile(fileName string) bool {
+	base := path.Base(fileName)
+	return strings.HasSuffix(base, ".m3u8") ||
+		strings.HasSuffix(base, ".ts") ||
+		strings.HasSuffix(base, ".m4s") ||
+		(strings.HasPrefix(base, "init") && strings.HasSuffix(base, ".mp4"))
+}
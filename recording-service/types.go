@@ -17,6 +17,11 @@ type RecordingTask struct {
 	SegmentCount int       `json:"segment_count,omitempty"`
 	Status       string    `json:"status"`
 	Timestamp    time.Time `json:"timestamp"`
+	ErrorMsg     string    `json:"error_message,omitempty"`
+	// Клип (action "register_clip"): StreamID - ID клипа, MP4 уже собран stream-app
+	SourceStreamID string `json:"source_stream_id,omitempty"`
+	FilePath       string `json:"file_path,omitempty"`
+	ThumbnailPath  string `json:"thumbnail_path,omitempty"`
 }
 
 // Recording структура записи в БД (обновленная)
@@ -33,6 +38,9 @@ type Recording struct {
 	Status        string    `json:"status"` // processing, ready, failed
 	CreatedAt     time.Time `json:"created_at"`
 	UpdatedAt     time.Time `json:"updated_at"`
+	// recording или clip; для клипа - стрим, из которого он вырезан
+	Kind           string `json:"kind"`
+	SourceStreamID string `json:"source_stream_id,omitempty"`
 }
 
 // ProcessingResult результат обработки (без изменений)
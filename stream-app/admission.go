@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"strconv"
+)
+
+// Контроль нагрузки: новый стрим с перекодированием принимается, только если
+// хватает слотов кодирования и уже идущие кодирования успевают за реальным временем.
+// Слот - один вариант libx264; passthrough слотов не занимает
+const (
+	defaultAdmissionMinSpeed = 0.9
+	// Скорость из -progress усредняется с начала запуска: первые секунды не показательны
+	admissionSpeedWarmup = 15.0
+)
+
+var (
+	transcodeSlots    = loadTranscodeSlots()
+	admissionMinSpeed = loadAdmissionMinSpeed()
+)
+
+// Отказ в приеме стрима: причина уходит в main-app
+type admissionError struct {
+	reason string
+}
+
+func (e *admissionError) Error() string {
+	return e.reason
+}
+
+func loadTranscodeSlots() int {
+	slots := runtime.NumCPU()
+	if value := os.Getenv("TRANSCODE_SLOTS"); value != "" {
+		if n, err := strconv.Atoi(value); err == nil && n >= 0 {
+			slots = n
+		} else {
+			log.Printf("⚠️ Invalid TRANSCODE_SLOTS %q, using %d", value, slots)
+		}
+	}
+	return slots
+}
+
+func loadAdmissionMinSpeed() float64 {
+	value := os.Getenv("ADMISSION_MIN_SPEED")
+	if value == "" {
+		return defaultAdmissionMinSpeed
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil || f < 0 {
+		log.Printf("⚠️ Invalid ADMISSION_MIN_SPEED %q, using %.2f", value, defaultAdmissionMinSpeed)
+		return defaultAdmissionMinSpeed
+	}
+	return f
+}
+
+// Сколько слотов занимает режим кодирования
+func transcodeCost(mode string) int {
+	switch mode {
+	case ProfilePassthrough:
+		return 0
+	case ProfileTranscode:
+		return 1
+	default:
+		cost := 0
+		for _, r := range hlsLadder {
+			if !r.AudioOnly {
+				cost++
+			}
+		}
+		return cost
+	}
+}
+
+// Текущая загрузка узла: занятые слоты и самая низкая скорость кодирования
+// среди подключенных стримов (0 - измерений пока нет). Вызывается под streamsMux
+func transcodeLoad() (int, float64) {
+	processesMux.Lock()
+	defer processesMux.Unlock()
+
+	used := 0
+	minSpeed := 0.0
+	for streamID, stream := range activeStreams {
+		mode := normalizeProfile(stream.Profile)
+		proc, exists := processes[streamID]
+		if exists {
+			// passthrough мог откатиться в transcode
+			mode = proc.EncodingMode
+		}
+		used += transcodeCost(mode)
+
+		if !exists || mode == ProfilePassthrough || !proc.IsConnected ||
+			proc.Stats.OutTime < admissionSpeedWarmup || proc.Stats.Speed <= 0 {
+			continue
+		}
+		if minSpeed == 0 || proc.Stats.Speed < minSpeed {
+			minSpeed = proc.Stats.Speed
+		}
+	}
+	return used, minSpeed
+}
+
+// Проверка перед запуском стрима; вызывается под streamsMux
+func admitStream(profile string) error {
+	cost := transcodeCost(normalizeProfile(profile))
+	if cost == 0 || transcodeSlots == 0 {
+		return nil
+	}
+
+	used, minSpeed := transcodeLoad()
+	if used+cost > transcodeSlots {
+		return &admissionError{reason: fmt.Sprintf("node %s is over transcode capacity: %d of %d slots used, profile %s needs %d",
+			nodeID, used, transcodeSlots, normalizeProfile(profile), cost)}
+	}
+	if minSpeed > 0 && minSpeed < admissionMinSpeed {
+		return &admissionError{reason: fmt.Sprintf("node %s is saturated: running encodes at %.2fx speed (minimum %.2fx)",
+			nodeID, minSpeed, admissionMinSpeed)}
+	}
+	return nil
+}
+
+// Кодирования не успевают за реальным временем
+func nodeSaturated() bool {
+	streamsMux.Lock()
+	_, minSpeed := transcodeLoad()
+	streamsMux.Unlock()
+	return minSpeed > 0 && minSpeed < admissionMinSpeed
+}
+
+// Для /health: состояние слотов и скорость кодирования
+func admissionStatus() map[string]interface{} {
+	streamsMux.Lock()
+	used, minSpeed := transcodeLoad()
+	streamsMux.Unlock()
+
+	return map[string]interface{}{
+		"transcode_slots": transcodeSlots,
+		"slots_used":      used,
+		"min_speed":       minSpeed,
+		"min_speed_limit": admissionMinSpeed,
+		"saturated":       minSpeed > 0 && minSpeed < admissionMinSpeed,
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"web/stream-app/kafka"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// Клипы: последние N секунд эфира собираются из сегментов, уже загруженных
+// в MinIO, в отдельный MP4 и регистрируются в VOD через recording-service
+const (
+	maxConcurrentClips = 2
+	minClipSeconds     = 30 // те же границы, что у main-app
+	maxClipSeconds     = 120
+	clipTimeout        = 5 * time.Minute
+)
+
+// Bucket VOD файлов, тот же что у recording-service
+var vodBucket = getEnv("MINIO_VOD_BUCKET", "recordings")
+
+// Слоты сборки клипов на узле: ffmpeg и скачивание сегментов не бесплатны
+var clipSlots = make(chan struct{}, maxConcurrentClips)
+
+// ClipRequest запрос main-app на сборку клипа
+type ClipRequest struct {
+	ClipID   string `json:"clip_id"`
+	Duration int    `json:"duration_seconds"`
+	Title    string `json:"title"`
+	UserID   int    `json:"user_id"`
+	Username string `json:"username"`
+}
+
+// ID клипа из main-app: <streamID>-clip-<hex>. Идет в имена файлов и ключи MinIO
+func validClipID(streamID, clipID string) bool {
+	suffix, ok := strings.CutPrefix(clipID, streamID+"-clip-")
+	if !ok || suffix == "" {
+		return false
+	}
+	_, err := hex.DecodeString(suffix)
+	return err == nil
+}
+
+// POST /stream/{id}/clips: сборка идет в фоне, клип появится в VOD под clip_id
+func streamClipHandler(w http.ResponseWriter, r *http.Request, streamID string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// Клипы заказывает только main-app (там проверка пользователя и лимиты)
+	if !isServiceRequest(r) {
+		http.Error(w, "Service API key required", http.StatusUnauthorized)
+		return
+	}
+
+	var req ClipRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.ClipID == "" || req.Duration < minClipSeconds || req.Duration > maxClipSeconds {
+		http.Error(w, fmt.Sprintf("clip_id and duration_seconds (%d-%d) are required", minClipSeconds, maxClipSeconds), http.StatusBadRequest)
+		return
+	}
+	if !validClipID(streamID, req.ClipID) {
+		http.Error(w, "Invalid clip_id", http.StatusBadRequest)
+		return
+	}
+
+	streamsMux.Lock()
+	_, exists := activeStreams[streamID]
+	streamsMux.Unlock()
+	if !exists {
+		http.Error(w, "Stream is not active", http.StatusNotFound)
+		return
+	}
+
+	select {
+	case clipSlots <- struct{}{}:
+	default:
+		http.Error(w, "Too many clips in progress, try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	go func() {
+		defer func() { <-clipSlots }()
+		createClip(streamID, req)
+	}()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{
+		"clip_id": req.ClipID,
+		"status":  "processing",
+	})
+}
+
+func createClip(streamID string, req ClipRequest) {
+	log.Printf("✂️ Creating clip %s: last %ds of stream %s", req.ClipID, req.Duration, streamID)
+
+	// Запись появляется в VOD сразу, со статусом processing
+	sendClipTask(streamID, req, kafka.RecordingTask{Status: "processing"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), clipTimeout)
+	defer cancel()
+
+	tempDir, err := os.MkdirTemp("", "clip_"+req.ClipID+"_")
+	if err != nil {
+		log.Printf("❌ Failed to create temp dir for clip %s: %v", req.ClipID, err)
+		sendClipTask(streamID, req, kafka.RecordingTask{Status: "failed", ErrorMsg: err.Error()})
+		return
+	}
+	defer os.RemoveAll(tempDir)
+
+	mp4Path := filepath.Join(tempDir, "clip.mp4")
+	duration, err := assembleClip(ctx, streamID, req.Duration, tempDir, mp4Path)
+	if err != nil {
+		log.Printf("❌ Failed to assemble clip %s: %v", req.ClipID, err)
+		sendClipTask(streamID, req, kafka.RecordingTask{Status: "failed", ErrorMsg: err.Error()})
+		return
+	}
+
+	thumbPath := filepath.Join(tempDir, "thumbnail.jpg")
+	if err := generateClipThumbnail(ctx, mp4Path, thumbPath); err != nil {
+		log.Printf("⚠️ Failed to generate thumbnail for clip %s: %v", req.ClipID, err)
+		thumbPath = ""
+	}
+
+	task, err := uploadClip(ctx, req.ClipID, mp4Path, thumbPath)
+	if err != nil {
+		log.Printf("❌ Failed to upload clip %s: %v", req.ClipID, err)
+		sendClipTask(streamID, req, kafka.RecordingTask{Status: "failed", ErrorMsg: err.Error()})
+		return
+	}
+
+	task.Status = "ready"
+	task.Duration = int(duration + 0.5)
+	sendClipTask(streamID, req, task)
+
+	log.Printf("✅ Clip %s ready: %ds from stream %s (%d bytes)", req.ClipID, task.Duration, streamID, task.FileSize)
+}
+
+// Сборка MP4 без перекодирования: лучший вариант из master.m3u8 (+ отдельное аудио для CMAF).
+// Возвращает фактическую длительность клипа
+func assembleClip(ctx context.Context, streamID string, seconds int, tempDir, mp4Path string) (float64, error) {
+	master, err := readMinIOObject(ctx, streamID+"/"+masterPlaylistName)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read master playlist: %v", err)
+	}
+
+	videoURI, audioURI := bestRenditions(master)
+	if videoURI == "" {
+		return 0, fmt.Errorf("no variants in master playlist")
+	}
+
+	window := time.Duration(seconds) * time.Second
+	videoPlaylist, duration, err := downloadClipPlaylist(ctx, streamID, videoURI, window, tempDir)
+	if err != nil {
+		return 0, err
+	}
+
+	args := []string{"-loglevel", "error", "-i", videoPlaylist}
+	if audioURI != "" {
+		audioPlaylist, _, err := downloadClipPlaylist(ctx, streamID, audioURI, window, tempDir)
+		if err != nil {
+			return 0, err
+		}
+		args = append(args, "-i", audioPlaylist, "-map", "0:v:0", "-map", "1:a:0")
+	}
+	args = append(args, "-c", "copy", "-movflags", "+faststart", "-y", mp4Path)
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return 0, fmt.Errorf("ffmpeg failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return duration, nil
+}
+
+// Вариант с наибольшим BANDWIDTH и его аудио группа (EXT-X-MEDIA TYPE=AUDIO), если она есть
+func bestRenditions(master []byte) (string, string) {
+	var videoURI, audioGroup string
+	bestBandwidth := -1
+	audioURIs := make(map[string]string)
+
+	scanner := bufio.NewScanner(bytes.NewReader(master))
+	var streamInf string
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-MEDIA:") && playlistAttr(line, "TYPE") == "AUDIO":
+			if uri := playlistAttr(line, "URI"); uri != "" {
+				audioURIs[playlistAttr(line, "GROUP-ID")] = uri
+			}
+		case strings.HasPrefix(line, "#EXT-X-STREAM-INF:"):
+			streamInf = line
+		case streamInf != "" && line != "" && !strings.HasPrefix(line, "#"):
+			bandwidth, _ := strconv.Atoi(playlistAttr(streamInf, "BANDWIDTH"))
+			if bandwidth > bestBandwidth {
+				bestBandwidth = bandwidth
+				videoURI = line
+				audioGroup = playlistAttr(streamInf, "AUDIO")
+			}
+			streamInf = ""
+		}
+	}
+
+	return videoURI, audioURIs[audioGroup]
+}
+
+// Скачивание последних сегментов плейлиста и локальный плейлист на них (с ENDLIST)
+func downloadClipPlaylist(ctx context.Context, streamID, relPath string, window time.Duration, tempDir string) (string, float64, error) {
+	data, err := readMinIOObject(ctx, streamID+"/"+relPath)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to read playlist %s: %v", relPath, err)
+	}
+
+	pl := parseDVRPlaylist(data).window(window)
+	if len(pl.Segments) == 0 {
+		return "", 0, fmt.Errorf("no uploaded segments in %s", relPath)
+	}
+	pl.Ended = true
+
+	dir := path.Dir(relPath)
+	downloaded := make(map[string]bool)
+	download := func(uri string) error {
+		ref := path.Join(dir, uri)
+		if downloaded[ref] {
+			return nil
+		}
+		localPath := filepath.Join(tempDir, filepath.FromSlash(ref))
+		if err := minioClient.FGetObject(ctx, minioBucket, streamID+"/"+ref, localPath, minio.GetObjectOptions{}); err != nil {
+			return fmt.Errorf("failed to download %s: %v", ref, err)
+		}
+		downloaded[ref] = true
+		return nil
+	}
+
+	duration := 0.0
+	for _, seg := range pl.Segments {
+		if seg.MapLine != "" {
+			if err := download(playlistAttr(seg.MapLine, "URI")); err != nil {
+				return "", 0, err
+			}
+		}
+		if err := download(seg.URI); err != nil {
+			return "", 0, err
+		}
+		duration += seg.Duration
+	}
+
+	localPlaylist := filepath.Join(tempDir, filepath.FromSlash(relPath))
+	if err := os.MkdirAll(filepath.Dir(localPlaylist), 0755); err != nil {
+		return "", 0, fmt.Errorf("failed to create playlist dir: %v", err)
+	}
+	if err := os.WriteFile(localPlaylist, []byte(pl.render()), 0644); err != nil {
+		return "", 0, fmt.Errorf("failed to write playlist: %v", err)
+	}
+	return localPlaylist, duration, nil
+}
+
+func generateClipThumbnail(ctx context.Context, mp4Path, thumbPath string) error {
+	cmd := exec.CommandContext(ctx, "ffmpeg", "-loglevel", "error",
+		"-ss", "1", "-i", mp4Path,
+		"-frames:v", "1", "-vf", "scale=320:-2",
+		"-y", thumbPath)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// Загрузка в VOD bucket по той же схеме, что и записи recording-service
+func uploadClip(ctx context.Context, clipID, mp4Path, thumbPath string) (kafka.RecordingTask, error) {
+	var task kafka.RecordingTask
+
+	mp4Key := fmt.Sprintf("vod/%s/video.mp4", clipID)
+	info, err := minioClient.FPutObject(ctx, vodBucket, mp4Key, mp4Path, minio.PutObjectOptions{ContentType: "video/mp4"})
+	if err != nil {
+		return task, fmt.Errorf("failed to upload MP4: %v", err)
+	}
+	task.FilePath = "/recordings/" + mp4Key
+	task.FileSize = info.Size
+
+	if thumbPath != "" {
+		thumbKey := fmt.Sprintf("vod/%s/thumbnail.jpg", clipID)
+		if _, err := minioClient.FPutObject(ctx, vodBucket, thumbKey, thumbPath, minio.PutObjectOptions{ContentType: "image/jpeg"}); err != nil {
+			log.Printf("⚠️ Failed to upload thumbnail for clip %s: %v", clipID, err)
+		} else {
+			task.ThumbnailPath = "/recordings/" + thumbKey
+		}
+	}
+	return task, nil
+}
+
+// Регистрация клипа в базе записей: recording-service обрабатывает action register_clip
+func sendClipTask(streamID string, req ClipRequest, task kafka.RecordingTask) {
+	task.StreamID = req.ClipID
+	task.SourceStreamID = streamID
+	task.UserID = req.UserID
+	task.Username = req.Username
+	task.Title = req.Title
+	task.Action = "register_clip"
+	task.Timestamp = time.Now()
+
+	enqueueRecordingTask(task)
+}
@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestValidClipID(t *testing.T) {
+	tests := []struct {
+		clipID string
+		want   bool
+	}{
+		{"abc-clip-0a1b2c3d", true},
+		{"abc-clip-", false},
+		{"abc-clip-xyz", false},
+		{"other-clip-0a1b2c3d", false},
+		{"abc-clip-0a1b/../x", false},
+		{"abc-clip-../../etc", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.clipID, func(t *testing.T) {
+			if got := validClipID("abc", tt.clipID); got != tt.want {
+				t.Fatalf("validClipID(%q) = %v, want %v", tt.clipID, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+)
+
+// Форматы вывода
+const (
+	OutputHLS  = "hls"  // HLS с .ts сегментами (или LL-HLS)
+	OutputCMAF = "cmaf" // CMAF сегменты, HLS плейлисты + DASH MPD от одного энкода
+)
+
+const dashManifestName = "manifest.mpd"
+
+func normalizeOutputFormat(format string) string {
+	if strings.ToLower(format) == OutputCMAF {
+		return OutputCMAF
+	}
+	return OutputHLS
+}
+
+// Путь к DASH манифесту для клиентов (только для CMAF стримов)
+func dashPath(streamID, format string) string {
+	if format != OutputCMAF {
+		return ""
+	}
+	return fmt.Sprintf("/hls/%s/%s", streamID, dashManifestName)
+}
+
+// DASH muxer: fMP4 (CMAF) сегменты, manifest.mpd и HLS плейлисты
+// (master.m3u8 + media_N.m3u8) на те же сегменты
+func buildCMAFArgs(hlsDir string, noAudio bool) []string {
+	adaptationSets := "id=0,streams=v id=1,streams=a"
+	if noAudio {
+		adaptationSets = "id=0,streams=v"
+	}
+	return []string{
+		"-f", "dash",
+		"-seg_duration", "4",
+		"-use_template", "1",
+		"-use_timeline", "1",
+		"-window_size", "0",
+		"-dash_segment_type", "mp4",
+		"-init_seg_name", "init-stream$RepresentationID$.m4s",
+		"-media_seg_name", "chunk-stream$RepresentationID$-$Number%05d$.m4s",
+		"-adaptation_sets", adaptationSets,
+		"-hls_playlist", "1",
+		"-hls_master_name", masterPlaylistName,
+		filepath.Join(hlsDir, dashManifestName),
+	}
+}
+
+// LL-HLS собирается из плейлистов hls muxer, с CMAF его совместить нельзя
+func resolveOutputFormat(streamID, format string, lowLatency bool) (string, bool) {
+	format = normalizeOutputFormat(format)
+	if format == OutputCMAF && lowLatency {
+		log.Printf("⚠️ Stream %s: low latency is not supported with CMAF output, using regular segments", streamID)
+		return format, false
+	}
+	return format, lowLatency
+}
@@ -0,0 +1,14 @@
+package main
+
+import "os"
+
+// Ключ для внутренних запросов к main-app (X-API-Key)
+var serviceAPIKey = getEnv("SERVICE_API_KEY", "dev-service-api-key-for-local-testing")
+
+func getEnv(key, defaultValue string) string {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// DVR: скользящее окно по сегментам, которые уже лежат в MinIO. Плейлист в MinIO
+// публикуется uploader только после загрузки всех его сегментов, поэтому окно
+// строится из него, а не из локальной папки (там остается лишь несколько сегментов)
+const (
+	// Плейлисты варианта кэшируются, чтобы зрители не опрашивали MinIO на каждый запрос
+	dvrPlaylistCacheTTL = time.Second
+	dvrRequestTimeout   = 10 * time.Second
+)
+
+var (
+	dvrCache    = make(map[string]dvrCachedPlaylist)
+	dvrCacheMux sync.Mutex
+)
+
+type dvrCachedPlaylist struct {
+	data    []byte
+	fetched time.Time
+}
+
+type dvrSegment struct {
+	Tags          []string // EXTINF, EXT-X-PROGRAM-DATE-TIME, EXT-X-BYTERANGE
+	Duration      float64
+	Discontinuity bool
+	MapLine       string // EXT-X-MAP, действующий для сегмента
+	URI           string
+}
+
+// dvrPlaylist медиа плейлист варианта, разобранный для нарезки окна
+type dvrPlaylist struct {
+	Version               int
+	TargetDuration        int
+	MediaSequence         int
+	DiscontinuitySequence int
+	IndependentSegments   bool
+	Segments              []dvrSegment
+	Ended                 bool
+}
+
+// Путь к DVR плейлисту для клиентов (только если окно задано)
+func dvrPath(streamID string, window int) string {
+	if window <= 0 {
+		return ""
+	}
+	return fmt.Sprintf("/stream/%s/dvr/%s", streamID, masterPlaylistName)
+}
+
+func parseDVRPlaylist(data []byte) *dvrPlaylist {
+	pl := &dvrPlaylist{Version: 3}
+	var current dvrSegment
+	mapLine := ""
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		tag, value, _ := strings.Cut(line, ":")
+
+		switch {
+		case line == "" || line == "#EXTM3U":
+		case tag == "#EXT-X-VERSION":
+			pl.Version, _ = strconv.Atoi(value)
+		case tag == "#EXT-X-TARGETDURATION":
+			pl.TargetDuration, _ = strconv.Atoi(value)
+		case tag == "#EXT-X-MEDIA-SEQUENCE":
+			pl.MediaSequence, _ = strconv.Atoi(value)
+		case tag == "#EXT-X-DISCONTINUITY-SEQUENCE":
+			pl.DiscontinuitySequence, _ = strconv.Atoi(value)
+		case line == "#EXT-X-INDEPENDENT-SEGMENTS":
+			pl.IndependentSegments = true
+		case line == "#EXT-X-ENDLIST":
+			pl.Ended = true
+		case line == "#EXT-X-DISCONTINUITY":
+			current.Discontinuity = true
+		case tag == "#EXT-X-MAP":
+			mapLine = line
+		case tag == "#EXTINF":
+			duration, _, _ := strings.Cut(value, ",")
+			current.Duration, _ = strconv.ParseFloat(duration, 64)
+			current.Tags = append(current.Tags, line)
+		case tag == "#EXT-X-PROGRAM-DATE-TIME" || tag == "#EXT-X-BYTERANGE":
+			current.Tags = append(current.Tags, line)
+		case strings.HasPrefix(line, "#"):
+			// PLAYLIST-TYPE:EVENT и прочее к скользящему окну не относится
+		default:
+			current.URI = line
+			current.MapLine = mapLine
+			pl.Segments = append(pl.Segments, current)
+			current = dvrSegment{}
+		}
+	}
+	return pl
+}
+
+// Последние сегменты общей длительностью не больше window (минимум один)
+func (pl *dvrPlaylist) window(window time.Duration) *dvrPlaylist {
+	first := len(pl.Segments)
+	total := 0.0
+	for first > 0 {
+		duration := pl.Segments[first-1].Duration
+		if first < len(pl.Segments) && total+duration > window.Seconds() {
+			break
+		}
+		total += duration
+		first--
+	}
+
+	sliced := *pl
+	sliced.Segments = pl.Segments[first:]
+	sliced.MediaSequence = pl.MediaSequence + first
+	for _, seg := range pl.Segments[:first] {
+		if seg.Discontinuity {
+			sliced.DiscontinuitySequence++
+		}
+	}
+	return &sliced
+}
+
+func (pl *dvrPlaylist) render() string {
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	fmt.Fprintf(&b, "#EXT-X-VERSION:%d\n", pl.Version)
+
+	targetDuration := pl.TargetDuration
+	for _, seg := range pl.Segments {
+		targetDuration = max(targetDuration, int(seg.Duration+0.5))
+	}
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", targetDuration)
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", pl.MediaSequence)
+	if pl.DiscontinuitySequence > 0 {
+		fmt.Fprintf(&b, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", pl.DiscontinuitySequence)
+	}
+	if pl.IndependentSegments {
+		b.WriteString("#EXT-X-INDEPENDENT-SEGMENTS\n")
+	}
+
+	mapLine := ""
+	for _, seg := range pl.Segments {
+		if seg.Discontinuity {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		if seg.MapLine != "" && seg.MapLine != mapLine {
+			b.WriteString(seg.MapLine + "\n")
+			mapLine = seg.MapLine
+		}
+		for _, tag := range seg.Tags {
+			b.WriteString(tag + "\n")
+		}
+		b.WriteString(seg.URI + "\n")
+	}
+
+	if pl.Ended {
+		b.WriteString("#EXT-X-ENDLIST\n")
+	}
+	return b.String()
+}
+
+// DVR окно стрима; стрим должен идти на этом узле
+func dvrWindow(streamID string) (time.Duration, bool) {
+	streamsMux.Lock()
+	defer streamsMux.Unlock()
+
+	stream, exists := activeStreams[streamID]
+	if !exists || stream.DVRWindow <= 0 {
+		return 0, false
+	}
+	return time.Duration(stream.DVRWindow) * time.Second, true
+}
+
+// Плейлист варианта из MinIO с коротким кэшем
+func fetchDVRPlaylist(ctx context.Context, objectPath string) ([]byte, error) {
+	dvrCacheMux.Lock()
+	cached, exists := dvrCache[objectPath]
+	dvrCacheMux.Unlock()
+	if exists && time.Since(cached.fetched) < dvrPlaylistCacheTTL {
+		return cached.data, nil
+	}
+
+	data, err := readMinIOObject(ctx, objectPath)
+	if err != nil {
+		return nil, err
+	}
+
+	dvrCacheMux.Lock()
+	now := time.Now()
+	for key, entry := range dvrCache {
+		if now.Sub(entry.fetched) > dvrPlaylistCacheTTL {
+			delete(dvrCache, key)
+		}
+	}
+	dvrCache[objectPath] = dvrCachedPlaylist{data: data, fetched: now}
+	dvrCacheMux.Unlock()
+
+	return data, nil
+}
+
+// GET /stream/{id}/dvr/{path}: master.m3u8 и сегменты отдаются из MinIO как есть,
+// плейлисты вариантов обрезаются до DVR окна. Ссылки в плейлистах относительные,
+// поэтому весь просмотр идет через этот же префикс
+func streamDVRHandler(w http.ResponseWriter, r *http.Request, streamID, relPath string) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	window, ok := dvrWindow(streamID)
+	if !ok {
+		http.Error(w, "DVR is not enabled for this stream", http.StatusNotFound)
+		return
+	}
+	if minioClient == nil {
+		http.Error(w, "Storage unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	relPath = strings.TrimPrefix(path.Clean("/"+relPath), "/")
+	if relPath == "" || relPath == "." {
+		relPath = masterPlaylistName
+	}
+	objectPath := streamID + "/" + relPath
+
+	ctx, cancel := context.WithTimeout(r.Context(), dvrRequestTimeout)
+	defer cancel()
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if strings.HasSuffix(relPath, ".m3u8") && relPath != masterPlaylistName {
+		data, err := fetchDVRPlaylist(ctx, objectPath)
+		if err != nil {
+			writeDVRError(w, streamID, relPath, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Header().Set("Cache-Control", "no-cache")
+		io.WriteString(w, parseDVRPlaylist(data).window(window).render())
+		return
+	}
+
+	object, err := minioClient.GetObject(ctx, minioBucket, objectPath, minio.GetObjectOptions{})
+	if err != nil {
+		writeDVRError(w, streamID, relPath, err)
+		return
+	}
+	defer object.Close()
+
+	info, err := object.Stat()
+	if err != nil {
+		writeDVRError(w, streamID, relPath, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", info.ContentType)
+	if relPath == masterPlaylistName {
+		w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		// Сегменты неизменяемы
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+	}
+	http.ServeContent(w, r, path.Base(relPath), info.LastModified, object)
+}
+
+func writeDVRError(w http.ResponseWriter, streamID, relPath string, err error) {
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	log.Printf("❌ DVR: failed to read %s of stream %s from MinIO: %v", relPath, streamID, err)
+	http.Error(w, "Failed to read from storage", http.StatusBadGateway)
+}
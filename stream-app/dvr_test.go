@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Плейлист из сегментов заданной длины, segment_000.ts, segment_001.ts, ...
+func dvrTestPlaylist(durations ...float64) string {
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:4\n#EXT-X-MEDIA-SEQUENCE:0\n#EXT-X-PLAYLIST-TYPE:EVENT\n")
+	for i, d := range durations {
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\nsegment_%03d.ts\n", d, i)
+	}
+	return b.String()
+}
+
+func TestParseDVRPlaylist(t *testing.T) {
+	content := strings.Join([]string{
+		"#EXTM3U",
+		"#EXT-X-VERSION:7",
+		"#EXT-X-TARGETDURATION:4",
+		"#EXT-X-MEDIA-SEQUENCE:10",
+		"#EXT-X-DISCONTINUITY-SEQUENCE:2",
+		"#EXT-X-PLAYLIST-TYPE:EVENT",
+		"#EXT-X-INDEPENDENT-SEGMENTS",
+		`#EXT-X-MAP:URI="init_0.mp4"`,
+		"#EXTINF:4.000000,",
+		"#EXT-X-PROGRAM-DATE-TIME:2026-01-01T00:00:00.000Z",
+		"seg_0.m4s",
+		"#EXT-X-DISCONTINUITY",
+		`#EXT-X-MAP:URI="init_1.mp4"`,
+		"#EXTINF:3.5,",
+		"seg_1.m4s",
+		"#EXT-X-ENDLIST",
+	}, "\n")
+
+	pl := parseDVRPlaylist([]byte(content))
+
+	if pl.Version != 7 || pl.TargetDuration != 4 || pl.MediaSequence != 10 || pl.DiscontinuitySequence != 2 {
+		t.Fatalf("header = %+v", pl)
+	}
+	if !pl.IndependentSegments || !pl.Ended {
+		t.Fatalf("IndependentSegments = %v, Ended = %v", pl.IndependentSegments, pl.Ended)
+	}
+	if len(pl.Segments) != 2 {
+		t.Fatalf("segments = %d, want 2", len(pl.Segments))
+	}
+
+	first, second := pl.Segments[0], pl.Segments[1]
+	if first.URI != "seg_0.m4s" || first.Duration != 4 || first.Discontinuity || first.MapLine != `#EXT-X-MAP:URI="init_0.mp4"` {
+		t.Fatalf("first segment = %+v", first)
+	}
+	if len(first.Tags) != 2 {
+		t.Fatalf("first segment tags = %v", first.Tags)
+	}
+	if second.URI != "seg_1.m4s" || second.Duration != 3.5 || !second.Discontinuity || second.MapLine != `#EXT-X-MAP:URI="init_1.mp4"` {
+		t.Fatalf("second segment = %+v", second)
+	}
+}
+
+func TestDVRPlaylistWindow(t *testing.T) {
+	tests := []struct {
+		name     string
+		segments []float64
+		window   time.Duration
+		first    int // первый сегмент в окне
+		count    int
+	}{
+		{"window larger than playlist", []float64{4, 4, 4}, time.Minute, 0, 3},
+		{"exact fit", []float64{4, 4, 4, 4}, 12 * time.Second, 1, 3},
+		{"one segment over", []float64{4, 4, 4, 4}, 11 * time.Second, 2, 2},
+		// Окно короче сегмента: все равно отдаем последний
+		{"window shorter than segment", []float64{4, 4, 4}, time.Second, 2, 1},
+		{"zero window", []float64{4, 4}, 0, 1, 1},
+		{"uneven durations", []float64{6, 2, 2, 2, 6}, 10 * time.Second, 2, 3},
+		{"empty playlist", nil, time.Minute, 0, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pl := parseDVRPlaylist([]byte(dvrTestPlaylist(tt.segments...)))
+			sliced := pl.window(tt.window)
+
+			if len(sliced.Segments) != tt.count {
+				t.Fatalf("window has %d segments, want %d", len(sliced.Segments), tt.count)
+			}
+			if sliced.MediaSequence != tt.first {
+				t.Fatalf("MediaSequence = %d, want %d", sliced.MediaSequence, tt.first)
+			}
+			if tt.count > 0 {
+				if want := fmt.Sprintf("segment_%03d.ts", tt.first); sliced.Segments[0].URI != want {
+					t.Fatalf("first segment = %s, want %s", sliced.Segments[0].URI, want)
+				}
+			}
+			// Исходный плейлист не меняется (он в кэше)
+			if len(pl.Segments) != len(tt.segments) || pl.MediaSequence != 0 {
+				t.Fatalf("window modified the source playlist")
+			}
+		})
+	}
+}
+
+func TestDVRPlaylistWindowDiscontinuity(t *testing.T) {
+	content := "#EXTM3U\n#EXT-X-TARGETDURATION:4\n#EXT-X-MEDIA-SEQUENCE:5\n#EXT-X-DISCONTINUITY-SEQUENCE:1\n" +
+		"#EXTINF:4,\na.ts\n#EXT-X-DISCONTINUITY\n#EXTINF:4,\nb.ts\n#EXT-X-DISCONTINUITY\n#EXTINF:4,\nc.ts\n#EXTINF:4,\nd.ts\n"
+
+	sliced := parseDVRPlaylist([]byte(content)).window(8 * time.Second)
+
+	// Разрыв перед b.ts ушел из окна, перед c.ts остался
+	if sliced.MediaSequence != 7 || sliced.DiscontinuitySequence != 2 {
+		t.Fatalf("MediaSequence = %d, DiscontinuitySequence = %d, want 7 and 2", sliced.MediaSequence, sliced.DiscontinuitySequence)
+	}
+	out := sliced.render()
+	if !strings.Contains(out, "#EXT-X-DISCONTINUITY-SEQUENCE:2\n#EXT-X-DISCONTINUITY\n#EXTINF:4,\nc.ts\n") {
+		t.Fatalf("unexpected playlist:\n%s", out)
+	}
+}
+
+func TestDVRPlaylistRender(t *testing.T) {
+	content := strings.Join([]string{
+		"#EXTM3U",
+		"#EXT-X-VERSION:7",
+		"#EXT-X-TARGETDURATION:4",
+		"#EXT-X-MEDIA-SEQUENCE:0",
+		"#EXT-X-PLAYLIST-TYPE:EVENT",
+		"#EXT-X-INDEPENDENT-SEGMENTS",
+		`#EXT-X-MAP:URI="init.mp4"`,
+		"#EXTINF:4.000,",
+		"seg_0.m4s",
+		"#EXTINF:4.000,",
+		"seg_1.m4s",
+		"#EXTINF:5.600,",
+		"seg_2.m4s",
+		"#EXT-X-ENDLIST",
+	}, "\n")
+
+	out := parseDVRPlaylist([]byte(content)).window(10 * time.Second).render()
+	want := strings.Join([]string{
+		"#EXTM3U",
+		"#EXT-X-VERSION:7",
+		// Округленная длительность самого длинного сегмента
+		"#EXT-X-TARGETDURATION:6",
+		"#EXT-X-MEDIA-SEQUENCE:1",
+		"#EXT-X-INDEPENDENT-SEGMENTS",
+		// EXT-X-MAP повторяется для окна, даже если в исходнике он был раньше
+		`#EXT-X-MAP:URI="init.mp4"`,
+		"#EXTINF:4.000,",
+		"seg_1.m4s",
+		"#EXTINF:5.600,",
+		"seg_2.m4s",
+		"#EXT-X-ENDLIST",
+		"",
+	}, "\n")
+
+	if out != want {
+		t.Fatalf("render() =\n%s\nwant\n%s", out, want)
+	}
+}
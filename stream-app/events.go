@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"web/stream-app/kafka"
+)
+
+// События жизненного цикла стримов в recording.events. Переходы случаются под
+// streamsMux/processesMux, поэтому событие только ставится в очередь в памяти,
+// а запись на диск и отправку по одному ведет отдельная горутина: порядок
+// сохраняется, медленный диск или Kafka не держат блокировки стримов.
+// Файл события удаляется после подтверждения Kafka, как задачи в outbox.
+// Крэш между постановкой и записью (доли секунды) теряет только еще не записанные события
+const (
+	eventRetryMin    = 500 * time.Millisecond
+	eventRetryMax    = time.Minute
+	eventSendTimeout = 10 * time.Second
+)
+
+var streamEventsDir = getEnv("STREAM_EVENTS_DIR", filepath.Join(filepath.Dir(stateFile), "events"))
+
+var (
+	streamEvents  = &eventOutbox{wake: make(chan struct{}, 1)}
+	eventSequence atomic.Int64
+)
+
+// pendingEvent событие, ожидающее подтверждения Kafka (один JSON файл на событие)
+type pendingEvent struct {
+	file      string
+	event     kafka.StreamEvent
+	persisted bool
+}
+
+type eventOutbox struct {
+	mu  sync.Mutex
+	dir string // пусто - диск недоступен, события только в памяти
+	// Очередь в порядке создания
+	queue []*pendingEvent
+	wake  chan struct{}
+
+	// Запись и удаление файлов (горутина отправки и shutdown), без mu
+	diskMu sync.Mutex
+}
+
+// Неотправленные события прошлого запуска уходят первыми; номер события
+// продолжается с последнего сохраненного
+func initStreamEvents() error {
+	if err := os.MkdirAll(streamEventsDir, 0755); err != nil {
+		return fmt.Errorf("failed to create events directory: %v", err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(streamEventsDir, "*.json"))
+	if err != nil {
+		return fmt.Errorf("failed to read events directory: %v", err)
+	}
+	sort.Strings(files)
+
+	var queue []*pendingEvent
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			log.Printf("⚠️ Failed to read stream event %s: %v", file, err)
+			continue
+		}
+		var event kafka.StreamEvent
+		if err := json.Unmarshal(data, &event); err != nil || event.EventID == "" {
+			log.Printf("⚠️ Skipping corrupted stream event %s: %v", file, err)
+			continue
+		}
+		queue = append(queue, &pendingEvent{file: strings.TrimSuffix(filepath.Base(file), ".json"), event: event, persisted: true})
+		if event.Sequence > eventSequence.Load() {
+			eventSequence.Store(event.Sequence)
+		}
+	}
+
+	streamEvents.mu.Lock()
+	streamEvents.dir = streamEventsDir
+	streamEvents.queue = append(queue, streamEvents.queue...)
+	streamEvents.mu.Unlock()
+
+	if len(queue) > 0 {
+		log.Printf("📣 %d stream events pending from previous run", len(queue))
+	}
+	return nil
+}
+
+func emitStreamEvent(streamID, eventType, message string) {
+	streamEvents.add(kafka.StreamEvent{
+		EventID:  newEventID(),
+		Type:     eventType,
+		StreamID: streamID,
+		NodeID:   nodeID,
+		Message:  message,
+	})
+}
+
+// Номер, время, имя файла и место в очереди назначаются под одной блокировкой:
+// порядок отправки и порядок после перезапуска совпадают с sequence
+func (o *eventOutbox) add(event kafka.StreamEvent) {
+	o.mu.Lock()
+	event.Sequence = eventSequence.Add(1)
+	event.Timestamp = time.Now()
+	o.queue = append(o.queue, &pendingEvent{
+		file:  fmt.Sprintf("%019d", event.Sequence),
+		event: event,
+	})
+	o.mu.Unlock()
+
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Запись на диск событий, поставленных после прошлого вызова. Ошибка записи
+// не останавливает отправку: событие остается в памяти, пока процесс жив
+func (o *eventOutbox) persistNew() {
+	o.diskMu.Lock()
+	defer o.diskMu.Unlock()
+
+	o.mu.Lock()
+	dir := o.dir
+	var fresh []*pendingEvent
+	for _, pending := range o.queue {
+		if !pending.persisted {
+			fresh = append(fresh, pending)
+		}
+	}
+	o.mu.Unlock()
+	if dir == "" {
+		return
+	}
+
+	for _, pending := range fresh {
+		data, err := json.Marshal(pending.event)
+		if err == nil {
+			err = writeFileDurable(filepath.Join(dir, pending.file+".json"), data)
+		}
+		if err != nil {
+			log.Printf("⚠️ Failed to persist %s event for stream %s: %v", pending.event.Type, pending.event.StreamID, err)
+		}
+		o.mu.Lock()
+		pending.persisted = true
+		o.mu.Unlock()
+	}
+}
+
+// Количество неотправленных событий
+func (o *eventOutbox) count() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.queue)
+}
+
+func (o *eventOutbox) next() (*pendingEvent, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.queue) == 0 {
+		return nil, false
+	}
+	return o.queue[0], true
+}
+
+// Событие подтверждено Kafka: удаляется из очереди и с диска
+func (o *eventOutbox) ack(pending *pendingEvent) {
+	o.diskMu.Lock()
+	defer o.diskMu.Unlock()
+
+	o.mu.Lock()
+	if len(o.queue) > 0 && o.queue[0] == pending {
+		o.queue = o.queue[1:]
+	}
+	dir := o.dir
+	o.mu.Unlock()
+
+	if dir == "" {
+		return
+	}
+	if err := os.Remove(filepath.Join(dir, pending.file+".json")); err != nil && !os.IsNotExist(err) {
+		log.Printf("⚠️ Failed to remove stream event %s: %v", pending.file, err)
+	}
+}
+
+// Отправка по порядку с повторами, пока Kafka не подтвердит: временная
+// недоступность Kafka или перезапуск не должны терять переходы
+func runEventPublisher() {
+	backoff := eventRetryMin
+	var retryAt time.Time
+	for {
+		// Событие попадает на диск до первой попытки отправки
+		streamEvents.persistNew()
+
+		pending, ok := streamEvents.next()
+		if !ok || time.Now().Before(retryAt) {
+			// Во время паузы новые события записываются сразу по пробуждению
+			var retry <-chan time.Time
+			if ok {
+				retry = time.After(time.Until(retryAt))
+			}
+			select {
+			case <-streamEvents.wake:
+			case <-retry:
+			}
+			continue
+		}
+
+		event := pending.event
+		if err := sendStreamEvent(event); err != nil {
+			log.Printf("⚠️ Failed to send %s event for stream %s, retrying in %s: %v", event.Type, event.StreamID, backoff, err)
+			retryAt = time.Now().Add(backoff)
+			backoff = min(backoff*2, eventRetryMax)
+			continue
+		}
+		retryAt = time.Time{}
+
+		streamEvents.ack(pending)
+		backoff = eventRetryMin
+		log.Printf("📣 Stream event %s: %s (seq %d)", event.StreamID, event.Type, event.Sequence)
+	}
+}
+
+func sendStreamEvent(event kafka.StreamEvent) error {
+	if kafkaProducer == nil {
+		return fmt.Errorf("kafka producer is not initialized")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), eventSendTimeout)
+	defer cancel()
+	return kafkaProducer.SendStreamEvent(ctx, event)
+}
+
+func newEventID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(id)
+}
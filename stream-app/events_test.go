@@ -0,0 +1,103 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"web/stream-app/kafka"
+)
+
+func TestStreamEventsSurviveRestart(t *testing.T) {
+	savedEvents, savedDir, savedSequence := streamEvents, streamEventsDir, eventSequence.Load()
+	defer func() {
+		streamEvents, streamEventsDir = savedEvents, savedDir
+		eventSequence.Store(savedSequence)
+	}()
+
+	streamEventsDir = t.TempDir()
+	streamEvents = &eventOutbox{wake: make(chan struct{}, 1)}
+	eventSequence.Store(0)
+	if err := initStreamEvents(); err != nil {
+		t.Fatalf("initStreamEvents: %v", err)
+	}
+
+	emitStreamEvent("s1", kafka.EventWaiting, "")
+	emitStreamEvent("s1", kafka.EventPublisherConnected, "")
+	emitStreamEvent("s1", kafka.EventStopped, "timed_out")
+	// Запись на диск ведет горутина отправки
+	streamEvents.persistNew()
+
+	// Первое событие подтверждено до "крэша"
+	first, _ := streamEvents.next()
+	streamEvents.ack(first)
+
+	files, _ := filepath.Glob(filepath.Join(streamEventsDir, "*.json"))
+	if len(files) != 2 {
+		t.Fatalf("events on disk = %d, want 2", len(files))
+	}
+
+	// Перезапуск: очередь и номер события восстанавливаются с диска
+	streamEvents = &eventOutbox{wake: make(chan struct{}, 1)}
+	eventSequence.Store(0)
+	if err := initStreamEvents(); err != nil {
+		t.Fatalf("initStreamEvents after restart: %v", err)
+	}
+
+	wantTypes := []string{kafka.EventPublisherConnected, kafka.EventStopped}
+	if streamEvents.count() != len(wantTypes) {
+		t.Fatalf("pending events = %d, want %d", streamEvents.count(), len(wantTypes))
+	}
+	for i, want := range wantTypes {
+		if got := streamEvents.queue[i].event; got.Type != want || got.Sequence != int64(i+2) {
+			t.Fatalf("event %d = %s (seq %d), want %s (seq %d)", i, got.Type, got.Sequence, want, i+2)
+		}
+	}
+	if eventSequence.Load() != 3 {
+		t.Fatalf("sequence after restart = %d, want 3", eventSequence.Load())
+	}
+
+	for streamEvents.count() > 0 {
+		pending, _ := streamEvents.next()
+		streamEvents.ack(pending)
+	}
+	if entries, _ := os.ReadDir(streamEventsDir); len(entries) != 0 {
+		t.Fatalf("acknowledged events left on disk: %d", len(entries))
+	}
+}
+
+func TestStreamEventsOrder(t *testing.T) {
+	savedEvents, savedSequence := streamEvents, eventSequence.Load()
+	defer func() {
+		streamEvents = savedEvents
+		eventSequence.Store(savedSequence)
+	}()
+	streamEvents = &eventOutbox{wake: make(chan struct{}, 1)}
+
+	// Параллельные переходы: очередь, sequence и имена файлов в одном порядке
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			emitStreamEvent("s1", kafka.EventPublisherConnected, "")
+		}()
+	}
+	wg.Wait()
+
+	queue := streamEvents.queue
+	if len(queue) != 50 {
+		t.Fatalf("queued %d events, want 50", len(queue))
+	}
+	files := make([]string, len(queue))
+	for i, pending := range queue {
+		files[i] = pending.file
+		if i > 0 && (pending.event.Sequence <= queue[i-1].event.Sequence || pending.event.Timestamp.Before(queue[i-1].event.Timestamp)) {
+			t.Fatalf("event %d (seq %d) queued after seq %d", i, pending.event.Sequence, queue[i-1].event.Sequence)
+		}
+	}
+	if !sort.StringsAreSorted(files) {
+		t.Fatalf("file names are not in queue order: %v", files)
+	}
+}
@@ -9,11 +9,30 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
+	"web/stream-app/kafka"
 )
 
+// Перезапуски ffmpeg: падения подряд идут с растущей паузой, после
+// FFMPEG_MAX_RESTARTS падений подряд стрим переводится в error
+const (
+	ffmpegRestartMin = 2 * time.Second
+	ffmpegRestartMax = time.Minute
+	// Запуск, проработавший дольше, считается удачным и сбрасывает счетчик
+	ffmpegStableAfter       = 30 * time.Second
+	defaultFFmpegMaxRestart = 10
+
+	// Причина остановки, когда ffmpeg исчерпал лимит перезапусков
+	stopReasonCrashLoop = "crash_loop"
+)
+
+var ffmpegMaxRestarts = loadFFmpegMaxRestarts()
+
+var errNoFreePorts = errors.New("no ports available")
+
 var (
 	portStart = 10000
 	portEnd   = 10100
@@ -30,6 +49,38 @@ type StreamProcess struct {
 	IsRunning   bool
 	IsConnected bool
 	StreamID    string
+	Options     StreamOptions
+	// Фактический режим кодирования: passthrough может откатиться в transcode
+	EncodingMode   string
+	TranscodeAudio bool
+	FallbackReason string
+	// У входа нет аудио дорожки: вывод только с видео
+	NoAudio bool
+	// Статистика текущего запуска ffmpeg (-progress)
+	Stats StreamStats
+	// Для таймаутов простоя: подключался ли publisher и с какого момента его нет
+	EverConnected bool
+	IdleSince     time.Time
+	// Перезапуски ffmpeg и причина последнего завершения (для /stream/status)
+	Restarts       int
+	LastExitReason string
+	// RTMP publisher с неверным ключом сброшен: такое завершение не считается падением
+	RejectedPublish bool
+	// ffmpeg остановлен нами для смены параметров вывода (fallback, вход без аудио)
+	IntentionalRestart bool
+}
+
+func loadFFmpegMaxRestarts() int {
+	value := os.Getenv("FFMPEG_MAX_RESTARTS")
+	if value == "" {
+		return defaultFFmpegMaxRestart
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		log.Printf("⚠️ Invalid FFMPEG_MAX_RESTARTS %q, using %d", value, defaultFFmpegMaxRestart)
+		return defaultFFmpegMaxRestart
+	}
+	return n
 }
 
 func acquirePort() (int, error) {
@@ -41,16 +92,32 @@ func acquirePort() (int, error) {
 			return p, nil
 		}
 	}
-	return 0, errors.New("no ports available")
+	return 0, errNoFreePorts
+}
+
+// Резервирование конкретного порта (восстановление после перезапуска)
+func reservePort(port int) bool {
+	poolMux.Lock()
+	defer poolMux.Unlock()
+	if port < portStart || port > portEnd || portPool[port] {
+		return false
+	}
+	portPool[port] = true
+	return true
 }
 
 func releasePort(port int) {
+	// Порт ffmpeg listener'а за SRT gateway
+	if port < portStart || port > portEnd {
+		releaseLoopbackPort(port)
+		return
+	}
 	poolMux.Lock()
 	defer poolMux.Unlock()
 	portPool[port] = false
 }
 
-func startFFmpegProcess(streamID, srtAddr string) error {
+func startFFmpegProcess(streamID string, opts StreamOptions) error {
 	hlsDir := filepath.Join("hls", streamID)
 	if err := os.MkdirAll(hlsDir, 0755); err != nil {
 		return fmt.Errorf("failed to create HLS directory: %v", err)
@@ -70,82 +137,179 @@ func startFFmpegProcess(streamID, srtAddr string) error {
 		IsRunning:   true,
 		IsConnected: false,
 		StreamID:    streamID,
+		Options:     opts,
+		// WebRTC всегда приносит Opus, его в HLS нужно перекодировать
+		EncodingMode:   normalizeProfile(opts.Profile),
+		TranscodeAudio: opts.Protocol == ProtocolWHIP,
+		IdleSince:      time.Now(),
 	}
 
-	go func() {
-		for {
-			select {
-			case <-stopChan:
-				log.Printf("Stopping ffmpeg loop for stream %s", streamID)
-				return
-			default:
-				if err := runFFmpegInstance(streamID, srtAddr, stopChan); err != nil {
-					log.Printf("FFmpeg instance error for stream %s: %v", streamID, err)
-				}
-
-				select {
-				case <-stopChan:
-					log.Printf("Stopping ffmpeg loop for stream %s", streamID)
-					return
-				default:
-					log.Printf("Restarting ffmpeg for stream %s in 2 seconds...", streamID)
-					time.Sleep(2 * time.Second)
-				}
-			}
-		}
-	}()
+	go superviseFFmpeg(streamID, opts, stopChan)
 
 	return nil
 }
 
-func runFFmpegInstance(streamID, srtAddr string, stopChan chan bool) error {
+// Цикл перезапуска ffmpeg с экспоненциальной паузой и лимитом падений подряд
+func superviseFFmpeg(streamID string, opts StreamOptions, stopChan chan bool) {
+	backoff := ffmpegRestartMin
+	failures := 0
+
+	for {
+		select {
+		case <-stopChan:
+			log.Printf("Stopping ffmpeg loop for stream %s", streamID)
+			return
+		default:
+		}
+
+		started := time.Now()
+		err := runFFmpegInstance(streamID, opts, stopChan)
+		if err != nil {
+			log.Printf("FFmpeg instance error for stream %s: %v", streamID, err)
+		}
+
+		select {
+		case <-stopChan:
+			log.Printf("Stopping ffmpeg loop for stream %s", streamID)
+			return
+		default:
+		}
+		// При остановке stream-app ffmpeg завершается по SIGINT и не перезапускается
+		if shuttingDown.Load() {
+			log.Printf("Stopping ffmpeg loop for stream %s: stream-app is shutting down", streamID)
+			return
+		}
+
+		// Штатный выход (publisher отключился), долгий запуск и наш перезапуск - не падения
+		reason := ffmpegExitReason(err)
+		expected := recordFFmpegExit(streamID, reason)
+		crashed := err != nil && time.Since(started) < ffmpegStableAfter && !expected
+		if !crashed {
+			failures = 0
+			backoff = ffmpegRestartMin
+		} else {
+			failures++
+		}
+
+		if crashed && ffmpegMaxRestarts > 0 && failures >= ffmpegMaxRestarts {
+			log.Printf("❌ FFmpeg for stream %s failed %d times in a row, giving up: %s", streamID, failures, reason)
+			failCrashLoopStream(streamID, reason)
+			return
+		}
+
+		delay := ffmpegRestartMin
+		if crashed {
+			delay = backoff
+			backoff = min(backoff*2, ffmpegRestartMax)
+		}
+		log.Printf("Restarting ffmpeg for stream %s in %s (failures in a row: %d)...", streamID, delay, failures)
+		emitStreamEvent(streamID, kafka.EventFFmpegRestarted, reason)
+
+		select {
+		case <-stopChan:
+			log.Printf("Stopping ffmpeg loop for stream %s", streamID)
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// Учет завершения ffmpeg; true - ffmpeg остановлен намеренно (неверный ключ
+// publisher'а или смена параметров вывода)
+func recordFFmpegExit(streamID, reason string) bool {
+	processesMux.Lock()
+	defer processesMux.Unlock()
+
+	proc, exists := processes[streamID]
+	if !exists {
+		return false
+	}
+	proc.Restarts++
+	proc.LastExitReason = reason
+	expected := proc.RejectedPublish || proc.IntentionalRestart
+	proc.RejectedPublish = false
+	proc.IntentionalRestart = false
+	return expected
+}
+
+// Лимит перезапусков исчерпан: стрим останавливается, main-app получает error с ошибкой ffmpeg
+func failCrashLoopStream(streamID, lastError string) {
+	emitStreamEvent(streamID, kafka.EventError, "ffmpeg crash loop: "+lastError)
+
+	streamsMux.Lock()
+	stream, exists := activeStreams[streamID]
+	if exists {
+		stopStream(streamID, segmentsProducedSince(streamID, stream.StartTime), stopReasonCrashLoop)
+	}
+	streamsMux.Unlock()
+
+	if exists {
+		notifyMainAppStreamError(streamID, stopReasonCrashLoop, lastError)
+	}
+}
+
+// Перезапуски и причина последнего завершения ffmpeg
+func currentRestartInfo(streamID string) (int, string) {
+	processesMux.Lock()
+	defer processesMux.Unlock()
+
+	if proc, exists := processes[streamID]; exists {
+		return proc.Restarts, proc.LastExitReason
+	}
+	return 0, ""
+}
+
+func runFFmpegInstance(streamID string, opts StreamOptions, stopChan chan bool) error {
 	hlsDir := filepath.Join("hls", streamID)
-	output := filepath.Join(hlsDir, "stream.m3u8")
 
-	cmd := exec.Command("ffmpeg",
+	out := OutputSettings{
+		Mode:       normalizeProfile(opts.Profile),
+		LowLatency: opts.LowLatency,
+		Format:     normalizeOutputFormat(opts.OutputFormat),
+	}
+	processesMux.Lock()
+	if proc, exists := processes[streamID]; exists {
+		out.Mode = proc.EncodingMode
+		out.TranscodeAudio = proc.TranscodeAudio
+		out.NoAudio = proc.NoAudio
+	}
+	processesMux.Unlock()
+
+	outputArgs, variants := buildOutputArgs(hlsDir, out)
+	if err := prepareRenditionDirs(hlsDir, variants); err != nil {
+		return err
+	}
+
+	args := []string{
 		"-hide_banner",
 		"-loglevel", "info",
+		"-progress", "pipe:1", // ✅ Структурированный прогресс в stdout
+		"-nostats",
 		"-fflags", "+nobuffer+genpts", // ✅ Добавить genpts для PTS
 		"-analyzeduration", "2000000", // ✅ Увеличить анализ до 2 сек
 		"-probesize", "2000000", // ✅ Увеличить размер пробы
-		"-timeout", "5000000",
-		"-i", srtAddr,
-
-		// ✅ ПРИНУДИТЕЛЬНОЕ ПЕРЕКОДИРОВАНИЕ ВИДЕО
-		"-c:v", "libx264", // Вместо copy
-		"-preset", "faster", // Быстрое кодирование для live
-		"-crf", "23", // Качество видео
-		"-maxrate", "5000k", // Ограничение битрейта
-		"-bufsize", "6000k", // Размер буфера
-		"-pix_fmt", "yuv420p", // Совместимый формат пикселей
-		"-g", "60", // GOP size (keyframe каждые 2 сек при 25fps)
-		"-keyint_min", "30", // Минимальный интервал ключевых кадров
-		"-sc_threshold", "0", // Отключить scene change detection
-		"-r", "30", // Принудительный framerate
-
-		// ✅ АУДИО БЕЗ ИЗМЕНЕНИЙ
-		"-c:a", "aac",
-		"-b:a", "128k",
-		"-ar", "48000", // ✅ Фиксированная частота
-		"-ac", "2", // ✅ Стерео
-
-		// ✅ HLS ПАРАМЕТРЫ
-		"-f", "hls",
-		"-hls_time", "4",
-		"-hls_list_size", "0",
-		"-hls_flags", "append_list+independent_segments", // ✅ Добавить independent_segments
-		"-hls_playlist_type", "event",
-		"-hls_allow_cache", "0",
-		"-hls_segment_filename", filepath.Join(hlsDir, "segment_%03d.ts"),
-		output)
+	}
+
+	// ✅ ВХОД: SRT или RTMP listener
+	args = append(args, buildInputArgs(opts)...)
+
+	// ✅ ВЫХОД: passthrough, transcode или ABR лестница, всегда с master.m3u8
+	args = append(args, outputArgs...)
+
+	cmd := exec.Command("ffmpeg", args...)
 
 	// Правильное использование StderrPipe
 	stderr, err := cmd.StderrPipe()
 	if err != nil {
 		return fmt.Errorf("failed to create stderr pipe: %v", err)
 	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("failed to create stdout pipe: %v", err)
+	}
 
-	log.Printf("Starting ffmpeg instance for stream %s", streamID)
+	log.Printf("Starting ffmpeg instance for stream %s (%s ingest, %s mode, %s output, low latency: %v)",
+		streamID, opts.Protocol, out.Mode, out.Format, out.LowLatency)
 
 	if err := cmd.Start(); err != nil {
 		return fmt.Errorf("failed to start ffmpeg: %v", err)
@@ -154,11 +318,28 @@ func runFFmpegInstance(streamID, srtAddr string, stopChan chan bool) error {
 	processesMux.Lock()
 	if proc, exists := processes[streamID]; exists {
 		proc.Cmd = cmd
+		proc.Stats = StreamStats{}
 	}
 	processesMux.Unlock()
 
 	// Мониторинг логов ffmpeg (теперь с правильным типом)
-	go monitorFFmpegLogs(streamID, stderr)
+	var probe *passthroughProbe
+	if out.Mode == ProfilePassthrough {
+		probe = &passthroughProbe{}
+	}
+	// Вывод ffmpeg пишется в лог стрима; последняя строка ошибки дополняет код выхода
+	sessionLog := openFFmpegSessionLog(streamID, redactStreamKey("ffmpeg "+strings.Join(args, " "), opts.StreamKey))
+	defer sessionLog.close()
+	logsDone := make(chan string, 1)
+	go func() {
+		logsDone <- monitorFFmpegLogs(streamID, opts.StreamKey, probe, stderr, sessionLog)
+	}()
+
+	// Подключение/разрыв publisher определяем по -progress
+	go monitorFFmpegProgress(streamID, stdout)
+	stallDone := make(chan struct{})
+	defer close(stallDone)
+	go watchFFmpegStall(streamID, stallDone)
 
 	// Горутина для остановки по сигналу
 	go func() {
@@ -169,14 +350,25 @@ func runFFmpegInstance(streamID, srtAddr string, stopChan chan bool) error {
 		}
 	}()
 
+	// Wait закрывает pipe: сначала дочитываем stderr до конца
+	lastErrorLine := <-logsDone
 	err = cmd.Wait()
+	if err != nil && lastErrorLine != "" {
+		err = fmt.Errorf("%v: %s", err, lastErrorLine)
+	}
+	sessionLog.write(fmt.Sprintf("ffmpeg exited: %s", ffmpegExitReason(err)))
 
 	processesMux.Lock()
 	if proc, exists := processes[streamID]; exists {
 		proc.Cmd = nil
 		if proc.IsConnected {
 			proc.IsConnected = false
-			go notifyMainAppStatusChange(streamID, "waiting")
+			proc.IdleSince = time.Now()
+			emitStreamEvent(streamID, kafka.EventPublisherDisconnected, "ffmpeg exited")
+			// При остановке статус в main-app определяет shutdown
+			if !shuttingDown.Load() {
+				go notifyMainAppStatusChange(streamID, "waiting")
+			}
 		}
 	}
 	processesMux.Unlock()
@@ -190,49 +382,67 @@ func runFFmpegInstance(streamID, srtAddr string, stopChan chan bool) error {
 	return nil
 }
 
-func monitorFFmpegLogs(streamID string, stderr io.ReadCloser) {
+// Причина завершения ffmpeg для события ffmpeg_restarted
+func ffmpegExitReason(err error) string {
+	if err == nil {
+		return "ffmpeg exited"
+	}
+	return err.Error()
+}
+
+// Чтение stderr ffmpeg до EOF в лог стрима; в общий лог попадают только ошибки.
+// Возвращает последнюю строку с ошибкой
+func monitorFFmpegLogs(streamID, streamKey string, probe *passthroughProbe, stderr io.ReadCloser, sessionLog *ffmpegSessionLog) string {
 	defer stderr.Close()
+	lastError := ""
+	input := &inputInfoParser{}
 	scanner := bufio.NewScanner(stderr)
 	for scanner.Scan() {
-		line := scanner.Text()
-		log.Printf("FFmpeg [%s]: %s", streamID, line)
-
-		lowerLine := strings.ToLower(line)
-
-		// Обнаружение подключения SRT
-		if strings.Contains(lowerLine, "stream #0") ||
-			strings.Contains(lowerLine, "input #0") ||
-			(strings.Contains(lowerLine, "video:") && strings.Contains(lowerLine, "fps")) {
+		// ffmpeg печатает адрес входа целиком, вместе с passphrase
+		line := redactStreamKey(scanner.Text(), streamKey)
+		sessionLog.write(line)
+		if isFFmpegErrorLine(line) {
+			log.Printf("FFmpeg [%s]: %s", streamID, line)
+			lastError = line
+		}
 
+		// RTMP publisher с неверным ключом: сбрасываем подключение, listener перезапустится
+		if isRejectedPublish(line) {
 			processesMux.Lock()
-			if proc, exists := processes[streamID]; exists && !proc.IsConnected {
-				proc.IsConnected = true
-				log.Printf("SRT connection detected for stream %s", streamID)
-				go notifyMainAppStatusChange(streamID, "running")
+			if proc, exists := processes[streamID]; exists && proc.Cmd != nil && proc.Cmd.Process != nil {
+				log.Printf("🔒 Rejected publisher with invalid stream key for stream %s", streamID)
+				proc.RejectedPublish = true
+				proc.Cmd.Process.Kill()
 			}
 			processesMux.Unlock()
+			continue
 		}
 
-		// Обнаружение разрыва соединения
-		if strings.Contains(lowerLine, "connection timed out") ||
-			strings.Contains(lowerLine, "connection failed") ||
-			strings.Contains(lowerLine, "connection closed") ||
-			strings.Contains(lowerLine, "no more input") ||
-			strings.Contains(lowerLine, "end of file") {
-
-			processesMux.Lock()
-			if proc, exists := processes[streamID]; exists && proc.IsConnected {
-				proc.IsConnected = false
-				log.Printf("SRT connection lost for stream %s", streamID)
-				go notifyMainAppStatusChange(streamID, "waiting")
+		// Параметры входа: для статистики и проверки кодеков в passthrough
+		if input.feed(line) {
+			setInputInfo(streamID, input.info)
+			applyInputAudio(streamID, input.info)
+			if probe != nil {
+				applyProbeVerdict(streamID, probe.checkCodecs(input.info))
 			}
-			processesMux.Unlock()
+		}
+
+		// Passthrough: проверяем длину сегментов
+		if probe != nil {
+			applyProbeVerdict(streamID, probe.inspect(line))
 		}
 	}
 
 	if err := scanner.Err(); err != nil {
 		log.Printf("Error reading ffmpeg stderr for stream %s: %v", streamID, err)
 	}
+	return lastError
+}
+
+func isFFmpegErrorLine(line string) bool {
+	lower := strings.ToLower(line)
+	return strings.Contains(lower, "error") || strings.Contains(lower, "failed") ||
+		strings.Contains(lower, "invalid") || strings.Contains(lower, "could not")
 }
 
 func stopFFmpegProcess(streamID string) {
@@ -4,9 +4,12 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"path/filepath"
 	"sync"
 	"time"
 	"web/stream-app/kafka"
@@ -20,19 +23,58 @@ type StreamNotification struct {
 	UserID   int    `json:"user_id,omitempty"`
 	Username string `json:"username,omitempty"`
 	Title    string `json:"title,omitempty"`
+	// Секретный ключ ingest (SRT passphrase), генерируется main-app
+	StreamKey string `json:"stream_key,omitempty"`
+	// Протокол ingest: "srt" (по умолчанию), "rtmp" или "whip"
+	Protocol string `json:"protocol,omitempty"`
+	// Профиль кодирования: "ladder" (по умолчанию), "transcode" или "passthrough"
+	Profile string `json:"profile,omitempty"`
+	// LL-HLS: короткие fMP4 части и блокирующая перезагрузка плейлиста
+	LowLatency bool `json:"low_latency,omitempty"`
+	// Формат вывода: "hls" (по умолчанию) или "cmaf" (HLS + DASH)
+	OutputFormat string `json:"output_format,omitempty"`
+	// DVR окно в секундах (0 - перемотка выключена)
+	DVRWindow int `json:"dvr_window,omitempty"`
+	// Внешние RTMP/SRT направления для ретрансляции
+	RestreamTargets []RestreamTarget `json:"restream_targets,omitempty"`
 }
 
 type StreamInfo struct {
-	StreamID  string    `json:"stream_id"`
-	Status    string    `json:"status"`
-	Port      int       `json:"port"`
-	SRTAddr   string    `json:"srt_addr"`
-	HLSPath   string    `json:"hls_path"`
-	StartTime time.Time `json:"start_time"`
+	StreamID   string    `json:"stream_id"`
+	Status     string    `json:"status"`
+	Port       int       `json:"port"`
+	Protocol   string    `json:"protocol"`
+	Profile    string    `json:"profile"`
+	LowLatency bool      `json:"low_latency"`
+	IngestURL  string    `json:"ingest_url"`
+	SRTAddr    string    `json:"srt_addr,omitempty"`
+	RTMPAddr   string    `json:"rtmp_addr,omitempty"`
+	HLSPath    string    `json:"hls_path"`
+	StartTime  time.Time `json:"start_time"`
 	// ✅ ДОБАВЛЯЕМ ПОЛЯ ДЛЯ ПОЛЬЗОВАТЕЛЯ
 	UserID   int    `json:"user_id,omitempty"`
 	Username string `json:"username,omitempty"`
 	Title    string `json:"title,omitempty"`
+	// Ключ не отдается в /stream/status
+	StreamKey string `json:"-"`
+	// Фактический режим кодирования (passthrough может откатиться в transcode)
+	EncodingMode    string `json:"encoding_mode,omitempty"`
+	AudioTranscoded bool   `json:"audio_transcoded,omitempty"`
+	FallbackReason  string `json:"fallback_reason,omitempty"`
+	// hls или cmaf; для cmaf рядом с master.m3u8 лежит DASH манифест
+	OutputFormat string `json:"output_format"`
+	DASHPath     string `json:"dash_path,omitempty"`
+	// DVR: скользящий плейлист по сегментам из MinIO
+	DVRWindow int    `json:"dvr_window,omitempty"`
+	DVRPath   string `json:"dvr_path,omitempty"`
+	// Статистика ffmpeg (-progress) для /stream/status
+	Stats *StreamStats `json:"stats,omitempty"`
+	// Направления с ключами скрыты, в /stream/status отдается только их состояние
+	RestreamTargets []RestreamTarget `json:"-"`
+	Restreams       []RestreamStatus `json:"restreams,omitempty"`
+	// Перезапуски ffmpeg и причина последнего завершения
+	FFmpegRestarts int    `json:"ffmpeg_restarts"`
+	LastExitReason string `json:"last_exit_reason,omitempty"`
 }
 
 var (
@@ -59,14 +101,32 @@ func streamNotifyHandler(w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("Received notification: StreamID=%s, Status=%s", notification.StreamID, notification.Status)
 
+	// Остановка разрешена до конца, новые стримы - нет
+	if notification.Status == "waiting" && shuttingDown.Load() {
+		http.Error(w, "Stream-app is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
 	streamsMux.Lock()
 	defer streamsMux.Unlock()
 
 	switch notification.Status {
 	case "waiting":
-		handleWaitingStatus(notification)
-	case "stopped", "error":
+		// Отказ (нет слотов кодирования, портов или ffmpeg не запустился) возвращаем main-app с причиной
+		if err := handleWaitingStatus(notification); err != nil {
+			status := http.StatusInternalServerError
+			var admissionErr *admissionError
+			if errors.As(err, &admissionErr) || errors.Is(err, errNoFreePorts) {
+				status = http.StatusServiceUnavailable
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+	case "stopped":
 		handleStopStatus(notification.StreamID)
+	case "error":
+		emitStreamEvent(notification.StreamID, kafka.EventError, "stream marked as failed by main-app")
+		stopStream(notification.StreamID, true, "error")
 	}
 
 	w.WriteHeader(http.StatusOK)
@@ -74,43 +134,85 @@ func streamNotifyHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // ✅ ОБНОВЛЕННАЯ ФУНКЦИЯ: принимает полную информацию от main-app
-func handleWaitingStatus(notification StreamNotification) {
+func handleWaitingStatus(notification StreamNotification) error {
 	streamID := notification.StreamID
 
 	if stream, exists := activeStreams[streamID]; exists {
 		log.Printf("Stream %s already active on port %d", streamID, stream.Port)
-		return
+		return nil
 	}
 
-	port, err := acquirePort()
+	// Перегруженный узел деградирует все стримы сразу: лучше отказать новому
+	if err := admitStream(notification.Profile); err != nil {
+		log.Printf("🚫 Stream %s refused: %v", streamID, err)
+		emitStreamEvent(streamID, kafka.EventError, err.Error())
+		return err
+	}
+
+	protocol := normalizeProtocol(notification.Protocol)
+	notification.OutputFormat, notification.LowLatency = resolveOutputFormat(streamID, notification.OutputFormat, notification.LowLatency)
+
+	// WHIP: порт и ffmpeg не нужны, пока браузер не пришлет SDP offer
+	if protocol == ProtocolWHIP {
+		handleWaitingWHIP(notification)
+		return nil
+	}
+
+	port, err := acquireIngestPort(protocol)
 	if err != nil {
 		log.Printf("Failed to acquire port for stream %s: %v", streamID, err)
-		return
+		emitStreamEvent(streamID, kafka.EventError, fmt.Sprintf("failed to acquire port: %v", err))
+		return err
 	}
 
-	srtAddr := fmt.Sprintf("srt://0.0.0.0:%d?mode=listener&streamid=%s&pkt_size=1316", port, streamID)
+	inputAddr := buildIngestAddr(protocol, port, streamID, notification.StreamKey)
+
+	opts := StreamOptions{
+		Protocol:     protocol,
+		InputAddr:    inputAddr,
+		StreamKey:    notification.StreamKey,
+		Profile:      notification.Profile,
+		LowLatency:   notification.LowLatency,
+		OutputFormat: notification.OutputFormat,
+	}
 
-	if err := startFFmpegProcess(streamID, srtAddr); err != nil {
+	if err := startFFmpegProcess(streamID, opts); err != nil {
 		log.Printf("Failed to start ffmpeg for stream %s: %v", streamID, err)
+		emitStreamEvent(streamID, kafka.EventError, fmt.Sprintf("failed to start ffmpeg: %v", err))
 		releasePort(port)
-		return
+		return fmt.Errorf("failed to start ffmpeg: %v", err)
 	}
 
 	// ✅ СОХРАНЯЕМ ИНФОРМАЦИЮ О ПОЛЬЗОВАТЕЛЕ ОТ MAIN-APP
-	activeStreams[streamID] = &StreamInfo{
-		StreamID:  streamID,
-		Status:    "waiting",
-		Port:      port,
-		SRTAddr:   srtAddr,
-		HLSPath:   fmt.Sprintf("/hls/%s/stream.m3u8", streamID),
-		StartTime: time.Now(),
-		UserID:    notification.UserID,
-		Username:  notification.Username,
-		Title:     notification.Title,
-	}
+	stream := &StreamInfo{
+		StreamID:     streamID,
+		Status:       "waiting",
+		Port:         port,
+		Protocol:     protocol,
+		Profile:      normalizeProfile(notification.Profile),
+		LowLatency:   notification.LowLatency,
+		OutputFormat: notification.OutputFormat,
+		DASHPath:     dashPath(streamID, notification.OutputFormat),
+		DVRWindow:    notification.DVRWindow,
+		DVRPath:      dvrPath(streamID, notification.DVRWindow),
+		IngestURL:    publicIngestURL(protocol, port, streamID),
+		HLSPath:      fmt.Sprintf("/hls/%s/%s", streamID, masterPlaylistName),
+		StartTime:    time.Now(),
+		UserID:       notification.UserID,
+		Username:     notification.Username,
+		Title:        notification.Title,
+		StreamKey:    notification.StreamKey,
+		// Ретрансляция читает локальный HLS вывод
+		RestreamTargets: notification.RestreamTargets,
+	}
+	setListenerAddr(stream, inputAddr)
+	activeStreams[streamID] = stream
+	saveStreamState()
 
 	// ✅ КРИТИЧЕСКИ ВАЖНО: ЗАПУСК HLS UPLOADER
 	startHLSUploader(streamID)
+	startRestreams(streamID)
+	emitStreamEvent(streamID, kafka.EventWaiting, fmt.Sprintf("%s listener on port %d", protocol, port))
 
 	// Уведомить main-app что стрим "live"
 	go func() {
@@ -118,72 +220,149 @@ func handleWaitingStatus(notification StreamNotification) {
 		notifyMainAppStatusChange(streamID, "running")
 	}()
 
-	log.Printf("Started stream %s on port %d (user: %s, id: %d)",
-		streamID, port, notification.Username, notification.UserID)
+	log.Printf("Started stream %s on port %d via %s, profile %s (user: %s, id: %d)",
+		streamID, port, protocol, stream.Profile, notification.Username, notification.UserID)
+	return nil
+}
+
+// WHIP стрим ожидает браузер: регистрируем стрим и uploader, ffmpeg запустит WHIP сессия
+func handleWaitingWHIP(notification StreamNotification) {
+	streamID := notification.StreamID
+
+	activeStreams[streamID] = &StreamInfo{
+		StreamID:     streamID,
+		Status:       "waiting",
+		Protocol:     ProtocolWHIP,
+		Profile:      normalizeProfile(notification.Profile),
+		LowLatency:   notification.LowLatency,
+		OutputFormat: notification.OutputFormat,
+		DASHPath:     dashPath(streamID, notification.OutputFormat),
+		DVRWindow:    notification.DVRWindow,
+		DVRPath:      dvrPath(streamID, notification.DVRWindow),
+		IngestURL:    publicWHIPURL(streamID),
+		HLSPath:      fmt.Sprintf("/hls/%s/%s", streamID, masterPlaylistName),
+		StartTime:    time.Now(),
+		UserID:       notification.UserID,
+		Username:     notification.Username,
+		Title:        notification.Title,
+		StreamKey:    notification.StreamKey,
+		// Ретрансляция начнется, когда WHIP сессия запишет первые сегменты
+		RestreamTargets: notification.RestreamTargets,
+	}
+	saveStreamState()
+
+	if err := os.MkdirAll(filepath.Join("hls", streamID), 0755); err != nil {
+		log.Printf("Failed to create HLS directory for stream %s: %v", streamID, err)
+	}
+
+	startHLSUploader(streamID)
+	startRestreams(streamID)
+	emitStreamEvent(streamID, kafka.EventWaiting, "whip endpoint")
+
+	log.Printf("Stream %s is waiting for WHIP publisher (user: %s, id: %d)",
+		streamID, notification.Username, notification.UserID)
+}
+
+// Сохраняем адрес listener в поле своего протокола (без ключа)
+func setListenerAddr(stream *StreamInfo, inputAddr string) {
+	addr := redactStreamKey(inputAddr, stream.StreamKey)
+	if stream.Protocol == ProtocolRTMP {
+		stream.RTMPAddr = addr
+	} else {
+		stream.SRTAddr = addr
+	}
 }
 
 // ✅ ИСПРАВЛЕННАЯ ФУНКЦИЯ handleStopStatus
 func handleStopStatus(streamID string) {
+	stopStream(streamID, true, "")
+}
+
+// Остановка стрима; emitRecording=false - стрим не дал ни одного сегмента (таймаут простоя),
+// reason уходит в событие stopped. Вызывается под streamsMux
+func stopStream(streamID string, emitRecording bool, reason string) {
 	stream, exists := activeStreams[streamID]
 	if !exists {
 		log.Printf("Stream %s not found for stopping", streamID)
 		return
 	}
 
+	// Закрываем WebRTC сессию, если стрим шел через WHIP
+	closeWHIPSession(streamID)
+
 	// Останавливаем ffmpeg процесс
 	stopFFmpegProcess(streamID)
+	forgetLLPlaylists(streamID)
+
+	// Uploader догружает оставшиеся файлы и завершается
+	uploaded := stopHLSUploader(streamID)
 
-	// Освобождаем порт
-	releasePort(stream.Port)
+	// Ретрансляция без источника не нужна
+	stopRestreams(streamID)
+
+	// Логи ffmpeg остановленного стрима читаются из файлов
+	dropStreamLog(streamID)
+	dropSRTGatewayStream(streamID)
+
+	// Освобождаем порт (у WHIP стримов порта из пула нет)
+	if stream.Port != 0 {
+		releasePort(stream.Port)
+	}
 
 	// ✅ ИСПРАВЛЕНИЕ: получить информацию о пользователе из сохраненных данных или main-app
 	userID, username, title := getUserInfoFromStream(streamID, stream)
 
 	// ✅ ОТПРАВЛЯЕМ В KAFKA С ПРАВИЛЬНОЙ ИНФОРМАЦИЕЙ О ПОЛЬЗОВАТЕЛЕ
-	if kafkaProducer != nil {
-		go func() {
-			endTime := time.Now()
-			startTime := stream.StartTime
-			if startTime.IsZero() {
-				startTime = endTime.Add(-60 * time.Second) // Fallback
-			}
-			duration := int(endTime.Sub(startTime).Seconds())
-
-			recordingTask := kafka.RecordingTask{
-				StreamID:  streamID,
-				UserID:    userID,   // ✅ ПРАВИЛЬНЫЙ USER_ID
-				Username:  username, // ✅ ПРАВИЛЬНЫЙ USERNAME
-				Title:     title,    // ✅ ПРАВИЛЬНЫЙ TITLE
-				Action:    "stop_recording",
-				HLSPath:   fmt.Sprintf("/hls/%s/", streamID),
-				StartTime: startTime,
-				EndTime:   endTime,
-				Duration:  duration,
-				Status:    "completed",
-				Timestamp: time.Now(),
-			}
-
-			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-			defer cancel()
-
-			if err := kafkaProducer.SendRecordingTask(ctx, recordingTask); err != nil {
-				log.Printf("❌ Failed to send recording task: %v", err)
-			} else {
-				log.Printf("✅ Recording task sent for stream: %s (user_id: %d, username: %s, duration: %ds)",
-					streamID, userID, username, duration)
-			}
-		}()
+	// Через outbox: задача сохраняется на диск и повторяется, пока Kafka не подтвердит.
+	// recording-service читает сегменты из MinIO, поэтому задача уходит после финальной загрузки
+	if emitRecording {
+		endTime := time.Now()
+		startTime := stream.StartTime
+		if startTime.IsZero() {
+			startTime = endTime.Add(-60 * time.Second) // Fallback
+		}
+		duration := int(endTime.Sub(startTime).Seconds())
+
+		task := kafka.RecordingTask{
+			StreamID:  streamID,
+			UserID:    userID,   // ✅ ПРАВИЛЬНЫЙ USER_ID
+			Username:  username, // ✅ ПРАВИЛЬНЫЙ USERNAME
+			Title:     title,    // ✅ ПРАВИЛЬНЫЙ TITLE
+			Action:    "stop_recording",
+			HLSPath:   fmt.Sprintf("/hls/%s/", streamID),
+			StartTime: startTime,
+			EndTime:   endTime,
+			Duration:  duration,
+			Status:    "completed",
+			Timestamp: time.Now(),
+		}
+		// Задача сразу на диске (waiting_upload): крэш до конца загрузки ее не теряет,
+		// в Kafka она уйдет, когда в журнале не останется сегментов стрима
+		enqueueRecordingTaskAfterUpload(task, uploaded)
+		log.Printf("📮 Recording task queued for stream: %s (user_id: %d, username: %s, duration: %ds)",
+			streamID, userID, username, duration)
 	}
 
 	// Удаляем из активных стримов (файлы остаются)
 	delete(activeStreams, streamID)
+	saveStreamState()
+	emitStreamEvent(streamID, kafka.EventStopped, reason)
 
-	log.Printf("Stopped stream %s (files preserved, Kafka notified with user info: %s/%d)",
+	if !emitRecording {
+		log.Printf("Stopped stream %s without recording: no segments were produced", streamID)
+		return
+	}
+	log.Printf("Stopped stream %s (files preserved, recording task will be sent after final upload: %s/%d)",
 		streamID, username, userID)
 }
 
 // ✅ НОВАЯ УЛУЧШЕННАЯ ФУНКЦИЯ: получение информации о пользователе
 func getUserInfoFromStream(streamID string, stream *StreamInfo) (int, string, string) {
+	// Самопроверка: владельца нет, main-app стрим не знает
+	if isSelfCheckStream(streamID) {
+		return 0, "selfcheck", stream.Title
+	}
+
 	// 1. Сначала проверяем сохраненную информацию в StreamInfo
 	if stream.UserID > 0 && stream.Username != "" {
 		log.Printf("✅ Found user info from StreamInfo: %s (ID: %d)", stream.Username, stream.UserID)
@@ -246,6 +425,11 @@ func streamStatusHandler(w http.ResponseWriter, r *http.Request) {
 
 	var result []*StreamInfo
 	for _, s := range activeStreams {
+		// Режим меняется при откате passthrough, берем актуальный из процесса
+		s.EncodingMode, s.AudioTranscoded, s.FallbackReason = currentEncodingMode(s.StreamID)
+		s.Stats = currentStreamStats(s.StreamID)
+		s.Restreams = restreamStatuses(s.StreamID)
+		s.FFmpegRestarts, s.LastExitReason = currentRestartInfo(s.StreamID)
 		result = append(result, s)
 	}
 
@@ -259,6 +443,11 @@ func streamRecoveryHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if shuttingDown.Load() {
+		http.Error(w, "Stream-app is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
 	go recoverActiveStreams()
 
 	w.WriteHeader(http.StatusOK)
@@ -266,6 +455,25 @@ func streamRecoveryHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func notifyMainAppStatusChange(streamID, status string) {
+	notifyMainAppStatusChangeWithReason(streamID, status, "")
+}
+
+// reason передается, когда stream-app останавливает стрим сам (timed_out)
+func notifyMainAppStatusChangeWithReason(streamID, status, reason string) {
+	sendMainAppStatusChange(streamID, status, reason, "")
+}
+
+// Стрим переведен в error; lastError - последняя ошибка ffmpeg
+func notifyMainAppStreamError(streamID, reason, lastError string) {
+	sendMainAppStatusChange(streamID, "error", reason, lastError)
+}
+
+func sendMainAppStatusChange(streamID, status, reason, lastError string) {
+	// Стрим самопроверки существует только в stream-app
+	if isSelfCheckStream(streamID) {
+		return
+	}
+
 	// ✅ ИСПРАВЛЕНИЕ: приводим статусы к валидным для main-app
 	var mainAppStatus string
 	switch status {
@@ -285,6 +493,12 @@ func notifyMainAppStatusChange(streamID, status string) {
 		"stream_id": streamID,
 		"status":    mainAppStatus, // ✅ ИСПОЛЬЗУЕМ ВАЛИДНЫЙ СТАТУС
 	}
+	if reason != "" {
+		notification["reason"] = reason
+	}
+	if lastError != "" {
+		notification["error"] = lastError
+	}
 
 	jsonData, err := json.Marshal(notification)
 	if err != nil {
@@ -319,6 +533,7 @@ func notifyMainAppStatusChange(streamID, status string) {
 	streamsMux.Lock()
 	if stream, exists := activeStreams[streamID]; exists {
 		stream.Status = status // Оставляем оригинальный статус в stream-app
+		saveStreamState()
 	}
 	streamsMux.Unlock()
 }
@@ -375,12 +590,39 @@ func healthHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// Незагруженные сегменты из журнала; застрявшие показываем списком
+	stuck := journal.stuck()
+	uploads := map[string]interface{}{
+		"pending": journal.pendingCount(),
+		"stuck":   len(stuck),
+	}
+	if len(stuck) > 0 {
+		uploads["stuck_segments"] = stuck[:min(len(stuck), 20)]
+	}
+
+	// Задачи записи, еще не подтвержденные Kafka
+	outboxPending, outboxFailed := outbox.counts()
+
 	health := map[string]interface{}{
 		"status":         "ok",
 		"active_streams": activeCount,
+		"uploads":        uploads,
+		"node_id":        nodeID,
+		"capacity":       nodeCapacity,
 		"kafka_status":   kafkaStatus,
 		"timestamp":      time.Now(),
 	}
+	health["recording_outbox"] = map[string]int{
+		"pending": outboxPending,
+		"failed":  outboxFailed,
+	}
+	health["admission"] = admissionStatus()
+	if status := srtGatewayStatus(); status != nil {
+		health["srt_gateway"] = status
+	}
+	if shuttingDown.Load() {
+		health["status"] = "shutting_down"
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(health)
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Простаивающие стримы: listener без publisher держит порт и перезапускает ffmpeg
+// бесконечно. По истечении таймаута стрим останавливается с причиной timed_out
+const (
+	defaultWaitingTimeout    = 15 * time.Minute
+	defaultDisconnectTimeout = 5 * time.Minute
+	idleCheckInterval        = 5 * time.Second
+)
+
+// Причина остановки, которую stream-app передает main-app
+const stopReasonTimedOut = "timed_out"
+
+var (
+	// Стрим запущен, но publisher так и не подключился
+	waitingTimeout = loadTimeout("STREAM_WAITING_TIMEOUT", defaultWaitingTimeout)
+	// Publisher был, но пропал и не вернулся
+	disconnectTimeout = loadTimeout("STREAM_DISCONNECT_TIMEOUT", defaultDisconnectTimeout)
+)
+
+// Длительность из env ("90s", "10m"); 0 выключает таймаут
+func loadTimeout(key string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		log.Printf("⚠️ Invalid %s %q, using %s", key, value, defaultValue)
+		return defaultValue
+	}
+	return d
+}
+
+type idleStream struct {
+	streamID  string
+	idleFor   time.Duration
+	connected bool // publisher подключался хотя бы раз
+}
+
+func runIdleWatchdog() {
+	if waitingTimeout == 0 && disconnectTimeout == 0 {
+		log.Println("⏱️ Idle stream timeouts are disabled")
+		return
+	}
+	log.Printf("⏱️ Idle stream timeouts: waiting %s, disconnected %s", waitingTimeout, disconnectTimeout)
+
+	ticker := time.NewTicker(idleCheckInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		stopIdleStreams()
+	}
+}
+
+func stopIdleStreams() {
+	// Стримы при остановке stream-app завершает shutdown
+	if shuttingDown.Load() {
+		return
+	}
+
+	streamsMux.Lock()
+	expired := findIdleStreams()
+
+	for _, idle := range expired {
+		stream, exists := activeStreams[idle.streamID]
+		if !exists {
+			continue
+		}
+		if idle.connected {
+			log.Printf("⏱️ Stream %s timed out: publisher disconnected %s ago", idle.streamID, idle.idleFor.Round(time.Second))
+		} else {
+			log.Printf("⏱️ Stream %s timed out: no publisher for %s", idle.streamID, idle.idleFor.Round(time.Second))
+		}
+
+		// Пустая запись в VOD не нужна: recording task только если были сегменты
+		stopStream(idle.streamID, segmentsProducedSince(idle.streamID, stream.StartTime), stopReasonTimedOut)
+	}
+	streamsMux.Unlock()
+
+	for _, idle := range expired {
+		go notifyMainAppStatusChangeWithReason(idle.streamID, "stopped", stopReasonTimedOut)
+	}
+}
+
+// Стримы, простаивающие дольше таймаута. Вызывается под streamsMux
+func findIdleStreams() []idleStream {
+	processesMux.Lock()
+	defer processesMux.Unlock()
+
+	now := time.Now()
+	var expired []idleStream
+	for streamID, stream := range activeStreams {
+		// WHIP стрим без браузера: ffmpeg еще не запускался
+		idle := idleStream{streamID: streamID, idleFor: now.Sub(stream.StartTime)}
+		if proc, exists := processes[streamID]; exists {
+			if proc.IsConnected {
+				continue
+			}
+			idle.idleFor = now.Sub(proc.IdleSince)
+			idle.connected = proc.EverConnected
+		}
+
+		timeout := waitingTimeout
+		if idle.connected {
+			timeout = disconnectTimeout
+		}
+		if timeout > 0 && idle.idleFor > timeout {
+			expired = append(expired, idle)
+		}
+	}
+	return expired
+}
+
+// Есть ли медиа сегменты, записанные после запуска стрима (папка переиспользуется)
+func segmentsProducedSince(streamID string, since time.Time) bool {
+	hlsDir := filepath.Join("hls", streamID)
+	files, err := listHLSFiles(hlsDir)
+	if err != nil {
+		return false
+	}
+	for _, relPath := range files {
+		if !isMediaSegment(filepath.Base(relPath)) {
+			continue
+		}
+		info, err := os.Stat(filepath.Join(hlsDir, filepath.FromSlash(relPath)))
+		if err == nil && info.ModTime().After(since) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Поддерживаемые протоколы ingest
+const (
+	ProtocolSRT  = "srt"
+	ProtocolRTMP = "rtmp"
+	ProtocolWHIP = "whip" // WebRTC из браузера, медиа приходит через WHIP endpoint
+)
+
+// Длина ключа шифрования SRT в байтах (16/24/32 = AES-128/192/256)
+var srtKeyLength = getEnv("SRT_PBKEYLEN", "16")
+
+// Публичный хост, который показываем стримерам в ingest URL
+var publicIngestHost = getEnv("PUBLIC_INGEST_HOST", "localhost")
+
+// StreamOptions параметры запуска ffmpeg для одного стрима
+type StreamOptions struct {
+	Protocol  string
+	InputAddr string
+	StreamKey string
+	Profile   string // passthrough, transcode или ladder
+	// LL-HLS: fMP4 части + EXT-X-PART
+	LowLatency bool
+	// hls или cmaf (HLS + DASH)
+	OutputFormat string
+}
+
+func normalizeProtocol(protocol string) string {
+	switch strings.ToLower(protocol) {
+	case ProtocolRTMP:
+		return ProtocolRTMP
+	case ProtocolWHIP:
+		return ProtocolWHIP
+	default:
+		return ProtocolSRT
+	}
+}
+
+// Адрес listener для ffmpeg в зависимости от протокола
+func buildIngestAddr(protocol string, port int, streamID, streamKey string) string {
+	if protocol == ProtocolRTMP {
+		return buildRTMPListenerAddr(port, streamID, streamKey)
+	}
+	return buildSRTListenerAddr(port, streamID, streamKey)
+}
+
+// Адрес SRT listener для ffmpeg. Если у стрима есть ключ, он передается
+// как passphrase и без него подключиться к порту нельзя.
+// За SRT gateway listener слушает только loopback
+func buildSRTListenerAddr(port int, streamID, streamKey string) string {
+	host := "0.0.0.0"
+	if srtGatewayEnabled() {
+		host = "127.0.0.1"
+	}
+	addr := fmt.Sprintf("srt://%s:%d?mode=listener&streamid=%s&pkt_size=1316", host, port, streamID)
+
+	if streamKey == "" {
+		log.Printf("⚠️ Stream %s has no stream key, SRT listener starts without passphrase", streamID)
+		return addr
+	}
+
+	return addr + fmt.Sprintf("&passphrase=%s&pbkeylen=%s", streamKey, srtKeyLength)
+}
+
+// Адрес RTMP listener для ffmpeg. Ключ стрима используется как имя потока
+// (rtmp://host:port/live/<stream_key>), как в OBS
+func buildRTMPListenerAddr(port int, streamID, streamKey string) string {
+	streamName := streamKey
+	if streamName == "" {
+		log.Printf("⚠️ Stream %s has no stream key, RTMP listener uses stream_id as stream name", streamID)
+		streamName = streamID
+	}
+	return fmt.Sprintf("rtmp://0.0.0.0:%d/live/%s", port, streamName)
+}
+
+// Публичный URL для стримера (без секретов)
+func publicIngestURL(protocol string, port int, streamID string) string {
+	switch protocol {
+	case ProtocolRTMP:
+		return fmt.Sprintf("rtmp://%s:%d/live", publicIngestHost, port)
+	case ProtocolWHIP:
+		return publicWHIPURL(streamID)
+	default:
+		if srtGatewayEnabled() {
+			port = srtGatewayPort
+		}
+		return fmt.Sprintf("srt://%s:%d?streamid=%s", publicIngestHost, port, streamID)
+	}
+}
+
+// Входные параметры ffmpeg для протокола
+func buildInputArgs(opts StreamOptions) []string {
+	switch opts.Protocol {
+	case ProtocolRTMP:
+		return []string{
+			"-listen", "1",
+			"-timeout", "-1", // Для RTMP это время ожидания publisher в секундах
+			"-i", opts.InputAddr,
+		}
+	case ProtocolWHIP:
+		// InputAddr - SDP файл с локальными RTP портами WHIP сессии
+		return []string{
+			"-protocol_whitelist", "file,udp,rtp",
+			"-i", opts.InputAddr,
+		}
+	default:
+		return []string{
+			"-timeout", "5000000",
+			"-i", opts.InputAddr,
+		}
+	}
+}
+
+// RTMP listener ffmpeg принимает любое имя потока и только предупреждает
+// "Unexpected stream". Такое подключение считаем попыткой без ключа
+func isRejectedPublish(line string) bool {
+	return strings.Contains(line, "Unexpected stream")
+}
+
+// Скрытие ключа в адресах и строках логов
+func redactStreamKey(text, streamKey string) string {
+	if streamKey == "" {
+		return text
+	}
+	return strings.ReplaceAll(text, streamKey, "***")
+}
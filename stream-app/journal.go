@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Журнал загрузок: сегмент попадает в него до загрузки и выходит только после
+// подтверждения MinIO. Пока сегмент в журнале, локальная очистка его не удаляет,
+// а после перезапуска stream-app загрузка продолжается
+const (
+	journalRetryInterval = 30 * time.Second
+	// Сегмент, который не загружается дольше этого времени, считается застрявшим
+	uploadStuckAfter = time.Minute
+)
+
+var uploadJournalFile = getEnv("UPLOAD_JOURNAL", filepath.Join(filepath.Dir(stateFile), "uploads.journal"))
+
+var journal *uploadJournal
+
+// journalEntry строка журнала (JSON lines, только дописывание)
+type journalEntry struct {
+	Op       string    `json:"op"` // add или done
+	StreamID string    `json:"stream_id"`
+	Path     string    `json:"path"`
+	At       time.Time `json:"at"`
+}
+
+type uploadJournal struct {
+	mu      sync.Mutex
+	path    string
+	file    *os.File
+	lines   int
+	pending map[string]map[string]time.Time // stream_id -> путь -> время постановки
+}
+
+// StuckUpload сегмент, который давно не удается загрузить
+type StuckUpload struct {
+	StreamID string    `json:"stream_id"`
+	Path     string    `json:"path"`
+	Since    time.Time `json:"since"`
+}
+
+func initUploadJournal() error {
+	j := &uploadJournal{path: uploadJournalFile, pending: make(map[string]map[string]time.Time)}
+	if err := j.load(); err != nil {
+		return err
+	}
+	if err := j.compact(); err != nil {
+		return err
+	}
+
+	journal = j
+	if count := j.pendingCount(); count > 0 {
+		log.Printf("📒 Upload journal: %d segments pending from previous run", count)
+	}
+	return nil
+}
+
+// Воспроизведение журнала; битая последняя строка (крэш во время записи) пропускается
+func (j *uploadJournal) load() error {
+	file, err := os.Open(j.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to open upload journal: %v", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			log.Printf("⚠️ Skipping corrupted upload journal line: %v", err)
+			continue
+		}
+		switch entry.Op {
+		case "add":
+			j.markPending(entry.StreamID, entry.Path, entry.At)
+		case "done":
+			j.unmarkPending(entry.StreamID, entry.Path)
+		}
+	}
+	return scanner.Err()
+}
+
+// Перезапись журнала только с незавершенными загрузками
+func (j *uploadJournal) compact() error {
+	if err := os.MkdirAll(filepath.Dir(j.path), 0755); err != nil {
+		return fmt.Errorf("failed to create journal directory: %v", err)
+	}
+
+	tmpPath := j.path + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to create journal: %v", err)
+	}
+
+	writer := bufio.NewWriter(tmp)
+	encoder := json.NewEncoder(writer)
+	lines := 0
+	for streamID, paths := range j.pending {
+		for relPath, at := range paths {
+			encoder.Encode(journalEntry{Op: "add", StreamID: streamID, Path: relPath, At: at})
+			lines++
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write journal: %v", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync journal: %v", err)
+	}
+	tmp.Close()
+
+	if j.file != nil {
+		j.file.Close()
+	}
+	if err := os.Rename(tmpPath, j.path); err != nil {
+		return fmt.Errorf("failed to replace journal: %v", err)
+	}
+
+	j.file, err = os.OpenFile(j.path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to reopen journal: %v", err)
+	}
+	j.lines = lines
+	return nil
+}
+
+func (j *uploadJournal) append(entry journalEntry, sync bool) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	if _, err := j.file.Write(append(data, '\n')); err != nil {
+		log.Printf("⚠️ Failed to write upload journal: %v", err)
+		return
+	}
+	// add должен пережить крэш; потерянный done означает лишь повторную загрузку
+	if sync {
+		j.file.Sync()
+	}
+	j.lines++
+}
+
+func (j *uploadJournal) markPending(streamID, relPath string, at time.Time) {
+	if j.pending[streamID] == nil {
+		j.pending[streamID] = make(map[string]time.Time)
+	}
+	j.pending[streamID][relPath] = at
+}
+
+func (j *uploadJournal) unmarkPending(streamID, relPath string) {
+	delete(j.pending[streamID], relPath)
+	if len(j.pending[streamID]) == 0 {
+		delete(j.pending, streamID)
+	}
+}
+
+// Сегмент поставлен в очередь на загрузку
+func (j *uploadJournal) add(streamID, relPath string) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if _, exists := j.pending[streamID][relPath]; exists {
+		return
+	}
+	now := time.Now()
+	j.markPending(streamID, relPath, now)
+	j.append(journalEntry{Op: "add", StreamID: streamID, Path: relPath, At: now}, true)
+}
+
+// MinIO подтвердил загрузку (или файла больше нет)
+func (j *uploadJournal) done(streamID, relPath string) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if _, exists := j.pending[streamID][relPath]; !exists {
+		return
+	}
+	j.unmarkPending(streamID, relPath)
+	j.append(journalEntry{Op: "done", StreamID: streamID, Path: relPath, At: time.Now()}, false)
+
+	// Журнал растет только дописыванием, периодически сжимаем
+	if j.lines > 1000 && j.lines > 4*j.pendingCountLocked() {
+		if err := j.compact(); err != nil {
+			log.Printf("⚠️ Failed to compact upload journal: %v", err)
+		}
+	}
+}
+
+func (j *uploadJournal) isPending(streamID, relPath string) bool {
+	if j == nil {
+		return false
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	_, exists := j.pending[streamID][relPath]
+	return exists
+}
+
+func (j *uploadJournal) pendingFor(streamID string) []string {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	paths := make([]string, 0, len(j.pending[streamID]))
+	for relPath := range j.pending[streamID] {
+		paths = append(paths, relPath)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func (j *uploadJournal) streams() []string {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	ids := make([]string, 0, len(j.pending))
+	for streamID := range j.pending {
+		ids = append(ids, streamID)
+	}
+	return ids
+}
+
+func (j *uploadJournal) pendingCount() int {
+	if j == nil {
+		return 0
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.pendingCountLocked()
+}
+
+func (j *uploadJournal) pendingCountLocked() int {
+	count := 0
+	for _, paths := range j.pending {
+		count += len(paths)
+	}
+	return count
+}
+
+// Сегменты, висящие в журнале дольше uploadStuckAfter (для /health)
+func (j *uploadJournal) stuck() []StuckUpload {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	cutoff := time.Now().Add(-uploadStuckAfter)
+	var stuck []StuckUpload
+	for streamID, paths := range j.pending {
+		for relPath, at := range paths {
+			if at.Before(cutoff) {
+				stuck = append(stuck, StuckUpload{StreamID: streamID, Path: relPath, Since: at})
+			}
+		}
+	}
+	sort.Slice(stuck, func(a, b int) bool { return stuck[a].Since.Before(stuck[b].Since) })
+	return stuck
+}
+
+// Догрузка сегментов стримов без uploader: остановленных или не восстановленных
+// после перезапуска. Для активных стримов журнал разбирает их uploader
+func runUploadJournalRetry() {
+	for {
+		for _, streamID := range journal.streams() {
+			uploadersMux.Lock()
+			_, running := uploaders[streamID]
+			uploadersMux.Unlock()
+			if !running {
+				drainJournalForStream(streamID)
+			}
+		}
+		time.Sleep(journalRetryInterval)
+	}
+}
+
+func drainJournalForStream(streamID string) {
+	hlsDir := filepath.Join("hls", streamID)
+	pending := journal.pendingFor(streamID)
+	uploaded := 0
+
+	for _, relPath := range pending {
+		localPath := filepath.Join(hlsDir, filepath.FromSlash(relPath))
+		if _, err := os.Stat(localPath); os.IsNotExist(err) {
+			log.Printf("⚠️ Journaled segment %s of stream %s is gone, dropping it", relPath, streamID)
+			journal.done(streamID, relPath)
+			continue
+		}
+
+		if err := uploadToMinIO(streamID, localPath, relPath); err != nil {
+			log.Printf("❌ Journal retry failed for %s of stream %s: %v", relPath, streamID, err)
+			return
+		}
+		journal.done(streamID, relPath)
+		uploaded++
+	}
+
+	// Все сегменты на месте: публикуем актуальные плейлисты
+	if uploaded > 0 && len(journal.pendingFor(streamID)) == 0 {
+		log.Printf("📒 Upload journal drained for stream %s (%d segments)", streamID, uploaded)
+		uploadAllHLSManifests(streamID, hlsDir)
+	}
+}
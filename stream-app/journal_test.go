@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestJournal(t *testing.T, content string) *uploadJournal {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "uploads.journal")
+	if content != "" {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &uploadJournal{path: path, pending: make(map[string]map[string]time.Time)}
+}
+
+func TestUploadJournalLoad(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    map[string][]string
+	}{
+		{"missing file", "", map[string][]string{}},
+		{
+			name: "add and done",
+			content: `{"op":"add","stream_id":"s1","path":"720p/segment_000.ts","at":"2026-01-01T00:00:00Z"}` + "\n" +
+				`{"op":"add","stream_id":"s1","path":"720p/segment_001.ts","at":"2026-01-01T00:00:04Z"}` + "\n" +
+				`{"op":"done","stream_id":"s1","path":"720p/segment_000.ts","at":"2026-01-01T00:00:05Z"}` + "\n",
+			want: map[string][]string{"s1": {"720p/segment_001.ts"}},
+		},
+		{
+			name: "all done",
+			content: `{"op":"add","stream_id":"s1","path":"a.ts","at":"2026-01-01T00:00:00Z"}` + "\n" +
+				`{"op":"done","stream_id":"s1","path":"a.ts","at":"2026-01-01T00:00:01Z"}` + "\n",
+			want: map[string][]string{},
+		},
+		{
+			// Крэш во время записи: последняя строка обрезана
+			name: "partial last line",
+			content: `{"op":"add","stream_id":"s1","path":"a.ts","at":"2026-01-01T00:00:00Z"}` + "\n" +
+				`{"op":"add","stream_id":"s2","path":"b.ts","at":"2026-01-01T00:00:00Z"}` + "\n" +
+				`{"op":"done","stream_id":"s1","pa`,
+			want: map[string][]string{"s1": {"a.ts"}, "s2": {"b.ts"}},
+		},
+		{
+			name: "corrupted line in the middle",
+			content: `{"op":"add","stream_id":"s1","path":"a.ts","at":"2026-01-01T00:00:00Z"}` + "\n" +
+				"garbage\n" +
+				`{"op":"add","stream_id":"s1","path":"b.ts","at":"2026-01-01T00:00:00Z"}` + "\n",
+			want: map[string][]string{"s1": {"a.ts", "b.ts"}},
+		},
+		{
+			name:    "done without add",
+			content: `{"op":"done","stream_id":"s1","path":"a.ts","at":"2026-01-01T00:00:00Z"}` + "\n",
+			want:    map[string][]string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			j := newTestJournal(t, tt.content)
+			if err := j.load(); err != nil {
+				t.Fatalf("load: %v", err)
+			}
+
+			if len(j.pending) != len(tt.want) {
+				t.Fatalf("pending streams = %v, want %v", j.streams(), tt.want)
+			}
+			for streamID, paths := range tt.want {
+				if got := j.pendingFor(streamID); strings.Join(got, ",") != strings.Join(paths, ",") {
+					t.Fatalf("pendingFor(%s) = %v, want %v", streamID, got, paths)
+				}
+			}
+		})
+	}
+}
+
+func TestUploadJournalCompact(t *testing.T) {
+	j := newTestJournal(t,
+		`{"op":"add","stream_id":"s1","path":"a.ts","at":"2026-01-01T00:00:00Z"}`+"\n"+
+			`{"op":"add","stream_id":"s1","path":"b.ts","at":"2026-01-01T00:00:04Z"}`+"\n"+
+			`{"op":"done","stream_id":"s1","path":"a.ts","at":"2026-01-01T00:00:05Z"}`+"\n"+
+			`{"op":"add","stream_id":"s2","path":"c.ts","at":"2026-01-01T00:00:06Z"}`+"\n")
+	if err := j.load(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if err := j.compact(); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	defer j.file.Close()
+
+	// После сжатия в файле только незавершенные загрузки
+	entries := readJournalEntries(t, j.path)
+	if len(entries) != 2 || j.lines != 2 {
+		t.Fatalf("compacted journal has %d entries (lines = %d), want 2", len(entries), j.lines)
+	}
+	for _, entry := range entries {
+		if entry.Op != "add" || entry.Path == "a.ts" {
+			t.Fatalf("unexpected entry after compaction: %+v", entry)
+		}
+	}
+	if _, err := os.Stat(j.path + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("temporary journal left behind: %v", err)
+	}
+
+	// Дописывание продолжается в сжатый файл, повторное чтение дает то же состояние
+	j.add("s2", "d.ts")
+	j.done("s2", "c.ts")
+
+	replayed := newTestJournal(t, "")
+	replayed.path = j.path
+	if err := replayed.load(); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if got := replayed.pendingFor("s1"); strings.Join(got, ",") != "b.ts" {
+		t.Fatalf("s1 pending after reload = %v", got)
+	}
+	if got := replayed.pendingFor("s2"); strings.Join(got, ",") != "d.ts" {
+		t.Fatalf("s2 pending after reload = %v", got)
+	}
+}
+
+func TestUploadJournalAddDone(t *testing.T) {
+	j := newTestJournal(t, "")
+	if err := j.compact(); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	defer j.file.Close()
+
+	j.add("s1", "a.ts")
+	j.add("s1", "a.ts") // повторная постановка не пишется
+	if j.lines != 1 || !j.isPending("s1", "a.ts") {
+		t.Fatalf("after add: lines = %d, pending = %v", j.lines, j.isPending("s1", "a.ts"))
+	}
+
+	j.done("s1", "a.ts")
+	j.done("s1", "a.ts") // done без pending игнорируется
+	if j.lines != 2 || j.isPending("s1", "a.ts") || j.pendingCount() != 0 {
+		t.Fatalf("after done: lines = %d, pending = %d", j.lines, j.pendingCount())
+	}
+	if len(j.streams()) != 0 {
+		t.Fatalf("stream without pending uploads is still listed: %v", j.streams())
+	}
+}
+
+func TestNilUploadJournal(t *testing.T) {
+	// Без журнала (UPLOAD_JOURNAL не инициализирован) вызовы ничего не делают
+	var j *uploadJournal
+	j.add("s1", "a.ts")
+	j.done("s1", "a.ts")
+	if j.isPending("s1", "a.ts") || j.pendingCount() != 0 || j.pendingFor("s1") != nil || j.stuck() != nil {
+		t.Fatal("nil journal reports pending uploads")
+	}
+}
+
+func readJournalEntries(t *testing.T, path string) []journalEntry {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var entries []journalEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("bad journal line %q: %v", scanner.Text(), err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
@@ -13,6 +13,35 @@ import (
 
 type Producer struct {
 	writer *kafka.Writer
+	// Долгоживущий writer для топика событий
+	eventsWriter *kafka.Writer
+}
+
+// Топик событий жизненного цикла стримов
+const EventsTopic = "recording.events"
+
+// Типы событий жизненного цикла стрима
+const (
+	EventWaiting               = "waiting"                // listener запущен, ждем publisher
+	EventPublisherConnected    = "publisher_connected"    // медиа пошло через ffmpeg
+	EventPublisherDisconnected = "publisher_disconnected" // publisher пропал, listener продолжает ждать
+	EventFFmpegRestarted       = "ffmpeg_restarted"       // ffmpeg завершился и перезапущен
+	EventStopped               = "stopped"
+	EventError                 = "error"
+)
+
+// StreamEvent событие жизненного цикла стрима. Сообщения одного стрима идут
+// с ключом stream_id в одну партицию, поэтому порядок внутри стрима сохраняется
+type StreamEvent struct {
+	EventID  string `json:"event_id"`
+	Type     string `json:"type"`
+	StreamID string `json:"stream_id"`
+	NodeID   string `json:"node_id,omitempty"`
+	// Монотонный номер события на узле: пропуск номера виден потребителю
+	Sequence  int64     `json:"sequence"`
+	Message   string    `json:"message,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+	Source    string    `json:"source"`
 }
 
 type RecordingTask struct {
@@ -20,7 +49,7 @@ type RecordingTask struct {
 	UserID       int       `json:"user_id"`  // ✅ ДОБАВЛЕНО
 	Username     string    `json:"username"` // ✅ ДОБАВЛЕНО
 	Title        string    `json:"title"`
-	Action       string    `json:"action"`   // "stop_recording", "start_recording"
+	Action       string    `json:"action"`   // "stop_recording", "start_recording", "register_clip"
 	HLSPath      string    `json:"hls_path"` // путь к HLS сегментам
 	StartTime    time.Time `json:"start_time"`
 	EndTime      time.Time `json:"end_time"`
@@ -30,6 +59,10 @@ type RecordingTask struct {
 	Status       string    `json:"status"` // "completed", "failed"
 	Timestamp    time.Time `json:"timestamp"`
 	ErrorMsg     string    `json:"error_message,omitempty"`
+	// Клип (action "register_clip"): StreamID - ID клипа, файлы уже в VOD bucket
+	SourceStreamID string `json:"source_stream_id,omitempty"`
+	FilePath       string `json:"file_path,omitempty"`
+	ThumbnailPath  string `json:"thumbnail_path,omitempty"`
 }
 
 // Создать новый producer
@@ -52,7 +85,19 @@ func NewProducer() (*Producer, error) {
 		AllowAutoTopicCreation: true,
 	}
 
-	return &Producer{writer: writer}, nil
+	// Hash вместо LeastBytes: события стрима всегда в одной партиции
+	eventsWriter := &kafka.Writer{
+		Addr:                   kafka.TCP(brokers),
+		Topic:                  EventsTopic,
+		Balancer:               &kafka.Hash{},
+		RequiredAcks:           kafka.RequireOne,
+		Async:                  false,
+		WriteTimeout:           10 * time.Second,
+		ReadTimeout:            10 * time.Second,
+		AllowAutoTopicCreation: true,
+	}
+
+	return &Producer{writer: writer, eventsWriter: eventsWriter}, nil
 }
 
 // Отправить задачу на обработку записи
@@ -107,35 +152,34 @@ func (p *Producer) SendRecordingTask(ctx context.Context, task RecordingTask) er
 	return nil
 }
 
-// Отправить событие о статусе
-func (p *Producer) SendStatusEvent(ctx context.Context, streamID, status, message string) error {
-	event := map[string]interface{}{
-		"stream_id": streamID,
-		"status":    status,
-		"message":   message,
-		"timestamp": time.Now(),
-		"source":    "stream-app",
+// Отправить событие жизненного цикла стрима
+func (p *Producer) SendStreamEvent(ctx context.Context, event StreamEvent) error {
+	if event.StreamID == "" || event.Type == "" {
+		return fmt.Errorf("stream_id and type are required")
+	}
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now()
 	}
+	event.Source = "stream-app"
 
 	eventBytes, err := json.Marshal(event)
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to marshal event: %w", err)
 	}
 
-	// Отправляем в топик events
-	writer := &kafka.Writer{
-		Addr:                   p.writer.Addr,
-		Topic:                  "recording.events",
-		Balancer:               &kafka.LeastBytes{},
-		AllowAutoTopicCreation: true,
-	}
-	defer writer.Close()
-
-	return writer.WriteMessages(ctx, kafka.Message{
-		Key:   []byte(streamID),
+	err = p.eventsWriter.WriteMessages(ctx, kafka.Message{
+		Key:   []byte(event.StreamID),
 		Value: eventBytes,
-		Time:  time.Now(),
+		Time:  event.Timestamp,
+		Headers: []kafka.Header{
+			{Key: "type", Value: []byte(event.Type)},
+			{Key: "source", Value: []byte("stream-app")},
+		},
 	})
+	if err != nil {
+		return fmt.Errorf("failed to write to kafka: %w", err)
+	}
+	return nil
 }
 
 // Проверить подключение к Kafka
@@ -150,6 +194,9 @@ func (p *Producer) TestConnection(ctx context.Context) error {
 
 // Закрыть producer
 func (p *Producer) Close() error {
+	if p.eventsWriter != nil {
+		p.eventsWriter.Close()
+	}
 	if p.writer != nil {
 		return p.writer.Close()
 	}
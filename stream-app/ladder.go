@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Rendition описывает один вариант в ABR-лестнице
+type Rendition struct {
+	Name         string
+	Height       int
+	VideoBitrate string
+	MaxRate      string
+	BufSize      string
+	AudioBitrate string
+	AudioOnly    bool
+}
+
+const masterPlaylistName = "master.m3u8"
+
+// Известные варианты, из которых собирается лестница через HLS_LADDER
+var knownRenditions = map[string]Rendition{
+	"1080p": {Name: "1080p", Height: 1080, VideoBitrate: "5000k", MaxRate: "5350k", BufSize: "7500k", AudioBitrate: "128k"},
+	"720p":  {Name: "720p", Height: 720, VideoBitrate: "2800k", MaxRate: "2996k", BufSize: "4200k", AudioBitrate: "128k"},
+	"480p":  {Name: "480p", Height: 480, VideoBitrate: "1400k", MaxRate: "1498k", BufSize: "2100k", AudioBitrate: "96k"},
+	"360p":  {Name: "360p", Height: 360, VideoBitrate: "800k", MaxRate: "856k", BufSize: "1200k", AudioBitrate: "96k"},
+	"audio": {Name: "audio", AudioBitrate: "64k", AudioOnly: true},
+}
+
+const defaultLadder = "1080p,720p,480p,audio"
+
+// Лестница, используемая для всех стримов
+var hlsLadder = loadLadder()
+
+// Загрузка лестницы из HLS_LADDER (например "1080p,720p,480p,audio")
+func loadLadder() []Rendition {
+	spec := os.Getenv("HLS_LADDER")
+	if spec == "" {
+		spec = defaultLadder
+	}
+
+	ladder, err := parseLadder(spec)
+	if err != nil {
+		log.Printf("⚠️ Invalid HLS_LADDER %q: %v, using default %q", spec, err, defaultLadder)
+		ladder, _ = parseLadder(defaultLadder)
+	}
+	return ladder
+}
+
+func parseLadder(spec string) ([]Rendition, error) {
+	var ladder []Rendition
+	hasVideo := false
+
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		rendition, ok := knownRenditions[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown rendition %q", name)
+		}
+		if !rendition.AudioOnly {
+			hasVideo = true
+		}
+		ladder = append(ladder, rendition)
+	}
+
+	if !hasVideo {
+		return nil, fmt.Errorf("ladder must contain at least one video rendition")
+	}
+	return ladder, nil
+}
+
+// Аргументы ffmpeg для кодирования лестницы в HLS с master плейлистом.
+// Каждый вариант пишется в hls/<stream_id>/<name>/stream.m3u8
+func buildLadderArgs(hlsDir string, ladder []Rendition, out OutputSettings) []string {
+	var videoRenditions []Rendition
+	for _, r := range ladder {
+		if !r.AudioOnly {
+			videoRenditions = append(videoRenditions, r)
+		}
+	}
+
+	// Разделяем входное видео на N потоков и масштабируем каждый (без апскейла)
+	filter := fmt.Sprintf("[0:v]split=%d", len(videoRenditions))
+	for i := range videoRenditions {
+		filter += fmt.Sprintf("[v%d]", i)
+	}
+	for i, r := range videoRenditions {
+		filter += fmt.Sprintf(";[v%d]scale=-2:'min(%d,ih)'[v%dout]", i, r.Height, i)
+	}
+
+	args := []string{"-filter_complex", filter}
+
+	for i, r := range videoRenditions {
+		idx := fmt.Sprint(i)
+		args = append(args,
+			"-map", fmt.Sprintf("[v%dout]", i),
+			"-c:v:"+idx, "libx264",
+			"-b:v:"+idx, r.VideoBitrate,
+			"-maxrate:v:"+idx, r.MaxRate,
+			"-bufsize:v:"+idx, r.BufSize,
+		)
+	}
+
+	// CMAF: одна общая аудио дорожка в своем adaptation set
+	if out.Format == OutputCMAF {
+		args = append(args, "-map", "0:a:0?", "-b:a", ladderAudioBitrate(ladder))
+		args = append(args, liveVideoArgs(false)...)
+		args = append(args, liveAudioArgs()...)
+		return append(args, buildCMAFArgs(hlsDir, out.NoAudio)...)
+	}
+
+	// Вход без аудио: только видео варианты, audio-only вариант не пишется
+	if out.NoAudio {
+		var streamMap []string
+		for i, r := range videoRenditions {
+			streamMap = append(streamMap, fmt.Sprintf("v:%d,name:%s", i, r.Name))
+		}
+		args = append(args, liveVideoArgs(out.LowLatency)...)
+		return append(args, buildHLSArgs(hlsDir, strings.Join(streamMap, " "), out)...)
+	}
+
+	// Аудио дорожка на каждый вариант (включая audio-only)
+	var streamMap []string
+	audioIdx, videoIdx := 0, 0
+	for _, r := range ladder {
+		args = append(args,
+			"-map", "0:a:0?",
+			fmt.Sprintf("-b:a:%d", audioIdx), r.AudioBitrate,
+		)
+
+		if r.AudioOnly {
+			streamMap = append(streamMap, fmt.Sprintf("a:%d,name:%s", audioIdx, r.Name))
+		} else {
+			streamMap = append(streamMap, fmt.Sprintf("v:%d,a:%d,name:%s", videoIdx, audioIdx, r.Name))
+			videoIdx++
+		}
+		audioIdx++
+	}
+
+	args = append(args, liveVideoArgs(out.LowLatency)...)
+	args = append(args, liveAudioArgs()...)
+	args = append(args, buildHLSArgs(hlsDir, strings.Join(streamMap, " "), out)...)
+
+	return args
+}
+
+// Битрейт общей аудио дорожки: максимальный из вариантов лестницы
+func ladderAudioBitrate(ladder []Rendition) string {
+	best, bestKbps := "128k", 0
+	for _, r := range ladder {
+		if kbps, err := strconv.Atoi(strings.TrimSuffix(r.AudioBitrate, "k")); err == nil && kbps > bestKbps {
+			best, bestKbps = r.AudioBitrate, kbps
+		}
+	}
+	return best
+}
+
+// Общие параметры видео для live перекодирования
+func liveVideoArgs(lowLatency bool) []string {
+	args := []string{
+		"-preset", "faster",
+		"-pix_fmt", "yuv420p",
+		"-g", "60",
+		"-keyint_min", "30",
+		"-sc_threshold", "0",
+		"-r", "30",
+	}
+
+	// LL-HLS: каждая часть должна начинаться с keyframe
+	if lowLatency {
+		args = append(args, "-force_key_frames", fmt.Sprintf("expr:gte(t,n_forced*%d)", llhlsPartSeconds))
+	}
+	return args
+}
+
+// Общие параметры аудио для live перекодирования
+func liveAudioArgs() []string {
+	return []string{
+		"-c:a", "aac",
+		"-ar", "48000",
+		"-ac", "2",
+	}
+}
+
+// HLS muxer: варианты из var_stream_map + master.m3u8
+func buildHLSArgs(hlsDir, streamMap string, out OutputSettings) []string {
+	switch {
+	case out.Format == OutputCMAF:
+		return buildCMAFArgs(hlsDir, out.NoAudio)
+	case out.LowLatency:
+		return buildLLHLSArgs(hlsDir, streamMap)
+	}
+
+	return []string{
+		"-f", "hls",
+		"-hls_time", "4",
+		"-hls_list_size", "0",
+		"-hls_flags", "append_list+independent_segments",
+		"-hls_playlist_type", "event",
+		"-hls_allow_cache", "0",
+		"-master_pl_name", masterPlaylistName,
+		"-var_stream_map", streamMap,
+		"-hls_segment_filename", filepath.Join(hlsDir, "%v", "segment_%03d.ts"),
+		filepath.Join(hlsDir, "%v", "stream.m3u8"),
+	}
+}
+
+// Создание папок вариантов заранее, чтобы ffmpeg мог писать сегменты
+func prepareRenditionDirs(hlsDir string, names []string) error {
+	for _, name := range names {
+		if err := os.MkdirAll(filepath.Join(hlsDir, name), 0755); err != nil {
+			return fmt.Errorf("failed to create rendition directory %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// Имена вариантов лестницы
+func ladderNames(ladder []Rendition, noAudio bool) []string {
+	names := make([]string, 0, len(ladder))
+	for _, r := range ladder {
+		if noAudio && r.AudioOnly {
+			continue
+		}
+		names = append(names, r.Name)
+	}
+	return names
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseLadder(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    string
+		want    []string
+		wantErr string
+	}{
+		{"default ladder", defaultLadder, []string{"1080p", "720p", "480p", "audio"}, ""},
+		{"spaces and empty items", " 720p , ,360p,", []string{"720p", "360p"}, ""},
+		{"order is kept", "360p,1080p", []string{"360p", "1080p"}, ""},
+		{"single video rendition", "480p", []string{"480p"}, ""},
+		{"unknown rendition", "720p,4k", nil, `unknown rendition "4k"`},
+		{"audio only", "audio", nil, "at least one video rendition"},
+		{"empty spec", "", nil, "at least one video rendition"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ladder, err := parseLadder(tt.spec)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseLadder(%q) error = %v, want %q", tt.spec, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseLadder(%q) unexpected error: %v", tt.spec, err)
+			}
+
+			var names []string
+			for _, r := range ladder {
+				names = append(names, r.Name)
+			}
+			if strings.Join(names, ",") != strings.Join(tt.want, ",") {
+				t.Fatalf("parseLadder(%q) = %v, want %v", tt.spec, names, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseLadderRenditionParams(t *testing.T) {
+	ladder, err := parseLadder("720p,audio")
+	if err != nil {
+		t.Fatalf("parseLadder: %v", err)
+	}
+
+	if got := ladder[0]; got.Height != 720 || got.VideoBitrate != "2800k" || got.AudioOnly {
+		t.Fatalf("720p rendition = %+v", got)
+	}
+	if got := ladder[1]; !got.AudioOnly || got.Height != 0 || got.AudioBitrate != "64k" {
+		t.Fatalf("audio rendition = %+v", got)
+	}
+}
@@ -0,0 +1,693 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LL-HLS: ffmpeg пишет короткие fMP4 части (part_00000.m4s) в обычный stream.m3u8,
+// а stream-app при отдаче собирает из них плейлист с EXT-X-PART и EXT-X-PRELOAD-HINT.
+// Полные сегменты (seg_00000.m4s) склеиваются из частей на лету.
+// На диске и в MinIO остается обычный fMP4 HLS, который понимает recording-service
+const (
+	llhlsPartSeconds    = 1  // целевая длина части
+	llhlsSegmentSeconds = 4  // длина полного сегмента, собранного из частей
+	llhlsPartSegments   = 3  // для скольких последних сегментов показываем EXT-X-PART
+	llhlsLocalParts     = 32 // сколько частей держать локально в каждом варианте
+
+	llhlsPartPrefix    = "part_"
+	llhlsSegmentPrefix = "seg_"
+	llhlsInitName      = "init.mp4"
+	llhlsBlockTimeout  = 3 * llhlsSegmentSeconds * time.Second
+	llhlsPollInterval  = 100 * time.Millisecond
+
+	// sample_flags fMP4: сэмпл не ключевой или зависит от других
+	mp4SampleNonSync      = 0x00010000
+	mp4SampleDependsOther = 0x01000000
+	mp4SampleDependsMask  = 0x03000000
+	// moof части - несколько килобайт, больше не читаем
+	mp4MaxMoofSize = 1 << 20
+)
+
+var (
+	errLLFarAhead = errors.New("requested segment is too far in the future")
+	errLLTimeout  = errors.New("timed out waiting for playlist update")
+)
+
+// Разобранные плейлисты по пути: ffmpeg переписывает файл раз в часть,
+// повторные запросы и блокирующее ожидание разбирают его только после изменения
+var (
+	llPlaylistCache = make(map[string]*cachedLLPlaylist)
+	llPlaylistMux   sync.Mutex
+)
+
+type cachedLLPlaylist struct {
+	modTime time.Time
+	size    int64
+	pl      *llPlaylist
+	// Результат проверки keyframe по URI части
+	independent map[string]bool
+}
+
+// Обычная раздача файлов для стримов без LL-HLS
+var hlsFileServer = http.StripPrefix("/hls/", http.FileServer(http.Dir("./hls")))
+
+// HLS muxer в режиме LL-HLS: fMP4 части длиной llhlsPartSeconds
+func buildLLHLSArgs(hlsDir, streamMap string) []string {
+	return []string{
+		"-f", "hls",
+		"-hls_time", fmt.Sprint(llhlsPartSeconds),
+		"-hls_list_size", "0",
+		"-hls_segment_type", "fmp4",
+		"-hls_fmp4_init_filename", llhlsInitName,
+		// temp_file: часть появляется на диске только целиком
+		"-hls_flags", "append_list+independent_segments+temp_file",
+		"-hls_playlist_type", "event",
+		"-hls_allow_cache", "0",
+		"-master_pl_name", masterPlaylistName,
+		"-var_stream_map", streamMap,
+		"-hls_segment_filename", filepath.Join(hlsDir, "%v", llhlsPartPrefix+"%05d.m4s"),
+		filepath.Join(hlsDir, "%v", "stream.m3u8"),
+	}
+}
+
+type llPart struct {
+	URI           string
+	Duration      float64
+	Discontinuity bool
+	// Часть начинается с keyframe (EXT-X-PART INDEPENDENT=YES)
+	Independent bool
+}
+
+type llSegment struct {
+	Parts         []llPart
+	Duration      float64
+	Discontinuity bool
+}
+
+// llPlaylist LL-HLS представление плейлиста ffmpeg. Segments - все сегменты
+// с начала стрима (индекс = media sequence), в плейлист попадают начиная с First
+type llPlaylist struct {
+	MapURI         string
+	Segments       []llSegment
+	Pending        []llPart // части текущего, еще не завершенного сегмента
+	Ended          bool
+	PartTarget     float64
+	TargetDuration int
+	// Первый сегмент, все части которого еще на диске (EXT-X-MEDIA-SEQUENCE)
+	First int
+	// Разрывов до First (EXT-X-DISCONTINUITY-SEQUENCE)
+	DiscontinuitySeq int
+}
+
+// Чтение плейлиста ffmpeg: каждая запись EXTINF это одна часть
+func readLLPlaylist(playlistPath string) (*llPlaylist, error) {
+	content, err := os.ReadFile(playlistPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var parts []llPart
+	var mapURI string
+	var duration float64
+	discontinuity, ended := false, false
+
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "#EXT-X-MAP:"):
+			mapURI = playlistAttr(line, "URI")
+		case strings.HasPrefix(line, "#EXTINF:"):
+			value := strings.TrimPrefix(line, "#EXTINF:")
+			if idx := strings.Index(value, ","); idx >= 0 {
+				value = value[:idx]
+			}
+			duration, _ = strconv.ParseFloat(value, 64)
+		case line == "#EXT-X-DISCONTINUITY":
+			discontinuity = true
+		case line == "#EXT-X-ENDLIST":
+			ended = true
+		case !strings.HasPrefix(line, "#"):
+			parts = append(parts, llPart{URI: line, Duration: duration, Discontinuity: discontinuity})
+			duration, discontinuity = 0, false
+		}
+	}
+
+	return groupLLParts(mapURI, parts, ended), nil
+}
+
+// Группировка частей в сегменты по llhlsSegmentSeconds.
+// Зависит только от префикса списка, поэтому номера сегментов стабильны
+func groupLLParts(mapURI string, parts []llPart, ended bool) *llPlaylist {
+	pl := &llPlaylist{
+		MapURI:         mapURI,
+		Ended:          ended,
+		PartTarget:     llhlsPartSeconds,
+		TargetDuration: llhlsSegmentSeconds,
+	}
+
+	var current llSegment
+	closeSegment := func() {
+		pl.Segments = append(pl.Segments, current)
+		if d := int(math.Ceil(current.Duration)); d > pl.TargetDuration {
+			pl.TargetDuration = d
+		}
+		current = llSegment{}
+	}
+
+	for _, part := range parts {
+		// Разрыв (перезапуск ffmpeg) всегда начинает новый сегмент
+		if part.Discontinuity && len(current.Parts) > 0 {
+			closeSegment()
+		}
+		if len(current.Parts) == 0 {
+			current.Discontinuity = part.Discontinuity
+		}
+
+		current.Parts = append(current.Parts, part)
+		current.Duration += part.Duration
+
+		// Passthrough: части режутся по keyframe источника и могут быть длиннее цели
+		if d := math.Ceil(part.Duration*1000) / 1000; d > pl.PartTarget {
+			pl.PartTarget = d
+		}
+
+		if current.Duration >= llhlsSegmentSeconds-0.05 {
+			closeSegment()
+		}
+	}
+
+	if len(current.Parts) > 0 {
+		if ended {
+			closeSegment()
+		} else {
+			pl.Pending = current.Parts
+		}
+	}
+
+	return pl
+}
+
+// Плейлист из кэша; файл разбирается заново, только если ffmpeg его переписал
+func loadLLPlaylist(playlistPath string) (*llPlaylist, error) {
+	info, err := os.Stat(playlistPath)
+	if err != nil {
+		return nil, err
+	}
+
+	llPlaylistMux.Lock()
+	cached := llPlaylistCache[playlistPath]
+	llPlaylistMux.Unlock()
+	if cached != nil && cached.modTime.Equal(info.ModTime()) && cached.size == info.Size() {
+		return cached.pl, nil
+	}
+
+	pl, err := readLLPlaylist(playlistPath)
+	if err != nil {
+		return nil, err
+	}
+	var known map[string]bool
+	if cached != nil {
+		known = cached.independent
+	}
+	independent := pl.prepare(filepath.Dir(playlistPath), known)
+
+	llPlaylistMux.Lock()
+	llPlaylistCache[playlistPath] = &cachedLLPlaylist{
+		modTime:     info.ModTime(),
+		size:        info.Size(),
+		pl:          pl,
+		independent: independent,
+	}
+	llPlaylistMux.Unlock()
+	return pl, nil
+}
+
+// Окно плейлиста по частям на диске и флаги INDEPENDENT для частей, которые
+// попадут в EXT-X-PART. known - уже проверенные части прошлой версии плейлиста
+func (pl *llPlaylist) prepare(dir string, known map[string]bool) map[string]bool {
+	pl.First = len(pl.Segments)
+	for pl.First > 0 && partsOnDisk(dir, pl.Segments[pl.First-1].Parts) {
+		pl.First--
+	}
+	for _, seg := range pl.Segments[:pl.First] {
+		if seg.Discontinuity {
+			pl.DiscontinuitySeq++
+		}
+	}
+
+	independent := make(map[string]bool)
+	mark := func(parts []llPart) {
+		for i := range parts {
+			value, checked := known[parts[i].URI]
+			if !checked {
+				value = partStartsWithKeyframe(filepath.Join(dir, filepath.FromSlash(parts[i].URI)))
+			}
+			independent[parts[i].URI] = value
+			parts[i].Independent = value
+		}
+	}
+	for msn := max(pl.First, len(pl.Segments)-llhlsPartSegments); msn < len(pl.Segments); msn++ {
+		mark(pl.Segments[msn].Parts)
+	}
+	mark(pl.Pending)
+	return independent
+}
+
+func partsOnDisk(dir string, parts []llPart) bool {
+	for _, part := range parts {
+		if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(part.URI))); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Остановленный стрим: разобранные плейлисты больше не нужны
+func forgetLLPlaylists(streamID string) {
+	prefix := filepath.Join("hls", streamID) + string(filepath.Separator)
+
+	llPlaylistMux.Lock()
+	defer llPlaylistMux.Unlock()
+	for playlistPath := range llPlaylistCache {
+		if strings.HasPrefix(playlistPath, prefix) {
+			delete(llPlaylistCache, playlistPath)
+		}
+	}
+}
+
+// Начинается ли fMP4 часть с keyframe. Transcode ставит keyframe на границу
+// каждой части, в passthrough это зависит от GOP источника, поэтому смотрим
+// флаги первого сэмпла каждой дорожки в moof
+func partStartsWithKeyframe(partPath string) bool {
+	file, err := os.Open(partPath)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(file, header); err != nil {
+			return false
+		}
+		size := int64(binary.BigEndian.Uint32(header))
+		if size < 8 {
+			return false
+		}
+		if string(header[4:]) != "moof" {
+			if _, err := file.Seek(size-8, io.SeekCurrent); err != nil {
+				return false
+			}
+			continue
+		}
+
+		if size > mp4MaxMoofSize {
+			return false
+		}
+		moof := make([]byte, size-8)
+		if _, err := io.ReadFull(file, moof); err != nil {
+			return false
+		}
+
+		trafs, keyframe := 0, true
+		walkMP4Boxes(moof, func(boxType string, body []byte) {
+			if boxType != "traf" {
+				return
+			}
+			trafs++
+			flags, ok := firstSampleFlags(body)
+			if !ok || flags&mp4SampleNonSync != 0 || flags&mp4SampleDependsMask == mp4SampleDependsOther {
+				keyframe = false
+			}
+		})
+		return trafs > 0 && keyframe
+	}
+}
+
+// Флаги первого сэмпла дорожки: из trun, иначе default_sample_flags из tfhd
+func firstSampleFlags(traf []byte) (uint32, bool) {
+	var defaultFlags, flags uint32
+	hasDefault, hasFlags, sawTrun := false, false, false
+
+	walkMP4Boxes(traf, func(boxType string, body []byte) {
+		if len(body) < 8 {
+			return
+		}
+		boxFlags := binary.BigEndian.Uint32(body) & 0xFFFFFF
+		offset := 8 // version/flags + track_ID или sample_count
+
+		switch boxType {
+		case "tfhd":
+			// base_data_offset, sample_description_index, duration, size
+			for _, field := range []struct {
+				flag uint32
+				size int
+			}{{0x01, 8}, {0x02, 4}, {0x08, 4}, {0x10, 4}} {
+				if boxFlags&field.flag != 0 {
+					offset += field.size
+				}
+			}
+			if boxFlags&0x20 != 0 && len(body) >= offset+4 {
+				defaultFlags, hasDefault = binary.BigEndian.Uint32(body[offset:]), true
+			}
+		case "trun":
+			if sawTrun {
+				return
+			}
+			sawTrun = true
+			sampleCount := binary.BigEndian.Uint32(body[4:])
+			if boxFlags&0x01 != 0 { // data_offset
+				offset += 4
+			}
+			if boxFlags&0x04 != 0 { // first_sample_flags
+				if len(body) >= offset+4 {
+					flags, hasFlags = binary.BigEndian.Uint32(body[offset:]), true
+				}
+				return
+			}
+			if sampleCount == 0 || boxFlags&0x400 == 0 {
+				return
+			}
+			// sample_duration и sample_size первого сэмпла перед его флагами
+			if boxFlags&0x100 != 0 {
+				offset += 4
+			}
+			if boxFlags&0x200 != 0 {
+				offset += 4
+			}
+			if len(body) >= offset+4 {
+				flags, hasFlags = binary.BigEndian.Uint32(body[offset:]), true
+			}
+		}
+	})
+
+	if hasFlags {
+		return flags, true
+	}
+	return defaultFlags, hasDefault
+}
+
+// Обход вложенных MP4 box'ов одного уровня
+func walkMP4Boxes(data []byte, visit func(boxType string, body []byte)) {
+	for len(data) >= 8 {
+		size := int(binary.BigEndian.Uint32(data))
+		if size < 8 || size > len(data) {
+			return
+		}
+		visit(string(data[4:8]), data[8:size])
+		data = data[size:]
+	}
+}
+
+// Есть ли в плейлисте сегмент msn (или его часть part, если part >= 0)
+func (pl *llPlaylist) has(msn, part int) bool {
+	if msn < len(pl.Segments) {
+		return true
+	}
+	return msn == len(pl.Segments) && part >= 0 && part < len(pl.Pending)
+}
+
+func (pl *llPlaylist) render() string {
+	var b strings.Builder
+
+	b.WriteString("#EXTM3U\n")
+	b.WriteString("#EXT-X-VERSION:9\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", pl.TargetDuration)
+	fmt.Fprintf(&b, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%.3f\n", 3*pl.PartTarget)
+	fmt.Fprintf(&b, "#EXT-X-PART-INF:PART-TARGET=%.3f\n", pl.PartTarget)
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", pl.First)
+	if pl.DiscontinuitySeq > 0 {
+		fmt.Fprintf(&b, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", pl.DiscontinuitySeq)
+	}
+	b.WriteString("#EXT-X-INDEPENDENT-SEGMENTS\n")
+	if pl.MapURI != "" {
+		fmt.Fprintf(&b, "#EXT-X-MAP:URI=\"%s\"\n", pl.MapURI)
+	}
+
+	writeParts := func(parts []llPart) {
+		for _, part := range parts {
+			independent := ""
+			if part.Independent {
+				independent = ",INDEPENDENT=YES"
+			}
+			fmt.Fprintf(&b, "#EXT-X-PART:DURATION=%.3f,URI=\"%s\"%s\n", part.Duration, part.URI, independent)
+		}
+	}
+
+	// Только сегменты, части которых еще не удалены uploader'ом
+	for msn := pl.First; msn < len(pl.Segments); msn++ {
+		seg := pl.Segments[msn]
+		if seg.Discontinuity {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		if msn >= len(pl.Segments)-llhlsPartSegments {
+			writeParts(seg.Parts)
+		}
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n%s\n", seg.Duration, llSegmentName(msn))
+	}
+
+	if len(pl.Pending) > 0 && pl.Pending[0].Discontinuity {
+		b.WriteString("#EXT-X-DISCONTINUITY\n")
+	}
+	writeParts(pl.Pending)
+
+	if pl.Ended {
+		b.WriteString("#EXT-X-ENDLIST\n")
+		return b.String()
+	}
+
+	// Подсказка о следующей части: плеер запрашивает ее заранее и ждет
+	if hint := pl.nextPartURI(); hint != "" {
+		fmt.Fprintf(&b, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"%s\"\n", hint)
+	}
+
+	return b.String()
+}
+
+// Имя следующей части ffmpeg: part_00012.m4s -> part_00013.m4s
+func (pl *llPlaylist) nextPartURI() string {
+	var last string
+	if len(pl.Pending) > 0 {
+		last = pl.Pending[len(pl.Pending)-1].URI
+	} else if len(pl.Segments) > 0 {
+		parts := pl.Segments[len(pl.Segments)-1].Parts
+		last = parts[len(parts)-1].URI
+	}
+	if last == "" {
+		return ""
+	}
+
+	number := strings.TrimSuffix(strings.TrimPrefix(last, llhlsPartPrefix), ".m4s")
+	n, err := strconv.Atoi(number)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%s%05d.m4s", llhlsPartPrefix, n+1)
+}
+
+func llSegmentName(msn int) string {
+	return fmt.Sprintf("%s%05d.m4s", llhlsSegmentPrefix, msn)
+}
+
+// Значение атрибута вида URI="init.mp4"
+func playlistAttr(line, attr string) string {
+	idx := strings.Index(line, attr+"=")
+	if idx < 0 {
+		return ""
+	}
+	value := line[idx+len(attr)+1:]
+	if strings.HasPrefix(value, "\"") {
+		value = value[1:]
+		if end := strings.Index(value, "\""); end >= 0 {
+			return value[:end]
+		}
+		return value
+	}
+	if end := strings.Index(value, ","); end >= 0 {
+		return value[:end]
+	}
+	return value
+}
+
+// Блокирующая перезагрузка плейлиста (_HLS_msn/_HLS_part)
+func waitForLLPlaylist(ctx context.Context, playlistPath string, msn, part int) (*llPlaylist, error) {
+	deadline := time.Now().Add(llhlsBlockTimeout)
+
+	for {
+		pl, err := loadLLPlaylist(playlistPath)
+		if err == nil {
+			if pl.Ended || pl.has(msn, part) {
+				return pl, nil
+			}
+			// Клиент просит сегмент больше чем на два вперед
+			if msn > len(pl.Segments)+2 {
+				return nil, errLLFarAhead
+			}
+		}
+
+		if time.Now().After(deadline) {
+			if err != nil {
+				return nil, err
+			}
+			return nil, errLLTimeout
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(llhlsPollInterval):
+		}
+	}
+}
+
+func isLowLatencyStream(streamID string) bool {
+	streamsMux.Lock()
+	defer streamsMux.Unlock()
+
+	stream, exists := activeStreams[streamID]
+	return exists && stream.LowLatency
+}
+
+// Раздача /hls/: для LL-HLS стримов плейлисты и сегменты собираются на лету
+func hlsHandler(w http.ResponseWriter, r *http.Request) {
+	relPath := strings.TrimPrefix(path.Clean("/"+strings.TrimPrefix(r.URL.Path, "/hls/")), "/")
+	streamID := strings.SplitN(relPath, "/", 2)[0]
+
+	if !isLowLatencyStream(streamID) {
+		hlsFileServer.ServeHTTP(w, r)
+		return
+	}
+
+	localPath := filepath.Join("hls", filepath.FromSlash(relPath))
+	name := path.Base(relPath)
+
+	switch {
+	case name == "stream.m3u8":
+		serveLLPlaylist(w, r, localPath)
+	case strings.HasPrefix(name, llhlsSegmentPrefix) && strings.HasSuffix(name, ".m4s"):
+		serveLLSegment(w, localPath)
+	case strings.HasPrefix(name, llhlsPartPrefix) && strings.HasSuffix(name, ".m4s"):
+		serveLLPart(w, r, localPath)
+	default:
+		hlsFileServer.ServeHTTP(w, r)
+	}
+}
+
+func serveLLPlaylist(w http.ResponseWriter, r *http.Request, playlistPath string) {
+	query := r.URL.Query()
+	msnParam, partParam := query.Get("_HLS_msn"), query.Get("_HLS_part")
+
+	var pl *llPlaylist
+	var err error
+
+	if msnParam == "" {
+		if partParam != "" {
+			http.Error(w, "_HLS_part requires _HLS_msn", http.StatusBadRequest)
+			return
+		}
+		pl, err = loadLLPlaylist(playlistPath)
+	} else {
+		msn, msnErr := strconv.Atoi(msnParam)
+		part := -1
+		if partParam != "" {
+			part, err = strconv.Atoi(partParam)
+		}
+		if msnErr != nil || err != nil || msn < 0 {
+			http.Error(w, "Invalid _HLS_msn or _HLS_part", http.StatusBadRequest)
+			return
+		}
+		pl, err = waitForLLPlaylist(r.Context(), playlistPath, msn, part)
+	}
+
+	switch {
+	case errors.Is(err, errLLFarAhead):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, errLLTimeout):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	case err != nil:
+		http.Error(w, "Playlist not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Header().Set("Cache-Control", "no-cache")
+	io.WriteString(w, pl.render())
+}
+
+// Полный сегмент = склейка fMP4 частей (moof+mdat подряд)
+func serveLLSegment(w http.ResponseWriter, segmentPath string) {
+	dir := filepath.Dir(segmentPath)
+	number := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(segmentPath), llhlsSegmentPrefix), ".m4s")
+	msn, err := strconv.Atoi(number)
+	if err != nil {
+		http.Error(w, "Invalid segment name", http.StatusBadRequest)
+		return
+	}
+
+	pl, err := loadLLPlaylist(filepath.Join(dir, "stream.m3u8"))
+	if err != nil || msn < pl.First || msn >= len(pl.Segments) {
+		http.Error(w, "Segment not found", http.StatusNotFound)
+		return
+	}
+
+	var files []string
+	for _, part := range pl.Segments[msn].Parts {
+		partPath := filepath.Join(dir, filepath.FromSlash(part.URI))
+		if _, err := os.Stat(partPath); err != nil {
+			http.Error(w, "Segment not found", http.StatusNotFound)
+			return
+		}
+		files = append(files, partPath)
+	}
+
+	w.Header().Set("Content-Type", "video/mp4")
+	for _, partPath := range files {
+		file, err := os.Open(partPath)
+		if err != nil {
+			return
+		}
+		io.Copy(w, file)
+		file.Close()
+	}
+}
+
+// Часть из EXT-X-PRELOAD-HINT запрашивается до того, как ffmpeg ее допишет
+func serveLLPart(w http.ResponseWriter, r *http.Request, partPath string) {
+	deadline := time.Now().Add(llhlsBlockTimeout)
+
+	for {
+		if _, err := os.Stat(partPath); err == nil {
+			w.Header().Set("Content-Type", "video/mp4")
+			http.ServeFile(w, r, partPath)
+			return
+		}
+
+		if time.Now().After(deadline) {
+			http.Error(w, "Part not found", http.StatusNotFound)
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(llhlsPollInterval):
+		}
+	}
+}
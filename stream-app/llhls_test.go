@@ -0,0 +1,377 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Части длиной 1s с именами part_00000.m4s, part_00001.m4s, ...
+func llTestParts(durations ...float64) []llPart {
+	parts := make([]llPart, len(durations))
+	for i, d := range durations {
+		parts[i] = llPart{URI: fmt.Sprintf("%s%05d.m4s", llhlsPartPrefix, i), Duration: d}
+	}
+	return parts
+}
+
+func TestGroupLLParts(t *testing.T) {
+	withDiscontinuity := llTestParts(1, 1, 1, 1, 1)
+	withDiscontinuity[2].Discontinuity = true
+
+	tests := []struct {
+		name           string
+		parts          []llPart
+		ended          bool
+		segments       []int // число частей в каждом сегменте
+		pending        int
+		partTarget     float64
+		targetDuration int
+	}{
+		{"no parts", nil, false, nil, 0, 1, 4},
+		{"incomplete first segment", llTestParts(1, 1, 1), false, nil, 3, 1, 4},
+		{"exactly one segment", llTestParts(1, 1, 1, 1), false, []int{4}, 0, 1, 4},
+		{"segment and pending parts", llTestParts(1, 1, 1, 1, 1, 1), false, []int{4}, 2, 1, 4},
+		// Допуск 0.05s на округление длительностей ffmpeg
+		{"rounding tolerance", llTestParts(0.99, 0.99, 0.99, 0.99, 1), false, []int{4}, 1, 1, 4},
+		{"ended closes pending", llTestParts(1, 1, 1, 1, 1), true, []int{4, 1}, 0, 1, 4},
+		{"discontinuity starts segment", withDiscontinuity, false, []int{2}, 3, 1, 4},
+		// Passthrough: часть по GOP источника длиннее цели
+		{"long passthrough part", llTestParts(2.5, 2.5, 1), false, []int{2}, 1, 2.5, 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pl := groupLLParts("init.mp4", tt.parts, tt.ended)
+
+			var segments []int
+			for _, seg := range pl.Segments {
+				segments = append(segments, len(seg.Parts))
+			}
+			if fmt.Sprint(segments) != fmt.Sprint(tt.segments) {
+				t.Fatalf("segments = %v, want %v", segments, tt.segments)
+			}
+			if len(pl.Pending) != tt.pending {
+				t.Fatalf("pending = %d, want %d", len(pl.Pending), tt.pending)
+			}
+			if pl.PartTarget != tt.partTarget {
+				t.Fatalf("PartTarget = %v, want %v", pl.PartTarget, tt.partTarget)
+			}
+			if pl.TargetDuration != tt.targetDuration {
+				t.Fatalf("TargetDuration = %d, want %d", pl.TargetDuration, tt.targetDuration)
+			}
+		})
+	}
+}
+
+func TestGroupLLPartsStablePrefix(t *testing.T) {
+	// Новая часть в конце списка не меняет уже собранные сегменты
+	short := groupLLParts("", llTestParts(1, 1, 1, 1, 1, 1, 1, 1, 1), false)
+	long := groupLLParts("", llTestParts(1, 1, 1, 1, 1, 1, 1, 1, 1, 1), false)
+
+	for msn := range short.Segments {
+		a, b := short.Segments[msn].Parts, long.Segments[msn].Parts
+		if fmt.Sprint(a) != fmt.Sprint(b) {
+			t.Fatalf("segment %d changed: %v -> %v", msn, a, b)
+		}
+	}
+}
+
+func TestGroupLLPartsDiscontinuityFlag(t *testing.T) {
+	parts := llTestParts(1, 1, 1, 1, 1, 1)
+	parts[4].Discontinuity = true
+
+	pl := groupLLParts("", parts, true)
+	if len(pl.Segments) != 2 {
+		t.Fatalf("segments = %d, want 2", len(pl.Segments))
+	}
+	if pl.Segments[0].Discontinuity || !pl.Segments[1].Discontinuity {
+		t.Fatalf("discontinuity flags = %v, %v", pl.Segments[0].Discontinuity, pl.Segments[1].Discontinuity)
+	}
+}
+
+func TestReadLLPlaylist(t *testing.T) {
+	dir := t.TempDir()
+	playlistPath := filepath.Join(dir, "stream.m3u8")
+	content := strings.Join([]string{
+		"#EXTM3U",
+		"#EXT-X-VERSION:7",
+		"#EXT-X-TARGETDURATION:1",
+		"#EXT-X-MEDIA-SEQUENCE:0",
+		"#EXT-X-PLAYLIST-TYPE:EVENT",
+		`#EXT-X-MAP:URI="init.mp4"`,
+		"#EXTINF:1.000000,",
+		"part_00000.m4s",
+		"#EXTINF:0.966667,",
+		"part_00001.m4s",
+		"#EXT-X-DISCONTINUITY",
+		"#EXTINF:1.033333,",
+		"part_00002.m4s",
+		"",
+	}, "\n")
+	if err := os.WriteFile(playlistPath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	pl, err := readLLPlaylist(playlistPath)
+	if err != nil {
+		t.Fatalf("readLLPlaylist: %v", err)
+	}
+	if pl.MapURI != "init.mp4" || pl.Ended {
+		t.Fatalf("MapURI = %q, Ended = %v", pl.MapURI, pl.Ended)
+	}
+	if len(pl.Segments) != 1 || len(pl.Segments[0].Parts) != 2 {
+		t.Fatalf("segments = %+v", pl.Segments)
+	}
+	if len(pl.Pending) != 1 || !pl.Pending[0].Discontinuity || pl.Pending[0].Duration != 1.033333 {
+		t.Fatalf("pending = %+v", pl.Pending)
+	}
+}
+
+// Пустые файлы частей: окно плейлиста строится по их наличию на диске
+func writeLLTestParts(t *testing.T, dir string, parts []llPart) {
+	t.Helper()
+	for _, part := range parts {
+		if err := os.WriteFile(filepath.Join(dir, part.URI), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLLPlaylistRender(t *testing.T) {
+	tests := []struct {
+		name     string
+		parts    []llPart
+		ended    bool
+		onDisk   int // сколько первых частей уже удалено uploader'ом
+		contains []string
+		excludes []string
+	}{
+		{
+			name:  "live playlist",
+			parts: llTestParts(1, 1, 1, 1, 1, 1),
+			contains: []string{
+				"#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=3.000\n",
+				"#EXT-X-PART-INF:PART-TARGET=1.000\n",
+				"#EXT-X-MEDIA-SEQUENCE:0\n",
+				`#EXT-X-MAP:URI="init.mp4"` + "\n",
+				`#EXT-X-PART:DURATION=1.000,URI="part_00003.m4s"` + "\n",
+				"#EXTINF:4.000,\nseg_00000.m4s\n",
+				`#EXT-X-PART:DURATION=1.000,URI="part_00005.m4s"` + "\n",
+				`#EXT-X-PRELOAD-HINT:TYPE=PART,URI="part_00006.m4s"` + "\n",
+			},
+			excludes: []string{"#EXT-X-ENDLIST", "#EXT-X-DISCONTINUITY-SEQUENCE"},
+		},
+		{
+			name:  "hint after completed segment",
+			parts: llTestParts(1, 1, 1, 1),
+			contains: []string{
+				"seg_00000.m4s\n",
+				`#EXT-X-PRELOAD-HINT:TYPE=PART,URI="part_00004.m4s"` + "\n",
+			},
+		},
+		{
+			name:     "ended playlist",
+			parts:    llTestParts(1, 1, 1, 1, 1),
+			ended:    true,
+			contains: []string{"seg_00001.m4s\n#EXT-X-ENDLIST\n"},
+			excludes: []string{"#EXT-X-PRELOAD-HINT"},
+		},
+		{
+			// PART-HOLD-BACK не меньше трех PART-TARGET
+			name:     "long passthrough parts",
+			parts:    llTestParts(2.5, 2.5, 1),
+			contains: []string{"PART-HOLD-BACK=7.500\n", "#EXT-X-PART-INF:PART-TARGET=2.500\n", "#EXT-X-TARGETDURATION:5\n"},
+		},
+		{
+			// Части старых сегментов в EXT-X-PART не попадают
+			name:     "parts only for recent segments",
+			parts:    llTestParts(1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1),
+			contains: []string{"seg_00000.m4s\n", `URI="part_00004.m4s"`},
+			excludes: []string{`URI="part_00003.m4s"`},
+		},
+		{
+			// Первый сегмент частично удален: окно начинается со второго
+			name:     "sliding window",
+			parts:    llTestParts(1, 1, 1, 1, 1, 1, 1, 1, 1),
+			onDisk:   2,
+			contains: []string{"#EXT-X-MEDIA-SEQUENCE:1\n", "seg_00001.m4s\n"},
+			excludes: []string{"seg_00000.m4s"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeLLTestParts(t, dir, tt.parts[tt.onDisk:])
+
+			pl := groupLLParts("init.mp4", tt.parts, tt.ended)
+			pl.prepare(dir, nil)
+			out := pl.render()
+
+			for _, want := range tt.contains {
+				if !strings.Contains(out, want) {
+					t.Errorf("playlist does not contain %q:\n%s", want, out)
+				}
+			}
+			for _, unwanted := range tt.excludes {
+				if strings.Contains(out, unwanted) {
+					t.Errorf("playlist contains %q:\n%s", unwanted, out)
+				}
+			}
+		})
+	}
+}
+
+func TestLLPlaylistDiscontinuitySequence(t *testing.T) {
+	parts := llTestParts(1, 1, 1, 1, 1, 1, 1, 1, 1)
+	parts[4].Discontinuity = true
+	parts[8].Discontinuity = true
+
+	dir := t.TempDir()
+	// Сегменты 0 и 1 удалены, в окне остается только последний
+	writeLLTestParts(t, dir, parts[8:])
+
+	pl := groupLLParts("", parts, true)
+	pl.prepare(dir, nil)
+	out := pl.render()
+
+	if pl.First != 2 || pl.DiscontinuitySeq != 1 {
+		t.Fatalf("First = %d, DiscontinuitySeq = %d, want 2 and 1", pl.First, pl.DiscontinuitySeq)
+	}
+	if !strings.Contains(out, "#EXT-X-DISCONTINUITY-SEQUENCE:1\n#EXT-X-INDEPENDENT-SEGMENTS\n#EXT-X-DISCONTINUITY\n") {
+		t.Fatalf("unexpected playlist head:\n%s", out)
+	}
+}
+
+func TestLLPlaylistHas(t *testing.T) {
+	pl := groupLLParts("", llTestParts(1, 1, 1, 1, 1, 1), false)
+
+	tests := []struct {
+		msn, part int
+		want      bool
+	}{
+		{0, -1, true},
+		{0, 3, true},
+		{1, -1, false}, // сегмент 1 еще не завершен
+		{1, 0, true},
+		{1, 1, true},
+		{1, 2, false},
+		{2, 0, false},
+	}
+	for _, tt := range tests {
+		if got := pl.has(tt.msn, tt.part); got != tt.want {
+			t.Errorf("has(%d, %d) = %v, want %v", tt.msn, tt.part, got, tt.want)
+		}
+	}
+}
+
+func mp4Box(boxType string, payload ...[]byte) []byte {
+	size := 8
+	for _, p := range payload {
+		size += len(p)
+	}
+	box := binary.BigEndian.AppendUint32(nil, uint32(size))
+	box = append(box, boxType...)
+	for _, p := range payload {
+		box = append(box, p...)
+	}
+	return box
+}
+
+func mp4Words(words ...uint32) []byte {
+	var b []byte
+	for _, w := range words {
+		b = binary.BigEndian.AppendUint32(b, w)
+	}
+	return b
+}
+
+const (
+	testKeyframeFlags = 0x02000000 // не зависит от других сэмплов
+	testDeltaFlags    = 0x01010000 // non-sync, зависит от предыдущих
+)
+
+// trun с first_sample_flags
+func trunFirstFlags(flags uint32) []byte {
+	return mp4Box("trun", mp4Words(0x000005, 3, 0x100, flags))
+}
+
+func TestPartStartsWithKeyframe(t *testing.T) {
+	tfhd := mp4Box("tfhd", mp4Words(0x020000, 1))
+	mfhd := mp4Box("mfhd", mp4Words(0, 1))
+	mdat := mp4Box("mdat", []byte{0, 0, 0, 0})
+
+	tests := []struct {
+		name string
+		data []byte
+		want bool
+	}{
+		{"first sample flags keyframe", mp4Box("moof", mfhd, mp4Box("traf", tfhd, trunFirstFlags(testKeyframeFlags))), true},
+		{"first sample flags delta", mp4Box("moof", mfhd, mp4Box("traf", tfhd, trunFirstFlags(testDeltaFlags))), false},
+		{
+			// styp перед moof пропускается
+			"leading styp box",
+			append(mp4Box("styp", []byte("msdh")), mp4Box("moof", mfhd, mp4Box("traf", tfhd, trunFirstFlags(testKeyframeFlags)))...),
+			true,
+		},
+		{
+			// Флаги на каждый сэмпл: duration и size перед флагами первого
+			"per-sample flags",
+			mp4Box("moof", mp4Box("traf", tfhd, mp4Box("trun", mp4Words(0x000701, 2, 0x100, 3000, 1200, testKeyframeFlags, 3000, 900, testDeltaFlags)))),
+			true,
+		},
+		{
+			// Флагов в trun нет: default_sample_flags из tfhd
+			"tfhd default flags",
+			mp4Box("moof", mp4Box("traf", mp4Box("tfhd", mp4Words(0x020020, 1, testDeltaFlags)), mp4Box("trun", mp4Words(0x000001, 3, 0x100)))),
+			false,
+		},
+		{
+			// Аудио дорожка с keyframe не спасает видео без него
+			"video track without keyframe",
+			mp4Box("moof",
+				mp4Box("traf", tfhd, trunFirstFlags(testDeltaFlags)),
+				mp4Box("traf", mp4Box("tfhd", mp4Words(0x020000, 2)), trunFirstFlags(testKeyframeFlags))),
+			false,
+		},
+		{"no flags at all", mp4Box("moof", mp4Box("traf", tfhd, mp4Box("trun", mp4Words(0x000001, 3, 0x100)))), false},
+		{"moof without traf", mp4Box("moof", mfhd), false},
+		{"no moof", mdat, false},
+		{"truncated moof", mp4Box("moof", mfhd)[:10], false},
+	}
+
+	dir := t.TempDir()
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			partPath := filepath.Join(dir, fmt.Sprintf("part_%05d.m4s", i))
+			data := append(append([]byte(nil), tt.data...), mdat...)
+			if err := os.WriteFile(partPath, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if got := partStartsWithKeyframe(partPath); got != tt.want {
+				t.Fatalf("partStartsWithKeyframe() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPlaylistAttr(t *testing.T) {
+	tests := []struct {
+		line, attr, want string
+	}{
+		{`#EXT-X-MAP:URI="init.mp4"`, "URI", "init.mp4"},
+		{`#EXT-X-MEDIA:TYPE=AUDIO,URI="audio/stream.m3u8",NAME="a"`, "URI", "audio/stream.m3u8"},
+		{`#EXT-X-STREAM-INF:BANDWIDTH=800000,CODECS="avc1"`, "BANDWIDTH", "800000"},
+		{`#EXT-X-MAP:URI="unterminated`, "URI", "unterminated"},
+		{`#EXT-X-MAP:BYTERANGE=100`, "URI", ""},
+	}
+	for _, tt := range tests {
+		if got := playlistAttr(tt.line, tt.attr); got != tt.want {
+			t.Errorf("playlistAttr(%q, %q) = %q, want %q", tt.line, tt.attr, got, tt.want)
+		}
+	}
+}
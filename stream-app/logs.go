@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Логи ffmpeg по стримам: вывод stderr не смешивается в общем логе процесса.
+// Последние строки держатся в памяти, каждый запуск ffmpeg пишется в свой файл
+// logs/<stream_id>/<session>.log; при превышении logFileMaxSize файл уходит в
+// <session>.1.log и начинается заново, так что хранятся последние ~2*logFileMaxSize
+// вывода. Старые сессии удаляются
+const (
+	defaultLogRingLines     = 1000
+	defaultLogResponseLines = 200
+	logFileMaxSize          = 5 * 1024 * 1024
+	logFilesPerStream       = 10
+	logSessionLayout        = "20060102-150405.000"
+	logPrevPartSuffix       = ".1.log"
+)
+
+var (
+	ffmpegLogDir = getEnv("FFMPEG_LOG_DIR", "logs")
+	logRingLines = loadLogRingLines()
+
+	streamLogs    = make(map[string]*streamLogRing)
+	streamLogsMux sync.Mutex
+)
+
+type logLine struct {
+	Time    time.Time `json:"time"`
+	Session string    `json:"session"`
+	Text    string    `json:"text"`
+}
+
+// Кольцевой буфер последних строк стрима (все запуски ffmpeg подряд)
+type streamLogRing struct {
+	mu    sync.Mutex
+	lines []logLine
+	next  int
+	full  bool
+}
+
+// Лог одного запуска ffmpeg
+type ffmpegSessionLog struct {
+	session string
+	ring    *streamLogRing
+	path    string
+	file    *os.File
+	size    int64
+}
+
+type logSessionInfo struct {
+	Session  string    `json:"session"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+func loadLogRingLines() int {
+	value := os.Getenv("FFMPEG_LOG_LINES")
+	if value == "" {
+		return defaultLogRingLines
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		log.Printf("⚠️ Invalid FFMPEG_LOG_LINES %q, using %d", value, defaultLogRingLines)
+		return defaultLogRingLines
+	}
+	return n
+}
+
+func streamLogsDir(streamID string) string {
+	return filepath.Join(ffmpegLogDir, streamID)
+}
+
+// Новый файл для запуска ffmpeg; header - командная строка без ключа
+func openFFmpegSessionLog(streamID, header string) *ffmpegSessionLog {
+	streamLogsMux.Lock()
+	ring, exists := streamLogs[streamID]
+	if !exists {
+		ring = &streamLogRing{lines: make([]logLine, logRingLines)}
+		streamLogs[streamID] = ring
+	}
+	streamLogsMux.Unlock()
+
+	s := &ffmpegSessionLog{session: time.Now().Format(logSessionLayout), ring: ring}
+
+	// Без файла лог остается только в памяти
+	dir := streamLogsDir(streamID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Printf("⚠️ Failed to create log directory for stream %s: %v", streamID, err)
+	} else {
+		rotateSessionLogs(dir)
+		s.path = filepath.Join(dir, s.session+".log")
+		file, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			log.Printf("⚠️ Failed to create ffmpeg log file for stream %s: %v", streamID, err)
+		} else {
+			s.file = file
+		}
+	}
+
+	s.write(header)
+	return s
+}
+
+func (s *ffmpegSessionLog) write(text string) {
+	line := logLine{Time: time.Now(), Session: s.session, Text: text}
+	s.ring.add(line)
+
+	if s.file == nil {
+		return
+	}
+	entry := line.Time.Format(time.RFC3339Nano) + " " + text + "\n"
+	if s.size > 0 && s.size+int64(len(entry)) > logFileMaxSize {
+		if !s.rollOver() {
+			return
+		}
+	}
+	n, err := s.file.WriteString(entry)
+	s.size += int64(n)
+	if err != nil {
+		log.Printf("⚠️ Failed to write ffmpeg log %s: %v", s.path, err)
+		s.file.Close()
+		s.file = nil
+	}
+}
+
+// Текущий файл становится <session>.1.log (предыдущий .1 удаляется), запись
+// продолжается в пустой <session>.log: конец вывода ffmpeg не теряется
+func (s *ffmpegSessionLog) rollOver() bool {
+	s.file.Close()
+	s.file = nil
+	prev := strings.TrimSuffix(s.path, ".log") + logPrevPartSuffix
+	if err := os.Rename(s.path, prev); err != nil {
+		log.Printf("⚠️ Failed to roll over ffmpeg log %s: %v", s.path, err)
+		return false
+	}
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		log.Printf("⚠️ Failed to reopen ffmpeg log %s: %v", s.path, err)
+		return false
+	}
+	s.file, s.size = file, 0
+	return true
+}
+
+func (s *ffmpegSessionLog) close() {
+	if s.file != nil {
+		s.file.Close()
+	}
+}
+
+func (r *streamLogRing) add(line logLine) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.lines[r.next] = line
+	r.next = (r.next + 1) % len(r.lines)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// Последние n строк в хронологическом порядке
+func (r *streamLogRing) tail(n int) []logLine {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var ordered []logLine
+	if r.full {
+		ordered = append(ordered, r.lines[r.next:]...)
+	}
+	ordered = append(ordered, r.lines[:r.next]...)
+	if len(ordered) > n {
+		ordered = ordered[len(ordered)-n:]
+	}
+	return ordered
+}
+
+// Буфер в памяти нужен только пока стрим активен, дальше логи читаются из файлов
+func dropStreamLog(streamID string) {
+	streamLogsMux.Lock()
+	delete(streamLogs, streamID)
+	streamLogsMux.Unlock()
+}
+
+// Перед новым файлом оставляем logFilesPerStream-1 последних
+func rotateSessionLogs(dir string) {
+	sessions := listLogSessions(dir)
+	for len(sessions) >= logFilesPerStream {
+		oldest := sessions[len(sessions)-1]
+		if err := os.Remove(filepath.Join(dir, oldest.Session+".log")); err != nil {
+			log.Printf("⚠️ Failed to remove old ffmpeg log %s: %v", oldest.Session, err)
+			return
+		}
+		if err := os.Remove(filepath.Join(dir, oldest.Session+logPrevPartSuffix)); err != nil && !os.IsNotExist(err) {
+			log.Printf("⚠️ Failed to remove old ffmpeg log %s: %v", oldest.Session+logPrevPartSuffix, err)
+		}
+		sessions = sessions[:len(sessions)-1]
+	}
+}
+
+// Сессии логов стрима, новые первыми (имя сессии сортируется по времени).
+// Size включает предыдущую часть <session>.1.log
+func listLogSessions(dir string) []logSessionInfo {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+
+	var sessions []logSessionInfo
+	prevSizes := make(map[string]int64)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".log") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		if session, found := strings.CutSuffix(name, logPrevPartSuffix); found {
+			prevSizes[session] = info.Size()
+			continue
+		}
+		sessions = append(sessions, logSessionInfo{
+			Session:  strings.TrimSuffix(name, ".log"),
+			Size:     info.Size(),
+			Modified: info.ModTime(),
+		})
+	}
+	for i := range sessions {
+		sessions[i].Size += prevSizes[sessions[i].Session]
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Session > sessions[j].Session })
+	return sessions
+}
+
+// Части файла сессии в хронологическом порядке: <session>.1.log (если был
+// перенос по размеру), затем <session>.log. Вызывающий закрывает файлы
+func openSessionParts(dir, session string) ([]*os.File, error) {
+	var parts []*os.File
+	if prev, err := os.Open(filepath.Join(dir, session+logPrevPartSuffix)); err == nil {
+		parts = append(parts, prev)
+	}
+	current, err := os.Open(filepath.Join(dir, session+".log"))
+	if err != nil {
+		closeSessionParts(parts)
+		return nil, err
+	}
+	return append(parts, current), nil
+}
+
+func closeSessionParts(parts []*os.File) {
+	for _, part := range parts {
+		part.Close()
+	}
+}
+
+// Последние n строк файла сессии (для остановленного стрима)
+func readSessionTail(dir, session string, n int) ([]logLine, error) {
+	parts, err := openSessionParts(dir, session)
+	if err != nil {
+		return nil, err
+	}
+	defer closeSessionParts(parts)
+
+	readers := make([]io.Reader, len(parts))
+	for i, part := range parts {
+		readers[i] = part
+	}
+
+	var lines []logLine
+	scanner := bufio.NewScanner(io.MultiReader(readers...))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := logLine{Session: session, Text: scanner.Text()}
+		if stamp, text, found := strings.Cut(line.Text, " "); found {
+			if t, err := time.Parse(time.RFC3339Nano, stamp); err == nil {
+				line.Time, line.Text = t, text
+			}
+		}
+		lines = append(lines, line)
+		if len(lines) > n {
+			lines = lines[1:]
+		}
+	}
+	return lines, scanner.Err()
+}
+
+// Имя сессии приходит из запроса: только формат logSessionLayout, без путей
+func validLogSession(session string) bool {
+	_, err := time.Parse(logSessionLayout, session)
+	return err == nil
+}
+
+// GET /stream/{id}/logs[?lines=200] - последние строки и список файлов сессий
+// GET /stream/{id}/logs?session=<session> - файл одного запуска ffmpeg целиком (text/plain)
+func streamLogsHandler(w http.ResponseWriter, r *http.Request, streamID string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// В логах адреса publisher'ов: только через main-app (владелец или admin)
+	if !isServiceRequest(r) {
+		http.Error(w, "Service API key required", http.StatusUnauthorized)
+		return
+	}
+
+	if streamID == "." || streamID == ".." {
+		http.NotFound(w, r)
+		return
+	}
+	dir := streamLogsDir(streamID)
+	query := r.URL.Query()
+
+	if session := query.Get("session"); session != "" {
+		if !validLogSession(session) {
+			http.Error(w, "Invalid session", http.StatusBadRequest)
+			return
+		}
+		parts, err := openSessionParts(dir, session)
+		if err != nil {
+			http.Error(w, "Log session not found", http.StatusNotFound)
+			return
+		}
+		defer closeSessionParts(parts)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, part := range parts {
+			if _, err := io.Copy(w, part); err != nil {
+				log.Printf("⚠️ Failed to send ffmpeg log %s of stream %s: %v", session, streamID, err)
+				return
+			}
+		}
+		return
+	}
+
+	n := defaultLogResponseLines
+	if value := query.Get("lines"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			http.Error(w, "lines must be a positive number", http.StatusBadRequest)
+			return
+		}
+		n = min(parsed, logRingLines)
+	}
+
+	streamLogsMux.Lock()
+	ring, live := streamLogs[streamID]
+	streamLogsMux.Unlock()
+
+	sessions := listLogSessions(dir)
+	var lines []logLine
+	switch {
+	case live:
+		lines = ring.tail(n)
+	case len(sessions) > 0:
+		var err error
+		if lines, err = readSessionTail(dir, sessions[0].Session, n); err != nil {
+			log.Printf("⚠️ Failed to read ffmpeg log of stream %s: %v", streamID, err)
+			http.Error(w, "Failed to read logs", http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, fmt.Sprintf("No logs for stream %s", streamID), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"stream_id": streamID,
+		"live":      live,
+		"lines":     lines,
+		"sessions":  sessions,
+	})
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFFmpegSessionLogRollsOver(t *testing.T) {
+	savedDir := ffmpegLogDir
+	defer func() {
+		ffmpegLogDir = savedDir
+		dropStreamLog("s1")
+	}()
+	ffmpegLogDir = t.TempDir()
+
+	s := openFFmpegSessionLog("s1", "ffmpeg -i ...")
+	padding := strings.Repeat("x", 1000)
+	const total = 12000 // ~12MB: файл переносится дважды
+	for i := 1; i <= total; i++ {
+		s.write(fmt.Sprintf("frame=%d %s", i, padding))
+	}
+	s.close()
+
+	dir := streamLogsDir("s1")
+	for _, name := range []string{s.session + ".log", s.session + logPrevPartSuffix} {
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("stat %s: %v", name, err)
+		}
+		if info.Size() > logFileMaxSize {
+			t.Errorf("%s size = %d, want <= %d", name, info.Size(), logFileMaxSize)
+		}
+	}
+
+	sessions := listLogSessions(dir)
+	if len(sessions) != 1 || sessions[0].Session != s.session {
+		t.Fatalf("sessions = %+v, want only %s", sessions, s.session)
+	}
+	if sessions[0].Size <= logFileMaxSize {
+		t.Errorf("session size = %d, want both parts counted", sessions[0].Size)
+	}
+
+	// Конец вывода сохраняется, начало вытеснено
+	lines, err := readSessionTail(dir, s.session, 2)
+	if err != nil {
+		t.Fatalf("readSessionTail: %v", err)
+	}
+	if len(lines) != 2 || !strings.HasPrefix(lines[1].Text, fmt.Sprintf("frame=%d ", total)) {
+		t.Fatalf("tail = %+v, want last line frame=%d", lines, total)
+	}
+	head, err := readSessionTail(dir, s.session, total+1)
+	if err != nil {
+		t.Fatalf("readSessionTail: %v", err)
+	}
+	if head[0].Text == "ffmpeg -i ..." {
+		t.Errorf("oldest part was not dropped")
+	}
+}
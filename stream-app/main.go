@@ -18,6 +18,13 @@ func main() {
 		log.Fatalf("Failed to initialize MinIO: %v", err)
 	}
 
+	// Журнал загрузок: незагруженные сегменты переживают перезапуск
+	if err := initUploadJournal(); err != nil {
+		log.Printf("⚠️ Failed to initialize upload journal: %v", err)
+	} else {
+		go runUploadJournalRetry()
+	}
+
 	// Инициализация Kafka
 	var err error
 	kafkaProducer, err = kafka.NewProducer()
@@ -28,18 +35,45 @@ func main() {
 		log.Println("✅ Kafka producer initialized successfully")
 	}
 
-	// Graceful shutdown для Kafka
+	// Outbox задач записи: повтор отправки, пока Kafka не подтвердит
+	if err := initRecordingOutbox(); err != nil {
+		log.Printf("⚠️ Failed to initialize recording outbox: %v", err)
+	} else {
+		go outbox.run()
+	}
+
+	// События жизненного цикла стримов (recording.events): хранятся на диске до подтверждения
+	if err := initStreamEvents(); err != nil {
+		log.Printf("⚠️ Failed to initialize stream events directory, events are kept in memory only: %v", err)
+	}
+	go runEventPublisher()
+
+	// Инициализация WHIP (WebRTC ingest из браузера)
+	if err := initWHIP(); err != nil {
+		log.Printf("Failed to initialize WHIP ingest: %v", err)
+	}
+
+	// SRT gateway: все SRT стримы через один порт (SRT_GATEWAY_PORT).
+	// Без него listener'ы на loopback недоступны publisher'ам
+	if err := initSRTGateway(); err != nil {
+		log.Fatalf("Failed to initialize SRT gateway: %v", err)
+	}
+
+	// Graceful shutdown: ffmpeg дописывает сегмент, файлы догружаются, стримы
+	// передаются на восстановление или завершаются (SHUTDOWN_MODE)
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
-		log.Println("🛑 Shutting down stream-app...")
-		if kafkaProducer != nil {
-			kafkaProducer.Close()
-		}
-		os.Exit(0)
+		shutdown()
 	}()
 
+	// Регистрация узла в main-app для размещения стримов
+	go runNodeHeartbeat()
+
+	// Остановка стримов, простаивающих без publisher
+	go runIdleWatchdog()
+
 	// Запускаем восстановление стримов в отдельной горутине
 	go func() {
 		time.Sleep(2 * time.Second)
@@ -55,13 +89,28 @@ func main() {
 	http.HandleFunc("/stream/recover", streamRecoveryHandler)
 	http.HandleFunc("/stream/cleanup", streamCleanupHandler)
 
+	// /stream/{id}/stats: битрейт, fps, dropped frames и параметры входа
+	// /stream/{id}/dvr/master.m3u8: перемотка в пределах DVR окна (сегменты из MinIO)
+	// POST /stream/{id}/clips: клип из последних секунд эфира в VOD
+	// GET /stream/{id}/logs: вывод ffmpeg стрима (X-API-Key, через main-app)
+	http.HandleFunc("/stream/", streamItemHandler)
+
+	// WHIP ingest: POST SDP offer / DELETE завершение сессии
+	http.HandleFunc("/whip/", whipHandler)
+
 	// Новые endpoints для интеграции с Kafka
 	//http.HandleFunc("/stream/start", streamStartHandler)
 	//http.HandleFunc("/stream/stop", streamStopHandler)
 	http.HandleFunc("/health", healthHandler)
+	http.HandleFunc("/admin/recording-outbox", recordingOutboxHandler)
+	http.HandleFunc("/admin/recording-outbox/", recordingOutboxHandler)
+
+	// Самопроверка цепочки ingest → HLS → MinIO → Kafka → VOD тестовым сигналом
+	http.HandleFunc("/admin/selfcheck", selfCheckHandler)
+	http.HandleFunc("/admin/selfcheck/", selfCheckHandler)
 
-	// Сервер отдачи HLS плейлистов и сегментов (резервный)
-	http.Handle("/hls/", http.StripPrefix("/hls/", http.FileServer(http.Dir("./hls"))))
+	// Сервер отдачи HLS плейлистов и сегментов (резервный), с поддержкой LL-HLS
+	http.HandleFunc("/hls/", hlsHandler)
 
 	addr := ":9090"
 	log.Printf("Stream-app listening on %s\n", addr)
@@ -1,14 +1,16 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
 	"sort"
 	"strings"
-	"time"
 
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
@@ -92,21 +94,10 @@ func initMinIO() error {
 // Загрузка файла в MinIO
 // Загрузка файла в MinIO с детальным логированием
 func uploadToMinIO(streamID, localFilePath, objectName string) error {
-	if minioClient == nil {
-		return fmt.Errorf("MinIO client not initialized")
-	}
-
-	ctx := context.Background()
-	objectPath := fmt.Sprintf("%s/%s", streamID, objectName)
-
-	// Определяем Content-Type
-	contentType := "application/octet-stream"
-	if strings.HasSuffix(objectName, ".m3u8") {
-		contentType = "application/vnd.apple.mpegurl"
-	} else if strings.HasSuffix(objectName, ".ts") {
-		contentType = "video/MP2T"
-	}
+	return uploadFileToMinIO(context.Background(), streamID, localFilePath, objectName)
+}
 
+func uploadFileToMinIO(ctx context.Context, streamID, localFilePath, objectName string) error {
 	// Проверить что файл существует и читается
 	file, err := os.Open(localFilePath)
 	if err != nil {
@@ -123,34 +114,92 @@ func uploadToMinIO(streamID, localFilePath, objectName string) error {
 		return fmt.Errorf("file is empty: %s", localFilePath)
 	}
 
-	// Попытка загрузки в MinIO
-	info, err := minioClient.PutObject(ctx, minioBucket, objectPath, file, stat.Size(), minio.PutObjectOptions{
+	return putHLSObject(ctx, streamID, objectName, file, stat.Size())
+}
+
+// Загрузка плейлиста из памяти: публикуется ровно то содержимое, которое проверил uploader
+func uploadBytesToMinIO(ctx context.Context, streamID, objectName string, data []byte) error {
+	if len(data) == 0 {
+		return fmt.Errorf("empty object: %s", objectName)
+	}
+	return putHLSObject(ctx, streamID, objectName, bytes.NewReader(data), int64(len(data)))
+}
+
+func putHLSObject(ctx context.Context, streamID, objectName string, reader io.Reader, size int64) error {
+	if minioClient == nil {
+		return fmt.Errorf("MinIO client not initialized")
+	}
+
+	objectPath := fmt.Sprintf("%s/%s", streamID, objectName)
+
+	// Определяем Content-Type
+	contentType := "application/octet-stream"
+	if strings.HasSuffix(objectName, ".m3u8") {
+		contentType = "application/vnd.apple.mpegurl"
+	} else if strings.HasSuffix(objectName, ".mpd") {
+		contentType = "application/dash+xml"
+	} else if strings.HasSuffix(objectName, ".ts") {
+		contentType = "video/MP2T"
+	} else if strings.HasSuffix(objectName, ".m4s") || strings.HasSuffix(objectName, ".mp4") {
+		contentType = "video/mp4"
+	}
+
+	_, err := minioClient.PutObject(ctx, minioBucket, objectPath, reader, size, minio.PutObjectOptions{
 		ContentType: contentType,
 	})
-
 	if err != nil {
 		return fmt.Errorf("failed to upload to MinIO: %v", err)
 	}
-
-	// ✅ УБРАЛИ ИЗБЫТОЧНЫЙ ЛОГ - теперь логируется только в uploadNewHLSFiles
-	_ = info // Избегаем unused variable warning
 	return nil
 }
 
-// Очистка локальных HLS сегментов, оставляя максимум maxChunks
-func cleanupLocalHLSSegments(streamID string, maxChunks int) {
+// Чтение объекта стрима из MinIO целиком (плейлисты)
+func readMinIOObject(ctx context.Context, objectPath string) ([]byte, error) {
+	if minioClient == nil {
+		return nil, fmt.Errorf("MinIO client not initialized")
+	}
+
+	object, err := minioClient.GetObject(ctx, minioBucket, objectPath, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer object.Close()
+
+	return io.ReadAll(object)
+}
+
+// Очистка локальных HLS сегментов, оставляя максимум maxChunks в каждом варианте.
+// Сегменты, для которых keep возвращает true (еще не загружены в MinIO), не удаляются
+func cleanupLocalHLSSegments(streamID string, maxChunks int, keep func(relPath string) bool) {
 	hlsDir := filepath.Join("hls", streamID)
 
+	dirs := []string{hlsDir}
 	entries, err := os.ReadDir(hlsDir)
 	if err != nil {
 		return
 	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			dirs = append(dirs, filepath.Join(hlsDir, entry.Name()))
+		}
+	}
+
+	for _, dir := range dirs {
+		cleanupSegmentsInDir(hlsDir, dir, maxChunks, keep)
+	}
+}
+
+func cleanupSegmentsInDir(hlsDir, dir string, maxChunks int, keep func(relPath string) bool) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
 
 	var tsFiles []os.FileInfo
 
-	// Собираем только .ts файлы
+	// Собираем только медиа сегменты (.ts или fMP4), init сегменты не трогаем
 	for _, entry := range entries {
-		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".ts") {
+		if entry.IsDir() || !isMediaSegment(entry.Name()) {
 			continue
 		}
 
@@ -175,211 +224,111 @@ func cleanupLocalHLSSegments(streamID string, maxChunks int) {
 	toDelete := tsFiles[:len(tsFiles)-maxChunks]
 
 	for _, file := range toDelete {
-		filePath := filepath.Join(hlsDir, file.Name())
+		filePath := filepath.Join(dir, file.Name())
+		if relPath, err := filepath.Rel(hlsDir, filePath); err == nil && keep(filepath.ToSlash(relPath)) {
+			continue
+		}
 		if err := os.Remove(filePath); err != nil {
 			log.Printf("Failed to remove local HLS segment %s: %v", filePath, err)
 		}
 	}
 }
 
-// Мониторинг и загрузка HLS файлов с локальной очисткой
-// Мониторинг и загрузка HLS файлов с локальной очисткой
-// Оптимизированный HLS Uploader без спама
-func startHLSUploader(streamID string) {
-	log.Printf("🚀 Starting optimized HLS uploader for stream: %s", streamID)
-
-	hlsDir := filepath.Join("hls", streamID)
-	maxLocalChunks := 8 // Увеличено для буферизации
-
-	// Трекинг загруженных файлов
-	uploadedFiles := make(map[string]time.Time)
-	lastPlaylistHash := ""
-
-	go func() {
-		log.Printf("📡 HLS uploader goroutine started for stream: %s", streamID)
-
-		uploadCycle := 0
-
-		for {
-			// Проверяем, активен ли еще стрим
-			streamsMux.Lock()
-			_, exists := activeStreams[streamID]
-			streamsMux.Unlock()
-
-			if !exists {
-				log.Printf("🛑 Stopping HLS uploader for stream %s (stream not active)", streamID)
-				// Финальная загрузка всех файлов
-				uploadAllHLSFiles(streamID, hlsDir)
-				break
-			}
-
-			uploadCycle++
-
-			// ✅ УМНАЯ ЗАГРУЗКА - только новые файлы
-			newFilesCount := uploadNewHLSFiles(streamID, hlsDir, uploadedFiles, &lastPlaylistHash)
-
-			// Логируем только если есть активность
-			if newFilesCount > 0 {
-				log.Printf("📊 HLS upload cycle #%d: %d new files uploaded for %s", uploadCycle, newFilesCount, streamID)
-			}
-
-			// Локальная очистка старых сегментов каждые 10 циклов
-			if uploadCycle%10 == 0 {
-				cleanupLocalHLSSegments(streamID, maxLocalChunks)
-				// Очистка трекинга старых файлов
-				cleanupUploadedFilesTracker(uploadedFiles)
-			}
-
-			// ✅ УВЕЛИЧЕН ИНТЕРВАЛ - каждые 5 секунд вместо 2
-			time.Sleep(5 * time.Second)
-		}
-
-		log.Printf("✅ HLS uploader stopped for stream %s", streamID)
-	}()
+// Проверка что файл относится к HLS/DASH выводу
+func isHLSFile(fileName string) bool {
+	return isManifestFile(fileName) || isSegmentFile(fileName)
+}
 
-	log.Printf("✅ Optimized HLS uploader launched for stream: %s", streamID)
+// Плейлист HLS или DASH манифест: перезаписывается ffmpeg по ходу стрима
+func isManifestFile(fileName string) bool {
+	return strings.HasSuffix(fileName, ".m3u8") || strings.HasSuffix(fileName, ".mpd")
 }
 
-// ✅ НОВАЯ ФУНКЦИЯ: умная загрузка только новых файлов
-func uploadNewHLSFiles(streamID, hlsDir string, uploadedFiles map[string]time.Time, lastPlaylistHash *string) int {
-	// Проверить что папка существует
-	if _, err := os.Stat(hlsDir); os.IsNotExist(err) {
-		return 0 // Тихо возвращаем, папка еще не создалась
-	}
+// Медиа сегмент: .ts, fMP4 часть LL-HLS или CMAF chunk
+func isMediaSegment(fileName string) bool {
+	return (strings.HasSuffix(fileName, ".ts") || strings.HasSuffix(fileName, ".m4s")) && !isInitSegment(fileName)
+}
 
-	files, err := os.ReadDir(hlsDir)
-	if err != nil {
-		log.Printf("❌ Failed to read HLS directory %s: %v", hlsDir, err)
-		return 0
-	}
+// fMP4 init сегмент: init.mp4 (HLS) или init-streamN.m4s (DASH)
+func isInitSegment(fileName string) bool {
+	return strings.HasPrefix(fileName, "init") &&
+		(strings.HasSuffix(fileName, ".mp4") || strings.HasSuffix(fileName, ".m4s"))
+}
 
-	if len(files) == 0 {
-		return 0
-	}
+// Неизменяемый файл, который загружается один раз: сегмент или init
+func isSegmentFile(fileName string) bool {
+	return isMediaSegment(fileName) || isInitSegment(fileName)
+}
 
-	uploadCount := 0
+// Список HLS файлов стрима (включая папки вариантов) в виде относительных путей.
+// Сегменты идут перед плейлистами, чтобы плейлист не ссылался на еще не загруженные файлы
+func listHLSFiles(hlsDir string) ([]string, error) {
+	var segments, playlists []string
 
-	for _, file := range files {
-		if file.IsDir() {
-			continue
+	err := filepath.WalkDir(hlsDir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
 		}
 
-		fileName := file.Name()
+		fileName := d.Name()
 
 		// Пропускаем временные файлы
-		if strings.HasSuffix(fileName, ".tmp") {
-			continue
-		}
-
-		if !strings.HasSuffix(fileName, ".m3u8") && !strings.HasSuffix(fileName, ".ts") {
-			continue
+		if strings.HasSuffix(fileName, ".tmp") || !isHLSFile(fileName) {
+			return nil
 		}
 
-		localPath := filepath.Join(hlsDir, fileName)
-
-		// Получаем информацию о файле
-		fileInfo, err := os.Stat(localPath)
+		relPath, err := filepath.Rel(hlsDir, path)
 		if err != nil {
-			continue
+			return nil
 		}
+		relPath = filepath.ToSlash(relPath)
 
-		// ✅ УМНАЯ ПРОВЕРКА: загружать только если файл новый или изменился
-		shouldUpload := false
-
-		if strings.HasSuffix(fileName, ".ts") {
-			// .ts сегменты загружаем только один раз
-			if lastUploaded, exists := uploadedFiles[fileName]; !exists {
-				shouldUpload = true
-			} else if fileInfo.ModTime().After(lastUploaded) {
-				shouldUpload = true
-			}
-		} else if strings.HasSuffix(fileName, ".m3u8") {
-			// .m3u8 загружаем только если содержимое изменилось
-			currentHash := getFileHash(localPath)
-			if currentHash != *lastPlaylistHash {
-				shouldUpload = true
-				*lastPlaylistHash = currentHash
-			}
+		if isManifestFile(fileName) {
+			playlists = append(playlists, relPath)
+		} else {
+			segments = append(segments, relPath)
 		}
-
-		if !shouldUpload {
-			continue // Тихо пропускаем без логов
-		}
-
-		// Загружаем файл
-		err = uploadToMinIO(streamID, localPath, fileName)
-		if err != nil {
-			log.Printf("❌ Failed to upload %s: %v", fileName, err)
-			continue
-		}
-
-		// Отмечаем как загруженный
-		uploadedFiles[fileName] = fileInfo.ModTime()
-		uploadCount++
-
-		// Логируем только новые загрузки
-		log.Printf("✅ Uploaded new file: %s", fileName)
-	}
-
-	return uploadCount
-}
-
-// ✅ НОВАЯ ФУНКЦИЯ: получение хеша файла для проверки изменений
-func getFileHash(filePath string) string {
-	file, err := os.Open(filePath)
+		return nil
+	})
 	if err != nil {
-		return ""
+		return nil, err
 	}
-	defer file.Close()
 
-	// Читаем первые 512 байт для быстрой проверки изменений
-	buffer := make([]byte, 512)
-	n, err := file.Read(buffer)
-	if err != nil && n == 0 {
-		return ""
-	}
+	sort.Strings(segments)
+	sort.Strings(playlists)
 
-	// Простой хеш на основе размера файла и содержимого
-	stat, _ := file.Stat()
-	return fmt.Sprintf("%d_%x", stat.Size(), buffer[:n])
-}
+	// master.m3u8 и manifest.mpd публикуем последними
+	sort.SliceStable(playlists, func(i, j int) bool {
+		return isTopLevelManifest(playlists[j]) && !isTopLevelManifest(playlists[i])
+	})
 
-// ✅ НОВАЯ ФУНКЦИЯ: очистка трекера загруженных файлов
-func cleanupUploadedFilesTracker(uploadedFiles map[string]time.Time) {
-	cutoff := time.Now().Add(-10 * time.Minute) // Удаляем записи старше 10 минут
+	return append(segments, playlists...), nil
+}
 
-	for fileName, uploadTime := range uploadedFiles {
-		if uploadTime.Before(cutoff) {
-			delete(uploadedFiles, fileName)
-		}
-	}
+func isTopLevelManifest(relPath string) bool {
+	return relPath == masterPlaylistName || relPath == dashManifestName
 }
 
 // ✅ ОБНОВЛЕННАЯ ФУНКЦИЯ: uploadAllHLSFiles для финальной загрузки
 func uploadAllHLSFiles(streamID, hlsDir string) {
 	log.Printf("🔄 Final upload of all remaining HLS files for stream %s", streamID)
 
-	// Простая загрузка всех файлов без трекинга при остановке
-	files, err := os.ReadDir(hlsDir)
+	// Загрузка всех файлов при остановке; неудачные сегменты остаются в журнале
+	files, err := listHLSFiles(hlsDir)
 	if err != nil {
 		log.Printf("⚠️ Error reading HLS dir for final upload: %v", err)
 		return
 	}
 
 	uploadCount := 0
-	for _, file := range files {
-		if file.IsDir() || strings.HasSuffix(file.Name(), ".tmp") {
-			continue
-		}
-
-		fileName := file.Name()
-		if !strings.HasSuffix(fileName, ".m3u8") && !strings.HasSuffix(fileName, ".ts") {
-			continue
-		}
-
-		localPath := filepath.Join(hlsDir, fileName)
+	for _, fileName := range files {
+		localPath := filepath.Join(hlsDir, filepath.FromSlash(fileName))
 		err := uploadToMinIO(streamID, localPath, fileName)
 		if err == nil {
+			journal.done(streamID, fileName)
 			uploadCount++
 		}
 	}
@@ -389,12 +338,30 @@ func uploadAllHLSFiles(streamID, hlsDir string) {
 	}
 }
 
+// Повторная публикация плейлистов после догрузки сегментов из журнала
+func uploadAllHLSManifests(streamID, hlsDir string) {
+	files, err := listHLSFiles(hlsDir)
+	if err != nil {
+		return
+	}
+
+	for _, fileName := range files {
+		if !isManifestFile(fileName) {
+			continue
+		}
+		localPath := filepath.Join(hlsDir, filepath.FromSlash(fileName))
+		if err := uploadToMinIO(streamID, localPath, fileName); err != nil {
+			log.Printf("❌ Failed to upload %s for stream %s: %v", fileName, streamID, err)
+		}
+	}
+}
+
 // Принудительная загрузка плейлиста в MinIO
 func forceUploadPlaylist(streamID, hlsDir string) {
-	playlistPath := filepath.Join(hlsDir, "stream.m3u8")
+	playlistPath := filepath.Join(hlsDir, masterPlaylistName)
 
 	if _, err := os.Stat(playlistPath); err == nil {
-		err := uploadToMinIO(streamID, playlistPath, "stream.m3u8")
+		err := uploadToMinIO(streamID, playlistPath, masterPlaylistName)
 		if err != nil {
 			log.Printf("Failed to force upload playlist for stream %s: %v", streamID, err)
 		}
@@ -413,7 +380,7 @@ func uploadHLSFiles(streamID, hlsDir string) error {
 		return nil // Не ошибка, папка еще не создалась
 	}
 
-	files, err := os.ReadDir(hlsDir)
+	files, err := listHLSFiles(hlsDir)
 	if err != nil {
 		log.Printf("❌ Failed to read HLS directory %s: %v", hlsDir, err)
 		return err
@@ -427,28 +394,11 @@ func uploadHLSFiles(streamID, hlsDir string) error {
 	log.Printf("📂 Found %d files in HLS directory %s", len(files), hlsDir)
 
 	uploadCount := 0
-	for _, file := range files {
-		if file.IsDir() {
-			continue
-		}
-
-		fileName := file.Name()
-
-		// Пропускаем временные файлы
-		if strings.HasSuffix(fileName, ".tmp") {
-			log.Printf("⏭️ Skipping temporary file: %s", fileName)
-			continue
-		}
+	for _, fileName := range files {
+		localPath := filepath.Join(hlsDir, filepath.FromSlash(fileName))
 
-		if !strings.HasSuffix(fileName, ".m3u8") && !strings.HasSuffix(fileName, ".ts") {
-			log.Printf("⏭️ Skipping non-HLS file: %s", fileName)
-			continue
-		}
-
-		localPath := filepath.Join(hlsDir, fileName)
-
-		// Для .ts сегментов проверяем, не загружен ли уже
-		if strings.HasSuffix(fileName, ".ts") {
+		// Для сегментов проверяем, не загружен ли уже
+		if isSegmentFile(path.Base(fileName)) {
 			if isFileUploaded(streamID, fileName, localPath) {
 				log.Printf("✅ File already uploaded: %s", fileName)
 				continue
@@ -497,29 +447,32 @@ func isFileUploaded(streamID, fileName, localPath string) bool {
 
 // Очистка файлов стрима из MinIO
 func cleanupStreamFromMinIO(streamID string) error {
+	removeMinIOPrefix(minioBucket, streamID+"/")
+	return nil
+}
+
+func removeMinIOPrefix(bucket, prefix string) {
 	if minioClient == nil {
-		return nil
+		return
 	}
 
 	ctx := context.Background()
-	objectsCh := minioClient.ListObjects(ctx, minioBucket, minio.ListObjectsOptions{
-		Prefix:    streamID + "/",
+	objectsCh := minioClient.ListObjects(ctx, bucket, minio.ListObjectsOptions{
+		Prefix:    prefix,
 		Recursive: true,
 	})
 
 	for object := range objectsCh {
 		if object.Err != nil {
-			log.Printf("Error listing objects for stream %s: %v", streamID, object.Err)
+			log.Printf("Error listing objects under %s/%s: %v", bucket, prefix, object.Err)
 			continue
 		}
 
-		err := minioClient.RemoveObject(ctx, minioBucket, object.Key, minio.RemoveObjectOptions{})
+		err := minioClient.RemoveObject(ctx, bucket, object.Key, minio.RemoveObjectOptions{})
 		if err != nil {
 			log.Printf("Failed to remove object %s: %v", object.Key, err)
 		}
 	}
-
-	return nil
 }
 
 // Очистка локальной папки HLS при удалении задачи
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+const nodeHeartbeatInterval = 10 * time.Second
+
+var (
+	// Идентификатор узла в реестре main-app
+	nodeID = getEnv("NODE_ID", defaultNodeID())
+	// Адрес, по которому main-app отправляет уведомления этому узлу
+	nodeURL = getEnv("NODE_URL", "http://"+defaultNodeID()+":9090")
+	// Сколько стримов узел готов принять (по умолчанию - размер пула портов)
+	nodeCapacity = loadNodeCapacity()
+)
+
+func defaultNodeID() string {
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		return hostname
+	}
+	return "stream-app"
+}
+
+// С SRT gateway пул портов нужен только RTMP стримам, SRT стримы ограничивает
+// admission control по слотам кодирования
+const defaultGatewayNodeCapacity = 500
+
+func loadNodeCapacity() int {
+	capacity := portEnd - portStart + 1
+	if srtGatewayEnabled() {
+		capacity = defaultGatewayNodeCapacity
+	}
+	if value := os.Getenv("NODE_CAPACITY"); value != "" {
+		if n, err := strconv.Atoi(value); err == nil && n >= 0 {
+			capacity = n
+		} else {
+			log.Printf("⚠️ Invalid NODE_CAPACITY %q, using %d", value, capacity)
+		}
+	}
+	return capacity
+}
+
+// Регистрация в main-app и периодический heartbeat с текущей нагрузкой
+func runNodeHeartbeat() {
+	registered := false
+	ticker := time.NewTicker(nodeHeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		if !registered {
+			if err := registerNode(); err != nil {
+				log.Printf("⚠️ Failed to register node %s: %v", nodeID, err)
+			} else {
+				registered = true
+				log.Printf("🖥️ Registered node %s at %s (capacity: %d)", nodeID, nodeURL, nodeCapacity)
+			}
+		} else if err := sendNodeHeartbeat(); err != nil {
+			log.Printf("⚠️ Node heartbeat failed: %v", err)
+			// main-app мог потерять реестр: регистрируемся заново
+			if err == errNodeNotRegistered {
+				registered = false
+				continue
+			}
+		}
+
+		<-ticker.C
+	}
+}
+
+var errNodeNotRegistered = errors.New("node is not registered")
+
+func registerNode() error {
+	return sendNodeRequest(http.MethodPost, "http://main-app:8080/nodes/register", map[string]interface{}{
+		"node_id":        nodeID,
+		"url":            nodeURL,
+		"capacity":       nodeCapacity,
+		"active_streams": activeStreamCount(),
+	})
+}
+
+func sendNodeHeartbeat() error {
+	// Останавливающийся узел новых стримов не принимает
+	capacity := nodeCapacity
+	if shuttingDown.Load() {
+		capacity = 0
+	} else if nodeSaturated() {
+		// Кодирования не успевают: для размещения узел выглядит заполненным
+		capacity = min(capacity, activeStreamCount())
+	}
+	return sendNodeRequest(http.MethodPut, fmt.Sprintf("http://main-app:8080/nodes/%s/heartbeat", nodeID), map[string]interface{}{
+		"capacity":       capacity,
+		"active_streams": activeStreamCount(),
+	})
+}
+
+func sendNodeRequest(method, url string, payload map[string]interface{}) error {
+	jsonData, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal node payload: %v", err)
+	}
+
+	req, err := http.NewRequest(method, url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-API-Key", serviceAPIKey)
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach main-app: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return errNodeNotRegistered
+	}
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("main-app returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func activeStreamCount() int {
+	streamsMux.Lock()
+	defer streamsMux.Unlock()
+	return len(activeStreams)
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"web/stream-app/kafka"
+)
+
+// Outbox задач записи: задача сначала сохраняется на диск, потом отправляется в Kafka
+// и удаляется только после подтверждения. Без этого недоступная Kafka в момент
+// остановки означала, что стрим никогда не станет VOD
+const (
+	outboxRetryMin     = 2 * time.Second
+	outboxRetryMax     = 5 * time.Minute
+	outboxPollInterval = 5 * time.Second
+	outboxSendTimeout  = 10 * time.Second
+	// После стольких неудачных попыток задача помечается failed (повторы продолжаются)
+	outboxFailAfter = 10
+
+	// Задача остановки ждет финальной загрузки сегментов: recording-service читает их из MinIO
+	outboxWaitingUpload = "waiting_upload"
+)
+
+var recordingOutboxDir = getEnv("RECORDING_OUTBOX_DIR", filepath.Join(filepath.Dir(stateFile), "outbox"))
+
+var outbox *recordingOutbox
+
+// outboxEntry задача записи в outbox (один JSON файл на задачу)
+type outboxEntry struct {
+	ID          string              `json:"id"`
+	Task        kafka.RecordingTask `json:"task"`
+	Status      string              `json:"status"` // waiting_upload, pending или failed
+	Attempts    int                 `json:"attempts"`
+	LastError   string              `json:"last_error,omitempty"`
+	LastAttempt *time.Time          `json:"last_attempt,omitempty"`
+	Created     time.Time           `json:"created"`
+}
+
+type recordingOutbox struct {
+	mu      sync.Mutex
+	dir     string
+	entries map[string]*outboxEntry
+	// Задачи, чей uploader еще догружает файлы в этом процессе.
+	// После перезапуска ожидание продолжается только по журналу загрузок
+	held map[string]bool
+	// Ожидающие подтверждения Kafka по стриму (самопроверка)
+	ackWatchers map[string][]chan struct{}
+	seq         atomic.Int64
+	wake        chan struct{}
+
+	// Общая пауза: ошибка Kafka обычно касается всех задач сразу
+	backoff time.Duration
+	retryAt time.Time
+}
+
+func initRecordingOutbox() error {
+	o := &recordingOutbox{
+		dir:         recordingOutboxDir,
+		entries:     make(map[string]*outboxEntry),
+		held:        make(map[string]bool),
+		ackWatchers: make(map[string][]chan struct{}),
+		wake:        make(chan struct{}, 1),
+		backoff:     outboxRetryMin,
+	}
+	if err := os.MkdirAll(o.dir, 0755); err != nil {
+		return fmt.Errorf("failed to create outbox directory: %v", err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(o.dir, "*.json"))
+	if err != nil {
+		return fmt.Errorf("failed to read outbox: %v", err)
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			log.Printf("⚠️ Failed to read outbox entry %s: %v", file, err)
+			continue
+		}
+		var entry outboxEntry
+		if err := json.Unmarshal(data, &entry); err != nil || entry.ID == "" {
+			log.Printf("⚠️ Skipping corrupted outbox entry %s: %v", file, err)
+			continue
+		}
+		o.entries[entry.ID] = &entry
+	}
+
+	outbox = o
+	if len(o.entries) > 0 {
+		log.Printf("📮 Recording outbox: %d tasks pending from previous run", len(o.entries))
+	}
+	return nil
+}
+
+// Постановка задачи записи: после возврата задача переживет перезапуск stream-app
+func enqueueRecordingTask(task kafka.RecordingTask) {
+	enqueueRecordingTaskAfterUpload(task, nil)
+}
+
+// Задача сохраняется сразу, а в Kafka уходит после закрытия uploaded и
+// загрузки всех сегментов стрима из журнала (uploaded == nil - без ожидания)
+func enqueueRecordingTaskAfterUpload(task kafka.RecordingTask, uploaded <-chan struct{}) {
+	if task.Timestamp.IsZero() {
+		task.Timestamp = time.Now()
+	}
+	// Невалидная задача никогда не отправится и заблокировала бы очередь
+	if task.StreamID == "" || task.Action == "" {
+		log.Printf("❌ Dropping invalid recording task: stream_id=%q action=%q", task.StreamID, task.Action)
+		return
+	}
+
+	// Без outbox (не удалось создать папку) отправляем напрямую, как раньше
+	if outbox == nil {
+		go func() {
+			if uploaded != nil {
+				<-uploaded
+			}
+			sendRecordingTaskDirect(task)
+		}()
+		return
+	}
+	if uploaded == nil {
+		outbox.add(task, "pending")
+		return
+	}
+
+	id := outbox.add(task, outboxWaitingUpload)
+	go func() {
+		<-uploaded
+		outbox.release(id)
+	}()
+}
+
+func sendRecordingTaskDirect(task kafka.RecordingTask) {
+	if kafkaProducer == nil {
+		log.Printf("❌ Kafka unavailable, recording task %s for stream %s is lost", task.Action, task.StreamID)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), outboxSendTimeout)
+	defer cancel()
+	if err := kafkaProducer.SendRecordingTask(ctx, task); err != nil {
+		log.Printf("❌ Failed to send recording task: %v", err)
+	}
+}
+
+func (o *recordingOutbox) add(task kafka.RecordingTask, status string) string {
+	now := time.Now()
+	entry := &outboxEntry{
+		// Имя сортируется по времени постановки: задачи уходят в порядке создания
+		ID:      fmt.Sprintf("%019d-%04d", now.UnixNano(), o.seq.Add(1)%10000),
+		Task:    task,
+		Status:  status,
+		Created: now,
+	}
+
+	o.mu.Lock()
+	o.entries[entry.ID] = entry
+	if status == outboxWaitingUpload {
+		o.held[entry.ID] = true
+	}
+	// Диск недоступен: задача остается в памяти и отправится, пока процесс жив
+	if err := o.persist(entry); err != nil {
+		log.Printf("⚠️ Failed to persist recording task %s for stream %s: %v", task.Action, task.StreamID, err)
+	}
+	o.mu.Unlock()
+
+	o.notify()
+	return entry.ID
+}
+
+// Uploader стрима завершился: дальше задача ждет только журнал загрузок
+func (o *recordingOutbox) release(id string) {
+	o.mu.Lock()
+	delete(o.held, id)
+	o.mu.Unlock()
+
+	o.notify()
+}
+
+func (o *recordingOutbox) notify() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Задача не должна потеряться при крэше
+func (o *recordingOutbox) persist(entry *outboxEntry) error {
+	data, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileDurable(filepath.Join(o.dir, entry.ID+".json"), data)
+}
+
+// Запись через временный файл и rename, с fsync: файл либо старый, либо целиком новый
+func writeFileDurable(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	file.Close()
+	return os.Rename(tmpPath, path)
+}
+
+func (o *recordingOutbox) run() {
+	for {
+		o.flush()
+
+		select {
+		case <-o.wake:
+		case <-time.After(outboxPollInterval):
+		}
+	}
+}
+
+// Отправка задач по порядку; при ошибке проход прерывается до конца паузы
+func (o *recordingOutbox) flush() {
+	o.mu.Lock()
+	if time.Now().Before(o.retryAt) {
+		o.mu.Unlock()
+		return
+	}
+	ids := make([]string, 0, len(o.entries))
+	for id := range o.entries {
+		ids = append(ids, id)
+	}
+	o.mu.Unlock()
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		o.mu.Lock()
+		entry, exists := o.entries[id]
+		var task kafka.RecordingTask
+		waiting, held := false, false
+		if exists {
+			task = entry.Task
+			waiting = entry.Status == outboxWaitingUpload
+			held = o.held[id]
+		}
+		o.mu.Unlock()
+		if !exists {
+			continue
+		}
+
+		// Сегменты стрима еще не в MinIO: задача ждет, остальные уходят
+		if waiting {
+			if held || len(journal.pendingFor(task.StreamID)) > 0 {
+				continue
+			}
+			o.mu.Lock()
+			entry.Status = "pending"
+			if err := o.persist(entry); err != nil {
+				log.Printf("⚠️ Failed to update outbox entry %s: %v", id, err)
+			}
+			o.mu.Unlock()
+			log.Printf("📮 Final upload of stream %s finished, sending recording task", task.StreamID)
+		}
+
+		err := o.send(task)
+
+		o.mu.Lock()
+		if err == nil {
+			delete(o.entries, id)
+			for _, acked := range o.ackWatchers[task.StreamID] {
+				close(acked)
+			}
+			delete(o.ackWatchers, task.StreamID)
+			if removeErr := os.Remove(filepath.Join(o.dir, id+".json")); removeErr != nil && !os.IsNotExist(removeErr) {
+				log.Printf("⚠️ Failed to remove outbox entry %s: %v", id, removeErr)
+			}
+			o.backoff = outboxRetryMin
+			o.mu.Unlock()
+			continue
+		}
+
+		now := time.Now()
+		entry.Attempts++
+		entry.LastError = err.Error()
+		entry.LastAttempt = &now
+		if entry.Attempts >= outboxFailAfter {
+			entry.Status = "failed"
+		}
+		if persistErr := o.persist(entry); persistErr != nil {
+			log.Printf("⚠️ Failed to update outbox entry %s: %v", id, persistErr)
+		}
+		o.retryAt = now.Add(o.backoff)
+		log.Printf("⚠️ Recording task %s for stream %s not sent (attempt %d), retrying in %s: %v",
+			task.Action, task.StreamID, entry.Attempts, o.backoff, err)
+		o.backoff = min(o.backoff*2, outboxRetryMax)
+		o.mu.Unlock()
+		return
+	}
+}
+
+func (o *recordingOutbox) send(task kafka.RecordingTask) error {
+	if kafkaProducer == nil {
+		return fmt.Errorf("kafka producer is not initialized")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), outboxSendTimeout)
+	defer cancel()
+	return kafkaProducer.SendRecordingTask(ctx, task)
+}
+
+// Снимок задач (status: "" - все, waiting_upload, pending или failed), по порядку отправки
+func (o *recordingOutbox) list(status string) []outboxEntry {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	entries := make([]outboxEntry, 0, len(o.entries))
+	for _, entry := range o.entries {
+		if status == "" || entry.Status == status {
+			entries = append(entries, *entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+	return entries
+}
+
+// Повтор задачи (id) или всех задач: сбрасывает счетчик попыток и паузу
+func (o *recordingOutbox) replay(id string) int {
+	o.mu.Lock()
+	count := 0
+	for entryID, entry := range o.entries {
+		if id != "" && entryID != id {
+			continue
+		}
+		// Задача, ждущая загрузки, раньше сегментов не уйдет
+		if entry.Status != outboxWaitingUpload {
+			entry.Status = "pending"
+		}
+		entry.Attempts = 0
+		if err := o.persist(entry); err != nil {
+			log.Printf("⚠️ Failed to update outbox entry %s: %v", entryID, err)
+		}
+		count++
+	}
+	if count > 0 {
+		o.backoff = outboxRetryMin
+		o.retryAt = time.Time{}
+	}
+	o.mu.Unlock()
+
+	if count > 0 {
+		o.notify()
+	}
+	return count
+}
+
+// Канал закрывается, когда Kafka подтвердит следующую задачу стрима.
+// Подписка до постановки задачи: иначе подтверждение можно пропустить
+func (o *recordingOutbox) watchAck(streamID string) <-chan struct{} {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	acked := make(chan struct{})
+	o.ackWatchers[streamID] = append(o.ackWatchers[streamID], acked)
+	return acked
+}
+
+// Количество неотправленных задач и среди них помеченных failed
+func (o *recordingOutbox) counts() (int, int) {
+	if o == nil {
+		return 0, 0
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	failed := 0
+	for _, entry := range o.entries {
+		if entry.Status == "failed" {
+			failed++
+		}
+	}
+	return len(o.entries), failed
+}
+
+// GET /admin/recording-outbox[?status=waiting_upload|pending|failed] - задачи, ожидающие Kafka
+// POST /admin/recording-outbox/replay[?id=...] - немедленный повтор
+func recordingOutboxHandler(w http.ResponseWriter, r *http.Request) {
+	if !isServiceRequest(r) {
+		http.Error(w, "Service API key required", http.StatusUnauthorized)
+		return
+	}
+	if outbox == nil {
+		http.Error(w, "Recording outbox is not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	action := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/recording-outbox"), "/")
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		status := r.URL.Query().Get("status")
+		if status != "" && status != outboxWaitingUpload && status != "pending" && status != "failed" {
+			http.Error(w, "status must be waiting_upload, pending or failed", http.StatusBadRequest)
+			return
+		}
+		entries := outbox.list(status)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"tasks": entries,
+			"count": len(entries),
+		})
+
+	case action == "replay" && r.Method == http.MethodPost:
+		id := r.URL.Query().Get("id")
+		count := outbox.replay(id)
+		if id != "" && count == 0 {
+			http.Error(w, "Task not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("📮 Replaying %d recording tasks from outbox", count)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"replayed": count})
+
+	case action == "" || action == "replay":
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Служебные endpoints stream-app закрыты тем же X-API-Key, что и запросы к main-app
+func isServiceRequest(r *http.Request) bool {
+	key := r.Header.Get("X-API-Key")
+	return key != "" && subtle.ConstantTimeCompare([]byte(key), []byte(serviceAPIKey)) == 1
+}
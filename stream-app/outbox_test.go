@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+	"time"
+	"web/stream-app/kafka"
+)
+
+func newTestOutbox(t *testing.T) *recordingOutbox {
+	t.Helper()
+	return &recordingOutbox{
+		dir:         t.TempDir(),
+		entries:     make(map[string]*outboxEntry),
+		held:        make(map[string]bool),
+		ackWatchers: make(map[string][]chan struct{}),
+		wake:        make(chan struct{}, 1),
+		backoff:     outboxRetryMin,
+	}
+}
+
+func TestOutboxWaitingUpload(t *testing.T) {
+	// Kafka недоступна: задача, дошедшая до отправки, получает попытку
+	savedJournal, savedProducer := journal, kafkaProducer
+	defer func() { journal, kafkaProducer = savedJournal, savedProducer }()
+	kafkaProducer = nil
+
+	tests := []struct {
+		name         string
+		release      bool     // uploader завершился
+		pending      []string // сегменты стрима в журнале
+		wantStatus   string
+		wantAttempts int
+	}{
+		{"uploader running", false, nil, outboxWaitingUpload, 0},
+		{"segments pending in journal", true, []string{"720p/segment_001.ts"}, outboxWaitingUpload, 0},
+		{"upload finished", true, nil, "pending", 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			journal = newTestJournal(t, "")
+			for _, relPath := range tt.pending {
+				journal.markPending("s1", relPath, time.Now())
+			}
+
+			o := newTestOutbox(t)
+			id := o.add(kafka.RecordingTask{StreamID: "s1", Action: "stop_recording"}, outboxWaitingUpload)
+			if tt.release {
+				o.release(id)
+			}
+			o.flush()
+
+			entry := o.entries[id]
+			if entry.Status != tt.wantStatus || entry.Attempts != tt.wantAttempts {
+				t.Fatalf("status = %s, attempts = %d, want %s and %d", entry.Status, entry.Attempts, tt.wantStatus, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestOutboxWaitingUploadSurvivesRestart(t *testing.T) {
+	savedJournal, savedOutbox, savedDir := journal, outbox, recordingOutboxDir
+	defer func() { journal, outbox, recordingOutboxDir = savedJournal, savedOutbox, savedDir }()
+	journal = nil
+
+	o := newTestOutbox(t)
+	id := o.add(kafka.RecordingTask{StreamID: "s1", Action: "stop_recording"}, outboxWaitingUpload)
+
+	// Крэш до конца загрузки: задача на диске, uploader нового процесса ее не держит
+	recordingOutboxDir = o.dir
+	if err := initRecordingOutbox(); err != nil {
+		t.Fatalf("initRecordingOutbox: %v", err)
+	}
+	entry, exists := outbox.entries[id]
+	if !exists || entry.Status != outboxWaitingUpload {
+		t.Fatalf("entry after restart = %+v", entry)
+	}
+	if outbox.held[id] {
+		t.Fatal("restored entry is held by an uploader of the previous run")
+	}
+}
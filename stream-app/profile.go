@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Профили кодирования live стрима
+const (
+	ProfilePassthrough = "passthrough" // копируем H.264/AAC без перекодирования
+	ProfileTranscode   = "transcode"   // один вариант libx264
+	ProfileLadder      = "ladder"      // ABR лестница из HLS_LADDER
+)
+
+// Имя единственного варианта для passthrough и transcode
+const sourceRenditionName = "source"
+
+// Сегмент длиннее этого значения означает слишком редкие keyframe у источника
+const maxPassthroughSegment = 10 * time.Second
+
+func normalizeProfile(profile string) string {
+	switch strings.ToLower(profile) {
+	case ProfilePassthrough:
+		return ProfilePassthrough
+	case ProfileTranscode:
+		return ProfileTranscode
+	default:
+		return ProfileLadder
+	}
+}
+
+// OutputSettings параметры вывода ffmpeg для одного запуска
+type OutputSettings struct {
+	Mode           string // passthrough, transcode или ladder
+	TranscodeAudio bool   // passthrough: аудио перекодируется в AAC
+	LowLatency     bool   // LL-HLS: fMP4 части вместо .ts сегментов
+	Format         string // hls или cmaf (HLS + DASH из одних сегментов)
+	NoAudio        bool   // у входа нет аудио: в var_stream_map только видео
+}
+
+// Аргументы вывода ffmpeg для выбранного режима и имена папок вариантов
+func buildOutputArgs(hlsDir string, out OutputSettings) ([]string, []string) {
+	var args, variants []string
+	switch out.Mode {
+	case ProfilePassthrough:
+		args, variants = buildPassthroughArgs(hlsDir, out), []string{sourceRenditionName}
+	case ProfileTranscode:
+		args, variants = buildTranscodeArgs(hlsDir, out), []string{sourceRenditionName}
+	default:
+		args, variants = buildLadderArgs(hlsDir, hlsLadder, out), ladderNames(hlsLadder, out.NoAudio)
+	}
+
+	// CMAF пишет все представления в корень папки стрима
+	if out.Format == OutputCMAF {
+		variants = nil
+	}
+	return args, variants
+}
+
+// Passthrough: видео копируется как есть, аудио копируется если это AAC
+func buildPassthroughArgs(hlsDir string, out OutputSettings) []string {
+	args := []string{
+		"-map", "0:v:0",
+		"-map", "0:a:0?",
+		"-c:v", "copy",
+	}
+
+	if out.TranscodeAudio {
+		args = append(args, "-b:a", "128k")
+		args = append(args, liveAudioArgs()...)
+	} else {
+		args = append(args, "-c:a", "copy")
+	}
+
+	return append(args, buildHLSArgs(hlsDir, sourceStreamMap(out), out)...)
+}
+
+// Transcode: один вариант в исходном разрешении
+func buildTranscodeArgs(hlsDir string, out OutputSettings) []string {
+	args := []string{
+		"-map", "0:v:0",
+		"-map", "0:a:0?",
+		"-c:v", "libx264",
+		"-crf", "23",
+		"-maxrate", "5000k",
+		"-bufsize", "6000k",
+		"-b:a", "128k",
+	}
+	args = append(args, liveVideoArgs(out.LowLatency)...)
+	args = append(args, liveAudioArgs()...)
+
+	return append(args, buildHLSArgs(hlsDir, sourceStreamMap(out), out)...)
+}
+
+// var_stream_map единственного варианта; без аудио ссылка на a:0 ломает hls muxer
+func sourceStreamMap(out OutputSettings) string {
+	if out.NoAudio {
+		return fmt.Sprintf("v:0,name:%s", sourceRenditionName)
+	}
+	return fmt.Sprintf("v:0,a:0,name:%s", sourceRenditionName)
+}
+
+// passthroughProbe проверяет, можно ли копировать вход: кодеки и интервал между сегментами
+type passthroughProbe struct {
+	lastSegment  time.Time
+	longSegments int
+}
+
+// Результат проверки строки лога ffmpeg
+type probeVerdict struct {
+	FallbackReason string // видео нельзя копировать, нужен transcode
+	TranscodeAudio bool   // аудио не AAC, перекодируем только его
+}
+
+// Проверка длины сегментов по строкам лога ffmpeg
+func (p *passthroughProbe) inspect(line string) probeVerdict {
+	trimmed := strings.TrimSpace(line)
+
+	// hls muxer пишет "Opening '.../segment_001.ts' for writing" на каждый новый сегмент.
+	// Вход идет в реальном времени, поэтому интервал между ними = длительность сегмента
+	if strings.Contains(trimmed, "Opening '") && isSegmentOpening(trimmed) {
+		now := time.Now()
+		if !p.lastSegment.IsZero() && now.Sub(p.lastSegment) > maxPassthroughSegment {
+			p.longSegments++
+		} else {
+			p.longSegments = 0
+		}
+		p.lastSegment = now
+
+		if p.longSegments >= 2 {
+			return probeVerdict{FallbackReason: fmt.Sprintf("keyframe interval exceeds %s", maxPassthroughSegment)}
+		}
+	}
+
+	return probeVerdict{}
+}
+
+// Проверка кодеков входа, как их определил ffmpeg
+func (p *passthroughProbe) checkCodecs(info InputInfo) probeVerdict {
+	if info.VideoCodec == "" {
+		return probeVerdict{FallbackReason: "no video stream detected"}
+	}
+	if info.VideoCodec != "h264" {
+		return probeVerdict{FallbackReason: fmt.Sprintf("video codec %s is not H.264", info.VideoCodec)}
+	}
+	return probeVerdict{TranscodeAudio: info.AudioCodec != "" && info.AudioCodec != "aac"}
+}
+
+func isSegmentOpening(line string) bool {
+	// DASH пишет аудио отдельными chunk-stream1-*, считаем только видео (stream0)
+	if strings.Contains(line, "chunk-stream") && !strings.Contains(line, "chunk-stream0-") {
+		return false
+	}
+	for _, ext := range []string{".ts", ".m4s"} {
+		// temp_file: ffmpeg сначала пишет в .tmp
+		if strings.Contains(line, ext+"' for writing") || strings.Contains(line, ext+".tmp' for writing") {
+			return true
+		}
+	}
+	return false
+}
+
+// Применяем результат проверки: перезапуск ffmpeg с другими параметрами вывода.
+// Publisher переподключится к тому же listener, supervisor перезапускает ffmpeg
+func applyProbeVerdict(streamID string, verdict probeVerdict) {
+	if verdict.FallbackReason == "" && !verdict.TranscodeAudio {
+		return
+	}
+
+	processesMux.Lock()
+	defer processesMux.Unlock()
+
+	proc, exists := processes[streamID]
+	if !exists || proc.EncodingMode != ProfilePassthrough {
+		return
+	}
+
+	if verdict.FallbackReason != "" {
+		proc.EncodingMode = ProfileTranscode
+		proc.FallbackReason = verdict.FallbackReason
+		log.Printf("🔁 Passthrough not possible for stream %s (%s), falling back to transcode", streamID, verdict.FallbackReason)
+	} else {
+		if proc.TranscodeAudio {
+			return
+		}
+		proc.TranscodeAudio = true
+		log.Printf("🔁 Stream %s audio is not AAC, copying video and transcoding audio", streamID)
+	}
+
+	if proc.Cmd != nil && proc.Cmd.Process != nil {
+		proc.IntentionalRestart = true
+		proc.Cmd.Process.Kill()
+	}
+}
+
+// Вход без аудио: вывод с ссылкой на a:0 в var_stream_map не запустится,
+// перезапускаем ffmpeg только с видео
+func applyInputAudio(streamID string, info InputInfo) {
+	if info.VideoCodec == "" || info.AudioCodec != "" {
+		return
+	}
+
+	processesMux.Lock()
+	defer processesMux.Unlock()
+
+	proc, exists := processes[streamID]
+	if !exists || proc.NoAudio {
+		return
+	}
+	proc.NoAudio = true
+	log.Printf("🔇 Stream %s input has no audio, restarting ffmpeg with video only", streamID)
+
+	if proc.Cmd != nil && proc.Cmd.Process != nil {
+		proc.IntentionalRestart = true
+		proc.Cmd.Process.Kill()
+	}
+}
+
+// Фактический режим кодирования стрима для /stream/status
+func currentEncodingMode(streamID string) (string, bool, string) {
+	processesMux.Lock()
+	defer processesMux.Unlock()
+
+	if proc, exists := processes[streamID]; exists {
+		return proc.EncodingMode, proc.TranscodeAudio, proc.FallbackReason
+	}
+	return "", false, ""
+}
@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"time"
+	"web/stream-app/kafka"
 )
 
 type ActiveTask struct {
@@ -13,23 +15,47 @@ type ActiveTask struct {
 	StreamID string `json:"stream_id"`
 	Name     string `json:"name"`
 	Status   string `json:"status"`
+	// Отдается main-app только при запросе с X-API-Key
+	StreamKey string `json:"stream_key"`
+	Protocol  string `json:"protocol"`
+	Profile   string `json:"profile"`
+	// LL-HLS включен для стрима
+	LowLatency bool `json:"low_latency"`
+	// hls или cmaf
+	OutputFormat string `json:"output_format"`
+	// DVR окно в секундах
+	DVRWindow int `json:"dvr_window"`
+	// Направления restream с ключами (только при запросе с X-API-Key)
+	RestreamTargets []RestreamTarget `json:"restream_targets"`
 }
 
 // Восстановление активных стримов при запуске stream-app
 func recoverActiveStreams() {
 	log.Println("Starting stream recovery process...")
 
+	// Сохраненное состояние: порты, время старта и владельцы стримов
+	saved := loadStreamState()
+	reserveSavedPorts(saved)
+	defer releaseUnrecoveredPorts(saved)
+
 	// Ждем, пока main-app станет доступен
-	if !waitForMainApp() {
-		log.Println("Failed to connect to main-app, skipping recovery")
-		return
+	var activeTasks []ActiveTask
+	var err error
+	if waitForMainApp() {
+		// Получаем список активных задач
+		activeTasks, err = getActiveTasksFromMainApp()
+	} else {
+		err = fmt.Errorf("main-app is not available")
 	}
 
-	// Получаем список активных задач
-	activeTasks, err := getActiveTasksFromMainApp()
 	if err != nil {
-		log.Printf("Failed to get active tasks: %v", err)
-		return
+		if len(saved) == 0 {
+			log.Printf("Failed to get active tasks: %v, skipping recovery", err)
+			return
+		}
+		// main-app недоступен: поднимаем стримы по локальному состоянию
+		log.Printf("Failed to get active tasks: %v, recovering from local state", err)
+		activeTasks = tasksFromState(saved)
 	}
 
 	if len(activeTasks) == 0 {
@@ -41,7 +67,10 @@ func recoverActiveStreams() {
 
 	// Восстанавливаем каждую активную задачу
 	for _, task := range activeTasks {
-		err := recoverSingleStream(task)
+		state := saved[task.StreamID]
+		delete(saved, task.StreamID)
+
+		err := recoverSingleStream(task, state)
 		if err != nil {
 			log.Printf("Failed to recover stream %s: %v", task.StreamID, err)
 			continue
@@ -55,6 +84,82 @@ func recoverActiveStreams() {
 	log.Println("Stream recovery process completed")
 }
 
+// Порты из состояния занимаем сразу, чтобы их не получил новый стрим,
+// пока мы ждем main-app. Уже активные стримы (повторный /stream/recover) не трогаем
+func reserveSavedPorts(saved map[string]*persistedStream) {
+	streamsMux.Lock()
+	defer streamsMux.Unlock()
+
+	for streamID, state := range saved {
+		if _, active := activeStreams[streamID]; active {
+			delete(saved, streamID)
+			continue
+		}
+		// SRT за gateway слушает loopback порт из отдельного диапазона
+		reserve := reservePort
+		if state.Info.Protocol == ProtocolSRT && srtGatewayEnabled() {
+			reserve = reserveLoopbackPort
+		}
+		if state.Info.Port != 0 && !reserve(state.Info.Port) {
+			log.Printf("⚠️ Saved port %d for stream %s is not available, a new one will be used", state.Info.Port, streamID)
+			state.Info.Port = 0
+		}
+	}
+}
+
+// Стримы из состояния, которых больше нет в main-app, были остановлены пока мы лежали
+func releaseUnrecoveredPorts(saved map[string]*persistedStream) {
+	for streamID, state := range saved {
+		log.Printf("Dropping saved stream %s: it is no longer active", streamID)
+		if state.Info.Port != 0 {
+			releasePort(state.Info.Port)
+		}
+	}
+
+	streamsMux.Lock()
+	saveStreamState()
+	streamsMux.Unlock()
+}
+
+func tasksFromState(saved map[string]*persistedStream) []ActiveTask {
+	tasks := make([]ActiveTask, 0, len(saved))
+	for streamID, state := range saved {
+		// Самопроверка после перезапуска не продолжается
+		if isSelfCheckStream(streamID) {
+			continue
+		}
+		tasks = append(tasks, ActiveTask{
+			StreamID:     streamID,
+			Name:         state.Info.Title,
+			Status:       state.Info.Status,
+			StreamKey:    state.StreamKey,
+			Protocol:     state.Info.Protocol,
+			Profile:      state.Info.Profile,
+			LowLatency:   state.Info.LowLatency,
+			OutputFormat: state.Info.OutputFormat,
+			DVRWindow:    state.Info.DVRWindow,
+			// Ключи направлений хранятся вне StreamInfo
+			RestreamTargets: state.RestreamTargets,
+		})
+	}
+	return tasks
+}
+
+// Переносим в восстановленный стрим данные, которые main-app не знает
+func restoreSavedInfo(stream *StreamInfo, state *persistedStream) {
+	if state == nil {
+		return
+	}
+	if !state.Info.StartTime.IsZero() {
+		stream.StartTime = state.Info.StartTime
+	}
+	stream.UserID = state.Info.UserID
+	stream.Username = state.Info.Username
+	if state.Info.Title != "" {
+		stream.Title = state.Info.Title
+	}
+}
+
 // Ожидание доступности main-app
 func waitForMainApp() bool {
 	maxRetries := 30
@@ -80,8 +185,17 @@ func waitForMainApp() bool {
 
 // Получение активных задач от main-app
 func getActiveTasksFromMainApp() ([]ActiveTask, error) {
+	// Только стримы, назначенные этому узлу
+	endpoint := "http://main-app:8080/tasks/active?node_id=" + url.QueryEscape(nodeID)
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+	// Ключ сервиса нужен, чтобы main-app вернул stream_key для SRT passphrase
+	req.Header.Set("X-API-Key", serviceAPIKey)
+
 	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Get("http://main-app:8080/tasks/active")
+	resp, err := client.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("failed to request active tasks: %v", err)
 	}
@@ -99,42 +213,122 @@ func getActiveTasksFromMainApp() ([]ActiveTask, error) {
 	return tasks, nil
 }
 
-// Восстановление одного стрима
-func recoverSingleStream(task ActiveTask) error {
-	// Выделяем порт
-	port, err := acquirePort()
-	if err != nil {
-		return fmt.Errorf("failed to acquire port: %v", err)
+// Восстановление одного стрима; state - сохраненная запись или nil
+func recoverSingleStream(task ActiveTask, state *persistedStream) error {
+	streamsMux.Lock()
+	_, active := activeStreams[task.StreamID]
+	streamsMux.Unlock()
+	if active {
+		log.Printf("Stream %s is already active, skipping recovery", task.StreamID)
+		if state != nil && state.Info.Port != 0 {
+			releasePort(state.Info.Port)
+		}
+		return nil
+	}
+
+	// WHIP стрим восстанавливается в ожидании нового SDP offer от браузера
+	if normalizeProtocol(task.Protocol) == ProtocolWHIP {
+		streamsMux.Lock()
+		handleWaitingWHIP(StreamNotification{
+			StreamID:     task.StreamID,
+			Status:       "waiting",
+			TaskID:       task.ID,
+			Title:        task.Name,
+			StreamKey:    task.StreamKey,
+			Protocol:     ProtocolWHIP,
+			Profile:      task.Profile,
+			LowLatency:   task.LowLatency,
+			OutputFormat: task.OutputFormat,
+			DVRWindow:    task.DVRWindow,
+			// Направления те же, что и до перезапуска
+			RestreamTargets: task.RestreamTargets,
+		})
+		if stream, exists := activeStreams[task.StreamID]; exists {
+			restoreSavedInfo(stream, state)
+			saveStreamState()
+		}
+		streamsMux.Unlock()
+
+		if task.Status == "running" {
+			go notifyMainAppStatusChange(task.StreamID, "waiting")
+		}
+		return nil
 	}
 
-	// Создаем SRT адрес
-	srtAddr := fmt.Sprintf("srt://0.0.0.0:%d?mode=listener&streamid=%s&pkt_size=1316", port, task.StreamID)
+	// Тот же порт, что и до перезапуска (уже зарезервирован), иначе новый
+	protocol := normalizeProtocol(task.Protocol)
+	port := 0
+	if state != nil {
+		port = state.Info.Port
+	}
+	if port == 0 {
+		var err error
+		port, err = acquireIngestPort(protocol)
+		if err != nil {
+			return fmt.Errorf("failed to acquire port: %v", err)
+		}
+	}
+
+	// Создаем адрес listener (SRT или RTMP)
+	inputAddr := buildIngestAddr(protocol, port, task.StreamID, task.StreamKey)
+	outputFormat, lowLatency := resolveOutputFormat(task.StreamID, task.OutputFormat, task.LowLatency)
 
 	// Создаем информацию о стриме
 	streamInfo := &StreamInfo{
-		StreamID: task.StreamID,
-		Status:   "waiting", // Начинаем с waiting, ffmpeg изменит на running при подключении
-		Port:     port,
-		SRTAddr:  srtAddr,
-		HLSPath:  "/hls/" + task.StreamID + "/stream.m3u8",
+		StreamID:     task.StreamID,
+		Status:       "waiting", // Начинаем с waiting, ffmpeg изменит на running при подключении
+		Port:         port,
+		Protocol:     protocol,
+		Profile:      normalizeProfile(task.Profile),
+		LowLatency:   lowLatency,
+		OutputFormat: outputFormat,
+		DASHPath:     dashPath(task.StreamID, outputFormat),
+		DVRWindow:    task.DVRWindow,
+		DVRPath:      dvrPath(task.StreamID, task.DVRWindow),
+		IngestURL:    publicIngestURL(protocol, port, task.StreamID),
+		HLSPath:      "/hls/" + task.StreamID + "/" + masterPlaylistName,
+		StartTime:    time.Now(),
+		Title:        task.Name,
+		StreamKey:    task.StreamKey,
+		// Направления restream продолжают работу после перезапуска
+		RestreamTargets: task.RestreamTargets,
 	}
+	setListenerAddr(streamInfo, inputAddr)
+	restoreSavedInfo(streamInfo, state)
 
 	// Добавляем в активные стримы
 	streamsMux.Lock()
 	activeStreams[task.StreamID] = streamInfo
+	saveStreamState()
+	startHLSUploader(task.StreamID)
+	startRestreams(task.StreamID)
 	streamsMux.Unlock()
 
 	// Запускаем ffmpeg процесс
-	if err := startFFmpegProcess(task.StreamID, srtAddr); err != nil {
+	opts := StreamOptions{
+		Protocol:     protocol,
+		InputAddr:    inputAddr,
+		StreamKey:    task.StreamKey,
+		Profile:      task.Profile,
+		LowLatency:   lowLatency,
+		OutputFormat: outputFormat,
+	}
+	if err := startFFmpegProcess(task.StreamID, opts); err != nil {
 		// Если не удалось запустить ffmpeg, очищаем ресурсы
 		streamsMux.Lock()
 		delete(activeStreams, task.StreamID)
+		saveStreamState()
 		streamsMux.Unlock()
+		stopHLSUploader(task.StreamID)
+		stopRestreams(task.StreamID)
 		releasePort(port)
+		emitStreamEvent(task.StreamID, kafka.EventError, fmt.Sprintf("recovery failed: %v", err))
 		return fmt.Errorf("failed to start ffmpeg: %v", err)
 	}
 
-	// Если задача была в статусе running, но SRT не подключен,
+	emitStreamEvent(task.StreamID, kafka.EventWaiting, fmt.Sprintf("recovered %s listener on port %d", protocol, port))
+
+	// Если задача была в статусе running, но publisher не подключен,
 	// переводим в waiting и уведомляем main-app
 	if task.Status == "running" {
 		go notifyMainAppStatusChange(task.StreamID, "waiting")
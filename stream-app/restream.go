@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Restream: каждое внешнее направление обслуживает отдельный ffmpeg, который читает
+// локальный HLS вывод стрима (лучший вариант, без перекодирования). Падение или
+// недоступность одного направления не влияет ни на стрим, ни на другие направления
+const (
+	restreamRetryMin = 2 * time.Second
+	restreamRetryMax = time.Minute
+	// Процесс, проработавший дольше, считается стабильным: пауза сбрасывается
+	restreamStableAfter = 30 * time.Second
+	// Как часто проверять, появился ли master.m3u8
+	restreamInputPoll = 2 * time.Second
+)
+
+// Состояния направления
+const (
+	RestreamWaiting      = "waiting"      // HLS вывод стрима еще не готов
+	RestreamConnecting   = "connecting"   // ffmpeg запущен, данные еще не ушли
+	RestreamLive         = "live"         // данные идут в направление
+	RestreamReconnecting = "reconnecting" // ffmpeg завершился, ждем паузу до перезапуска
+	RestreamStopped      = "stopped"
+)
+
+// RestreamTarget внешнее RTMP/SRT направление от main-app
+type RestreamTarget struct {
+	ID        int    `json:"id"`
+	Name      string `json:"name"`
+	URL       string `json:"url"`
+	StreamKey string `json:"stream_key,omitempty"`
+}
+
+// RestreamStatus состояние направления для /stream/status (без ключа)
+type RestreamStatus struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	URL       string    `json:"url"`
+	State     string    `json:"state"`
+	Restarts  int       `json:"restarts"`
+	LastError string    `json:"last_error,omitempty"`
+	Since     time.Time `json:"since"`
+}
+
+var (
+	restreams    = make(map[string]*restreamGroup)
+	restreamsMux sync.Mutex
+)
+
+type restreamGroup struct {
+	stop    chan struct{}
+	workers []*restreamWorker
+}
+
+type restreamWorker struct {
+	streamID string
+	target   RestreamTarget
+
+	mu     sync.Mutex
+	status RestreamStatus
+}
+
+// Запуск ретрансляции на все направления стрима. Вызывается под streamsMux
+func startRestreams(streamID string) {
+	stream, exists := activeStreams[streamID]
+	if !exists || len(stream.RestreamTargets) == 0 {
+		return
+	}
+
+	restreamsMux.Lock()
+	defer restreamsMux.Unlock()
+
+	if _, running := restreams[streamID]; running {
+		return
+	}
+
+	group := &restreamGroup{stop: make(chan struct{})}
+	for _, target := range stream.RestreamTargets {
+		w := &restreamWorker{
+			streamID: streamID,
+			target:   target,
+			status: RestreamStatus{
+				ID:    target.ID,
+				Name:  target.Name,
+				URL:   target.URL,
+				State: RestreamWaiting,
+				Since: time.Now(),
+			},
+		}
+		group.workers = append(group.workers, w)
+		go w.run(group.stop)
+	}
+	restreams[streamID] = group
+
+	log.Printf("📡 Restream started for stream %s (%d targets)", streamID, len(group.workers))
+}
+
+// Остановка всех направлений стрима; ffmpeg процессы завершаются в своих горутинах
+func stopRestreams(streamID string) {
+	restreamsMux.Lock()
+	group, exists := restreams[streamID]
+	delete(restreams, streamID)
+	restreamsMux.Unlock()
+
+	if exists {
+		close(group.stop)
+	}
+}
+
+// Снимок состояния направлений стрима для API
+func restreamStatuses(streamID string) []RestreamStatus {
+	restreamsMux.Lock()
+	group, exists := restreams[streamID]
+	restreamsMux.Unlock()
+	if !exists {
+		return nil
+	}
+
+	statuses := make([]RestreamStatus, 0, len(group.workers))
+	for _, w := range group.workers {
+		w.mu.Lock()
+		statuses = append(statuses, w.status)
+		w.mu.Unlock()
+	}
+	return statuses
+}
+
+func (w *restreamWorker) setState(state, lastError string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.status.State != state {
+		w.status.State = state
+		w.status.Since = time.Now()
+	}
+	if lastError != "" {
+		w.status.LastError = lastError
+	}
+}
+
+// Цикл направления: ffmpeg перезапускается с экспоненциальной паузой
+func (w *restreamWorker) run(stop <-chan struct{}) {
+	backoff := restreamRetryMin
+
+	for {
+		inputs, err := restreamInputs(w.streamID)
+		if err != nil {
+			w.setState(RestreamWaiting, "")
+			if !sleepOrStop(stop, restreamInputPoll) {
+				w.setState(RestreamStopped, "")
+				return
+			}
+			continue
+		}
+
+		started := time.Now()
+		err = w.runFFmpeg(inputs, stop)
+
+		select {
+		case <-stop:
+			w.setState(RestreamStopped, "")
+			log.Printf("📡 Restream to %s (%s) stopped for stream %s", w.target.Name, w.target.URL, w.streamID)
+			return
+		default:
+		}
+
+		if time.Since(started) > restreamStableAfter {
+			backoff = restreamRetryMin
+		}
+
+		w.mu.Lock()
+		w.status.Restarts++
+		w.mu.Unlock()
+		w.setState(RestreamReconnecting, err.Error())
+		log.Printf("⚠️ Restream to %s (%s) for stream %s failed, reconnecting in %s: %v",
+			w.target.Name, w.target.URL, w.streamID, backoff, err)
+
+		if !sleepOrStop(stop, backoff) {
+			w.setState(RestreamStopped, "")
+			return
+		}
+		backoff = min(backoff*2, restreamRetryMax)
+	}
+}
+
+// Один запуск ffmpeg; возвращает причину завершения
+func (w *restreamWorker) runFFmpeg(inputs []string, stop <-chan struct{}) error {
+	output, format := restreamOutput(w.target)
+
+	args := []string{"-hide_banner", "-loglevel", "error", "-progress", "pipe:1", "-nostats"}
+	for _, input := range inputs {
+		// Начинаем с живого края, а не с начала окна плейлиста
+		args = append(args, "-live_start_index", "-1", "-i", input)
+	}
+	if len(inputs) > 1 {
+		args = append(args, "-map", "0:v:0", "-map", "1:a:0")
+	} else {
+		args = append(args, "-map", "0:v:0", "-map", "0:a:0?")
+	}
+	args = append(args, "-c", "copy", "-f", format, output)
+
+	cmd := exec.Command("ffmpeg", args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("failed to create stdout pipe: %v", err)
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return fmt.Errorf("failed to create stderr pipe: %v", err)
+	}
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start ffmpeg: %v", err)
+	}
+	w.setState(RestreamConnecting, "")
+
+	var lastLine string
+	var readers sync.WaitGroup
+	readers.Add(2)
+	go func() {
+		defer readers.Done()
+		lastLine = w.readLogs(stderr)
+	}()
+	go func() {
+		defer readers.Done()
+		w.readProgress(stdout)
+	}()
+
+	done := make(chan error, 1)
+	go func() {
+		readers.Wait()
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err = <-done:
+	case <-stop:
+		cmd.Process.Kill()
+		<-done
+		return nil
+	}
+
+	if err == nil {
+		err = errors.New("ffmpeg exited")
+	}
+	if lastLine != "" {
+		return fmt.Errorf("%v: %s", err, lastLine)
+	}
+	return err
+}
+
+// Ошибки ffmpeg в лог; возвращает последнюю строку для last_error
+func (w *restreamWorker) readLogs(stderr io.Reader) string {
+	var lastLine string
+	scanner := bufio.NewScanner(stderr)
+	for scanner.Scan() {
+		// В адресе направления может быть ключ
+		line := redactStreamKey(strings.TrimSpace(scanner.Text()), w.target.StreamKey)
+		if line == "" {
+			continue
+		}
+		log.Printf("FFmpeg restream [%s -> %s]: %s", w.streamID, w.target.Name, line)
+		lastLine = line
+	}
+	return lastLine
+}
+
+// Первый растущий out_time означает, что данные уходят в направление
+func (w *restreamWorker) readProgress(stdout io.Reader) {
+	live := false
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if !ok || live || key != "out_time_us" || parseProgressInt(value) <= 0 {
+			continue
+		}
+		live = true
+		w.setState(RestreamLive, "")
+		log.Printf("📡 Restream to %s (%s) is live for stream %s", w.target.Name, w.target.URL, w.streamID)
+	}
+}
+
+// Локальные плейлисты лучшего варианта (и отдельного аудио для CMAF)
+func restreamInputs(streamID string) ([]string, error) {
+	hlsDir := filepath.Join("hls", streamID)
+	master, err := os.ReadFile(filepath.Join(hlsDir, masterPlaylistName))
+	if err != nil {
+		return nil, err
+	}
+
+	videoURI, audioURI := bestRenditions(master)
+	if videoURI == "" {
+		return nil, fmt.Errorf("no variants in master playlist")
+	}
+
+	var inputs []string
+	for _, uri := range []string{videoURI, audioURI} {
+		if uri == "" {
+			continue
+		}
+		playlist := filepath.Join(hlsDir, filepath.FromSlash(uri))
+		if _, err := os.Stat(playlist); err != nil {
+			return nil, err
+		}
+		inputs = append(inputs, playlist)
+	}
+	return inputs, nil
+}
+
+// Адрес и формат вывода: RTMP(S) - FLV с ключом в конце пути, SRT - MPEG-TS с ключом в streamid
+func restreamOutput(target RestreamTarget) (string, string) {
+	if strings.HasPrefix(target.URL, "srt://") {
+		u, err := url.Parse(target.URL)
+		if err != nil || target.StreamKey == "" {
+			return target.URL, "mpegts"
+		}
+		query := u.Query()
+		if query.Get("streamid") == "" {
+			query.Set("streamid", target.StreamKey)
+		}
+		u.RawQuery = query.Encode()
+		return u.String(), "mpegts"
+	}
+
+	if target.StreamKey == "" {
+		return target.URL, "flv"
+	}
+	return strings.TrimRight(target.URL, "/") + "/" + target.StreamKey, "flv"
+}
+
+// Пауза, прерываемая остановкой; false - пришла остановка
+func sleepOrStop(stop <-chan struct{}, d time.Duration) bool {
+	select {
+	case <-stop:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
@@ -0,0 +1,566 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os/exec"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// Самопроверка цепочки SRT/RTMP → HLS → MinIO → Kafka → VOD без энкодера:
+// ffmpeg публикует тестовую картинку с тоном в обычный listener стрима,
+// стрим останавливается через handleStopStatus, каждый этап получает passed/failed
+const (
+	selfCheckPrefix          = "selfcheck-"
+	defaultSelfCheckDuration = 20 * time.Second
+	minSelfCheckDuration     = 10 * time.Second
+	maxSelfCheckDuration     = 5 * time.Minute
+	selfCheckPollInterval    = 500 * time.Millisecond
+	selfCheckStageTimeout    = 30 * time.Second
+	// Сколько последних отчетов хранить в памяти
+	selfCheckHistory = 20
+)
+
+var (
+	vodServiceURL   = getEnv("VOD_SERVICE_URL", "http://vod-service:8081")
+	selfCheckVODTTL = loadTimeout("SELFCHECK_VOD_TIMEOUT", 3*time.Minute)
+
+	selfChecks    = make(map[string]*selfCheckReport)
+	selfChecksMux sync.Mutex
+)
+
+// Этапы в порядке прохождения
+const (
+	stageSource = "source" // ffmpeg с тестовым сигналом запущен
+	stageIngest = "ingest" // listener принял publisher
+	stageHLS    = "hls"    // локально появились медиа сегменты
+	stageMinIO  = "minio"  // плейлист и сегменты загружены в MinIO
+	stageKafka  = "kafka"  // recording task подтвержден Kafka
+	stageVOD    = "vod"    // recording-service собрал запись, vod-service отдает ready
+)
+
+type selfCheckStage struct {
+	Name       string `json:"name"`
+	Status     string `json:"status"` // pending, running, passed, failed, skipped
+	Message    string `json:"message,omitempty"`
+	DurationMs int64  `json:"duration_ms,omitempty"`
+	started    time.Time
+}
+
+type selfCheckReport struct {
+	ID         string            `json:"id"`
+	StreamID   string            `json:"stream_id"`
+	Protocol   string            `json:"protocol"`
+	Profile    string            `json:"profile"`
+	Duration   int               `json:"duration_seconds"`
+	Status     string            `json:"status"` // running, passed, failed
+	Started    time.Time         `json:"started"`
+	Finished   *time.Time        `json:"finished,omitempty"`
+	Stages     []*selfCheckStage `json:"stages"`
+	stageIndex map[string]*selfCheckStage
+}
+
+func isSelfCheckStream(streamID string) bool {
+	return strings.HasPrefix(streamID, selfCheckPrefix)
+}
+
+// POST /admin/selfcheck?duration=20s&protocol=srt|rtmp&profile=... - запуск
+// GET /admin/selfcheck - последние отчеты, GET /admin/selfcheck/{id} - один отчет
+func selfCheckHandler(w http.ResponseWriter, r *http.Request) {
+	if !isServiceRequest(r) {
+		http.Error(w, "Service API key required", http.StatusUnauthorized)
+		return
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/selfcheck"), "/")
+	switch {
+	case id == "" && r.Method == http.MethodPost:
+		startSelfCheckHandler(w, r)
+	case id == "" && r.Method == http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(listSelfChecks())
+	case id != "" && r.Method == http.MethodGet:
+		report := getSelfCheck(id)
+		if report == nil {
+			http.Error(w, "Self-check not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func startSelfCheckHandler(w http.ResponseWriter, r *http.Request) {
+	if shuttingDown.Load() {
+		http.Error(w, "Stream-app is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	query := r.URL.Query()
+	duration := defaultSelfCheckDuration
+	if value := query.Get("duration"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < minSelfCheckDuration || d > maxSelfCheckDuration {
+			http.Error(w, fmt.Sprintf("duration must be between %s and %s", minSelfCheckDuration, maxSelfCheckDuration), http.StatusBadRequest)
+			return
+		}
+		duration = d
+	}
+
+	protocol := strings.ToLower(query.Get("protocol"))
+	if protocol == "" {
+		protocol = ProtocolSRT
+	}
+	if protocol != ProtocolSRT && protocol != ProtocolRTMP {
+		http.Error(w, "protocol must be srt or rtmp", http.StatusBadRequest)
+		return
+	}
+
+	report, err := newSelfCheck(protocol, normalizeProfile(query.Get("profile")), duration)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	go runSelfCheck(report, duration)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(report.snapshot())
+}
+
+// Новый отчет; одновременно идет только одна самопроверка
+func newSelfCheck(protocol, profile string, duration time.Duration) (*selfCheckReport, error) {
+	selfChecksMux.Lock()
+	defer selfChecksMux.Unlock()
+
+	for _, report := range selfChecks {
+		if report.Status == "running" {
+			return nil, fmt.Errorf("self-check %s is already running", report.ID)
+		}
+	}
+
+	id := newEventID()
+	report := &selfCheckReport{
+		ID:         id,
+		StreamID:   selfCheckPrefix + id,
+		Protocol:   protocol,
+		Profile:    profile,
+		Duration:   int(duration.Seconds()),
+		Status:     "running",
+		Started:    time.Now(),
+		stageIndex: make(map[string]*selfCheckStage),
+	}
+	for _, name := range []string{stageSource, stageIngest, stageHLS, stageMinIO, stageKafka, stageVOD} {
+		stage := &selfCheckStage{Name: name, Status: "pending"}
+		report.Stages = append(report.Stages, stage)
+		report.stageIndex[name] = stage
+	}
+
+	// Старые отчеты вытесняются
+	if len(selfChecks) >= selfCheckHistory {
+		oldest := ""
+		for reportID, r := range selfChecks {
+			if oldest == "" || r.Started.Before(selfChecks[oldest].Started) {
+				oldest = reportID
+			}
+		}
+		delete(selfChecks, oldest)
+	}
+	selfChecks[id] = report
+	return report, nil
+}
+
+func runSelfCheck(report *selfCheckReport, duration time.Duration) {
+	streamID := report.StreamID
+	streamKey := newEventID() + newEventID()
+	started := time.Now()
+	log.Printf("🧪 Self-check %s started: stream %s via %s for %s", report.ID, streamID, report.Protocol, duration)
+
+	// Обычный запуск стрима, как по уведомлению main-app
+	streamsMux.Lock()
+	startErr := handleWaitingStatus(StreamNotification{
+		StreamID:  streamID,
+		Status:    "waiting",
+		Title:     "Pipeline self-check",
+		StreamKey: streamKey,
+		Protocol:  report.Protocol,
+		Profile:   report.Profile,
+	})
+	stream, exists := activeStreams[streamID]
+	port := 0
+	if exists {
+		port = stream.Port
+	}
+	streamsMux.Unlock()
+
+	if startErr != nil || !exists {
+		report.fail(stageSource, fmt.Sprintf("failed to start stream listener: %v", startErr))
+		report.finish()
+		return
+	}
+
+	// Listener ffmpeg запускается асинхронно
+	time.Sleep(2 * time.Second)
+
+	report.begin(stageSource)
+	publisher, stderr, err := startTestPublisher(report.Protocol, port, streamID, streamKey, duration)
+	if err != nil {
+		report.fail(stageSource, err.Error())
+		stopSelfCheckStream(streamID, started, false)
+		report.finish()
+		return
+	}
+	publisherDone := make(chan error, 1)
+	go func() { publisherDone <- publisher.Wait() }()
+	report.pass(stageSource, "testsrc2 1280x720@30 with 1 kHz tone")
+
+	// Этапы эфира: publisher работает, пока они проверяются
+	var publisherErr error
+	publisherExited := false
+	publisherAlive := func() error {
+		if publisherExited {
+			return publisherErr
+		}
+		select {
+		case err := <-publisherDone:
+			publisherExited = true
+			if err != nil {
+				publisherErr = fmt.Errorf("test publisher exited: %v: %s", err, lastLine(stderr.String()))
+			}
+			return publisherErr
+		default:
+		}
+		return nil
+	}
+
+	liveOK := report.check(stageIngest, selfCheckStageTimeout, func() (bool, error) {
+		if err := publisherAlive(); err != nil {
+			return false, err
+		}
+		processesMux.Lock()
+		defer processesMux.Unlock()
+		proc, exists := processes[streamID]
+		return exists && proc.EverConnected, nil
+	}, "publisher connected") &&
+		report.check(stageHLS, selfCheckStageTimeout, func() (bool, error) {
+			return segmentsProducedSince(streamID, started), nil
+		}, "media segments written") &&
+		report.check(stageMinIO, selfCheckStageTimeout, func() (bool, error) {
+			return minIOHasStream(streamID)
+		}, "master playlist and segments uploaded")
+
+	// Дожидаемся конца тестового сигнала (или прерываем его при ошибке)
+	if !publisherExited {
+		if !liveOK {
+			publisher.Process.Kill()
+		}
+		select {
+		case <-publisherDone:
+		case <-time.After(duration + selfCheckStageTimeout):
+			publisher.Process.Kill()
+			<-publisherDone
+		}
+	}
+
+	// Подтверждение ждем именно для задачи этой остановки
+	var acked <-chan struct{}
+	if liveOK && outbox != nil {
+		acked = outbox.watchAck(streamID)
+	}
+	stopSelfCheckStream(streamID, started, liveOK)
+	if !liveOK {
+		report.finish()
+		return
+	}
+
+	// Остановка прошла обычным путем: recording task в outbox → Kafka → recording-service
+	if report.check(stageKafka, selfCheckStageTimeout, func() (bool, error) {
+		if acked == nil {
+			return false, fmt.Errorf("recording outbox is not available")
+		}
+		select {
+		case <-acked:
+			return true, nil
+		default:
+			return false, nil
+		}
+	}, "recording task acknowledged") {
+		report.check(stageVOD, selfCheckVODTTL, func() (bool, error) {
+			return vodRecordingReady(streamID)
+		}, "recording is ready in vod-service")
+	}
+	report.finish()
+	cleanupSelfCheck(streamID)
+}
+
+// Самопроверка не оставляет следов в каталоге VOD и хранилище: запись vod-service,
+// файлы VOD и HLS в MinIO, локальная папка HLS
+func cleanupSelfCheck(streamID string) {
+	if err := deleteVODRecording(streamID); err != nil {
+		log.Printf("⚠️ Failed to delete self-check recording %s: %v", streamID, err)
+	}
+	removeMinIOPrefix(vodBucket, "vod/"+streamID+"/")
+	cleanupStreamFromMinIO(streamID)
+
+	// Незагруженные сегменты догрузил бы журнал, снова создав файлы в MinIO
+	for _, relPath := range journal.pendingFor(streamID) {
+		journal.done(streamID, relPath)
+	}
+	if err := cleanupLocalHLSFolder(streamID); err != nil {
+		log.Printf("⚠️ %v", err)
+	}
+	log.Printf("🧹 Self-check stream %s cleaned up", streamID)
+}
+
+// Удаление записи через DELETE vod-service (404 - запись не создана)
+func deleteVODRecording(streamID string) error {
+	req, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("%s/api/v1/recordings/%s", vodServiceURL, streamID), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-API-Key", serviceAPIKey)
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("vod-service returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Тестовый publisher: testsrc2 + синус, кодирование как у типичного OBS
+func startTestPublisher(protocol string, port int, streamID, streamKey string, duration time.Duration) (*exec.Cmd, *bytes.Buffer, error) {
+	args := []string{
+		"-hide_banner",
+		"-loglevel", "error",
+		"-re",
+		"-f", "lavfi", "-i", "testsrc2=size=1280x720:rate=30",
+		"-f", "lavfi", "-i", "sine=frequency=1000:sample_rate=48000",
+		"-t", strconv.Itoa(int(duration.Seconds())),
+		"-c:v", "libx264", "-preset", "veryfast", "-tune", "zerolatency",
+		"-pix_fmt", "yuv420p", "-g", "60", "-b:v", "2500k",
+		"-c:a", "aac", "-b:a", "128k", "-ar", "48000",
+	}
+	if protocol == ProtocolRTMP {
+		args = append(args, "-f", "flv", fmt.Sprintf("rtmp://127.0.0.1:%d/live/%s", port, streamKey))
+	} else {
+		// За gateway проверяем и его: подключение по streamid к общему порту
+		if srtGatewayEnabled() {
+			port = srtGatewayPort
+		}
+		args = append(args, "-f", "mpegts", fmt.Sprintf(
+			"srt://127.0.0.1:%d?mode=caller&streamid=%s&pkt_size=1316&passphrase=%s&pbkeylen=%s",
+			port, streamID, streamKey, srtKeyLength))
+	}
+
+	cmd := exec.Command("ffmpeg", args...)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	if err := cmd.Start(); err != nil {
+		return nil, nil, fmt.Errorf("failed to start test publisher: %v", err)
+	}
+	return cmd, stderr, nil
+}
+
+// Стрим с сегментами останавливается обычным путем (с recording task), без - без записи
+func stopSelfCheckStream(streamID string, started time.Time, producedMedia bool) {
+	streamsMux.Lock()
+	defer streamsMux.Unlock()
+
+	if producedMedia || segmentsProducedSince(streamID, started) {
+		handleStopStatus(streamID)
+		return
+	}
+	stopStream(streamID, false, "self_check_failed")
+}
+
+// Плейлист и хотя бы один медиа сегмент стрима в MinIO
+func minIOHasStream(streamID string) (bool, error) {
+	if minioClient == nil {
+		return false, fmt.Errorf("MinIO client not initialized")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	hasPlaylist, hasSegment := false, false
+	for object := range minioClient.ListObjects(ctx, minioBucket, minio.ListObjectsOptions{Prefix: streamID + "/", Recursive: true}) {
+		if object.Err != nil {
+			return false, nil
+		}
+		name := path.Base(object.Key)
+		if name == masterPlaylistName {
+			hasPlaylist = true
+		} else if isMediaSegment(name) {
+			hasSegment = true
+		}
+		if hasPlaylist && hasSegment {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Статус записи в vod-service: ready - готово, failed - ошибка сборки
+func vodRecordingReady(streamID string) (bool, error) {
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(fmt.Sprintf("%s/api/v1/recordings/%s", vodServiceURL, streamID))
+	if err != nil {
+		return false, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if resp.StatusCode >= 400 {
+		return false, fmt.Errorf("vod-service returned status %d", resp.StatusCode)
+	}
+
+	var recording struct {
+		Status string `json:"status"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&recording); err != nil {
+		return false, fmt.Errorf("failed to decode vod-service response: %v", err)
+	}
+	if recording.Status == "failed" {
+		return false, fmt.Errorf("recording-service marked the recording as failed")
+	}
+	return recording.Status == "ready", nil
+}
+
+// Ожидание этапа: check возвращает true - этап пройден, ошибку - этап провален сразу
+func (report *selfCheckReport) check(name string, timeout time.Duration, check func() (bool, error), message string) bool {
+	report.begin(name)
+	deadline := time.Now().Add(timeout)
+	for {
+		ok, err := check()
+		if err != nil {
+			report.fail(name, err.Error())
+			return false
+		}
+		if ok {
+			report.pass(name, message)
+			return true
+		}
+		if time.Now().After(deadline) {
+			report.fail(name, fmt.Sprintf("not completed within %s", timeout))
+			return false
+		}
+		time.Sleep(selfCheckPollInterval)
+	}
+}
+
+func (report *selfCheckReport) begin(name string) {
+	selfChecksMux.Lock()
+	defer selfChecksMux.Unlock()
+	stage := report.stageIndex[name]
+	stage.Status = "running"
+	stage.started = time.Now()
+}
+
+func (report *selfCheckReport) pass(name, message string) {
+	report.complete(name, "passed", message)
+}
+
+func (report *selfCheckReport) fail(name, message string) {
+	log.Printf("🧪 Self-check %s: stage %s failed: %s", report.ID, name, message)
+	report.complete(name, "failed", message)
+}
+
+func (report *selfCheckReport) complete(name, status, message string) {
+	selfChecksMux.Lock()
+	defer selfChecksMux.Unlock()
+	stage := report.stageIndex[name]
+	if stage.Status == "running" {
+		stage.DurationMs = time.Since(stage.started).Milliseconds()
+	}
+	stage.Status = status
+	stage.Message = message
+}
+
+// Итог: failed, если хоть один этап провален; непройденные этапы - skipped
+func (report *selfCheckReport) finish() {
+	selfChecksMux.Lock()
+	defer selfChecksMux.Unlock()
+
+	report.Status = "passed"
+	for _, stage := range report.Stages {
+		switch stage.Status {
+		case "failed":
+			report.Status = "failed"
+		case "pending", "running":
+			stage.Status = "skipped"
+		}
+	}
+	now := time.Now()
+	report.Finished = &now
+	log.Printf("🧪 Self-check %s finished: %s (%s)", report.ID, report.Status, now.Sub(report.Started).Round(time.Second))
+}
+
+// Копия для JSON ответа (отчет меняется горутиной самопроверки)
+func (report *selfCheckReport) snapshot() selfCheckReport {
+	selfChecksMux.Lock()
+	defer selfChecksMux.Unlock()
+	return report.copyLocked()
+}
+
+func (report *selfCheckReport) copyLocked() selfCheckReport {
+	copied := *report
+	copied.stageIndex = nil
+	copied.Stages = make([]*selfCheckStage, len(report.Stages))
+	for i, stage := range report.Stages {
+		s := *stage
+		if s.Status == "running" {
+			s.DurationMs = time.Since(s.started).Milliseconds()
+		}
+		copied.Stages[i] = &s
+	}
+	return copied
+}
+
+func getSelfCheck(id string) *selfCheckReport {
+	selfChecksMux.Lock()
+	defer selfChecksMux.Unlock()
+	report, exists := selfChecks[id]
+	if !exists {
+		return nil
+	}
+	copied := report.copyLocked()
+	return &copied
+}
+
+// Отчеты, новые первыми
+func listSelfChecks() []selfCheckReport {
+	selfChecksMux.Lock()
+	defer selfChecksMux.Unlock()
+
+	reports := make([]selfCheckReport, 0, len(selfChecks))
+	for _, report := range selfChecks {
+		reports = append(reports, report.copyLocked())
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Started.After(reports[j].Started) })
+	return reports
+}
+
+func lastLine(text string) string {
+	lines := strings.Split(strings.TrimSpace(text), "\n")
+	return lines[len(lines)-1]
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Остановка stream-app по SIGTERM: новые стримы не принимаются, ffmpeg дописывает
+// текущий сегмент (SIGINT), uploader догружает файлы, затем стримы либо остаются
+// в файле состояния для восстановления (handoff), либо завершаются с записью в VOD (finalize)
+const (
+	defaultShutdownTimeout = 30 * time.Second
+	shutdownPollInterval   = 100 * time.Millisecond
+
+	shutdownModeHandoff  = "handoff"
+	shutdownModeFinalize = "finalize"
+
+	// Причина остановки при finalize, передается main-app
+	stopReasonShutdown = "shutdown"
+)
+
+var (
+	shutdownTimeout = loadTimeout("SHUTDOWN_TIMEOUT", defaultShutdownTimeout)
+	shutdownMode    = loadShutdownMode()
+
+	// Выставляется первым шагом остановки: новые стримы и WHIP сессии отклоняются
+	shuttingDown atomic.Bool
+)
+
+func loadShutdownMode() string {
+	mode := getEnv("SHUTDOWN_MODE", shutdownModeHandoff)
+	if mode != shutdownModeHandoff && mode != shutdownModeFinalize {
+		log.Printf("⚠️ Invalid SHUTDOWN_MODE %q, using %s", mode, shutdownModeHandoff)
+		return shutdownModeHandoff
+	}
+	return mode
+}
+
+func shutdown() {
+	if shuttingDown.Swap(true) {
+		return
+	}
+	deadline := time.Now().Add(shutdownTimeout)
+	log.Printf("🛑 Shutting down stream-app (mode: %s, timeout: %s)...", shutdownMode, shutdownTimeout)
+
+	// main-app не должен размещать стримы на этом узле
+	if err := sendNodeHeartbeat(); err != nil {
+		log.Printf("⚠️ Failed to report draining node: %v", err)
+	}
+
+	// ffmpeg получает половину времени, остальное - загрузка и уведомления
+	stopFFmpegGracefully(time.Now().Add(shutdownTimeout / 2))
+
+	// Uploader'ы завершаются финальной загрузкой (uploadAllHLSFiles)
+	streamsMux.Lock()
+	streamIDs := make([]string, 0, len(activeStreams))
+	var uploads []<-chan struct{}
+	for streamID := range activeStreams {
+		streamIDs = append(streamIDs, streamID)
+		stopRestreams(streamID)
+		uploads = append(uploads, stopHLSUploader(streamID))
+	}
+	streamsMux.Unlock()
+
+	for _, done := range uploads {
+		select {
+		case <-done:
+		case <-time.After(time.Until(deadline)):
+			log.Println("⚠️ Shutdown deadline reached before final HLS upload finished")
+		}
+	}
+
+	if shutdownMode == shutdownModeFinalize {
+		finalizeStreams(streamIDs)
+	} else if len(streamIDs) > 0 {
+		// Файл состояния не трогаем: после перезапуска стримы восстановятся
+		log.Printf("📂 %d streams handed off for recovery after restart", len(streamIDs))
+	}
+
+	// Неотправленные задачи записи и события остаются на диске до следующего запуска
+	waitUntil(deadline, func() bool {
+		pending, _ := outbox.counts()
+		return pending == 0 && streamEvents.count() == 0
+	})
+	if pending, _ := outbox.counts(); pending > 0 {
+		log.Printf("📮 %d recording tasks stay in outbox until next start", pending)
+	}
+	// Горутина отправки может висеть в попытке Kafka: события записываются здесь
+	streamEvents.persistNew()
+	if pending := streamEvents.count(); pending > 0 {
+		log.Printf("📣 %d stream events stay on disk until next start", pending)
+	}
+
+	if kafkaProducer != nil {
+		kafkaProducer.Close()
+	}
+	log.Println("✅ Stream-app stopped")
+	os.Exit(0)
+}
+
+// SIGINT: ffmpeg закрывает текущий сегмент и дописывает плейлист; после срока - kill
+func stopFFmpegGracefully(deadline time.Time) {
+	interrupted := make(map[*exec.Cmd]bool)
+	interrupt := func() bool {
+		processesMux.Lock()
+		defer processesMux.Unlock()
+
+		running := false
+		for streamID, proc := range processes {
+			if proc.Cmd == nil || proc.Cmd.Process == nil {
+				continue
+			}
+			running = true
+			// Повторный SIGINT ffmpeg воспринимает как требование выйти немедленно
+			if interrupted[proc.Cmd] {
+				continue
+			}
+			interrupted[proc.Cmd] = true
+			log.Printf("Interrupting ffmpeg for stream %s", streamID)
+			if err := proc.Cmd.Process.Signal(os.Interrupt); err != nil {
+				log.Printf("⚠️ Failed to interrupt ffmpeg for stream %s: %v", streamID, err)
+			}
+		}
+		return !running
+	}
+	if !waitUntil(deadline, interrupt) {
+		log.Println("⚠️ ffmpeg did not finish in time, killing remaining processes")
+	}
+
+	processesMux.Lock()
+	streamIDs := make([]string, 0, len(processes))
+	for streamID := range processes {
+		streamIDs = append(streamIDs, streamID)
+	}
+	processesMux.Unlock()
+	for _, streamID := range streamIDs {
+		stopFFmpegProcess(streamID)
+	}
+}
+
+// Завершение стримов как при обычной остановке: recording task и stopped в main-app
+func finalizeStreams(streamIDs []string) {
+	streamsMux.Lock()
+	for _, streamID := range streamIDs {
+		stream, exists := activeStreams[streamID]
+		if !exists {
+			continue
+		}
+		stopStream(streamID, segmentsProducedSince(streamID, stream.StartTime), stopReasonShutdown)
+	}
+	streamsMux.Unlock()
+
+	var wg sync.WaitGroup
+	for _, streamID := range streamIDs {
+		wg.Add(1)
+		go func(streamID string) {
+			defer wg.Done()
+			notifyMainAppStatusChangeWithReason(streamID, "stopped", stopReasonShutdown)
+		}(streamID)
+	}
+	wg.Wait()
+}
+
+// Ожидание условия до срока; false - срок истек
+func waitUntil(deadline time.Time, done func() bool) bool {
+	for !done() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(shutdownPollInterval)
+	}
+	return true
+}
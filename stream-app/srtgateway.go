@@ -0,0 +1,564 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SRT gateway: один публичный UDP порт на все SRT стримы узла. Handshake induction
+// gateway отвечает сам, из conclusion берет streamid, проверяет стрим в main-app и
+// дальше пересылает пакеты ffmpeg listener'у стрима на loopback порту.
+// Медиа и шифрование (passphrase) проходят насквозь, их проверяет ffmpeg
+const (
+	srtHeaderSize    = 16
+	srtHandshakeSize = 48 // CIF handshake без расширений
+	srtMaxPacketSize = 1500
+
+	srtCtrlHandshake = 0x0000
+	srtCtrlShutdown  = 0x0005
+
+	srtHSInduction  = 1
+	srtHSConclusion = 0xFFFFFFFF // -1
+	srtMagicCode    = 0x4A17     // listener поддерживает HSv5
+	srtUDTDgram     = 2
+	srtExtSID       = 5 // SRT_CMD_SID
+
+	// URQ_FAILURE_TYPES + SRT_REJX_NOTFOUND: caller получает "stream not found"
+	srtRejectNotFound = 1000 + 1404
+
+	srtGatewayIdleTimeout = 30 * time.Second
+	// Положительная проверка main-app: повторные подключения publisher ее не ждут
+	srtGatewayValidationTTL = 30 * time.Second
+
+	// Порты ffmpeg listener'ов за gateway: наружу не публикуются и
+	// не пересекаются с RTP портами WHIP (20000-20999) и эфемерными портами ОС (32768+)
+	defaultLoopbackPorts = "21000-29999"
+)
+
+// Смещения полей handshake от начала пакета
+const (
+	srtHSVersion    = srtHeaderSize
+	srtHSEncryption = srtHeaderSize + 4
+	srtHSExtension  = srtHeaderSize + 6
+	srtHSType       = srtHeaderSize + 20
+	srtHSSocketID   = srtHeaderSize + 24
+	srtHSCookie     = srtHeaderSize + 28
+)
+
+var (
+	// 0 - gateway выключен, у каждого SRT стрима свой порт из пула
+	srtGatewayPort = loadSRTGatewayPort()
+
+	gateway *srtGateway
+
+	loopbackPortStart, loopbackPortEnd = loadLoopbackPortRange()
+	loopbackPorts                      = make(map[int]bool)
+	loopbackMux                        sync.Mutex
+)
+
+type srtGateway struct {
+	conn     *net.UDPConn
+	secret   []byte
+	socketID uint32
+
+	mu sync.Mutex
+	// Сессии по адресу publisher'а
+	sessions map[string]*srtGatewaySession
+	// Conclusion уже обрабатывается (проверка в main-app, induction к ffmpeg)
+	pending   map[string]bool
+	validated map[string]time.Time
+}
+
+type srtGatewaySession struct {
+	streamID string
+	caller   *net.UDPAddr
+	upstream *net.UDPConn
+	// Cookie ffmpeg listener'а: подставляется в повторные conclusion от caller
+	cookie   uint32
+	lastSeen atomic.Int64
+}
+
+func loadSRTGatewayPort() int {
+	value := os.Getenv("SRT_GATEWAY_PORT")
+	if value == "" {
+		return 0
+	}
+	port, err := strconv.Atoi(value)
+	if err != nil || port < 0 || port > 65535 {
+		log.Printf("⚠️ Invalid SRT_GATEWAY_PORT %q, SRT gateway disabled", value)
+		return 0
+	}
+	return port
+}
+
+func srtGatewayEnabled() bool {
+	return srtGatewayPort != 0
+}
+
+// Запуск gateway; без SRT_GATEWAY_PORT ничего не делает
+func initSRTGateway() error {
+	if !srtGatewayEnabled() {
+		return nil
+	}
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: srtGatewayPort})
+	if err != nil {
+		return fmt.Errorf("failed to listen on SRT gateway port %d: %v", srtGatewayPort, err)
+	}
+
+	gateway, err = newSRTGateway(conn)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	go gateway.run()
+	log.Printf("🔀 SRT gateway listening on udp :%d", srtGatewayPort)
+	return nil
+}
+
+func newSRTGateway(conn *net.UDPConn) (*srtGateway, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("failed to generate SRT gateway secret: %v", err)
+	}
+	return &srtGateway{
+		conn:      conn,
+		secret:    secret,
+		socketID:  binary.BigEndian.Uint32(secret[:4]) | 1,
+		sessions:  make(map[string]*srtGatewaySession),
+		pending:   make(map[string]bool),
+		validated: make(map[string]time.Time),
+	}, nil
+}
+
+func loadLoopbackPortRange() (int, int) {
+	value := getEnv("SRT_GATEWAY_INTERNAL_PORTS", defaultLoopbackPorts)
+	first, last, found := strings.Cut(value, "-")
+	start, err1 := strconv.Atoi(first)
+	end, err2 := strconv.Atoi(last)
+	// Диапазон не должен пересекаться с пулом порта стримов и блоками WHIP (по 4 порта)
+	if !found || err1 != nil || err2 != nil || start < 1 || end > 65535 || start > end ||
+		(start <= portEnd && end >= portStart) ||
+		(start <= whipRTPPortEnd+3 && end >= whipRTPPortStart) {
+		log.Printf("⚠️ Invalid SRT_GATEWAY_INTERNAL_PORTS %q, using %s", value, defaultLoopbackPorts)
+		return 21000, 29999
+	}
+	return start, end
+}
+
+// UDP порт на loopback для ffmpeg listener за gateway. Выданные порты учитываются
+// до releasePort: ffmpeg занимает порт позже, в своей горутине, и при перезапусках.
+// Порт, занятый другим процессом, пропускаем
+func acquireLoopbackPort() (int, error) {
+	loopbackMux.Lock()
+	defer loopbackMux.Unlock()
+	for p := loopbackPortStart; p <= loopbackPortEnd; p++ {
+		if loopbackPorts[p] {
+			continue
+		}
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: p})
+		if err != nil {
+			continue
+		}
+		conn.Close()
+		loopbackPorts[p] = true
+		return p, nil
+	}
+	return 0, errNoFreePorts
+}
+
+// Резервирование сохраненного loopback порта (восстановление после перезапуска)
+func reserveLoopbackPort(port int) bool {
+	loopbackMux.Lock()
+	defer loopbackMux.Unlock()
+	if port < loopbackPortStart || port > loopbackPortEnd || loopbackPorts[port] {
+		return false
+	}
+	loopbackPorts[port] = true
+	return true
+}
+
+func releaseLoopbackPort(port int) {
+	loopbackMux.Lock()
+	defer loopbackMux.Unlock()
+	delete(loopbackPorts, port)
+}
+
+// Порт listener'а стрима: SRT за gateway - loopback, остальные - из пула
+func acquireIngestPort(protocol string) (int, error) {
+	if protocol == ProtocolSRT && srtGatewayEnabled() {
+		return acquireLoopbackPort()
+	}
+	return acquirePort()
+}
+
+func (g *srtGateway) run() {
+	buf := make([]byte, srtMaxPacketSize)
+	for {
+		n, addr, err := g.conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("⚠️ SRT gateway read error: %v", err)
+			continue
+		}
+		g.handlePacket(buf[:n], addr)
+	}
+}
+
+func (g *srtGateway) handlePacket(pkt []byte, addr *net.UDPAddr) {
+	key := addr.String()
+	hsType, isHandshake := srtHandshakeType(pkt)
+
+	g.mu.Lock()
+	session := g.sessions[key]
+	pending := g.pending[key]
+	g.mu.Unlock()
+
+	// Новое подключение с того же адреса заменяет старую сессию
+	if isHandshake && hsType == srtHSInduction {
+		if session != nil {
+			g.closeSession(key, session)
+		}
+		g.conn.WriteToUDP(g.inductionResponse(pkt, addr), addr)
+		return
+	}
+
+	if session != nil {
+		if isHandshake && hsType == srtHSConclusion {
+			rewriteConclusion(pkt, session.cookie)
+		}
+		session.touch()
+		session.upstream.Write(pkt)
+		if isSRTControl(pkt, srtCtrlShutdown) {
+			g.closeSession(key, session)
+		}
+		return
+	}
+
+	// Без сессии принимаем только conclusion с нашим cookie
+	if !isHandshake || hsType != srtHSConclusion || pending {
+		return
+	}
+	if !g.validCookie(addr, binary.BigEndian.Uint32(pkt[srtHSCookie:])) {
+		return
+	}
+
+	g.mu.Lock()
+	g.pending[key] = true
+	g.mu.Unlock()
+	go g.connect(addr, bytes.Clone(pkt))
+}
+
+// Проверка стрима, handshake с ffmpeg listener и создание сессии
+func (g *srtGateway) connect(addr *net.UDPAddr, conclusion []byte) {
+	key := addr.String()
+	defer func() {
+		g.mu.Lock()
+		delete(g.pending, key)
+		g.mu.Unlock()
+	}()
+
+	streamID := parseSRTStreamID(srtStreamIDExtension(conclusion))
+	port, err := g.resolve(streamID)
+	if err != nil {
+		log.Printf("🚫 SRT gateway: rejected %s for stream %q: %v", addr, streamID, err)
+		g.conn.WriteToUDP(rejectResponse(conclusion), addr)
+		return
+	}
+
+	upstream, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+	if err != nil {
+		log.Printf("⚠️ SRT gateway: failed to reach listener of stream %s: %v", streamID, err)
+		return
+	}
+
+	// ffmpeg еще не слушает или перезапускается: caller повторит conclusion
+	cookie, err := upstreamInduction(upstream, conclusion)
+	if err != nil {
+		log.Printf("⚠️ SRT gateway: listener of stream %s did not answer: %v", streamID, err)
+		upstream.Close()
+		return
+	}
+
+	session := &srtGatewaySession{streamID: streamID, caller: addr, upstream: upstream, cookie: cookie}
+	session.touch()
+
+	g.mu.Lock()
+	g.sessions[key] = session
+	g.mu.Unlock()
+
+	go g.relay(key, session)
+	rewriteConclusion(conclusion, cookie)
+	upstream.Write(conclusion)
+	log.Printf("🔀 SRT gateway: %s connected to stream %s", addr, streamID)
+}
+
+// Loopback порт listener'а стрима; для чужих и остановленных стримов - ошибка
+func (g *srtGateway) resolve(streamID string) (int, error) {
+	if streamID == "" {
+		return 0, errors.New("no streamid in handshake")
+	}
+
+	streamsMux.Lock()
+	port := 0
+	if stream, exists := activeStreams[streamID]; exists && stream.Protocol == ProtocolSRT {
+		port = stream.Port
+	}
+	streamsMux.Unlock()
+
+	if port == 0 {
+		return 0, errors.New("stream is not waiting for SRT publisher on this node")
+	}
+	// Self-check стримы в main-app не зарегистрированы
+	if isSelfCheckStream(streamID) {
+		return port, nil
+	}
+
+	g.mu.Lock()
+	until, cached := g.validated[streamID]
+	g.mu.Unlock()
+	if cached && time.Now().Before(until) {
+		return port, nil
+	}
+
+	if err := checkIngestWithMainApp(streamID); err != nil {
+		return 0, err
+	}
+	g.mu.Lock()
+	g.validated[streamID] = time.Now().Add(srtGatewayValidationTTL)
+	g.mu.Unlock()
+	return port, nil
+}
+
+// Ответы ffmpeg -> publisher, пока сессия активна
+func (g *srtGateway) relay(key string, session *srtGatewaySession) {
+	defer g.closeSession(key, session)
+
+	buf := make([]byte, srtMaxPacketSize)
+	for {
+		session.upstream.SetReadDeadline(time.Now().Add(srtGatewayIdleTimeout))
+		n, err := session.upstream.Read(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() &&
+				time.Since(time.Unix(0, session.lastSeen.Load())) < srtGatewayIdleTimeout {
+				continue
+			}
+			// Таймаут простоя, listener закрыт (ffmpeg упал) или сессия закрыта
+			return
+		}
+		session.touch()
+		g.conn.WriteToUDP(buf[:n], session.caller)
+	}
+}
+
+func (g *srtGateway) closeSession(key string, session *srtGatewaySession) {
+	g.mu.Lock()
+	if g.sessions[key] == session {
+		delete(g.sessions, key)
+	}
+	g.mu.Unlock()
+	session.upstream.Close()
+}
+
+// Остановленный стрим: разрываем его сессии и забываем проверку main-app
+func dropSRTGatewayStream(streamID string) {
+	if gateway == nil {
+		return
+	}
+
+	gateway.mu.Lock()
+	delete(gateway.validated, streamID)
+	var closing []*srtGatewaySession
+	for key, session := range gateway.sessions {
+		if session.streamID == streamID {
+			delete(gateway.sessions, key)
+			closing = append(closing, session)
+		}
+	}
+	gateway.mu.Unlock()
+
+	for _, session := range closing {
+		session.upstream.Close()
+	}
+}
+
+// Для /health
+func srtGatewayStatus() map[string]interface{} {
+	if gateway == nil {
+		return nil
+	}
+	gateway.mu.Lock()
+	defer gateway.mu.Unlock()
+	return map[string]interface{}{
+		"port":     srtGatewayPort,
+		"sessions": len(gateway.sessions),
+	}
+}
+
+func (s *srtGatewaySession) touch() {
+	s.lastSeen.Store(time.Now().UnixNano())
+}
+
+// Cookie induction: привязан к адресу publisher и минуте, как в libsrt
+func (g *srtGateway) cookie(addr *net.UDPAddr, minute int64) uint32 {
+	h := sha256.New()
+	h.Write(g.secret)
+	fmt.Fprintf(h, "%s|%d", addr, minute)
+	return binary.BigEndian.Uint32(h.Sum(nil))
+}
+
+// Текущая или предыдущая минута: handshake мог начаться на границе
+func (g *srtGateway) validCookie(addr *net.UDPAddr, cookie uint32) bool {
+	minute := time.Now().Unix() / 60
+	return cookie == g.cookie(addr, minute) || cookie == g.cookie(addr, minute-1)
+}
+
+// Ответ на induction от имени listener'а с поддержкой HSv5
+func (g *srtGateway) inductionResponse(req []byte, addr *net.UDPAddr) []byte {
+	resp := make([]byte, srtHeaderSize+srtHandshakeSize)
+	copy(resp, req)
+	binary.BigEndian.PutUint32(resp[12:], binary.BigEndian.Uint32(req[srtHSSocketID:]))
+	binary.BigEndian.PutUint32(resp[srtHSVersion:], 5)
+	binary.BigEndian.PutUint16(resp[srtHSEncryption:], 0)
+	binary.BigEndian.PutUint16(resp[srtHSExtension:], srtMagicCode)
+	binary.BigEndian.PutUint32(resp[srtHSSocketID:], g.socketID)
+	binary.BigEndian.PutUint32(resp[srtHSCookie:], g.cookie(addr, time.Now().Unix()/60))
+	return resp
+}
+
+// Отказ на conclusion: caller сразу получает ошибку вместо таймаута
+func rejectResponse(conclusion []byte) []byte {
+	resp := make([]byte, srtHeaderSize+srtHandshakeSize)
+	copy(resp, conclusion)
+	binary.BigEndian.PutUint32(resp[12:], binary.BigEndian.Uint32(conclusion[srtHSSocketID:]))
+	binary.BigEndian.PutUint32(resp[srtHSType:], srtRejectNotFound)
+	return resp
+}
+
+// Induction от имени publisher'а к ffmpeg listener; возвращает cookie listener'а
+func upstreamInduction(upstream *net.UDPConn, conclusion []byte) (uint32, error) {
+	req := make([]byte, srtHeaderSize+srtHandshakeSize)
+	copy(req, conclusion)
+	binary.BigEndian.PutUint32(req[12:], 0)
+	binary.BigEndian.PutUint32(req[srtHSVersion:], 4)
+	binary.BigEndian.PutUint16(req[srtHSEncryption:], 0)
+	binary.BigEndian.PutUint16(req[srtHSExtension:], srtUDTDgram)
+	binary.BigEndian.PutUint32(req[srtHSType:], srtHSInduction)
+	binary.BigEndian.PutUint32(req[srtHSCookie:], 0)
+
+	buf := make([]byte, srtMaxPacketSize)
+	for attempt := 0; attempt < 3; attempt++ {
+		if _, err := upstream.Write(req); err != nil {
+			return 0, err
+		}
+		upstream.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		n, err := upstream.Read(buf)
+		if err != nil {
+			continue
+		}
+		if hsType, ok := srtHandshakeType(buf[:n]); ok && hsType == srtHSInduction {
+			return binary.BigEndian.Uint32(buf[srtHSCookie:]), nil
+		}
+	}
+	return 0, errors.New("no induction response")
+}
+
+// Conclusion для ffmpeg: cookie listener'а и нулевой получатель (listener socket)
+func rewriteConclusion(pkt []byte, cookie uint32) {
+	binary.BigEndian.PutUint32(pkt[12:], 0)
+	binary.BigEndian.PutUint32(pkt[srtHSCookie:], cookie)
+}
+
+func isSRTControl(pkt []byte, ctrlType uint16) bool {
+	return len(pkt) >= srtHeaderSize && pkt[0]&0x80 != 0 &&
+		binary.BigEndian.Uint16(pkt[0:])&0x7FFF == ctrlType
+}
+
+// Тип handshake (induction, conclusion, отказ); false - не handshake пакет
+func srtHandshakeType(pkt []byte) (uint32, bool) {
+	if len(pkt) < srtHeaderSize+srtHandshakeSize || !isSRTControl(pkt, srtCtrlHandshake) {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(pkt[srtHSType:]), true
+}
+
+// Расширение SID из conclusion. libsrt пишет строку 32-битными словами
+// в обратном порядке байт
+func srtStreamIDExtension(pkt []byte) string {
+	offset := srtHeaderSize + srtHandshakeSize
+	for offset+4 <= len(pkt) {
+		extType := binary.BigEndian.Uint16(pkt[offset:])
+		size := int(binary.BigEndian.Uint16(pkt[offset+2:])) * 4
+		offset += 4
+		if offset+size > len(pkt) {
+			return ""
+		}
+		if extType == srtExtSID {
+			content := pkt[offset : offset+size]
+			sid := make([]byte, 0, size)
+			for i := 0; i+4 <= len(content); i += 4 {
+				sid = append(sid, content[i+3], content[i+2], content[i+1], content[i])
+			}
+			return strings.TrimRight(string(sid), "\x00")
+		}
+		offset += size
+	}
+	return ""
+}
+
+// streamid - это stream_id, либо синтаксис SRT access control "#!::r=<stream_id>,m=publish"
+func parseSRTStreamID(sid string) string {
+	rest, ok := strings.CutPrefix(sid, "#!::")
+	if !ok {
+		return sid
+	}
+	for _, pair := range strings.Split(rest, ",") {
+		if key, value, found := strings.Cut(pair, "="); found && key == "r" {
+			return value
+		}
+	}
+	return ""
+}
+
+// Стрим должен быть запущен в main-app и назначен этому узлу. Если main-app
+// недоступен, пускаем: стрим запускал он, passphrase все равно проверит ffmpeg
+func checkIngestWithMainApp(streamID string) error {
+	endpoint := fmt.Sprintf("http://main-app:8080/nodes/%s/ingest/%s", url.PathEscape(nodeID), url.PathEscape(streamID))
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("X-API-Key", serviceAPIKey)
+
+	client := &http.Client{Timeout: 3 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Printf("⚠️ SRT gateway: main-app unavailable, admitting stream %s without check: %v", streamID, err)
+		return nil
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var message bytes.Buffer
+		message.ReadFrom(resp.Body)
+		return fmt.Errorf("main-app rejected stream: %s", strings.TrimSpace(message.String()))
+	}
+	return nil
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Handshake пакеты libsrt 1.5 caller'а (ffmpeg -f mpegts srt://...?streamid=...&passphrase=...):
+// induction HSv4 и conclusion HSv5 с расширениями HSREQ, KMREQ и SID.
+// Cookie в conclusion нулевой, тесты подставляют нужный
+const (
+	libsrtInduction = "80000000" + "00000000" + "00000064" + "00000000" +
+		"00000004" + "00000002" + "3a1b2c4d" + "000005dc" + "00002000" + "00000001" +
+		"1d5c9e21" + "00000000" + "0100007f000000000000000000000000"
+
+	libsrtConclusionHead = "80000000" + "00000000" + "000001f4" + "00000000" +
+		"00000005" + "00020007" + "3a1b2c4d" + "000005dc" + "00002000" + "ffffffff" +
+		"1d5c9e21" + "00000000" + "0100007f000000000000000000000000" +
+		// SRT_CMD_HSREQ: версия 1.5.2, флаги, latency 120ms
+		"00010003" + "00010502" + "000000bf" + "00780000" +
+		// SRT_CMD_KMREQ (начало key material)
+		"00030004" + "12202901" + "00000000" + "02000200" + "00000404"
+
+	libsrtCallerSocketID = 0x1d5c9e21
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("bad fixture: %v", err)
+	}
+	return b
+}
+
+func TestSRTStreamIDExtension(t *testing.T) {
+	tests := []struct {
+		name   string
+		sidExt string
+		raw    string
+		stream string
+	}{
+		{"length not multiple of 4", "000500046576696c7274732d2d6d616500003234", "live-stream-42", "live-stream-42"},
+		{"access control syntax", "000500063a3a212362613d7232312d633d6d2c336c62757000687369", "#!::r=abc-123,m=publish", "abc-123"},
+		{"length multiple of 4", "000500026463626134333231", "abcd1234", "abcd1234"},
+		{"single byte", "0005000100000078", "x", "x"},
+		{"no SID extension", "", "", ""},
+		// Размер расширения (10 слов) больше остатка пакета
+		{"truncated extension", "0005000a6576", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pkt := mustHex(t, libsrtConclusionHead+tt.sidExt)
+			raw := srtStreamIDExtension(pkt)
+			if raw != tt.raw {
+				t.Fatalf("srtStreamIDExtension() = %q, want %q", raw, tt.raw)
+			}
+			if got := parseSRTStreamID(raw); got != tt.stream {
+				t.Fatalf("parseSRTStreamID(%q) = %q, want %q", raw, got, tt.stream)
+			}
+		})
+	}
+}
+
+func TestParseSRTStreamID(t *testing.T) {
+	tests := []struct {
+		sid  string
+		want string
+	}{
+		{"stream-1", "stream-1"},
+		{"#!::r=stream-1,m=publish", "stream-1"},
+		{"#!::m=publish,r=stream-1", "stream-1"},
+		{"#!::u=admin,m=publish", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := parseSRTStreamID(tt.sid); got != tt.want {
+			t.Errorf("parseSRTStreamID(%q) = %q, want %q", tt.sid, got, tt.want)
+		}
+	}
+}
+
+func TestSRTHandshakeType(t *testing.T) {
+	tests := []struct {
+		name      string
+		pkt       string
+		hsType    uint32
+		handshake bool
+	}{
+		{"induction", libsrtInduction, srtHSInduction, true},
+		{"conclusion", libsrtConclusionHead, srtHSConclusion, true},
+		{"shutdown control", "80050000" + "00000000" + "00000064" + "1d5c9e21", 0, false},
+		{"data packet", "00000001" + "00000000" + "00000064" + "1d5c9e21" + "47400011", 0, false},
+		{"short handshake", "80000000" + "00000000" + "00000064" + "00000000" + "00000004", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hsType, ok := srtHandshakeType(mustHex(t, tt.pkt))
+			if ok != tt.handshake || hsType != tt.hsType {
+				t.Fatalf("srtHandshakeType() = %d, %v, want %d, %v", hsType, ok, tt.hsType, tt.handshake)
+			}
+		})
+	}
+
+	if !isSRTControl(mustHex(t, "80050000"+"00000000"+"00000064"+"1d5c9e21"), srtCtrlShutdown) {
+		t.Fatal("shutdown packet is not recognized")
+	}
+}
+
+func TestSRTInductionResponse(t *testing.T) {
+	g, err := newSRTGateway(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := &net.UDPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 40123}
+	req := mustHex(t, libsrtInduction)
+
+	resp := g.inductionResponse(req, addr)
+	if len(resp) != srtHeaderSize+srtHandshakeSize {
+		t.Fatalf("response length = %d", len(resp))
+	}
+
+	checks := []struct {
+		name string
+		got  uint32
+		want uint32
+	}{
+		{"destination socket", binary.BigEndian.Uint32(resp[12:]), libsrtCallerSocketID},
+		{"version", binary.BigEndian.Uint32(resp[srtHSVersion:]), 5},
+		{"encryption", uint32(binary.BigEndian.Uint16(resp[srtHSEncryption:])), 0},
+		{"extension magic", uint32(binary.BigEndian.Uint16(resp[srtHSExtension:])), srtMagicCode},
+		{"handshake type", binary.BigEndian.Uint32(resp[srtHSType:]), srtHSInduction},
+		{"socket id", binary.BigEndian.Uint32(resp[srtHSSocketID:]), g.socketID},
+		{"initial sequence", binary.BigEndian.Uint32(resp[srtHeaderSize+8:]), 0x3a1b2c4d},
+	}
+	for _, c := range checks {
+		if c.got != c.want {
+			t.Errorf("%s = %#x, want %#x", c.name, c.got, c.want)
+		}
+	}
+
+	cookie := binary.BigEndian.Uint32(resp[srtHSCookie:])
+	if !g.validCookie(addr, cookie) {
+		t.Error("cookie from induction response is not accepted")
+	}
+	other := &net.UDPAddr{IP: net.IPv4(203, 0, 113, 8), Port: 40123}
+	if g.validCookie(other, cookie) {
+		t.Error("cookie is accepted for another address")
+	}
+}
+
+func TestSRTRewriteConclusion(t *testing.T) {
+	pkt := mustHex(t, libsrtConclusionHead+"000500046576696c7274732d2d6d616500003234")
+	binary.BigEndian.PutUint32(pkt[12:], 0x11111111)
+	binary.BigEndian.PutUint32(pkt[srtHSCookie:], 0x22222222)
+	extensions := bytes.Clone(pkt[srtHeaderSize+srtHandshakeSize:])
+
+	rewriteConclusion(pkt, 0xcafebabe)
+
+	if got := binary.BigEndian.Uint32(pkt[12:]); got != 0 {
+		t.Errorf("destination socket = %#x, want 0", got)
+	}
+	if got := binary.BigEndian.Uint32(pkt[srtHSCookie:]); got != 0xcafebabe {
+		t.Errorf("cookie = %#x, want 0xcafebabe", got)
+	}
+	if !bytes.Equal(pkt[srtHeaderSize+srtHandshakeSize:], extensions) {
+		t.Error("extensions changed")
+	}
+	if got := srtStreamIDExtension(pkt); got != "live-stream-42" {
+		t.Errorf("streamid after rewrite = %q", got)
+	}
+}
+
+func TestSRTRejectResponse(t *testing.T) {
+	resp := rejectResponse(mustHex(t, libsrtConclusionHead))
+	if got := binary.BigEndian.Uint32(resp[srtHSType:]); got != srtRejectNotFound {
+		t.Errorf("handshake type = %d, want %d", got, srtRejectNotFound)
+	}
+	if got := binary.BigEndian.Uint32(resp[12:]); got != libsrtCallerSocketID {
+		t.Errorf("destination socket = %#x, want caller socket", got)
+	}
+}
+
+// Стрим в activeStreams на время теста (self-check префикс: без проверки в main-app)
+func registerGatewayTestStream(t *testing.T, streamID string, port int) {
+	t.Helper()
+	streamsMux.Lock()
+	activeStreams[streamID] = &StreamInfo{StreamID: streamID, Protocol: ProtocolSRT, Port: port}
+	streamsMux.Unlock()
+	t.Cleanup(func() {
+		streamsMux.Lock()
+		delete(activeStreams, streamID)
+		streamsMux.Unlock()
+		dropSRTGatewayStream(streamID)
+	})
+}
+
+func startTestGateway(t *testing.T) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := newSRTGateway(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gateway = g
+	go g.run()
+	t.Cleanup(func() {
+		conn.Close()
+		gateway = nil
+	})
+	return conn
+}
+
+// Handshake и пересылка через gateway с подставным listener'ом вместо ffmpeg
+func TestSRTGatewayRelay(t *testing.T) {
+	listener, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	received := make(chan []byte, 10)
+	go func() {
+		buf := make([]byte, srtMaxPacketSize)
+		for {
+			n, addr, err := listener.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			pkt := bytes.Clone(buf[:n])
+			received <- pkt
+			if hsType, _ := srtHandshakeType(pkt); hsType == srtHSInduction {
+				resp := mustHex(t, libsrtInduction)
+				binary.BigEndian.PutUint32(resp[srtHSCookie:], 0xcafe)
+				listener.WriteToUDP(resp, addr)
+			} else {
+				listener.WriteToUDP([]byte("agreement"), addr)
+			}
+		}
+	}()
+
+	gatewayConn := startTestGateway(t)
+	registerGatewayTestStream(t, "selfcheck-relay", listener.LocalAddr().(*net.UDPAddr).Port)
+
+	caller, err := net.DialUDP("udp", nil, gatewayConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer caller.Close()
+	caller.SetReadDeadline(time.Now().Add(3 * time.Second))
+	buf := make([]byte, srtMaxPacketSize)
+
+	caller.Write(mustHex(t, libsrtInduction))
+	n, err := caller.Read(buf)
+	if err != nil {
+		t.Fatalf("no induction response: %v", err)
+	}
+	cookie := binary.BigEndian.Uint32(buf[srtHSCookie:n])
+
+	conclusion := mustHex(t, libsrtConclusionHead+"00050004666c65736365686365722d6b0079616c")
+	binary.BigEndian.PutUint32(conclusion[srtHSCookie:], cookie)
+	caller.Write(conclusion)
+
+	upstreamInduction := <-received
+	if hsType, _ := srtHandshakeType(upstreamInduction); hsType != srtHSInduction ||
+		binary.BigEndian.Uint32(upstreamInduction[srtHSVersion:]) != 4 {
+		t.Fatal("gateway did not send induction to the listener")
+	}
+	upstreamConclusion := <-received
+	if got := binary.BigEndian.Uint32(upstreamConclusion[srtHSCookie:]); got != 0xcafe {
+		t.Fatalf("conclusion cookie = %#x, want listener cookie", got)
+	}
+	if got := srtStreamIDExtension(upstreamConclusion); got != "selfcheck-relay" {
+		t.Fatalf("forwarded streamid = %q", got)
+	}
+
+	n, err = caller.Read(buf)
+	if err != nil || string(buf[:n]) != "agreement" {
+		t.Fatalf("listener response not relayed: %q, %v", buf[:n], err)
+	}
+	caller.Write([]byte("media"))
+	if got := <-received; string(got) != "media" {
+		t.Fatalf("media not relayed: %q", got)
+	}
+
+	dropSRTGatewayStream("selfcheck-relay")
+	gateway.mu.Lock()
+	sessions := len(gateway.sessions)
+	gateway.mu.Unlock()
+	if sessions != 0 {
+		t.Fatalf("sessions after stream stop = %d", sessions)
+	}
+}
+
+func TestSRTGatewayRejectsUnknownStream(t *testing.T) {
+	gatewayConn := startTestGateway(t)
+
+	caller, err := net.DialUDP("udp", nil, gatewayConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer caller.Close()
+	caller.SetReadDeadline(time.Now().Add(3 * time.Second))
+	buf := make([]byte, srtMaxPacketSize)
+
+	caller.Write(mustHex(t, libsrtInduction))
+	if _, err := caller.Read(buf); err != nil {
+		t.Fatalf("no induction response: %v", err)
+	}
+	conclusion := mustHex(t, libsrtConclusionHead+"000500046576696c7274732d2d6d616500003234")
+	copy(conclusion[srtHSCookie:], buf[srtHSCookie:srtHSCookie+4])
+	caller.Write(conclusion)
+
+	n, err := caller.Read(buf)
+	if err != nil {
+		t.Fatalf("no reject: %v", err)
+	}
+	if got := binary.BigEndian.Uint32(buf[srtHSType:n]); got != srtRejectNotFound {
+		t.Fatalf("handshake type = %d, want reject %d", got, srtRejectNotFound)
+	}
+}
+
+// Настоящий ffmpeg caller через gateway к ffmpeg listener'у стрима
+func TestSRTGatewayFFmpegCaller(t *testing.T) {
+	if testing.Short() {
+		t.Skip("integration test")
+	}
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		t.Skip("ffmpeg is not installed")
+	}
+	if out, err := exec.Command("ffmpeg", "-hide_banner", "-protocols").Output(); err != nil || !strings.Contains(string(out), "srt") {
+		t.Skip("ffmpeg is built without libsrt")
+	}
+
+	gatewayConn := startTestGateway(t)
+	gatewayPort := gatewayConn.LocalAddr().(*net.UDPAddr).Port
+	savedPort := srtGatewayPort
+	srtGatewayPort = gatewayPort
+	t.Cleanup(func() { srtGatewayPort = savedPort })
+
+	const streamID, streamKey = "selfcheck-ffmpeg", "gateway-test-passphrase"
+	port, err := acquireLoopbackPort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer releasePort(port)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	listener := exec.CommandContext(ctx, "ffmpeg", "-hide_banner", "-loglevel", "error",
+		"-i", buildSRTListenerAddr(port, streamID, streamKey), "-f", "null", "-")
+	var listenerErr bytes.Buffer
+	listener.Stderr = &listenerErr
+	if err := listener.Start(); err != nil {
+		t.Fatal(err)
+	}
+	registerGatewayTestStream(t, streamID, port)
+	time.Sleep(time.Second)
+
+	publish := func(sid string) error {
+		return exec.CommandContext(ctx, "ffmpeg", "-hide_banner", "-loglevel", "error",
+			"-re", "-f", "lavfi", "-i", "testsrc2=size=320x240:rate=25", "-t", "3",
+			"-c:v", "libx264", "-preset", "ultrafast", "-f", "mpegts",
+			"srt://127.0.0.1:"+strconv.Itoa(gatewayPort)+"?mode=caller&pkt_size=1316&streamid="+sid+
+				"&passphrase="+streamKey+"&pbkeylen="+srtKeyLength).Run()
+	}
+
+	if err := publish("selfcheck-missing"); err == nil {
+		t.Error("publisher with unknown streamid was accepted")
+	}
+	if err := publish(streamID); err != nil {
+		t.Fatalf("publisher through gateway failed: %v", err)
+	}
+	if err := listener.Wait(); err != nil {
+		t.Fatalf("listener failed: %v: %s", err, listenerErr.String())
+	}
+}
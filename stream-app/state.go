@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// Файл с состоянием активных стримов: переживает перезапуск stream-app
+var stateFile = getEnv("STATE_FILE", filepath.Join("state", "streams.json"))
+
+// persistedStream запись о стриме в файле состояния
+type persistedStream struct {
+	Info StreamInfo `json:"info"`
+	// В StreamInfo ключ скрыт от JSON, храним отдельно для перезапуска listener
+	StreamKey string `json:"stream_key"`
+	// Направления restream тоже содержат ключи
+	RestreamTargets []RestreamTarget `json:"restream_targets,omitempty"`
+}
+
+// Сохранение activeStreams в файл. Вызывать под streamsMux
+func saveStreamState() {
+	snapshot := make(map[string]persistedStream, len(activeStreams))
+	for id, stream := range activeStreams {
+		info := *stream
+		info.Stats = nil
+		info.Restreams = nil
+		info.FFmpegRestarts, info.LastExitReason = 0, ""
+		snapshot[id] = persistedStream{Info: info, StreamKey: stream.StreamKey, RestreamTargets: stream.RestreamTargets}
+	}
+
+	if err := writeStateFile(snapshot); err != nil {
+		log.Printf("⚠️ Failed to save stream state: %v", err)
+	}
+}
+
+// Запись через временный файл и rename, чтобы крэш не оставил обрезанный JSON
+func writeStateFile(snapshot map[string]persistedStream) error {
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal state: %v", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(stateFile), 0755); err != nil {
+		return fmt.Errorf("failed to create state directory: %v", err)
+	}
+
+	tmpFile := stateFile + ".tmp"
+	// 0600: в файле лежат ключи стримов
+	if err := os.WriteFile(tmpFile, data, 0600); err != nil {
+		return fmt.Errorf("failed to write state file: %v", err)
+	}
+	if err := os.Rename(tmpFile, stateFile); err != nil {
+		return fmt.Errorf("failed to replace state file: %v", err)
+	}
+	return nil
+}
+
+// Загрузка сохраненного состояния; отсутствие файла - не ошибка
+func loadStreamState() map[string]*persistedStream {
+	state := make(map[string]*persistedStream)
+
+	data, err := os.ReadFile(stateFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("⚠️ Failed to read stream state: %v", err)
+		}
+		return state
+	}
+
+	if err := json.Unmarshal(data, &state); err != nil {
+		log.Printf("⚠️ Failed to parse stream state %s: %v", stateFile, err)
+		return make(map[string]*persistedStream)
+	}
+
+	log.Printf("📂 Loaded state for %d streams from %s", len(state), stateFile)
+	return state
+}
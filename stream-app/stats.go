@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"web/stream-app/kafka"
+)
+
+// Если out_time не растет дольше этого времени, считаем что publisher пропал
+const progressStallTimeout = 10 * time.Second
+
+var (
+	resolutionPattern = regexp.MustCompile(`\b(\d{2,5}x\d{2,5})\b`)
+	frameRatePattern  = regexp.MustCompile(`([\d.]+) fps`)
+	sampleRatePattern = regexp.MustCompile(`(\d+) Hz`)
+)
+
+// InputInfo параметры входного потока, как их определил ffmpeg
+type InputInfo struct {
+	VideoCodec string  `json:"video_codec,omitempty"`
+	Resolution string  `json:"resolution,omitempty"`
+	FrameRate  float64 `json:"frame_rate,omitempty"`
+	AudioCodec string  `json:"audio_codec,omitempty"`
+	SampleRate int     `json:"sample_rate,omitempty"`
+	Channels   string  `json:"channels,omitempty"`
+}
+
+// StreamStats состояние ffmpeg по данным -progress
+type StreamStats struct {
+	Connected   bool      `json:"connected"`
+	Frame       int64     `json:"frame"`
+	FPS         float64   `json:"fps"`
+	BitrateKbps float64   `json:"bitrate_kbps"`
+	TotalSize   int64     `json:"total_size_bytes"`
+	OutTime     float64   `json:"out_time_seconds"`
+	DupFrames   int64     `json:"dup_frames"`
+	DropFrames  int64     `json:"drop_frames"`
+	Speed       float64   `json:"speed"`
+	Input       InputInfo `json:"input"`
+	UpdatedAt   time.Time `json:"updated_at"`
+
+	// Когда out_time последний раз увеличился
+	lastAdvance time.Time
+}
+
+// inputInfoParser собирает InputInfo из секции "Input #0" в stderr ffmpeg
+type inputInfoParser struct {
+	inInput bool
+	done    bool
+	info    InputInfo
+}
+
+// Возвращает true один раз, когда секция входа закончилась
+func (p *inputInfoParser) feed(line string) bool {
+	trimmed := strings.TrimSpace(line)
+
+	switch {
+	case strings.HasPrefix(trimmed, "Input #0"):
+		p.inInput = true
+
+	case strings.HasPrefix(trimmed, "Output #0"), strings.HasPrefix(trimmed, "Stream mapping:"):
+		if p.inInput && !p.done {
+			p.inInput = false
+			p.done = true
+			return true
+		}
+		p.inInput = false
+
+	case p.inInput && strings.HasPrefix(trimmed, "Stream #0:"):
+		if codec := codecAfter(trimmed, "Video: "); codec != "" && p.info.VideoCodec == "" {
+			p.info.VideoCodec = codec
+			if m := resolutionPattern.FindStringSubmatch(trimmed); m != nil {
+				p.info.Resolution = m[1]
+			}
+			if m := frameRatePattern.FindStringSubmatch(trimmed); m != nil {
+				p.info.FrameRate, _ = strconv.ParseFloat(m[1], 64)
+			}
+		}
+		if codec := codecAfter(trimmed, "Audio: "); codec != "" && p.info.AudioCodec == "" {
+			p.info.AudioCodec = codec
+			if m := sampleRatePattern.FindStringSubmatch(trimmed); m != nil {
+				p.info.SampleRate, _ = strconv.Atoi(m[1])
+			}
+			// Каналы идут сразу после частоты: "48000 Hz, stereo, fltp"
+			fields := strings.Split(trimmed, ", ")
+			for i, field := range fields {
+				if strings.HasSuffix(field, " Hz") && i+1 < len(fields) {
+					p.info.Channels = fields[i+1]
+					break
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// Имя кодека из строки вида "Stream #0:0: Video: h264 (High), yuv420p, ..."
+func codecAfter(line, marker string) string {
+	idx := strings.Index(line, marker)
+	if idx < 0 {
+		return ""
+	}
+	fields := strings.FieldsFunc(line[idx+len(marker):], func(r rune) bool {
+		return r == ' ' || r == ',' || r == '('
+	})
+	if len(fields) == 0 {
+		return ""
+	}
+	return strings.ToLower(fields[0])
+}
+
+func setInputInfo(streamID string, info InputInfo) {
+	processesMux.Lock()
+	defer processesMux.Unlock()
+
+	if proc, exists := processes[streamID]; exists {
+		proc.Stats.Input = info
+	}
+	log.Printf("📊 Stream %s input: video %s %s @ %.2f fps, audio %s %d Hz %s",
+		streamID, info.VideoCodec, info.Resolution, info.FrameRate, info.AudioCodec, info.SampleRate, info.Channels)
+}
+
+// Чтение -progress pipe:1: блоки key=value, каждый заканчивается строкой progress=...
+func monitorFFmpegProgress(streamID string, stdout io.ReadCloser) {
+	defer stdout.Close()
+
+	block := make(map[string]string)
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if !ok {
+			continue
+		}
+		block[key] = value
+
+		if key == "progress" {
+			applyProgress(streamID, block)
+			block = make(map[string]string)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		log.Printf("Error reading ffmpeg progress for stream %s: %v", streamID, err)
+	}
+}
+
+func applyProgress(streamID string, block map[string]string) {
+	processesMux.Lock()
+	defer processesMux.Unlock()
+
+	proc, exists := processes[streamID]
+	if !exists {
+		return
+	}
+
+	now := time.Now()
+	stats := &proc.Stats
+	stats.Frame = parseProgressInt(block["frame"])
+	stats.FPS = parseProgressFloat(block["fps"])
+	stats.BitrateKbps = parseProgressFloat(strings.TrimSuffix(block["bitrate"], "kbits/s"))
+	stats.TotalSize = parseProgressInt(block["total_size"])
+	stats.DupFrames = parseProgressInt(block["dup_frames"])
+	stats.DropFrames = parseProgressInt(block["drop_frames"])
+	stats.Speed = parseProgressFloat(strings.TrimSuffix(block["speed"], "x"))
+	stats.UpdatedAt = now
+
+	outTime := float64(parseProgressInt(block["out_time_us"])) / 1e6
+	if outTime > stats.OutTime {
+		stats.lastAdvance = now
+	}
+	stats.OutTime = outTime
+
+	// Медиа идет через ffmpeg: publisher подключен
+	if outTime > 0 && !stats.lastAdvance.IsZero() && !proc.IsConnected {
+		proc.IsConnected = true
+		proc.EverConnected = true
+		log.Printf("Publisher connection detected for stream %s", streamID)
+		emitStreamEvent(streamID, kafka.EventPublisherConnected, "")
+		go notifyMainAppStatusChange(streamID, "running")
+	}
+}
+
+// "N/A" и пустые значения считаем нулем
+func parseProgressInt(value string) int64 {
+	n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+func parseProgressFloat(value string) float64 {
+	f, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil {
+		return 0
+	}
+	return f
+}
+
+// Сторож: progress есть, но out_time стоит на месте - вход перестал приходить
+func watchFFmpegStall(streamID string, done chan struct{}) {
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			processesMux.Lock()
+			if proc, exists := processes[streamID]; exists && proc.IsConnected &&
+				!proc.Stats.lastAdvance.IsZero() && time.Since(proc.Stats.lastAdvance) > progressStallTimeout {
+				proc.IsConnected = false
+				proc.IdleSince = time.Now()
+				log.Printf("Publisher connection lost for stream %s (no media for %s)", streamID, progressStallTimeout)
+				emitStreamEvent(streamID, kafka.EventPublisherDisconnected, fmt.Sprintf("no media for %s", progressStallTimeout))
+				go notifyMainAppStatusChange(streamID, "waiting")
+			}
+			processesMux.Unlock()
+		}
+	}
+}
+
+// Снимок статистики стрима для API
+func currentStreamStats(streamID string) *StreamStats {
+	processesMux.Lock()
+	defer processesMux.Unlock()
+
+	proc, exists := processes[streamID]
+	if !exists {
+		return nil
+	}
+
+	stats := proc.Stats
+	stats.Connected = proc.IsConnected
+	return &stats
+}
+
+// GET /stream/{id}/stats
+func streamStatsHandler(w http.ResponseWriter, r *http.Request, streamID string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	streamsMux.Lock()
+	_, exists := activeStreams[streamID]
+	streamsMux.Unlock()
+	if !exists {
+		http.Error(w, "Stream not found", http.StatusNotFound)
+		return
+	}
+
+	stats := currentStreamStats(streamID)
+	if stats == nil {
+		// WHIP стрим без подключенного браузера: ffmpeg еще не запущен
+		stats = &StreamStats{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		StreamID string `json:"stream_id"`
+		*StreamStats
+	}{streamID, stats})
+}
+
+// Маршруты вида /stream/{id}/{action}
+func streamItemHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.Trim(strings.TrimPrefix(r.URL.Path, "/stream/"), "/"), "/", 3)
+	if len(parts) < 2 || parts[0] == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	streamID, action, rest := parts[0], parts[1], ""
+	if len(parts) == 3 {
+		rest = parts[2]
+	}
+
+	switch {
+	case action == "stats" && rest == "":
+		streamStatsHandler(w, r, streamID)
+	case action == "clips" && rest == "":
+		streamClipHandler(w, r, streamID)
+	case action == "dvr":
+		streamDVRHandler(w, r, streamID, rest)
+	case action == "logs" && rest == "":
+		streamLogsHandler(w, r, streamID)
+	default:
+		http.NotFound(w, r)
+	}
+}
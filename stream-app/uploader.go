@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HLS uploader: сегменты загружаются по событию "файл дописан" (inotify),
+// параллельно и с повтором, а плейлист публикуется только когда все сегменты,
+// на которые он ссылается, уже лежат в MinIO
+const (
+	uploadRetryMin       = 500 * time.Millisecond
+	uploadRetryMax       = 10 * time.Second
+	localCleanupInterval = 10 * time.Second
+	defaultUploadWorkers = 4
+)
+
+// Число параллельных загрузок сегментов на стрим
+var hlsUploadWorkers = loadUploadWorkers()
+
+var (
+	uploaders    = make(map[string]*hlsUploader)
+	uploadersMux sync.Mutex
+)
+
+type hlsUploader struct {
+	streamID       string
+	hlsDir         string
+	maxLocalChunks int
+	stop           chan struct{}
+	// Закрывается после финальной загрузки
+	done chan struct{}
+}
+
+type uploadResult struct {
+	relPath string
+	err     error
+}
+
+func loadUploadWorkers() int {
+	value := os.Getenv("HLS_UPLOAD_WORKERS")
+	if value == "" {
+		return defaultUploadWorkers
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		log.Printf("⚠️ Invalid HLS_UPLOAD_WORKERS %q, using %d", value, defaultUploadWorkers)
+		return defaultUploadWorkers
+	}
+	return n
+}
+
+// Запуск uploader для стрима. Вызывается под streamsMux
+func startHLSUploader(streamID string) {
+	maxLocalChunks := 8 // Увеличено для буферизации
+
+	// LL-HLS части короче обычных сегментов, держим их больше
+	if stream, exists := activeStreams[streamID]; exists && stream.LowLatency {
+		maxLocalChunks = llhlsLocalParts
+	}
+
+	uploadersMux.Lock()
+	defer uploadersMux.Unlock()
+
+	if _, running := uploaders[streamID]; running {
+		return
+	}
+
+	u := &hlsUploader{
+		streamID:       streamID,
+		hlsDir:         filepath.Join("hls", streamID),
+		maxLocalChunks: maxLocalChunks,
+		stop:           make(chan struct{}),
+		done:           make(chan struct{}),
+	}
+	uploaders[streamID] = u
+
+	go u.run()
+	log.Printf("🚀 HLS uploader launched for stream %s (%d workers)", streamID, hlsUploadWorkers)
+}
+
+// Остановка uploader: финальная загрузка идет в его горутине, возвращаемый канал
+// закрывается после нее (по нему ставится задача записи и завершается stream-app)
+func stopHLSUploader(streamID string) <-chan struct{} {
+	uploadersMux.Lock()
+	u, exists := uploaders[streamID]
+	delete(uploaders, streamID)
+	uploadersMux.Unlock()
+
+	if !exists {
+		done := make(chan struct{})
+		close(done)
+		return done
+	}
+	close(u.stop)
+	return u.done
+}
+
+func (u *hlsUploader) run() {
+	if err := os.MkdirAll(u.hlsDir, 0755); err != nil {
+		log.Printf("❌ Failed to create HLS directory for stream %s: %v", u.streamID, err)
+	}
+
+	watchStop := make(chan struct{})
+	events, err := watchHLSDir(u.hlsDir, watchStop)
+	if err != nil {
+		log.Printf("⚠️ File watcher unavailable for stream %s (%v), polling the directory", u.streamID, err)
+		events = pollHLSDir(u.hlsDir, watchStop)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	jobs := make(chan string)
+	results := make(chan uploadResult)
+
+	var wg sync.WaitGroup
+	for i := 0; i < hlsUploadWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for relPath := range jobs {
+				results <- uploadResult{relPath: relPath, err: u.uploadSegment(ctx, relPath)}
+			}
+		}()
+	}
+
+	defer func() {
+		close(watchStop)
+		cancel()
+		close(jobs)
+		go func() {
+			wg.Wait()
+			close(results)
+		}()
+		for range results {
+		}
+
+		// Финальная загрузка всех файлов, включая прерванные
+		uploadAllHLSFiles(u.streamID, u.hlsDir)
+		log.Printf("✅ HLS uploader stopped for stream %s", u.streamID)
+		close(u.done)
+	}()
+
+	var queue []string
+	queued := make(map[string]bool)    // в очереди или загружается
+	manifests := make(map[string]bool) // ждут публикации
+	published := make(map[string]bool) // плейлисты, загруженные хотя бы раз
+	uploadedCount := 0
+
+	handle := func(relPath string) {
+		name := path.Base(relPath)
+		switch {
+		case strings.HasSuffix(name, ".tmp") || !isHLSFile(name):
+		case isManifestFile(name):
+			manifests[relPath] = true
+		case !queued[relPath]:
+			// Сначала в журнал: после крэша загрузка продолжится
+			journal.add(u.streamID, relPath)
+			queued[relPath] = true
+			queue = append(queue, relPath)
+		}
+	}
+
+	// Сегменты из журнала, которых уже нет на диске, загрузить не получится
+	for _, relPath := range journal.pendingFor(u.streamID) {
+		if _, err := os.Stat(filepath.Join(u.hlsDir, filepath.FromSlash(relPath))); os.IsNotExist(err) {
+			log.Printf("⚠️ Journaled segment %s of stream %s is gone, dropping it", relPath, u.streamID)
+			journal.done(u.streamID, relPath)
+		}
+	}
+
+	// Файлы, появившиеся до запуска watcher (например, после перезапуска stream-app)
+	rescan := func() {
+		files, err := listHLSFiles(u.hlsDir)
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("❌ Failed to read HLS directory %s: %v", u.hlsDir, err)
+		}
+		for _, relPath := range files {
+			handle(relPath)
+		}
+	}
+	rescan()
+
+	cleanup := time.NewTicker(localCleanupInterval)
+	defer cleanup.Stop()
+
+	for {
+		u.publishManifests(ctx, manifests, queued, published)
+
+		var next string
+		var jobsCh chan<- string
+		if len(queue) > 0 {
+			next, jobsCh = queue[0], jobs
+		}
+
+		select {
+		case <-u.stop:
+			return
+
+		case relPath, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			// Пустой путь: watcher потерял события, пересканируем папку
+			if relPath == "" {
+				rescan()
+			} else {
+				handle(relPath)
+			}
+
+		case jobsCh <- next:
+			queue = queue[1:]
+
+		case res := <-results:
+			delete(queued, res.relPath)
+			// Ошибка здесь значит, что файла уже нет: повторять нечего
+			if res.err != nil {
+				log.Printf("❌ Failed to upload %s for stream %s: %v", res.relPath, u.streamID, res.err)
+			} else {
+				uploadedCount++
+			}
+			journal.done(u.streamID, res.relPath)
+
+		case <-cleanup.C:
+			// Стрим удален без stopHLSUploader
+			streamsMux.Lock()
+			_, exists := activeStreams[u.streamID]
+			streamsMux.Unlock()
+			if !exists {
+				log.Printf("🛑 Stopping HLS uploader for stream %s (stream not active)", u.streamID)
+				uploadersMux.Lock()
+				if uploaders[u.streamID] == u {
+					delete(uploaders, u.streamID)
+				}
+				uploadersMux.Unlock()
+				return
+			}
+
+			if uploadedCount > 0 {
+				log.Printf("📊 HLS uploader: %d segments uploaded for %s (queued: %d)", uploadedCount, u.streamID, len(queued))
+				uploadedCount = 0
+			}
+			// Локально удаляем только то, что MinIO уже подтвердил
+			cleanupLocalHLSSegments(u.streamID, u.maxLocalChunks, func(relPath string) bool {
+				return queued[relPath] || journal.isPending(u.streamID, relPath)
+			})
+		}
+	}
+}
+
+// Загрузка сегмента с повторами. Сегмент неизменяем, поэтому повтор безопасен
+func (u *hlsUploader) uploadSegment(ctx context.Context, relPath string) error {
+	localPath := filepath.Join(u.hlsDir, filepath.FromSlash(relPath))
+	backoff := uploadRetryMin
+
+	for attempt := 1; ; attempt++ {
+		err := uploadFileToMinIO(ctx, u.streamID, localPath, relPath)
+		if err == nil {
+			return nil
+		}
+		// Файл уже удален: повторять бессмысленно
+		if _, statErr := os.Stat(localPath); os.IsNotExist(statErr) {
+			return err
+		}
+
+		log.Printf("⚠️ Upload of %s failed (attempt %d), retrying in %s: %v", relPath, attempt, backoff, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, uploadRetryMax)
+	}
+}
+
+// Публикация плейлистов, все сегменты которых уже загружены.
+// Варианты публикуются раньше master.m3u8/manifest.mpd
+func (u *hlsUploader) publishManifests(ctx context.Context, manifests, queued, published map[string]bool) {
+	if len(manifests) == 0 {
+		return
+	}
+
+	names := make([]string, 0, len(manifests))
+	for relPath := range manifests {
+		names = append(names, relPath)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if isTopLevelManifest(names[i]) != isTopLevelManifest(names[j]) {
+			return isTopLevelManifest(names[j])
+		}
+		return names[i] < names[j]
+	})
+
+	for _, relPath := range names {
+		data, err := os.ReadFile(filepath.Join(u.hlsDir, filepath.FromSlash(relPath)))
+		if err != nil {
+			if os.IsNotExist(err) {
+				delete(manifests, relPath)
+			}
+			continue
+		}
+
+		if !manifestReady(relPath, data, queued, published) {
+			continue
+		}
+
+		if err := uploadBytesToMinIO(ctx, u.streamID, relPath, data); err != nil {
+			log.Printf("❌ Failed to publish %s for stream %s: %v", relPath, u.streamID, err)
+			continue
+		}
+		delete(manifests, relPath)
+		published[relPath] = true
+	}
+}
+
+// Все ли файлы, на которые ссылается плейлист, уже в MinIO
+func manifestReady(relPath string, data []byte, queued, published map[string]bool) bool {
+	dir := path.Dir(relPath)
+
+	// DASH манифест адресует сегменты шаблоном: ждем все сегменты своей папки
+	if strings.HasSuffix(relPath, ".mpd") {
+		for pending := range queued {
+			if path.Dir(pending) == dir {
+				return false
+			}
+		}
+		return true
+	}
+
+	for _, uri := range playlistURIs(data) {
+		ref := path.Join(dir, uri)
+		if isManifestFile(ref) {
+			if !published[ref] {
+				return false
+			}
+		} else if queued[ref] {
+			return false
+		}
+	}
+	return true
+}
+
+// Ссылки плейлиста: строки без # и атрибуты URI="..." (EXT-X-MAP, EXT-X-MEDIA)
+func playlistURIs(data []byte) []string {
+	var uris []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		uri := line
+		if strings.HasPrefix(line, "#") {
+			uri = playlistAttr(line, "URI")
+		}
+		if uri == "" || strings.Contains(uri, "://") {
+			continue
+		}
+		if idx := strings.Index(uri, "?"); idx >= 0 {
+			uri = uri[:idx]
+		}
+		uris = append(uris, uri)
+	}
+	return uris
+}
+
+// Запасной вариант без inotify: опрос папки раз в секунду. Файл считается дописанным,
+// когда его размер и время изменения не менялись между двумя проходами
+func pollHLSDir(hlsDir string, stop <-chan struct{}) <-chan string {
+	events := make(chan string, 64)
+
+	go func() {
+		defer close(events)
+
+		type fileState struct {
+			size    int64
+			modTime time.Time
+			sent    bool
+		}
+		seen := make(map[string]fileState)
+
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+
+			files, _ := listHLSFiles(hlsDir)
+			current := make(map[string]fileState, len(files))
+			for _, relPath := range files {
+				info, err := os.Stat(filepath.Join(hlsDir, filepath.FromSlash(relPath)))
+				if err != nil {
+					continue
+				}
+
+				state := fileState{size: info.Size(), modTime: info.ModTime()}
+				prev, known := seen[relPath]
+				if known && prev.size == state.size && prev.modTime.Equal(state.modTime) {
+					state.sent = prev.sent
+					if !state.sent {
+						select {
+						case events <- relPath:
+							state.sent = true
+						case <-stop:
+							return
+						}
+					}
+				}
+				current[relPath] = state
+			}
+			seen = current
+		}
+	}()
+
+	return events
+}
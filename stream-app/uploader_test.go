@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPlaylistURIs(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+	}{
+		{
+			name: "media playlist",
+			content: "#EXTM3U\n#EXT-X-TARGETDURATION:4\n#EXTINF:4.000,\nsegment_000.ts\n" +
+				"#EXTINF:4.000,\nsegment_001.ts\n#EXT-X-ENDLIST\n",
+			want: []string{"segment_000.ts", "segment_001.ts"},
+		},
+		{
+			name:    "fmp4 init segment",
+			content: "#EXTM3U\n#EXT-X-MAP:URI=\"init.mp4\"\n#EXTINF:1.000,\npart_00000.m4s\n",
+			want:    []string{"init.mp4", "part_00000.m4s"},
+		},
+		{
+			name: "master playlist",
+			content: "#EXTM3U\n#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"a\",URI=\"audio/stream.m3u8\"\n" +
+				"#EXT-X-STREAM-INF:BANDWIDTH=5000000\n1080p/stream.m3u8\n",
+			want: []string{"audio/stream.m3u8", "1080p/stream.m3u8"},
+		},
+		{
+			name:    "query string and absolute urls",
+			content: "#EXTINF:4.000,\nsegment_000.ts?v=1\n#EXTINF:4.000,\nhttps://cdn.example.com/segment_001.ts\n",
+			want:    []string{"segment_000.ts"},
+		},
+		{
+			name:    "blank lines and crlf",
+			content: "#EXTM3U\r\n\r\n#EXTINF:4.000,\r\nsegment_000.ts\r\n",
+			want:    []string{"segment_000.ts"},
+		},
+		{"empty playlist", "", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := playlistURIs([]byte(tt.content))
+			if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Fatalf("playlistURIs() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestManifestReady(t *testing.T) {
+	variant := []byte("#EXTM3U\n#EXT-X-MAP:URI=\"init.mp4\"\n#EXTINF:4.000,\nsegment_000.ts\n#EXTINF:4.000,\nsegment_001.ts\n")
+	master := []byte("#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=2800000\n720p/stream.m3u8\n#EXT-X-STREAM-INF:BANDWIDTH=1400000\n480p/stream.m3u8\n")
+
+	tests := []struct {
+		name      string
+		relPath   string
+		data      []byte
+		queued    []string
+		published []string
+		want      bool
+	}{
+		{"all segments uploaded", "720p/stream.m3u8", variant, nil, nil, true},
+		{"segment still uploading", "720p/stream.m3u8", variant, []string{"720p/segment_001.ts"}, nil, false},
+		{"init segment still uploading", "720p/stream.m3u8", variant, []string{"720p/init.mp4"}, nil, false},
+		{"other variant uploading", "720p/stream.m3u8", variant, []string{"480p/segment_001.ts"}, nil, true},
+		{"master before variants", masterPlaylistName, master, nil, []string{"720p/stream.m3u8"}, false},
+		{"master after variants", masterPlaylistName, master, nil, []string{"720p/stream.m3u8", "480p/stream.m3u8"}, true},
+		// DASH манифест ссылается на сегменты шаблоном: ждем всю папку
+		{"dash with pending chunk", dashManifestName, []byte("<MPD/>"), []string{"chunk-stream0-00003.m4s"}, nil, false},
+		{"dash with pending chunk elsewhere", dashManifestName, []byte("<MPD/>"), []string{"720p/segment_001.ts"}, nil, true},
+		{"dash ready", dashManifestName, []byte("<MPD/>"), nil, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			queued := make(map[string]bool)
+			for _, relPath := range tt.queued {
+				queued[relPath] = true
+			}
+			published := make(map[string]bool)
+			for _, relPath := range tt.published {
+				published[relPath] = true
+			}
+
+			if got := manifestReady(tt.relPath, tt.data, queued, published); got != tt.want {
+				t.Fatalf("manifestReady(%q) = %v, want %v", tt.relPath, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPublishManifestsKeepsUnpublished(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "720p"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	playlist := []byte("#EXTM3U\n#EXTINF:4.000,\nsegment_000.ts\n")
+	if err := os.WriteFile(filepath.Join(dir, "720p", "stream.m3u8"), playlist, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	u := &hlsUploader{streamID: "test", hlsDir: dir}
+	manifests := map[string]bool{
+		"720p/stream.m3u8": true,
+		"480p/stream.m3u8": true, // файла уже нет
+	}
+	queued := map[string]bool{"720p/segment_000.ts": true}
+	published := make(map[string]bool)
+
+	u.publishManifests(context.Background(), manifests, queued, published)
+
+	// Удаленный плейлист публиковать нечего, неготовый ждет своих сегментов
+	if manifests["480p/stream.m3u8"] {
+		t.Fatalf("missing playlist was not dropped")
+	}
+	if !manifests["720p/stream.m3u8"] || published["720p/stream.m3u8"] {
+		t.Fatalf("playlist with pending segment was published: manifests=%v published=%v", manifests, published)
+	}
+}
@@ -0,0 +1,156 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Файл дописан (IN_CLOSE_WRITE) или переименован из .tmp (IN_MOVED_TO);
+// IN_CREATE нужен, чтобы следить за новыми папками вариантов
+const hlsWatchMask = unix.IN_CLOSE_WRITE | unix.IN_MOVED_TO | unix.IN_CREATE
+
+type inotifyWatcher struct {
+	fd   int
+	root string
+	dirs map[int]string
+}
+
+// Слежение за папкой стрима через inotify. В канал приходят относительные пути
+// дописанных файлов; пустая строка означает, что события потеряны и нужен пересмотр папки
+func watchHLSDir(hlsDir string, stop <-chan struct{}) (<-chan string, error) {
+	fd, err := unix.InotifyInit1(unix.IN_NONBLOCK | unix.IN_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("inotify init failed: %v", err)
+	}
+
+	w := &inotifyWatcher{fd: fd, root: hlsDir, dirs: make(map[int]string)}
+	if err := w.addTree(hlsDir); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+
+	events := make(chan string, 64)
+	go w.run(events, stop)
+	return events, nil
+}
+
+func (w *inotifyWatcher) addTree(dir string) error {
+	wd, err := unix.InotifyAddWatch(w.fd, dir, hlsWatchMask)
+	if err != nil {
+		return fmt.Errorf("failed to watch %s: %v", dir, err)
+	}
+	w.dirs[wd] = dir
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			if err := w.addTree(filepath.Join(dir, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (w *inotifyWatcher) run(events chan<- string, stop <-chan struct{}) {
+	defer close(events)
+	defer unix.Close(w.fd)
+
+	emit := func(relPath string) bool {
+		select {
+		case events <- relPath:
+			return true
+		case <-stop:
+			return false
+		}
+	}
+
+	buf := make([]byte, 64*1024)
+	pollFds := []unix.PollFd{{Fd: int32(w.fd), Events: unix.POLLIN}}
+
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		// Таймаут нужен, чтобы заметить stop
+		ready, err := unix.Poll(pollFds, 500)
+		if err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+			log.Printf("❌ inotify poll failed for %s: %v", w.root, err)
+			return
+		}
+		if ready == 0 {
+			continue
+		}
+
+		n, err := unix.Read(w.fd, buf)
+		if err != nil {
+			if err == unix.EAGAIN || err == unix.EINTR {
+				continue
+			}
+			log.Printf("❌ inotify read failed for %s: %v", w.root, err)
+			return
+		}
+
+		for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+			event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + unix.SizeofInotifyEvent
+			name := strings.TrimRight(string(buf[nameStart:nameStart+int(event.Len)]), "\x00")
+			offset = nameStart + int(event.Len)
+
+			if event.Mask&unix.IN_Q_OVERFLOW != 0 {
+				if !emit("") {
+					return
+				}
+				continue
+			}
+
+			dir, ok := w.dirs[int(event.Wd)]
+			if !ok || name == "" {
+				continue
+			}
+			fullPath := filepath.Join(dir, name)
+
+			// Новая папка варианта: следим за ней и забираем уже созданные в ней файлы
+			if event.Mask&unix.IN_ISDIR != 0 {
+				if event.Mask&unix.IN_CREATE != 0 {
+					if err := w.addTree(fullPath); err != nil {
+						log.Printf("⚠️ %v", err)
+					}
+					if !emit("") {
+						return
+					}
+				}
+				continue
+			}
+
+			if event.Mask&(unix.IN_CLOSE_WRITE|unix.IN_MOVED_TO) == 0 {
+				continue
+			}
+
+			relPath, err := filepath.Rel(w.root, fullPath)
+			if err != nil {
+				continue
+			}
+			if !emit(filepath.ToSlash(relPath)) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+// Без inotify следим за папкой опросом
+func watchHLSDir(hlsDir string, stop <-chan struct{}) (<-chan string, error) {
+	return pollHLSDir(hlsDir, stop), nil
+}
@@ -0,0 +1,491 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"web/stream-app/kafka"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+)
+
+// Локальные RTP порты для передачи медиа из WebRTC в ffmpeg (только 127.0.0.1).
+// На каждую сессию выделяется блок из 4 портов: видео RTP/RTCP и аудио RTP/RTCP
+var (
+	whipRTPPortStart = 20000
+	whipRTPPortEnd   = 20996
+	whipRTPPool      = make(map[int]bool)
+	whipRTPPoolMux   sync.Mutex
+
+	whipSessions    = make(map[string]*WHIPSession)
+	whipSessionsMux sync.Mutex
+
+	whipAPI *webrtc.API
+)
+
+// Payload types, которые ожидает SDP файл для ffmpeg
+const (
+	whipVideoPayloadType = 96
+	whipAudioPayloadType = 111
+)
+
+// Базовый публичный URL stream-app для WHIP endpoint
+var publicWHIPBaseURL = getEnv("PUBLIC_WHIP_BASE_URL", "http://localhost:9090")
+
+// WHIPSession одна WebRTC сессия браузерного стримера
+type WHIPSession struct {
+	StreamID  string
+	PC        *webrtc.PeerConnection
+	BasePort  int
+	SDPPath   string
+	CreatedAt time.Time
+}
+
+// Инициализация WebRTC API: H264 + Opus, один UDP порт для всех ICE подключений
+func initWHIP() error {
+	m := &webrtc.MediaEngine{}
+
+	if err := m.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType:    webrtc.MimeTypeH264,
+			ClockRate:   90000,
+			SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f",
+		},
+		PayloadType: 102,
+	}, webrtc.RTPCodecTypeVideo); err != nil {
+		return fmt.Errorf("failed to register H264 codec: %v", err)
+	}
+
+	if err := m.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType:    webrtc.MimeTypeOpus,
+			ClockRate:   48000,
+			Channels:    2,
+			SDPFmtpLine: "minptime=10;useinbandfec=1",
+		},
+		PayloadType: 111,
+	}, webrtc.RTPCodecTypeAudio); err != nil {
+		return fmt.Errorf("failed to register Opus codec: %v", err)
+	}
+
+	registry := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(m, registry); err != nil {
+		return fmt.Errorf("failed to register interceptors: %v", err)
+	}
+
+	settings := webrtc.SettingEngine{}
+
+	udpPort, err := strconv.Atoi(getEnv("WHIP_UDP_PORT", "8189"))
+	if err != nil {
+		return fmt.Errorf("invalid WHIP_UDP_PORT: %v", err)
+	}
+
+	udpListener, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4zero, Port: udpPort})
+	if err != nil {
+		return fmt.Errorf("failed to listen on WHIP UDP port %d: %v", udpPort, err)
+	}
+	settings.SetICEUDPMux(webrtc.NewICEUDPMux(nil, udpListener))
+
+	// В Docker кандидат с внутренним IP недоступен браузеру
+	if publicIP := os.Getenv("WHIP_PUBLIC_IP"); publicIP != "" {
+		settings.SetNAT1To1IPs([]string{publicIP}, webrtc.ICECandidateTypeHost)
+	}
+
+	whipAPI = webrtc.NewAPI(
+		webrtc.WithMediaEngine(m),
+		webrtc.WithInterceptorRegistry(registry),
+		webrtc.WithSettingEngine(settings),
+	)
+
+	log.Printf("✅ WHIP ingest initialized (ICE UDP port %d)", udpPort)
+	return nil
+}
+
+// Публичный WHIP URL стрима
+func publicWHIPURL(streamID string) string {
+	return fmt.Sprintf("%s/whip/%s", strings.TrimRight(publicWHIPBaseURL, "/"), streamID)
+}
+
+func acquireRTPPorts() (int, error) {
+	whipRTPPoolMux.Lock()
+	defer whipRTPPoolMux.Unlock()
+	for p := whipRTPPortStart; p <= whipRTPPortEnd; p += 4 {
+		if !whipRTPPool[p] {
+			whipRTPPool[p] = true
+			return p, nil
+		}
+	}
+	return 0, errors.New("no RTP ports available")
+}
+
+func releaseRTPPorts(basePort int) {
+	whipRTPPoolMux.Lock()
+	defer whipRTPPoolMux.Unlock()
+	delete(whipRTPPool, basePort)
+}
+
+// SDP для ffmpeg: принимает RTP от WHIP сессии на локальных портах
+func writeWHIPSDPFile(streamID string, basePort int) (string, error) {
+	sdp := fmt.Sprintf(`v=0
+o=- 0 0 IN IP4 127.0.0.1
+s=WHIP %s
+c=IN IP4 127.0.0.1
+t=0 0
+m=video %d RTP/AVP %d
+a=rtpmap:%d H264/90000
+a=fmtp:%d packetization-mode=1
+m=audio %d RTP/AVP %d
+a=rtpmap:%d opus/48000/2
+`, streamID,
+		basePort, whipVideoPayloadType, whipVideoPayloadType, whipVideoPayloadType,
+		basePort+2, whipAudioPayloadType, whipAudioPayloadType)
+
+	sdpPath := filepath.Join(os.TempDir(), fmt.Sprintf("whip_%s.sdp", streamID))
+	if err := os.WriteFile(sdpPath, []byte(sdp), 0644); err != nil {
+		return "", fmt.Errorf("failed to write SDP file: %v", err)
+	}
+	return sdpPath, nil
+}
+
+// /whip/{stream_id}: POST - SDP offer, DELETE - завершение сессии
+func whipHandler(w http.ResponseWriter, r *http.Request) {
+	// CORS для браузерного стриминга напрямую на stream-app
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+	w.Header().Set("Access-Control-Expose-Headers", "Location")
+
+	streamID := strings.Trim(strings.TrimPrefix(r.URL.Path, "/whip/"), "/")
+	if streamID == "" {
+		http.Error(w, "Missing stream_id", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodOptions:
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodPost:
+		handleWHIPOffer(w, r, streamID)
+	case http.MethodDelete:
+		handleWHIPDelete(w, r, streamID)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Проверка Bearer токена (stream key) для WHIP стрима
+func authorizeWHIP(r *http.Request, streamID string) (int, error) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	streamsMux.Lock()
+	stream, exists := activeStreams[streamID]
+	var streamKey, protocol string
+	if exists {
+		streamKey = stream.StreamKey
+		protocol = stream.Protocol
+	}
+	streamsMux.Unlock()
+
+	if !exists {
+		return http.StatusNotFound, fmt.Errorf("stream %s is not started", streamID)
+	}
+	if protocol != ProtocolWHIP {
+		return http.StatusConflict, fmt.Errorf("stream %s uses %s ingest", streamID, protocol)
+	}
+	if streamKey != "" && subtle.ConstantTimeCompare([]byte(token), []byte(streamKey)) != 1 {
+		return http.StatusUnauthorized, fmt.Errorf("invalid stream key")
+	}
+	return http.StatusOK, nil
+}
+
+func handleWHIPOffer(w http.ResponseWriter, r *http.Request, streamID string) {
+	if shuttingDown.Load() {
+		http.Error(w, "Stream-app is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	if status, err := authorizeWHIP(r, streamID); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/sdp") {
+		http.Error(w, "Content-Type must be application/sdp", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	offer, err := io.ReadAll(io.LimitReader(r.Body, 64*1024))
+	if err != nil || len(offer) == 0 {
+		http.Error(w, "Invalid SDP offer", http.StatusBadRequest)
+		return
+	}
+
+	// Место занимается до согласования: параллельный offer получит 409
+	whipSessionsMux.Lock()
+	_, busy := whipSessions[streamID]
+	if !busy {
+		whipSessions[streamID] = nil
+	}
+	whipSessionsMux.Unlock()
+	if busy {
+		http.Error(w, "Stream already has an active WHIP session", http.StatusConflict)
+		return
+	}
+
+	answer, err := startWHIPSession(streamID, string(offer))
+	if err != nil {
+		releaseWHIPReservation(streamID)
+		log.Printf("❌ Failed to start WHIP session for stream %s: %v", streamID, err)
+		http.Error(w, "Failed to start WHIP session", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Location", "/whip/"+streamID)
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(answer))
+}
+
+// Снятие резерва неудавшегося offer; запущенную сессию не трогает
+func releaseWHIPReservation(streamID string) {
+	whipSessionsMux.Lock()
+	defer whipSessionsMux.Unlock()
+	if session, exists := whipSessions[streamID]; exists && session == nil {
+		delete(whipSessions, streamID)
+	}
+}
+
+func handleWHIPDelete(w http.ResponseWriter, r *http.Request, streamID string) {
+	if status, err := authorizeWHIP(r, streamID); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	stopWHIPStream(streamID)
+	w.WriteHeader(http.StatusOK)
+}
+
+// Создание PeerConnection, запуск ffmpeg на SDP входе и пересылка RTP
+func startWHIPSession(streamID, offer string) (string, error) {
+	basePort, err := acquireRTPPorts()
+	if err != nil {
+		return "", err
+	}
+
+	sdpPath, err := writeWHIPSDPFile(streamID, basePort)
+	if err != nil {
+		releaseRTPPorts(basePort)
+		return "", err
+	}
+
+	pc, err := whipAPI.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		releaseRTPPorts(basePort)
+		os.Remove(sdpPath)
+		return "", fmt.Errorf("failed to create peer connection: %v", err)
+	}
+
+	session := &WHIPSession{
+		StreamID:  streamID,
+		PC:        pc,
+		BasePort:  basePort,
+		SDPPath:   sdpPath,
+		CreatedAt: time.Now(),
+	}
+
+	fail := func(err error) (string, error) {
+		pc.Close()
+		releaseRTPPorts(basePort)
+		os.Remove(sdpPath)
+		return "", err
+	}
+
+	pc.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		go forwardWHIPTrack(session, track)
+	})
+
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		log.Printf("WHIP [%s]: connection state %s", streamID, state)
+
+		switch state {
+		case webrtc.PeerConnectionStateConnected:
+			processesMux.Lock()
+			if proc, exists := processes[streamID]; exists && !proc.IsConnected {
+				proc.IsConnected = true
+				proc.EverConnected = true
+				emitStreamEvent(streamID, kafka.EventPublisherConnected, "whip")
+			}
+			processesMux.Unlock()
+			go notifyMainAppStatusChange(streamID, "running")
+
+		case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+			// Браузер пропал без DELETE - завершаем так же, как по DELETE.
+			// Закрытие при неудачном согласовании или старой сессии стрим не трогает
+			whipSessionsMux.Lock()
+			current := whipSessions[streamID] == session
+			whipSessionsMux.Unlock()
+			if current {
+				go stopWHIPStream(streamID)
+			}
+		}
+	})
+
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer}); err != nil {
+		return fail(fmt.Errorf("failed to set remote description: %v", err))
+	}
+
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		return fail(fmt.Errorf("failed to create answer: %v", err))
+	}
+
+	gatherComplete := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(answer); err != nil {
+		return fail(fmt.Errorf("failed to set local description: %v", err))
+	}
+	<-gatherComplete
+
+	streamsMux.Lock()
+	stream, exists := activeStreams[streamID]
+	streamKey, profile, lowLatency, outputFormat := "", "", false, ""
+	if exists {
+		streamKey = stream.StreamKey
+		profile = stream.Profile
+		lowLatency = stream.LowLatency
+		outputFormat = stream.OutputFormat
+	}
+	streamsMux.Unlock()
+	if !exists {
+		return fail(fmt.Errorf("stream %s was stopped during negotiation", streamID))
+	}
+
+	// ffmpeg читает RTP из SDP и пишет в тот же HLS пайплайн, что и SRT/RTMP
+	opts := StreamOptions{
+		Protocol:     ProtocolWHIP,
+		InputAddr:    sdpPath,
+		StreamKey:    streamKey,
+		Profile:      profile,
+		LowLatency:   lowLatency,
+		OutputFormat: outputFormat,
+	}
+	if err := startFFmpegProcess(streamID, opts); err != nil {
+		return fail(fmt.Errorf("failed to start ffmpeg: %v", err))
+	}
+
+	// Стрим мог быть остановлен во время запуска: резерв тогда уже снят
+	whipSessionsMux.Lock()
+	_, reserved := whipSessions[streamID]
+	if reserved {
+		whipSessions[streamID] = session
+	}
+	whipSessionsMux.Unlock()
+	if !reserved {
+		stopFFmpegProcess(streamID)
+		return fail(fmt.Errorf("stream %s was stopped during negotiation", streamID))
+	}
+
+	log.Printf("✅ WHIP session started for stream %s (RTP ports %d/%d)", streamID, basePort, basePort+2)
+	return pc.LocalDescription().SDP, nil
+}
+
+// Пересылка RTP пакетов трека в локальный порт ffmpeg
+func forwardWHIPTrack(session *WHIPSession, track *webrtc.TrackRemote) {
+	port := session.BasePort
+	payloadType := uint8(whipVideoPayloadType)
+	if track.Kind() == webrtc.RTPCodecTypeAudio {
+		port = session.BasePort + 2
+		payloadType = whipAudioPayloadType
+	}
+
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+	if err != nil {
+		log.Printf("❌ WHIP [%s]: failed to open RTP forwarder: %v", session.StreamID, err)
+		return
+	}
+	defer conn.Close()
+
+	log.Printf("WHIP [%s]: forwarding %s track (%s) to 127.0.0.1:%d",
+		session.StreamID, track.Kind(), track.Codec().MimeType, port)
+
+	// Периодический запрос ключевого кадра, чтобы ffmpeg мог начать декодирование
+	if track.Kind() == webrtc.RTPCodecTypeVideo {
+		go func() {
+			ticker := time.NewTicker(3 * time.Second)
+			defer ticker.Stop()
+			for range ticker.C {
+				err := session.PC.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(track.SSRC())}})
+				if err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		packet, _, err := track.ReadRTP()
+		if err != nil {
+			return
+		}
+
+		packet.PayloadType = payloadType
+		n, err := packet.MarshalTo(buf)
+		if err != nil {
+			continue
+		}
+
+		// ffmpeg может быть еще не запущен или перезапускается - пакеты просто теряются
+		conn.Write(buf[:n])
+	}
+}
+
+// Закрытие WHIP сессии без остановки стрима (вызывается из handleStopStatus)
+func closeWHIPSession(streamID string) {
+	whipSessionsMux.Lock()
+	session, exists := whipSessions[streamID]
+	delete(whipSessions, streamID)
+	whipSessionsMux.Unlock()
+
+	// nil - offer еще согласуется, startWHIPSession увидит снятый резерв
+	if !exists || session == nil {
+		return
+	}
+
+	if err := session.PC.Close(); err != nil {
+		log.Printf("⚠️ WHIP [%s]: failed to close peer connection: %v", streamID, err)
+	}
+	releaseRTPPorts(session.BasePort)
+	os.Remove(session.SDPPath)
+
+	log.Printf("WHIP session closed for stream %s", streamID)
+}
+
+// WHIP DELETE или обрыв соединения: тот же путь, что и остановка из main-app,
+// чтобы запись ушла в Kafka и стрим стал VOD
+func stopWHIPStream(streamID string) {
+	// streamsMux сериализует DELETE и обрыв соединения: второй вызов сессию уже не найдет
+	streamsMux.Lock()
+	whipSessionsMux.Lock()
+	session := whipSessions[streamID]
+	whipSessionsMux.Unlock()
+	if session == nil {
+		streamsMux.Unlock()
+		return
+	}
+
+	handleStopStatus(streamID)
+	streamsMux.Unlock()
+
+	notifyMainAppStatusChange(streamID, "stopped")
+}
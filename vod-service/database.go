@@ -101,6 +101,10 @@ func createTablesIfNotExist(db *pgxpool.Pool) error {
         updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
     );
 
+    -- Клипы из live стримов (миграция 002 recording-service)
+    ALTER TABLE recordings ADD COLUMN IF NOT EXISTS kind VARCHAR(16) NOT NULL DEFAULT 'recording';
+    ALTER TABLE recordings ADD COLUMN IF NOT EXISTS source_stream_id VARCHAR(100);
+
     CREATE INDEX IF NOT EXISTS idx_recordings_stream_id ON recordings(stream_id);
     CREATE INDEX IF NOT EXISTS idx_recordings_user_id ON recordings(user_id);
     CREATE INDEX IF NOT EXISTS idx_recordings_status ON recordings(status);
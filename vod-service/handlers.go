@@ -59,6 +59,8 @@ func (h *Handlers) ListRecordings(w http.ResponseWriter, r *http.Request) {
 	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
 	status := r.URL.Query().Get("status")
 	search := r.URL.Query().Get("search")
+	kind := r.URL.Query().Get("kind")
+	sourceStreamID := r.URL.Query().Get("source_stream_id")
 
 	if page < 0 {
 		page = 0
@@ -70,7 +72,8 @@ func (h *Handlers) ListRecordings(w http.ResponseWriter, r *http.Request) {
 	// ✅ ИСПРАВЛЕНО: Прямой SQL запрос вместо вызова несуществующей функции
 	query := `
         SELECT id, stream_id, user_id, title, duration_seconds, file_path, 
-               thumbnail_path, file_size_bytes, status, created_at, updated_at
+               thumbnail_path, file_size_bytes, status, created_at, updated_at,
+               kind, source_stream_id
         FROM recordings
         WHERE 1=1
     `
@@ -91,6 +94,20 @@ func (h *Handlers) ListRecordings(w http.ResponseWriter, r *http.Request) {
 		args = append(args, "%"+search+"%")
 	}
 
+	// Только записи или только клипы
+	if kind != "" {
+		argCount++
+		query += fmt.Sprintf(" AND kind = $%d", argCount)
+		args = append(args, kind)
+	}
+
+	// Клипы конкретного стрима
+	if sourceStreamID != "" {
+		argCount++
+		query += fmt.Sprintf(" AND source_stream_id = $%d", argCount)
+		args = append(args, sourceStreamID)
+	}
+
 	query += " ORDER BY created_at DESC"
 
 	// LIMIT и OFFSET
@@ -116,6 +133,7 @@ func (h *Handlers) ListRecordings(w http.ResponseWriter, r *http.Request) {
 			&r.ID, &r.StreamID, &r.UserID, &r.Title, &r.Duration,
 			&r.FilePath, &r.ThumbnailPath, &r.FileSize, &r.Status,
 			&r.CreatedAt, &r.UpdatedAt,
+			&r.Kind, &r.SourceStreamID,
 		)
 		if err != nil {
 			h.handleError(w, NewInternalError("Row scan failed: "+err.Error()))
@@ -148,7 +166,8 @@ func (h *Handlers) GetRecording(w http.ResponseWriter, r *http.Request) {
 	var rec Recording
 	query := `
         SELECT id, stream_id, user_id, title, duration_seconds, file_path,
-               thumbnail_path, file_size_bytes, status, created_at, updated_at
+               thumbnail_path, file_size_bytes, status, created_at, updated_at,
+               kind, source_stream_id
         FROM recordings
         WHERE stream_id = $1
     `
@@ -157,6 +176,7 @@ func (h *Handlers) GetRecording(w http.ResponseWriter, r *http.Request) {
 		&rec.ID, &rec.StreamID, &rec.UserID, &rec.Title, &rec.Duration,
 		&rec.FilePath, &rec.ThumbnailPath, &rec.FileSize, &rec.Status,
 		&rec.CreatedAt, &rec.UpdatedAt,
+		&rec.Kind, &rec.SourceStreamID,
 	)
 
 	if err != nil {
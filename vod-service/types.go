@@ -25,6 +25,9 @@ type Recording struct {
 	Status        string    `json:"status" db:"status"`
 	CreatedAt     time.Time `json:"created_at" db:"created_at"`
 	UpdatedAt     time.Time `json:"updated_at" db:"updated_at"`
+	// recording или clip; для клипа - стрим, из которого он вырезан
+	Kind           string  `json:"kind" db:"kind"`
+	SourceStreamID *string `json:"source_stream_id,omitempty" db:"source_stream_id"`
 }
 
 type RecordingResponse struct {
@@ -39,6 +42,7 @@ type ListRecordingsRequest struct {
 	Status *string `json:"status,omitempty"`
 	UserID *int    `json:"user_id,omitempty"`
 	Search *string `json:"search,omitempty"`
+	Kind   *string `json:"kind,omitempty"`
 }
 
 type ListRecordingsResponse struct {